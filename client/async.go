@@ -0,0 +1,154 @@
+package memcached
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrClientClosed is returned by Go once the client's connection has
+// failed or been closed.
+var ErrClientClosed = errors.New("client closed")
+
+// demux routes responses read in the background to the Go call
+// waiting for them.
+type demux struct {
+	mu      sync.Mutex
+	waiting map[uint32]chan *gomemcached.MCResponse
+	err     error // why the reader stopped, if it has
+
+	// Holds a token for each request in flight, if they're limited.
+	slots chan struct{}
+
+	done chan struct{} // closed when the reader exits
+}
+
+// SetMaxInFlight limits how many requests sent with Go may be waiting
+// for their responses at once, or 0 for no limit.  Beyond it, Go
+// blocks until a response arrives.
+//
+// It must be set before the first call to Go.
+func (c *Client) SetMaxInFlight(n int) {
+	c.maxInFlight = n
+}
+
+// Go sends a request without waiting for its response.
+//
+// The request is assigned a unique opaque, and the returned channel
+// receives the matching response (whatever its status) once it
+// arrives.  Responses are read by a background goroutine, so any
+// number of requests may be outstanding at once, from any number of
+// goroutines, unless limited with SetMaxInFlight.  If the connection
+// fails or is closed first, the channel is closed without a value.
+//
+// Go must not be used with quiet commands, which may never respond.
+// After the first call to Go the background reader owns the
+// connection's responses; Send, Receive and the other methods that
+// read responses must not be used afterwards.
+func (c *Client) Go(req *gomemcached.MCRequest) (<-chan *gomemcached.MCResponse, error) {
+	d := c.startDemux()
+
+	if d.slots != nil {
+		select {
+		case d.slots <- struct{}{}:
+		case <-d.done:
+			return nil, ErrClientClosed
+		}
+	}
+
+	ch := make(chan *gomemcached.MCResponse, 1)
+	req.Opaque = c.nextOpaque()
+
+	d.mu.Lock()
+	if d.err != nil {
+		d.mu.Unlock()
+		d.release()
+		return nil, ErrClientClosed
+	}
+	d.waiting[req.Opaque] = ch
+	d.mu.Unlock()
+
+	err := c.Transmit(req)
+	if err == nil {
+		err = c.FlushBuffer()
+	}
+	if err != nil {
+		d.mu.Lock()
+		delete(d.waiting, req.Opaque)
+		d.mu.Unlock()
+		d.release()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// release frees an in-flight request's slot.
+func (d *demux) release() {
+	if d.slots != nil {
+		<-d.slots
+	}
+}
+
+// startDemux starts the background reader if it's not running yet.
+func (c *Client) startDemux() *demux {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if c.demux == nil {
+		c.demux = &demux{
+			waiting: map[uint32]chan *gomemcached.MCResponse{},
+			done:    make(chan struct{}),
+		}
+		if c.maxInFlight > 0 {
+			c.demux.slots = make(chan struct{}, c.maxInFlight)
+		}
+		go c.demux.run(c.reader, c.maxBody)
+	}
+	return c.demux
+}
+
+// stopDemux waits for the background reader (if any) to exit.  The
+// connection must already be closed.
+func (c *Client) stopDemux() {
+	c.dmu.Lock()
+	d := c.demux
+	c.dmu.Unlock()
+	if d != nil {
+		<-d.done
+	}
+}
+
+func (d *demux) run(r io.Reader, maxBody int) {
+	defer close(d.done)
+	hdrBuf := make([]byte, gomemcached.HDR_LEN)
+	for {
+		res, _, err := getResponseInto(r, hdrBuf, nil, maxBody)
+		if err != nil && err != res {
+			d.fail(err)
+			return
+		}
+
+		d.mu.Lock()
+		ch, ok := d.waiting[res.Opaque]
+		delete(d.waiting, res.Opaque)
+		d.mu.Unlock()
+
+		// Responses nobody is waiting for are dropped.
+		if ok {
+			ch <- res
+			d.release()
+		}
+	}
+}
+
+// fail wakes up every waiting caller after the reader stops.
+func (d *demux) fail(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+	for opaque, ch := range d.waiting {
+		close(ch)
+		delete(d.waiting, opaque)
+	}
+}
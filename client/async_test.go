@@ -0,0 +1,280 @@
+package memcached
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	mcserver "github.com/couchbase/gomemcached/server"
+)
+
+func TestGo(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		k := strconv.Itoa(i)
+		if _, err := c.Set(0, k, 0, 0, []byte("val-"+k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	chans := make([]<-chan *gomemcached.MCResponse, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ch, err := c.Go(&gomemcached.MCRequest{
+				Opcode: gomemcached.GET,
+				Key:    []byte(strconv.Itoa(i)),
+			})
+			if err != nil {
+				t.Errorf("Error in Go: %v", err)
+				return
+			}
+			chans[i] = ch
+		}(i)
+	}
+	wg.Wait()
+
+	for i, ch := range chans {
+		if ch == nil {
+			continue
+		}
+		res := <-ch
+		if exp := "val-" + strconv.Itoa(i); res == nil || string(res.Body) != exp {
+			t.Errorf("Expected %q for %d, got %v", exp, i, res)
+		}
+	}
+
+	// Failures are delivered as responses too.
+	ch, err := c.Go(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("missing"),
+	})
+	if err != nil {
+		t.Fatalf("Error in Go: %v", err)
+	}
+	if res := <-ch; res == nil || res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected KEY_ENOENT, got %v", res)
+	}
+}
+
+func TestGoOutOfOrder(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	const n = 10
+	// Answer each batch of requests in reverse order.
+	go func() {
+		var reqs []gomemcached.MCRequest
+		for i := 0; i < n; i++ {
+			req, err := mcserver.ReadPacket(sconn)
+			if err != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			res := &gomemcached.MCResponse{
+				Opcode: reqs[i].Opcode,
+				Opaque: reqs[i].Opaque,
+				Body:   reqs[i].Key,
+			}
+			if _, err := res.Transmit(sconn); err != nil {
+				return
+			}
+		}
+	}()
+
+	var chans []<-chan *gomemcached.MCResponse
+	for i := 0; i < n; i++ {
+		ch, err := c.Go(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(strconv.Itoa(i)),
+		})
+		if err != nil {
+			t.Fatalf("Error in Go: %v", err)
+		}
+		chans = append(chans, ch)
+	}
+
+	for i, ch := range chans {
+		if res := <-ch; res == nil || string(res.Body) != strconv.Itoa(i) {
+			t.Errorf("Expected response for %d, got %v", i, res)
+		}
+	}
+}
+
+func TestGoClose(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+
+	// Read the request, but never respond.
+	go mcserver.ReadPacket(sconn)
+
+	ch, err := c.Go(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	if err != nil {
+		t.Fatalf("Error in Go: %v", err)
+	}
+	c.Close()
+
+	if res, ok := <-ch; ok {
+		t.Errorf("Expected channel to be closed, got %v", res)
+	}
+	if _, err := c.Go(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")}); err != ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestGoMaxInFlight(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+	c.SetMaxInFlight(2)
+
+	// Answer a request each time we're told to.
+	reqs := make(chan gomemcached.MCRequest, 10)
+	answer := make(chan bool)
+	go func() {
+		for {
+			req, err := mcserver.ReadPacket(sconn)
+			if err != nil {
+				return
+			}
+			reqs <- req
+		}
+	}()
+	go func() {
+		for range answer {
+			req := <-reqs
+			res := &gomemcached.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque}
+			if _, err := res.Transmit(sconn); err != nil {
+				return
+			}
+		}
+	}()
+	defer close(answer)
+
+	get := &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")}
+	first, err := c.Go(get)
+	if err != nil {
+		t.Fatalf("Error in Go: %v", err)
+	}
+	if _, err := c.Go(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")}); err != nil {
+		t.Fatalf("Error in Go: %v", err)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := c.Go(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+		sent <- err
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("Expected Go to block at the limit, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	answer <- true
+	if res := <-first; res == nil {
+		t.Fatalf("Expected the first response")
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("Error in Go after a response: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Go to proceed after a response arrived")
+	}
+
+	// Closing the client wakes senders blocked at the limit.
+	go func() {
+		_, err := c.Go(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+		sent <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-sent:
+		if err != ErrClientClosed {
+			t.Errorf("Expected ErrClientClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the blocked Go to fail on close")
+	}
+}
+
+// Run with -race: concurrent reads mustn't share header buffers.
+func TestConcurrentReads(t *testing.T) {
+	s := newFakeServer()
+	goer := s.connect(t)
+	defer goer.Close()
+	sender := s.connect(t)
+	defer sender.Close()
+
+	for i := 0; i < 10; i++ {
+		k := strconv.Itoa(i)
+		if _, err := sender.Set(0, k, 0, 0, []byte("val-"+k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				k := strconv.Itoa((g + i) % 10)
+				ch, err := goer.Go(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte(k)})
+				if err != nil {
+					t.Errorf("Error in Go: %v", err)
+					return
+				}
+				if res := <-ch; res == nil || string(res.Body) != "val-"+k {
+					t.Errorf("Expected val-%v, got %v", k, res)
+				}
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			var buf bytes.Buffer
+			for i := 0; i < 50; i++ {
+				k := strconv.Itoa((g + i) % 10)
+				var body []byte
+				var err error
+				if i%2 == 0 {
+					var res *gomemcached.MCResponse
+					res, err = sender.Get(0, k)
+					if err == nil {
+						body = res.Body
+					}
+				} else {
+					buf.Reset()
+					_, _, err = sender.GetTo(0, k, &buf)
+					body = buf.Bytes()
+				}
+				if err != nil || string(body) != "val-"+k {
+					t.Errorf("Expected val-%v, got %q (%v)", k, body, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,343 @@
+package memcached
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrCircuitOpen is returned by a CircuitBreaker's operations while
+// it's failing fast.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed passes operations through to the client.
+	BreakerClosed = BreakerState(iota)
+	// BreakerOpen fails operations with ErrCircuitOpen.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through, to see whether
+	// the client has recovered.
+	BreakerHalfOpen
+)
+
+// String names the state, as in "half-open".
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker wraps a client so that once it fails threshold
+// operations in a row, further operations fail fast with
+// ErrCircuitOpen rather than waiting on a node that's down.  After
+// cooldown, the next operation is let through as a probe: if it
+// succeeds the breaker closes again, and if it fails it stays open
+// for another cooldown.
+//
+// Only failures reaching the node count: network errors, the
+// connection closing or going out of sync, and ErrReceiveTimeout.
+// Failure statuses and a CasFunc's CASQuit or CASDelete are answers
+// from a working server, and reset the count like a success.  Any
+// other error, such as a request the client refuses to send or a
+// cancelled context, neither counts nor resets the count.
+//
+// The ClientIface methods returning errors are guarded; Close,
+// IsHealthy, and the rest of the client's methods are passed
+// through.  To fail fast on a node whose connections come from a
+// Pool, keep a breaker per client taken from it.
+type CircuitBreaker struct {
+	ClientIface
+
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int       // in a row, while closed
+	opened   time.Time // when it last opened
+}
+
+// NewCircuitBreaker wraps c in a breaker that opens after threshold
+// consecutive failures, and probes again after cooldown.
+func NewCircuitBreaker(c ClientIface, threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &CircuitBreaker{ClientIface: c, threshold: threshold, cooldown: cooldown}
+}
+
+// State returns the breaker's state.  An open breaker whose cooldown
+// has passed is reported as half-open, since its next operation will
+// be a probe.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && timeNow().Sub(b.opened) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow returns ErrCircuitOpen if an operation mustn't be tried now.
+// Once the cooldown has passed, it lets one probe through.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if timeNow().Sub(b.opened) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		return nil
+	case BreakerHalfOpen:
+		// A probe is already out.
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of an operation allow
+// let through.
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case isNodeFailure(err):
+		b.failures++
+		if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+			b.state = BreakerOpen
+			b.opened = timeNow()
+		}
+	case err == nil || isStatus(err) || isCasOp(err):
+		b.state = BreakerClosed
+		b.failures = 0
+	default:
+		// The request was refused before reaching the node, so a
+		// probe proved nothing.
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerOpen
+		}
+	}
+}
+
+// isStatus is true if err is a response from the server.
+func isStatus(err error) bool {
+	var res *gomemcached.MCResponse
+	return errors.As(err, &res)
+}
+
+// isCasOp is true if err is a CasFunc ending a CAS loop.
+func isCasOp(err error) bool {
+	var op CasOp
+	return errors.As(err, &op)
+}
+
+// isNodeFailure is true if err means the operation didn't get an
+// answer from the server.
+func isNodeFailure(err error) bool {
+	// context.DeadlineExceeded is a net.Error too, but it's the
+	// caller giving up, not the node.
+	if err == nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, errNoConn) || errors.Is(err, ErrOpaqueMismatch) ||
+		errors.Is(err, ErrReceiveTimeout)
+}
+
+// do runs an operation returning a response, if the breaker allows.
+func (b *CircuitBreaker) do(f func() (*gomemcached.MCResponse, error)) (*gomemcached.MCResponse, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	res, err := f()
+	b.record(err)
+	return res, err
+}
+
+// guard runs an operation returning only an error, if the breaker
+// allows.
+func (b *CircuitBreaker) guard(f func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := f()
+	b.record(err)
+	return err
+}
+
+// Send calls the client's Send, if the breaker allows.
+func (b *CircuitBreaker) Send(req *gomemcached.MCRequest) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Send(req) })
+}
+
+// SendContext calls the client's SendContext, if the breaker allows.
+func (b *CircuitBreaker) SendContext(ctx context.Context, req *gomemcached.MCRequest) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.SendContext(ctx, req) })
+}
+
+// Transmit calls the client's Transmit, if the breaker allows.
+func (b *CircuitBreaker) Transmit(req *gomemcached.MCRequest) error {
+	return b.guard(func() error { return b.ClientIface.Transmit(req) })
+}
+
+// Receive calls the client's Receive, if the breaker allows.
+func (b *CircuitBreaker) Receive() (*gomemcached.MCResponse, error) {
+	return b.do(b.ClientIface.Receive)
+}
+
+// FlushBuffer calls the client's FlushBuffer, if the breaker allows.
+func (b *CircuitBreaker) FlushBuffer() error {
+	return b.guard(b.ClientIface.FlushBuffer)
+}
+
+// Noop calls the client's Noop, if the breaker allows.
+func (b *CircuitBreaker) Noop() (*gomemcached.MCResponse, error) {
+	return b.do(b.ClientIface.Noop)
+}
+
+// Version calls the client's Version, if the breaker allows.
+func (b *CircuitBreaker) Version() (v string, err error) {
+	err = b.guard(func() (err error) {
+		v, err = b.ClientIface.Version()
+		return err
+	})
+	return v, err
+}
+
+// Auth calls the client's Auth, if the breaker allows.
+func (b *CircuitBreaker) Auth(user, pass string) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Auth(user, pass) })
+}
+
+// SelectBucket calls the client's SelectBucket, if the breaker allows.
+func (b *CircuitBreaker) SelectBucket(bucket string) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.SelectBucket(bucket) })
+}
+
+// Get calls the client's Get, if the breaker allows.
+func (b *CircuitBreaker) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Get(vb, key) })
+}
+
+// GetBulk calls the client's GetBulk, if the breaker allows.
+func (b *CircuitBreaker) GetBulk(vb uint16, keys []string) (rv map[string]*gomemcached.MCResponse, err error) {
+	err = b.guard(func() (err error) {
+		rv, err = b.ClientIface.GetBulk(vb, keys)
+		return err
+	})
+	return rv, err
+}
+
+// GetAndTouch calls the client's GetAndTouch, if the breaker allows.
+func (b *CircuitBreaker) GetAndTouch(vb uint16, key string, exp int) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.GetAndTouch(vb, key, exp) })
+}
+
+// Touch calls the client's Touch, if the breaker allows.
+func (b *CircuitBreaker) Touch(vb uint16, key string, exp int) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Touch(vb, key, exp) })
+}
+
+// Set calls the client's Set, if the breaker allows.
+func (b *CircuitBreaker) Set(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Set(vb, key, flags, exp, body) })
+}
+
+// SetCas calls the client's SetCas, if the breaker allows.
+func (b *CircuitBreaker) SetCas(vb uint16, key string, flags int, exp int, cas uint64, body []byte) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) {
+		return b.ClientIface.SetCas(vb, key, flags, exp, cas, body)
+	})
+}
+
+// Add calls the client's Add, if the breaker allows.
+func (b *CircuitBreaker) Add(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Add(vb, key, flags, exp, body) })
+}
+
+// Replace calls the client's Replace, if the breaker allows.
+func (b *CircuitBreaker) Replace(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Replace(vb, key, flags, exp, body) })
+}
+
+// Append calls the client's Append, if the breaker allows.
+func (b *CircuitBreaker) Append(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Append(vb, key, data) })
+}
+
+// Prepend calls the client's Prepend, if the breaker allows.
+func (b *CircuitBreaker) Prepend(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Prepend(vb, key, data) })
+}
+
+// Del calls the client's Del, if the breaker allows.
+func (b *CircuitBreaker) Del(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.Del(vb, key) })
+}
+
+// DelCas calls the client's DelCas, if the breaker allows.
+func (b *CircuitBreaker) DelCas(vb uint16, key string, cas uint64) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.DelCas(vb, key, cas) })
+}
+
+// Incr calls the client's Incr, if the breaker allows.
+func (b *CircuitBreaker) Incr(vb uint16, key string, amt, def uint64, exp int) (rv uint64, err error) {
+	err = b.guard(func() (err error) {
+		rv, err = b.ClientIface.Incr(vb, key, amt, def, exp)
+		return err
+	})
+	return rv, err
+}
+
+// Decr calls the client's Decr, if the breaker allows.
+func (b *CircuitBreaker) Decr(vb uint16, key string, amt, def uint64, exp int) (rv uint64, err error) {
+	err = b.guard(func() (err error) {
+		rv, err = b.ClientIface.Decr(vb, key, amt, def, exp)
+		return err
+	})
+	return rv, err
+}
+
+// CAS calls the client's CAS, if the breaker allows.
+func (b *CircuitBreaker) CAS(vb uint16, k string, f CasFunc, initexp int) (*gomemcached.MCResponse, error) {
+	return b.do(func() (*gomemcached.MCResponse, error) { return b.ClientIface.CAS(vb, k, f, initexp) })
+}
+
+// Stats calls the client's Stats, if the breaker allows.
+func (b *CircuitBreaker) Stats(key string) (rv []StatValue, err error) {
+	err = b.guard(func() (err error) {
+		rv, err = b.ClientIface.Stats(key)
+		return err
+	})
+	return rv, err
+}
+
+// StatsMap calls the client's StatsMap, if the breaker allows.
+func (b *CircuitBreaker) StatsMap(key string) (rv map[string]string, err error) {
+	err = b.guard(func() (err error) {
+		rv, err = b.ClientIface.StatsMap(key)
+		return err
+	})
+	return rv, err
+}
+
+var _ ClientIface = (*CircuitBreaker)(nil)
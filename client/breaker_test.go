@@ -0,0 +1,155 @@
+package memcached
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// flakyClient fails Get with err, counting the calls that reach it.
+type flakyClient struct {
+	ClientIface
+	err    error
+	calls  int
+	during func() // called inside Get, if set
+}
+
+func (f *flakyClient) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	f.calls++
+	if f.during != nil {
+		f.during()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &gomemcached.MCResponse{Body: []byte("v")}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	f := &flakyClient{err: io.ErrUnexpectedEOF}
+	b := NewCircuitBreaker(f, 3, time.Minute)
+
+	get := func() error {
+		_, err := b.Get(0, "k")
+		return err
+	}
+	expectState := func(exp BreakerState) {
+		t.Helper()
+		if got := b.State(); got != exp {
+			t.Fatalf("Expected breaker %v, got %v", exp, got)
+		}
+	}
+
+	// A success resets the count of failures in a row.
+	get()
+	get()
+	f.err = nil
+	if err := get(); err != nil {
+		t.Fatalf("Error getting through a closed breaker: %v", err)
+	}
+	f.err = io.ErrUnexpectedEOF
+	get()
+	get()
+	expectState(BreakerClosed)
+
+	// Statuses and refused requests aren't the node failing.
+	f.err = &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	get()
+	f.err = ErrKeyTooLong
+	get()
+	expectState(BreakerClosed)
+
+	// Nor are the caller giving up, or a CasFunc ending a CAS loop.
+	for _, err := range []error{
+		context.Canceled, context.DeadlineExceeded,
+		fmt.Errorf("waiting: %w", context.DeadlineExceeded),
+		CASQuit, CASDelete, ErrTooManyCASRetries,
+	} {
+		f.err = err
+		get()
+		get()
+		get()
+		expectState(BreakerClosed)
+	}
+
+	f.err = io.ErrUnexpectedEOF
+	get()
+	get()
+	get()
+	expectState(BreakerOpen)
+
+	calls := f.calls
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if f.calls != calls {
+		t.Errorf("Expected an open breaker not to call the client")
+	}
+
+	// A failed probe opens it for another cooldown.
+	now = now.Add(time.Minute)
+	expectState(BreakerHalfOpen)
+	if err := get(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected the probe's error, got %v", err)
+	}
+	expectState(BreakerOpen)
+	now = now.Add(time.Second)
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen after a failed probe, got %v", err)
+	}
+
+	// Only one probe at a time, and a successful one closes it.
+	now = now.Add(time.Minute)
+	f.err = nil
+	f.during = func() {
+		if err := get(); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("Expected ErrCircuitOpen during a probe, got %v", err)
+		}
+	}
+	if err := get(); err != nil {
+		t.Fatalf("Error probing: %v", err)
+	}
+	f.during = nil
+	expectState(BreakerClosed)
+	if err := get(); err != nil {
+		t.Errorf("Error getting through the closed breaker: %v", err)
+	}
+}
+
+func TestIsNodeFailure(t *testing.T) {
+	tests := []struct {
+		err error
+		exp bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: net.ErrClosed}, true},
+		{errNoConn, true},
+		{ErrOpaqueMismatch, true},
+		{fmt.Errorf("%w: i/o timeout", ErrReceiveTimeout), true},
+		{&gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}, false},
+		{ErrKeyTooLong, false},
+		{ErrClientClosed, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{CASQuit, false},
+		{ErrTooManyCASRetries, false},
+		{errors.New("something else"), false},
+	}
+	for _, test := range tests {
+		if got := isNodeFailure(test.err); got != test.exp {
+			t.Errorf("isNodeFailure(%v) = %v, expected %v", test.err, got, test.exp)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package memcached
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrNoClusterConfig is returned by GetClusterConfig from servers
+// that don't have one, such as plain memcached.
+var ErrNoClusterConfig = errors.New("server has no cluster config")
+
+// GetClusterConfig gets the server's cluster map, as JSON.
+//
+// Couchbase servers may write the address of the node itself as
+// "$HOST", for the caller to replace with the host it connected to.
+func (c *Client) GetClusterConfig() ([]byte, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET_CLUSTER_CONFIG,
+	})
+	if gomemcached.IsNotSupported(err) {
+		return nil, fmt.Errorf("%w: %v", ErrNoClusterConfig, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// VBucketServerMap is the part of a cluster map saying which servers
+// hold each vbucket.
+type VBucketServerMap struct {
+	HashAlgorithm string   `json:"hashAlgorithm"`
+	NumReplicas   int      `json:"numReplicas"`
+	ServerList    []string `json:"serverList"`
+	// For each vbucket, the index in ServerList of its active
+	// server followed by its replicas', or -1 where there's none.
+	VBucketMap [][]int `json:"vBucketMap"`
+}
+
+// ParseVBucketServerMap decodes the vbucket map from a cluster map, as
+// returned by GetClusterConfig.
+func ParseVBucketServerMap(config []byte) (*VBucketServerMap, error) {
+	var cfg struct {
+		VBucketServerMap *VBucketServerMap `json:"vBucketServerMap"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return nil, fmt.Errorf("decoding cluster config: %w", err)
+	}
+	m := cfg.VBucketServerMap
+	if m == nil || len(m.VBucketMap) == 0 {
+		return nil, errors.New("cluster config has no vbucket map")
+	}
+	return m, nil
+}
+
+// VBucket is the vbucket a key belongs to in a bucket with
+// numVBuckets vbuckets, using the CRC hash Couchbase buckets use:
+// bits 16 to 30 of the key's CRC-32, modulo numVBuckets.  It's an
+// error for numVBuckets not to be positive.
+func VBucket(key []byte, numVBuckets int) (uint16, error) {
+	if numVBuckets <= 0 {
+		return 0, fmt.Errorf("invalid vbucket count %d", numVBuckets)
+	}
+	h := (crc32.ChecksumIEEE(key) >> 16) & 0x7fff
+	return uint16(int(h) % numVBuckets), nil
+}
+
+// VBucket is the vbucket a key belongs to in the map.  It's an error
+// for the map to be empty.
+func (m *VBucketServerMap) VBucket(key string) (uint16, error) {
+	return VBucket([]byte(key), len(m.VBucketMap))
+}
+
+// Server is the address of the server with the active copy of a
+// vbucket.
+func (m *VBucketServerMap) Server(vb uint16) (string, error) {
+	if int(vb) >= len(m.VBucketMap) || len(m.VBucketMap[vb]) == 0 {
+		return "", fmt.Errorf("no vbucket %d in the map", vb)
+	}
+	i := m.VBucketMap[vb][0]
+	if i < 0 || i >= len(m.ServerList) {
+		return "", fmt.Errorf("vbucket %d has no active server", vb)
+	}
+	return m.ServerList[i], nil
+}
@@ -0,0 +1,97 @@
+package memcached
+
+import (
+	"errors"
+	"testing"
+)
+
+const sampleClusterConfig = `{
+  "rev": 1024,
+  "name": "default",
+  "nodeLocator": "vbucket",
+  "vBucketServerMap": {
+    "hashAlgorithm": "CRC",
+    "numReplicas": 1,
+    "serverList": ["10.0.0.1:11210", "10.0.0.2:11210"],
+    "vBucketMap": [[0, 1], [1, 0], [0, -1], [-1, -1]]
+  }
+}`
+
+func TestVBucket(t *testing.T) {
+	tests := []struct {
+		key string
+		n   int
+		exp uint16
+	}{
+		{"foo", 1024, 115},
+		{"foo", 64, 51},
+		{"bar", 1024, 767},
+		{"hello", 1024, 528},
+		{"hello", 64, 16},
+		{"user::1234", 1024, 495},
+		{"\x00\xff", 1024, 219},
+		{"", 1024, 0},
+		{"foo", 1, 0},
+	}
+	for _, test := range tests {
+		if got, err := VBucket([]byte(test.key), test.n); err != nil || got != test.exp {
+			t.Errorf("Expected vbucket %d of %d for %q, got %d (%v)", test.exp, test.n, test.key, got, err)
+		}
+	}
+
+	for _, n := range []int{0, -1, -1024} {
+		if _, err := VBucket([]byte("foo"), n); err == nil {
+			t.Errorf("Expected an error for %d vbuckets", n)
+		}
+	}
+	if _, err := (&VBucketServerMap{}).VBucket("foo"); err == nil {
+		t.Errorf("Expected an error for an empty map")
+	}
+}
+
+func TestGetClusterConfig(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.GetClusterConfig(); !errors.Is(err, ErrNoClusterConfig) {
+		t.Errorf("Expected ErrNoClusterConfig, got %v", err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected the client to stay healthy")
+	}
+
+	s.clusterConfig = []byte(sampleClusterConfig)
+	config, err := c.GetClusterConfig()
+	if err != nil {
+		t.Fatalf("Error getting cluster config: %v", err)
+	}
+	if string(config) != sampleClusterConfig {
+		t.Errorf("Expected the config body, got %s", config)
+	}
+
+	m, err := ParseVBucketServerMap(config)
+	if err != nil {
+		t.Fatalf("Error parsing vbucket map: %v", err)
+	}
+	if m.HashAlgorithm != "CRC" || m.NumReplicas != 1 || len(m.ServerList) != 2 || len(m.VBucketMap) != 4 {
+		t.Errorf("Unexpected vbucket map: %+v", m)
+	}
+	for vb, exp := range []string{"10.0.0.1:11210", "10.0.0.2:11210", "10.0.0.1:11210", ""} {
+		got, err := m.Server(uint16(vb))
+		if got != exp || (err != nil) != (exp == "") {
+			t.Errorf("Expected %q for vbucket %d, got %q (%v)", exp, vb, got, err)
+		}
+	}
+	if _, err := m.Server(4); err == nil {
+		t.Errorf("Expected an error for a vbucket outside the map")
+	}
+	// crc32("foo") is 0x8c736521.
+	if vb, err := m.VBucket("foo"); err != nil || vb != (0x8c73&0x7fff)%4 {
+		t.Errorf("Unexpected vbucket for foo: %d (%v)", vb, err)
+	}
+
+	if _, err := ParseVBucketServerMap([]byte(`{"rev": 1}`)); err == nil {
+		t.Errorf("Expected an error for a config without a vbucket map")
+	}
+}
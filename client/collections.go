@@ -0,0 +1,118 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrCollectionsDisabled is returned by SetCollection if the
+// collections feature wasn't negotiated with Hello.
+var ErrCollectionsDisabled = errors.New("collections not negotiated")
+
+// Length of COLLECTIONS_GET_ID response extras: the manifest UID and
+// the collection ID.
+const collectionIDLen = 12
+
+// GetCollectionID looks up the ID of a collection, and the UID of the
+// collections manifest it was found in.
+func (c *Client) GetCollectionID(scope, collection string) (uint32, uint64, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.COLLECTIONS_GET_ID,
+		Key:    []byte(scope + "." + collection),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(res.Extras) < collectionIDLen {
+		return 0, 0, fmt.Errorf("collection id extras is %d bytes, expected %d",
+			len(res.Extras), collectionIDLen)
+	}
+	return binary.BigEndian.Uint32(res.Extras[8:12]),
+		binary.BigEndian.Uint64(res.Extras[0:8]), nil
+}
+
+// SetCollection looks up a collection and has the client's requests
+// use it from then on, as with SetCollectionID.  The collections feature
+// must have been negotiated with Hello.
+func (c *Client) SetCollection(scope, collection string) error {
+	if !c.HasFeature(gomemcached.FEATURE_COLLECTIONS) {
+		return ErrCollectionsDisabled
+	}
+	cid, _, err := c.GetCollectionID(scope, collection)
+	if err != nil {
+		return err
+	}
+	c.SetCollectionID(cid)
+	return nil
+}
+
+// SetCollectionID has the client use the collection with the given
+// ID.  Every request for an item, including those built by the caller
+// and given to Send, Transmit or Batch, has its key prefixed with the
+// ID as it's written, so keys are always given without one.
+//
+// It may be called while the client is in use; each request is
+// written in either the old collection or the new one.
+func (c *Client) SetCollectionID(cid uint32) {
+	c.collection.Store(1<<32 | uint64(cid))
+}
+
+// currentCollection is the collection the client's keys are in, and
+// whether it has one.
+func (c *Client) currentCollection() (uint32, bool) {
+	v := c.collection.Load()
+	return uint32(v), v != 0
+}
+
+// CollectionKey is a key as sent to a server with collections
+// enabled: the collection ID, LEB128 encoded, followed by the key.
+func CollectionKey(cid uint32, key string) []byte {
+	return append(appendLEB128(make([]byte, 0, 5+len(key)), cid), key...)
+}
+
+// key is a key as the server sees it, in the client's collection if
+// it has one.
+func (c *Client) key(key string) []byte {
+	cid, ok := c.currentCollection()
+	if !ok {
+		return []byte(key)
+	}
+	return CollectionKey(cid, key)
+}
+
+// inCollection returns req as it's sent: if the client has a
+// collection and req is for an item, a copy with the collection ID
+// prefixed to its key.  req itself is left alone, so it can be sent
+// again.
+func (c *Client) inCollection(req *gomemcached.MCRequest) *gomemcached.MCRequest {
+	cid, ok := c.currentCollection()
+	if !ok || !hasKey(req.Opcode) {
+		return req
+	}
+	r := *req
+	r.Key = append(appendLEB128(make([]byte, 0, 5+len(req.Key)), cid), req.Key...)
+	return &r
+}
+
+// keyPrefixLen is the length of the collection prefix inCollection
+// adds to the key of a request with the given opcode.
+func (c *Client) keyPrefixLen(opcode gomemcached.CommandCode) int {
+	cid, ok := c.currentCollection()
+	if !ok || !hasKey(opcode) {
+		return 0
+	}
+	return len(appendLEB128(nil, cid))
+}
+
+// appendLEB128 appends v in unsigned LEB128 form: seven bits a byte,
+// least significant first, with the high bit set on all but the last.
+func appendLEB128(b []byte, v uint32) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
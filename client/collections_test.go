@@ -0,0 +1,248 @@
+package memcached
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestCollectionKey(t *testing.T) {
+	tests := []struct {
+		cid uint32
+		exp []byte
+	}{
+		{0, []byte{0x00}},
+		{8, []byte{0x08}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x80, 0x01}},
+		{0x3fff, []byte{0xff, 0x7f}},
+		{0x4000, []byte{0x80, 0x80, 0x01}},
+		{0xffffffff, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+	for _, test := range tests {
+		got := CollectionKey(test.cid, "k")
+		if exp := append(test.exp, 'k'); !bytes.Equal(got, exp) {
+			t.Errorf("Expected %v for %#x, got %v", exp, test.cid, got)
+		}
+	}
+}
+
+func TestGetCollectionID(t *testing.T) {
+	s := newFakeServer()
+	s.collections = map[string]uint32{"inventory.airline": 9}
+	s.manifest = 0x12
+	c := s.connect(t)
+	defer c.Close()
+
+	cid, uid, err := c.GetCollectionID("inventory", "airline")
+	if err != nil {
+		t.Fatalf("Error getting collection id: %v", err)
+	}
+	if cid != 9 || uid != 0x12 {
+		t.Errorf("Expected collection 9 in manifest 0x12, got %v in %#x", cid, uid)
+	}
+	if k := string(s.lastRequest().Key); k != "inventory.airline" {
+		t.Errorf("Expected the collection's path as the key, got %q", k)
+	}
+
+	_, _, err = c.GetCollectionID("inventory", "hotel")
+	if !gomemcached.IsUnknownCollection(err) {
+		t.Errorf("Expected an unknown collection, got %v", err)
+	}
+}
+
+func TestSetCollection(t *testing.T) {
+	s := newFakeServer()
+	s.collections = map[string]uint32{"inventory.airline": 0x80}
+	c := s.connect(t)
+	defer c.Close()
+
+	if err := c.SetCollection("inventory", "airline"); !errors.Is(err, ErrCollectionsDisabled) {
+		t.Fatalf("Expected ErrCollectionsDisabled, got %v", err)
+	}
+
+	s.features = map[gomemcached.Feature]bool{gomemcached.FEATURE_COLLECTIONS: true}
+	if _, err := c.Hello("test", gomemcached.FEATURE_COLLECTIONS); err != nil {
+		t.Fatalf("Error in hello: %v", err)
+	}
+	if err := c.SetCollection("inventory", "airline"); err != nil {
+		t.Fatalf("Error setting collection: %v", err)
+	}
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	wire := string([]byte{0x80, 0x01, 'k'})
+	if k := string(s.lastRequest().Key); k != wire {
+		t.Errorf("Expected key %q on the wire, got %q", wire, k)
+	}
+	res, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != "v" {
+		t.Errorf("Expected v, got %q", res.Body)
+	}
+	if item := s.item("k"); item.Data != nil {
+		t.Errorf("Expected nothing stored outside the collection, got %+v", item)
+	}
+}
+
+func TestCollectionKeysEverywhere(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetCollectionID(9)
+	prefix := []byte{9}
+
+	var buf bytes.Buffer
+	ops := map[string]func(){
+		"Get":          func() { c.Get(0, "k") },
+		"GetReplica":   func() { c.GetReplica(0, "k") },
+		"GetInto":      func() { c.GetInto(0, "k", make([]byte, 8)) },
+		"GetAndTouch":  func() { c.GetAndTouch(0, "k", 10) },
+		"Touch":        func() { c.Touch(0, "k", 10) },
+		"GetAndLock":   func() { c.GetAndLock(0, "locked", 10) },
+		"Unlock":       func() { c.Unlock(0, "locked", 1) },
+		"Set":          func() { c.Set(0, "k", 0, 0, []byte("v")) },
+		"SetQ":         func() { c.SetQ(0, "k", 0, 0, []byte("v")); c.ReceiveBatch(c.nextOpaque()) },
+		"Add":          func() { c.Add(0, "k", 0, 0, []byte("v")) },
+		"Replace":      func() { c.Replace(0, "k", 0, 0, []byte("v")) },
+		"SetCas":       func() { c.SetCas(0, "k", 0, 0, 1, []byte("v")) },
+		"Append":       func() { c.Append(0, "k", []byte("v")) },
+		"Prepend":      func() { c.Prepend(0, "k", []byte("v")) },
+		"Del":          func() { c.Del(0, "k") },
+		"DelCas":       func() { c.DelCas(0, "k", 1) },
+		"DeleteQ":      func() { c.DeleteQ(0, "k"); c.ReceiveBatch(c.nextOpaque()) },
+		"Incr":         func() { c.Incr(0, "n", 1, 0, 0) },
+		"Decr":         func() { c.Decr(0, "n", 1, 0, 0) },
+		"GetBulk":      func() { c.GetBulk(0, []string{"k", "j"}) },
+		"GetMeta":      func() { c.GetMeta(0, "k") },
+		"SetWithMeta":  func() { c.SetWithMeta(0, "k", MetaArgs{}, []byte("v")) },
+		"DelWithMeta":  func() { c.DelWithMeta(0, "k", MetaArgs{}) },
+		"SetMulti":     func() { c.SetMulti(0, []Item{{Key: []byte("k"), Value: []byte("v")}}) },
+		"DeleteMulti":  func() { c.DeleteMulti(0, []string{"k"}) },
+		"TouchMulti":   func() { c.TouchMulti(0, []string{"k"}, 10) },
+		"CAS":          func() { c.CAS(0, "k", func(b []byte) ([]byte, CasOp) { return b, CASStore }, 0) },
+		"SetReader":    func() { c.SetReader(0, "k", 0, 0, strings.NewReader("v"), 1) },
+		"GetTo":        func() { c.GetTo(0, "k", &buf) },
+		"SubdocGet":    func() { c.SubdocGet(0, "k", "p") },
+		"SetPreserve":  func() { c.SetPreserveFlags(0, "k", 0, []byte("v")) },
+		"Counter":      func() { n := c.Counter(0, "n"); n.Add(1); n.Sub(1); n.Get() },
+		"GetJSON":      func() { var v interface{}; c.GetJSON(0, "k", &v) },
+		"Batch":        func() { c.Batch([]*gomemcached.MCRequest{{Opcode: gomemcached.GET, Key: []byte("k")}}) },
+		"Send":         func() { c.Send(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")}) },
+		"SubdocLookup": func() { c.SubdocMultiLookup(0, "k", []LookupSpec{{Opcode: gomemcached.SUBDOC_GET, Path: "p"}}) },
+		"GetItem":      func() { c.GetItem(0, "k") },
+		"SetJSON":      func() { c.SetJSON(0, "k", 0, 1) },
+		"GetOrError":   func() { c.GetOrError(0, "k") },
+		"AddReturnCas": func() { c.AddReturnCas(0, "k", 0, 0, []byte("v")) },
+		"SubdocMutate": func() {
+			c.SubdocMultiMutation(0, "k", []MutationSpec{{Opcode: gomemcached.SUBDOC_DICT_UPSERT, Path: "p", Value: []byte("1")}})
+		},
+		"Observe": func() { c.Observe(0, "k") },
+	}
+	for name, op := range ops {
+		s.mu.Lock()
+		before := len(s.reqs)
+		s.mu.Unlock()
+		op()
+		s.mu.Lock()
+		reqs := s.reqs[before:]
+		s.mu.Unlock()
+
+		keyed := 0
+		for _, req := range reqs {
+			key := req.Key
+			if req.Opcode == gomemcached.OBSERVE && len(req.Body) > 4 {
+				key = req.Body[4:]
+			} else if !hasKey(req.Opcode) {
+				continue
+			}
+			keyed++
+			if !bytes.HasPrefix(key, prefix) {
+				t.Errorf("%v: sent %v for %q outside the collection", name, req.Opcode, key)
+			}
+		}
+		if keyed == 0 {
+			t.Errorf("%v: sent no requests for an item: %v", name, reqs)
+		}
+		if !c.IsHealthy() {
+			t.Fatalf("%v: left the client unhealthy", name)
+		}
+	}
+	s.mu.Lock()
+	for k := range s.data {
+		if !strings.HasPrefix(k, string(prefix)) {
+			t.Errorf("Stored %q outside the collection", k)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func TestCollectionCAS(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetCollectionID(9)
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("a")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	_, err := c.CAS(0, "k", func(b []byte) ([]byte, CasOp) {
+		return append(b, 'b'), CASStore
+	}, 0)
+	if err != nil {
+		t.Fatalf("Error in CAS: %v", err)
+	}
+	if got := string(s.item(string(CollectionKey(9, "k"))).Data); got != "ab" {
+		t.Errorf("Expected ab in the collection, got %q", got)
+	}
+	if item := s.item("k"); item.Data != nil {
+		t.Errorf("Expected nothing outside the collection, got %+v", item)
+	}
+
+	if _, err := c.CAS(0, "k", func([]byte) ([]byte, CasOp) { return nil, CASDelete }, 0); err != nil {
+		t.Fatalf("Error deleting in CAS: %v", err)
+	}
+	if item := s.item(string(CollectionKey(9, "k"))); item.Data != nil {
+		t.Errorf("Expected the item deleted from the collection, got %+v", item)
+	}
+}
+
+func TestSetCollectionIDConcurrent(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+				t.Errorf("Error setting: %v", err)
+				return
+			}
+		}
+	}()
+	for cid := uint32(1); ; cid++ {
+		select {
+		case <-done:
+			c.SetCollectionID(9)
+			if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+				t.Fatalf("Error setting: %v", err)
+			}
+			if k := s.lastRequest().Key; !bytes.Equal(k, CollectionKey(9, "k")) {
+				t.Errorf("Expected the last collection's key, got %q", k)
+			}
+			return
+		default:
+			c.SetCollectionID(cid % 200)
+			time.Sleep(time.Microsecond)
+		}
+	}
+}
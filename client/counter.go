@@ -0,0 +1,68 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// CounterValue decodes the new value of a counter from an INCREMENT
+// or DECREMENT response, whose body is the value as an 8 byte big
+// endian integer.
+func CounterValue(res *gomemcached.MCResponse) (uint64, error) {
+	if len(res.Body) != 8 {
+		return 0, fmt.Errorf("%v: expected 8 byte counter value, got %d bytes",
+			res.Opcode, len(res.Body))
+	}
+	return binary.BigEndian.Uint64(res.Body), nil
+}
+
+// Counter is a numeric value kept at a key, changed with INCREMENT and
+// DECREMENT so concurrent updates aren't lost.
+type Counter struct {
+	c   *Client
+	vb  uint16
+	key string
+
+	// Exp is the expiration the counter is created with, if Add or
+	// Sub creates it.  Changing the counter doesn't change it.
+	Exp int
+}
+
+// Counter returns the counter at key.  It needn't exist yet; the
+// first Add or Sub creates it.
+func (c *Client) Counter(vb uint16, key string) *Counter {
+	return &Counter{c: c, vb: vb, key: key}
+}
+
+// Add adds delta to the counter and returns its new value.  If the
+// counter doesn't exist, it's created with the value delta.
+func (n *Counter) Add(delta uint64) (uint64, error) {
+	return n.c.Incr(n.vb, n.key, delta, delta, n.Exp)
+}
+
+// Sub subtracts delta from the counter and returns its new value.
+// The server stops counters at 0 rather than letting them wrap, and
+// one that doesn't exist is created with the value 0.
+func (n *Counter) Sub(delta uint64) (uint64, error) {
+	return n.c.Decr(n.vb, n.key, delta, 0, n.Exp)
+}
+
+// Get returns the counter's value.  One that doesn't exist fails with
+// KEY_ENOENT.
+//
+// Servers store counters as decimal text, so a key set to something
+// else isn't a counter, and Get returns an error for it.
+func (n *Counter) Get() (uint64, error) {
+	res, err := n.c.Get(n.vb, n.key)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(string(res.Body), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't a counter: %w", n.key, err)
+	}
+	return v, nil
+}
@@ -0,0 +1,95 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestCounterValue(t *testing.T) {
+	res := &gomemcached.MCResponse{Opcode: gomemcached.INCREMENT, Body: make([]byte, 8)}
+	binary.BigEndian.PutUint64(res.Body, 0x0102030405060708)
+	if v, err := CounterValue(res); err != nil || v != 0x0102030405060708 {
+		t.Errorf("Expected 0x0102030405060708, got %#x/%v", v, err)
+	}
+
+	res.Body = res.Body[:4]
+	if _, err := CounterValue(res); err == nil {
+		t.Errorf("Expected an error decoding a 4 byte body")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	n := c.Counter(0, "ctr")
+	n.Exp = 60
+	if _, err := n.Get(); !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected KEY_ENOENT before the counter exists, got %v", err)
+	}
+
+	if v, err := n.Add(5); err != nil || v != 5 {
+		t.Fatalf("Expected a new counter to be 5, got %v/%v", v, err)
+	}
+	if req := s.lastRequest(); binary.BigEndian.Uint32(req.Extras[16:]) != 60 {
+		t.Errorf("Expected the counter created with exp 60, got %v", req.Extras)
+	}
+	if v, err := n.Add(10); err != nil || v != 15 {
+		t.Errorf("Expected 15, got %v/%v", v, err)
+	}
+	if v, err := n.Sub(3); err != nil || v != 12 {
+		t.Errorf("Expected 12, got %v/%v", v, err)
+	}
+	if v, err := n.Sub(100); err != nil || v != 0 {
+		t.Errorf("Expected the counter to stop at 0, got %v/%v", v, err)
+	}
+
+	if _, err := c.Set(0, "existing", 0, 0, []byte("41")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	e := c.Counter(0, "existing")
+	if v, err := e.Get(); err != nil || v != 41 {
+		t.Errorf("Expected 41, got %v/%v", v, err)
+	}
+	if v, err := e.Add(1); err != nil || v != 42 {
+		t.Errorf("Expected 42, got %v/%v", v, err)
+	}
+	if v, err := e.Get(); err != nil || v != 42 {
+		t.Errorf("Expected 42 after adding, got %v/%v", v, err)
+	}
+
+	if v, err := c.Counter(0, "fresh").Sub(1); err != nil || v != 0 {
+		t.Errorf("Expected a counter created by Sub to be 0, got %v/%v", v, err)
+	}
+
+	if _, err := c.Set(0, "text", 0, 0, []byte("hello")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.Counter(0, "text").Get(); err == nil {
+		t.Errorf("Expected an error getting a non-numeric value")
+	}
+}
+
+func TestCounterInCollection(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetCollectionID(9)
+
+	n := c.Counter(0, "ctr")
+	if _, err := n.Add(5); err != nil {
+		t.Fatalf("Error adding: %v", err)
+	}
+	if _, err := n.Sub(2); err != nil {
+		t.Fatalf("Error subtracting: %v", err)
+	}
+	if v, err := n.Get(); err != nil || v != 3 {
+		t.Errorf("Expected Get to read the counter Add and Sub changed, got %v/%v", v, err)
+	}
+	if got := string(s.item(string(CollectionKey(9, "ctr"))).Data); got != "3" {
+		t.Errorf("Expected the counter in the collection, got %q", got)
+	}
+}
@@ -0,0 +1,65 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// DurabilityLevel is how widely a mutation must be replicated or
+// persisted before the server acknowledges it.
+type DurabilityLevel uint8
+
+const (
+	// No requirement; the mutation is acknowledged once it's in
+	// the active node's memory.
+	DurabilityNone = DurabilityLevel(0x00)
+	// In memory on a majority of the replicas.
+	DurabilityMajority = DurabilityLevel(0x01)
+	// In memory on a majority of the replicas and persisted on
+	// the active node.
+	DurabilityMajorityAndPersistOnMaster = DurabilityLevel(0x02)
+	// Persisted on a majority of the replicas.
+	DurabilityPersistToMajority = DurabilityLevel(0x03)
+)
+
+// Durability is a mutation's durability requirement, sent in its
+// framing extras.  The server must have negotiated
+// gomemcached.FEATURE_SYNC_REPLICATION.
+//
+// A server that can't meet the level fails the mutation with
+// DURABILITY_IMPOSSIBLE (see gomemcached.IsDurabilityImpossible), and
+// other writes to the key fail with SYNC_WRITE_IN_PROGRESS while it's
+// pending.
+type Durability struct {
+	Level DurabilityLevel
+	// How long the server may take to meet the level.  0 means the
+	// server's default; it's sent in milliseconds, up to about a
+	// minute.
+	Timeout time.Duration
+}
+
+// Longest durability timeout that can be sent.
+const maxDurabilityTimeout = 0xffff * time.Millisecond
+
+// appendFrame appends the durability framing extra to b, unless there
+// is no requirement.
+func (d Durability) appendFrame(b []byte) []byte {
+	if d.Level == DurabilityNone {
+		return b
+	}
+	if d.Timeout <= 0 {
+		return gomemcached.AppendFrame(b, gomemcached.FRAME_DURABILITY, []byte{byte(d.Level)})
+	}
+	t := d.Timeout
+	if t > maxDurabilityTimeout {
+		t = maxDurabilityTimeout
+	} else if t < time.Millisecond {
+		// 0 would be the server's default.
+		t = time.Millisecond
+	}
+	data := []byte{byte(d.Level), 0, 0}
+	binary.BigEndian.PutUint16(data[1:], uint16(t/time.Millisecond))
+	return gomemcached.AppendFrame(b, gomemcached.FRAME_DURABILITY, data)
+}
@@ -0,0 +1,96 @@
+package memcached
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	mcserver "github.com/couchbase/gomemcached/server"
+)
+
+func TestDurabilityFrame(t *testing.T) {
+	tests := []struct {
+		d   Durability
+		exp []byte
+	}{
+		{Durability{}, nil},
+		{Durability{Timeout: time.Second}, nil},
+		{Durability{Level: DurabilityMajority}, []byte{0x11, 0x01}},
+		{Durability{Level: DurabilityMajorityAndPersistOnMaster}, []byte{0x11, 0x02}},
+		{Durability{Level: DurabilityPersistToMajority}, []byte{0x11, 0x03}},
+		{Durability{Level: DurabilityMajority, Timeout: 1500 * time.Millisecond},
+			[]byte{0x13, 0x01, 0x05, 0xdc}},
+		{Durability{Level: DurabilityMajority, Timeout: time.Hour},
+			[]byte{0x13, 0x01, 0xff, 0xff}},
+		{Durability{Level: DurabilityMajority, Timeout: time.Microsecond},
+			[]byte{0x13, 0x01, 0x00, 0x01}},
+	}
+	for _, test := range tests {
+		if got := test.d.appendFrame(nil); !bytes.Equal(got, test.exp) {
+			t.Errorf("Expected %v for %+v, got %v", test.exp, test.d, got)
+		}
+	}
+}
+
+func TestSetDurability(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	for _, level := range []DurabilityLevel{DurabilityMajority,
+		DurabilityMajorityAndPersistOnMaster, DurabilityPersistToMajority} {
+		_, err := c.SetOpts(0, "k", []byte("v"), StoreOptions{
+			Durability: Durability{Level: level},
+		})
+		if err != nil {
+			t.Fatalf("Error setting with %v: %v", level, err)
+		}
+		req := s.lastRequest()
+		if exp := []byte{0x11, byte(level)}; !bytes.Equal(req.FramingExtras, exp) {
+			t.Errorf("Expected framing extras %v, got %v", exp, req.FramingExtras)
+		}
+		if len(req.Extras) != 8 || string(req.Key) != "k" || string(req.Body) != "v" {
+			t.Errorf("Unexpected request: %v", req)
+		}
+	}
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if req := s.lastRequest(); req.FramingExtras != nil {
+		t.Errorf("Expected no framing extras, got %v", req.FramingExtras)
+	}
+}
+
+func TestDurabilityImpossible(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	go func() {
+		req, err := mcserver.ReadPacket(sconn)
+		if err != nil {
+			return
+		}
+		res := &gomemcached.MCResponse{
+			Opcode: req.Opcode,
+			Opaque: req.Opaque,
+			Status: gomemcached.DURABILITY_IMPOSSIBLE,
+		}
+		res.Transmit(sconn)
+	}()
+
+	_, err = c.SetOpts(0, "k", []byte("v"), StoreOptions{
+		Durability: Durability{Level: DurabilityPersistToMajority},
+	})
+	if !gomemcached.IsDurabilityImpossible(err) {
+		t.Fatalf("Expected DURABILITY_IMPOSSIBLE, got %v", err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+}
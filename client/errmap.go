@@ -0,0 +1,143 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrorMap is a server's description of its statuses, as returned by
+// GetErrorMap.
+type ErrorMap struct {
+	Version  int
+	Revision int
+	Errors   map[gomemcached.Status]ErrorInfo
+}
+
+// ErrorInfo describes a status in an ErrorMap.
+type ErrorInfo struct {
+	Name  string   `json:"name"`
+	Desc  string   `json:"desc"`
+	Attrs []string `json:"attrs"` // such as "temp", "item-only" or "retry-now"
+
+	// How to retry the request, if the server suggests it.
+	Retry *RetrySpec `json:"retry,omitempty"`
+}
+
+// HasAttr is true if the status has the given attribute.
+func (e ErrorInfo) HasAttr(attr string) bool {
+	for _, a := range e.Attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// RetrySpec is an error map's advice on retrying a request that
+// failed.  Durations are in milliseconds.
+type RetrySpec struct {
+	Strategy    string `json:"strategy"` // "constant", "linear" or "exponential"
+	Interval    int    `json:"interval"`
+	After       int    `json:"after"`        // before the first retry
+	MaxDuration int    `json:"max-duration"` // after which to give up
+	Ceil        int    `json:"ceil"`         // longest interval
+}
+
+// GetErrorMap gets the server's error map, in the newest format it
+// has up to version.  Servers only return extended statuses from it
+// once FEATURE_XERROR has been negotiated with Hello.
+func (c *Client) GetErrorMap(version uint16) (*ErrorMap, error) {
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, version)
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET_ERROR_MAP,
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseErrorMap(res.Body)
+}
+
+// parseErrorMap decodes an error map, whose statuses are given in
+// hex.
+func parseErrorMap(b []byte) (*ErrorMap, error) {
+	var raw struct {
+		Version  int                  `json:"version"`
+		Revision int                  `json:"revision"`
+		Errors   map[string]ErrorInfo `json:"errors"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("decoding error map: %w", err)
+	}
+	m := &ErrorMap{
+		Version:  raw.Version,
+		Revision: raw.Revision,
+		Errors:   make(map[gomemcached.Status]ErrorInfo, len(raw.Errors)),
+	}
+	for k, info := range raw.Errors {
+		st, err := strconv.ParseUint(k, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("error map status %q: %w", k, err)
+		}
+		m.Errors[gomemcached.Status(st)] = info
+	}
+	return m, nil
+}
+
+// SetErrorMap has Send, and the methods built on it, return failures
+// whose status is in m as a *StatusError carrying the server's
+// description.  A nil map turns this off.
+func (c *Client) SetErrorMap(m *ErrorMap) {
+	c.errMap = m
+}
+
+// StatusError is a failure response along with its status's entry
+// in the error map set with SetErrorMap.
+type StatusError struct {
+	Res  *gomemcached.MCResponse
+	Info ErrorInfo
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v (%s: %s)", e.Res.Error(), e.Info.Name, e.Info.Desc)
+}
+
+// Unwrap returns the underlying response, so the gomemcached status
+// predicates still apply.
+func (e *StatusError) Unwrap() error {
+	return e.Res
+}
+
+// Retryable is true if the server says the request may succeed if
+// retried.
+func (e *StatusError) Retryable() bool {
+	return e.Info.Retry != nil || e.Info.HasAttr("retry-now") ||
+		e.Info.HasAttr("retry-later")
+}
+
+// RetryAfter is how long the server suggests waiting before retrying,
+// or 0 if it doesn't say.
+func (e *StatusError) RetryAfter() time.Duration {
+	if e.Info.Retry == nil {
+		return 0
+	}
+	return time.Duration(e.Info.Retry.After) * time.Millisecond
+}
+
+// describe returns failure responses as a *StatusError if the error
+// map has their status.
+func (c *Client) describe(resp *gomemcached.MCResponse, err error) error {
+	if c.errMap == nil || resp == nil || err != resp {
+		return err
+	}
+	if info, ok := c.errMap.Errors[resp.Status]; ok {
+		return &StatusError{Res: resp, Info: info}
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+const sampleErrorMap = `{
+  "version": 1,
+  "revision": 4,
+  "errors": {
+    "1": {
+      "name": "KEY_ENOENT",
+      "desc": "key not found",
+      "attrs": ["item-only"]
+    },
+    "86": {
+      "name": "ETMPFAIL",
+      "desc": "temporary failure",
+      "attrs": ["temp", "retry-later"],
+      "retry": {
+        "strategy": "exponential",
+        "interval": 10,
+        "after": 5,
+        "max-duration": 5000,
+        "ceil": 500
+      }
+    }
+  }
+}`
+
+func TestParseErrorMap(t *testing.T) {
+	m, err := parseErrorMap([]byte(sampleErrorMap))
+	if err != nil {
+		t.Fatalf("Error parsing error map: %v", err)
+	}
+	if m.Version != 1 || m.Revision != 4 || len(m.Errors) != 2 {
+		t.Fatalf("Unexpected error map: %+v", m)
+	}
+	enoent := m.Errors[gomemcached.KEY_ENOENT]
+	if enoent.Name != "KEY_ENOENT" || enoent.Desc != "key not found" ||
+		!enoent.HasAttr("item-only") || enoent.HasAttr("temp") || enoent.Retry != nil {
+		t.Errorf("Unexpected KEY_ENOENT entry: %+v", enoent)
+	}
+	tmpfail := m.Errors[gomemcached.TMPFAIL]
+	exp := RetrySpec{Strategy: "exponential", Interval: 10, After: 5, MaxDuration: 5000, Ceil: 500}
+	if tmpfail.Retry == nil || *tmpfail.Retry != exp {
+		t.Errorf("Expected retry %+v, got %+v", exp, tmpfail.Retry)
+	}
+
+	for _, bad := range []string{`{"errors": {"zz": {}}}`, `{"errors": [`} {
+		if _, err := parseErrorMap([]byte(bad)); err == nil {
+			t.Errorf("Expected an error parsing %s", bad)
+		}
+	}
+}
+
+func TestGetErrorMap(t *testing.T) {
+	s := newFakeServer()
+	s.errorMap = []byte(sampleErrorMap)
+	c := s.connect(t)
+	defer c.Close()
+
+	m, err := c.GetErrorMap(1)
+	if err != nil {
+		t.Fatalf("Error getting error map: %v", err)
+	}
+	if req := s.lastRequest(); binary.BigEndian.Uint16(req.Body) != 1 {
+		t.Errorf("Expected version 1 requested, got %v", req.Body)
+	}
+	if m.Errors[gomemcached.TMPFAIL].Name != "ETMPFAIL" {
+		t.Errorf("Unexpected error map: %+v", m)
+	}
+
+	c.SetErrorMap(m)
+	_, err = c.Get(0, "missing")
+	var serr *StatusError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Expected a StatusError, got %v", err)
+	}
+	if serr.Info.Desc != "key not found" || serr.Retryable() {
+		t.Errorf("Unexpected description of KEY_ENOENT: %+v", serr.Info)
+	}
+	if !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected the status to still be KEY_ENOENT, got %v", err)
+	}
+
+	s.tmpfails = 1
+	_, err = c.Get(0, "missing")
+	if !errors.As(err, &serr) || !serr.Retryable() || serr.RetryAfter() != 5*time.Millisecond {
+		t.Errorf("Expected a retryable TMPFAIL, got %v", err)
+	}
+
+	// Statuses the map doesn't have are returned as before.
+	_, err = c.Send(&gomemcached.MCRequest{Opcode: gomemcached.GET_ERROR_MAP})
+	if _, ok := err.(*gomemcached.MCResponse); !ok {
+		t.Errorf("Expected a plain response error for EINVAL, got %v", err)
+	}
+
+	c.SetErrorMap(nil)
+	if _, err := c.Get(0, "missing"); errors.As(err, &serr) {
+		t.Errorf("Expected no description without an error map, got %v", err)
+	}
+}
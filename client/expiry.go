@@ -0,0 +1,47 @@
+package memcached
+
+import (
+	"time"
+)
+
+// MaxRelativeExpiry is the longest expiration servers treat as
+// relative to now.  Any larger exp is taken as an absolute unix time,
+// so a duration longer than thirty days passed as seconds would
+// expire in 1970, immediately.
+const MaxRelativeExpiry = 30 * 24 * 60 * 60
+
+// For tests.
+var timeNow = time.Now
+
+// Expiry returns the exp to pass to the store and touch methods for
+// an item that should live for d.
+//
+// Durations up to MaxRelativeExpiry seconds are sent as relative
+// seconds (rounded up, so a fraction of a second isn't 0); longer ones
+// as the absolute time.  0 means the item never expires, and a
+// negative duration expires it immediately.
+func Expiry(d time.Duration) int {
+	switch {
+	case d == 0:
+		return 0
+	case d < 0 || d > MaxRelativeExpiry*time.Second:
+		return ExpiryAt(timeNow().Add(d))
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// ExpiryAt returns the exp for an item that should expire at t, as
+// an absolute unix time.  The zero Time means the item never
+// expires.
+func ExpiryAt(t time.Time) int {
+	if t.IsZero() {
+		return 0
+	}
+	exp := t.Unix()
+	if exp <= MaxRelativeExpiry {
+		// Would be mistaken for a relative time; it's long past
+		// anyway.
+		exp = MaxRelativeExpiry + 1
+	}
+	return int(exp)
+}
@@ -0,0 +1,50 @@
+package memcached
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	day := 24 * time.Hour
+	tests := []struct {
+		d   time.Duration
+		exp int
+	}{
+		{0, 0},
+		{time.Millisecond, 1},
+		{90 * time.Second, 90},
+		{1500 * time.Millisecond, 2},
+		{29 * day, 29 * 86400},
+		{30 * day, MaxRelativeExpiry},
+		{30*day + time.Second, 1600000000 + MaxRelativeExpiry + 1},
+		{31 * day, 1600000000 + 31*86400},
+		{-time.Minute, 1600000000 - 60},
+	}
+	for _, x := range tests {
+		if got := Expiry(x.d); got != x.exp {
+			t.Errorf("Expected Expiry(%v) = %v, got %v", x.d, x.exp, got)
+		}
+	}
+}
+
+func TestExpiryAt(t *testing.T) {
+	tests := []struct {
+		t   time.Time
+		exp int
+	}{
+		{time.Time{}, 0},
+		{time.Unix(1600000000, 0), 1600000000},
+		{time.Unix(1600000000, 999999999), 1600000000},
+		{time.Unix(60, 0), MaxRelativeExpiry + 1},
+	}
+	for _, x := range tests {
+		if got := ExpiryAt(x.t); got != x.exp {
+			t.Errorf("Expected ExpiryAt(%v) = %v, got %v", x.t, x.exp, got)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package memcached
+
+import (
+	"context"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ClientIface is the set of operations a *Client provides, so code
+// using a client can be tested against a substitute.
+//
+// *Client is the implementation; the interface may grow as the
+// client does, so mocks should embed it rather than implement it
+// from scratch.
+type ClientIface interface {
+	Send(req *gomemcached.MCRequest) (*gomemcached.MCResponse, error)
+	SendContext(ctx context.Context, req *gomemcached.MCRequest) (*gomemcached.MCResponse, error)
+	Transmit(req *gomemcached.MCRequest) error
+	Receive() (*gomemcached.MCResponse, error)
+	FlushBuffer() error
+	Close() error
+	IsHealthy() bool
+
+	Noop() (*gomemcached.MCResponse, error)
+	Version() (string, error)
+	Auth(user, pass string) (*gomemcached.MCResponse, error)
+	SelectBucket(bucket string) (*gomemcached.MCResponse, error)
+
+	Get(vb uint16, key string) (*gomemcached.MCResponse, error)
+	GetBulk(vb uint16, keys []string) (map[string]*gomemcached.MCResponse, error)
+	GetAndTouch(vb uint16, key string, exp int) (*gomemcached.MCResponse, error)
+	Touch(vb uint16, key string, exp int) (*gomemcached.MCResponse, error)
+	Set(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error)
+	SetCas(vb uint16, key string, flags int, exp int, cas uint64, body []byte) (*gomemcached.MCResponse, error)
+	Add(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error)
+	Replace(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error)
+	Append(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error)
+	Prepend(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error)
+	Del(vb uint16, key string) (*gomemcached.MCResponse, error)
+	DelCas(vb uint16, key string, cas uint64) (*gomemcached.MCResponse, error)
+	Incr(vb uint16, key string, amt, def uint64, exp int) (uint64, error)
+	Decr(vb uint16, key string, amt, def uint64, exp int) (uint64, error)
+	CAS(vb uint16, k string, f CasFunc, initexp int) (*gomemcached.MCResponse, error)
+
+	Stats(key string) ([]StatValue, error)
+	StatsMap(key string) (map[string]string, error)
+}
+
+var _ ClientIface = (*Client)(nil)
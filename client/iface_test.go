@@ -0,0 +1,55 @@
+package memcached
+
+import (
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// mockClient answers Get from a map; anything else it's asked to do
+// panics on the nil embedded interface.
+type mockClient struct {
+	ClientIface
+	data map[string]string
+}
+
+func (m *mockClient) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	v, ok := m.data[key]
+	if !ok {
+		res := &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		return res, res
+	}
+	return &gomemcached.MCResponse{Body: []byte(v)}, nil
+}
+
+// getOr is a stand in for code written against ClientIface.
+func getOr(c ClientIface, key, def string) string {
+	res, err := c.Get(0, key)
+	if gomemcached.IsNotFound(err) {
+		return def
+	}
+	if err != nil {
+		return ""
+	}
+	return string(res.Body)
+}
+
+func TestClientIfaceMock(t *testing.T) {
+	m := &mockClient{data: map[string]string{"k": "v"}}
+	if got := getOr(m, "k", "def"); got != "v" {
+		t.Errorf("Expected v, got %q", got)
+	}
+	if got := getOr(m, "missing", "def"); got != "def" {
+		t.Errorf("Expected def, got %q", got)
+	}
+
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	if _, err := c.Set(0, "k", 0, 0, []byte("real")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if got := getOr(c, "k", "def"); got != "real" {
+		t.Errorf("Expected real, got %q", got)
+	}
+}
@@ -0,0 +1,61 @@
+package memcached
+
+import (
+	"encoding/binary"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Item is a value decoded from a get response.
+type Item struct {
+	Key   []byte
+	Value []byte
+	Flags uint32
+	Cas   uint64
+	// Expiration, when the response carries it.  Get responses
+	// don't, so it's 0 from GetItem.
+	Expiry int
+}
+
+// GetItem gets the value for a key as an Item.
+//
+// A non-success status is returned as a *gomemcached.KeyError naming
+// the key, as with GetOrError; gomemcached.IsNotFound reports misses.
+func (c *Client) GetItem(vb uint16, key string) (*Item, error) {
+	res, err := c.GetOrError(vb, key)
+	if err != nil {
+		return nil, err
+	}
+	it := itemOf(res)
+	it.Key = []byte(key)
+	return it, nil
+}
+
+// GetRandomKey gets a random item from the server, for sampling what
+// it holds.
+//
+// An empty cache fails with KEY_ENOENT (see gomemcached.IsNotFound).
+func (c *Client) GetRandomKey(vb uint16) (*Item, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.GET_RANDOM_KEY,
+		VBucket: vb,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return itemOf(res), nil
+}
+
+// itemOf decodes a get response.  The flags are the first four bytes
+// of the extras.
+func itemOf(res *gomemcached.MCResponse) *Item {
+	it := &Item{
+		Key:   res.Key,
+		Value: res.Body,
+		Cas:   res.Cas,
+	}
+	if len(res.Extras) >= 4 {
+		it.Flags = binary.BigEndian.Uint32(res.Extras)
+	}
+	return it
+}
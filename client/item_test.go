@@ -0,0 +1,77 @@
+package memcached
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/testserver"
+)
+
+func TestGetItem(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	set, err := c.Set(0, "k", 0xdeadbeef, 0, []byte("v"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	it, err := c.GetItem(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting item: %v", err)
+	}
+	if string(it.Key) != "k" || string(it.Value) != "v" || it.Flags != 0xdeadbeef ||
+		it.Cas != set.Cas || it.Expiry != 0 {
+		t.Errorf("Unexpected item: %+v", it)
+	}
+
+	it, err = c.GetItem(0, "missing")
+	if it != nil || !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected not found, got %v, %v", it, err)
+	}
+	var ke *gomemcached.KeyError
+	if !errors.As(err, &ke) || ke.Key != "missing" {
+		t.Errorf("Expected a KeyError for missing, got %#v", err)
+	}
+}
+
+func TestItemOf(t *testing.T) {
+	it := itemOf(&gomemcached.MCResponse{
+		Cas:    42,
+		Extras: []byte{0x01, 0x02, 0x03, 0x04},
+		Key:    []byte("k"),
+		Body:   []byte("v"),
+	})
+	if it.Flags != 0x01020304 || it.Cas != 42 || string(it.Key) != "k" || string(it.Value) != "v" {
+		t.Errorf("Unexpected item: %+v", it)
+	}
+	if it := itemOf(&gomemcached.MCResponse{}); it.Flags != 0 {
+		t.Errorf("Expected no flags without extras, got %+v", it)
+	}
+}
+
+func TestGetRandomKey(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+	c := connectTest(t, s)
+	defer c.Close()
+
+	if _, err := c.GetRandomKey(0); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found from an empty cache, got %v", err)
+	}
+
+	seeded := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for k, v := range seeded {
+		if _, err := c.Set(0, k, 7, 0, []byte(v)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+	it, err := c.GetRandomKey(0)
+	if err != nil {
+		t.Fatalf("Error getting a random key: %v", err)
+	}
+	if v, ok := seeded[string(it.Key)]; !ok || string(it.Value) != v || it.Flags != 7 {
+		t.Errorf("Expected one of the seeded items, got %+v", it)
+	}
+}
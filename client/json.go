@@ -0,0 +1,46 @@
+package memcached
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// SetJSON stores the JSON encoding of v with the JSON datatype set.
+//
+// If v can't be encoded, nothing is sent and the json package's error
+// is returned (wrapped), rather than a *gomemcached.MCResponse.
+func (c *Client) SetJSON(vb uint16, key string, exp int, v interface{}) (*gomemcached.MCResponse, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %q: %w", key, err)
+	}
+
+	return c.SetOpts(vb, key, body, StoreOptions{
+		Exp:      exp,
+		Datatype: gomemcached.DATATYPE_JSON,
+	})
+}
+
+// GetJSON gets the value for a key and decodes it as JSON into out.
+//
+// Snappy compressed values are decompressed first, whether or not
+// the client is set to decompress them.  Decoding errors
+// are returned (wrapped) from the json package, so they can be told
+// apart from failure statuses.
+func (c *Client) GetJSON(vb uint16, key string, out interface{}) (*gomemcached.MCResponse, error) {
+	res, err := c.Get(vb, key)
+	if err != nil {
+		return res, err
+	}
+
+	body, err := res.DecompressedMax(c.maxBody)
+	if err != nil {
+		return res, err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return res, fmt.Errorf("decoding %q: %w", key, err)
+	}
+	return res, nil
+}
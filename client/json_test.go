@@ -0,0 +1,85 @@
+package memcached
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestJSON(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	type doc struct {
+		Name  string   `json:"name"`
+		Count int      `json:"count"`
+		Tags  []string `json:"tags"`
+	}
+	in := doc{"thing", 3, []string{"a", "b"}}
+	if _, err := c.SetJSON(0, "doc", 0, in); err != nil {
+		t.Fatalf("Error in SetJSON: %v", err)
+	}
+	req := s.lastRequest()
+	if req.Datatype != gomemcached.DATATYPE_JSON {
+		t.Errorf("Expected JSON datatype, got %#x", req.Datatype)
+	}
+	if string(req.Body) != `{"name":"thing","count":3,"tags":["a","b"]}` {
+		t.Errorf("Unexpected body %s", req.Body)
+	}
+
+	var out doc
+	if _, err := c.GetJSON(0, "doc", &out); err != nil {
+		t.Fatalf("Error in GetJSON: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+
+	m := map[string]interface{}{"x": 1.5, "y": "z"}
+	if _, err := c.SetJSON(0, "map", 0, m); err != nil {
+		t.Fatalf("Error in SetJSON: %v", err)
+	}
+	var mout map[string]interface{}
+	if _, err := c.GetJSON(0, "map", &mout); err != nil {
+		t.Fatalf("Error in GetJSON: %v", err)
+	}
+	if !reflect.DeepEqual(m, mout) {
+		t.Errorf("Expected %v, got %v", m, mout)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	_, err := c.SetJSON(0, "bad", 0, make(chan int))
+	var uerr *json.UnsupportedTypeError
+	if !errors.As(err, &uerr) {
+		t.Errorf("Expected an encoding error, got %v", err)
+	}
+	s.mu.Lock()
+	if len(s.reqs) != 0 {
+		t.Errorf("Expected nothing to be sent, got %v", s.reqs)
+	}
+	s.mu.Unlock()
+
+	if _, err := c.Set(0, "notjson", 0, 0, []byte("{nope")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	var out interface{}
+	_, err = c.GetJSON(0, "notjson", &out)
+	var serr *json.SyntaxError
+	if !errors.As(err, &serr) {
+		t.Errorf("Expected a decoding error, got %v", err)
+	}
+
+	_, err = c.GetJSON(0, "missing", &out)
+	if !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
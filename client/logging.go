@@ -0,0 +1,60 @@
+package memcached
+
+import (
+	"github.com/couchbase/gomemcached"
+)
+
+// Logger is what a client logs protocol traffic to.  *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// LogLevel says how much protocol traffic a client logs.
+type LogLevel int
+
+const (
+	// LogNone logs nothing.
+	LogNone = LogLevel(iota)
+	// LogErrors logs failed responses and connection errors.
+	LogErrors
+	// LogAll logs every request and response too.
+	LogAll
+)
+
+// SetLogger makes the client log traffic to l, as much as level says.
+// Requests sent by Transmit (and so Send) are logged, as are the
+// responses read by Send and Receive.  Bodies are summarized by their
+// length, never logged.
+//
+// With no logger or LogNone, nothing is formatted.
+func (c *Client) SetLogger(l Logger, level LogLevel) {
+	if l == nil {
+		level = LogNone
+	}
+	c.logger, c.logLevel = l, level
+}
+
+func (c *Client) logRequest(req *gomemcached.MCRequest, err error) {
+	switch {
+	case err != nil && c.logLevel >= LogErrors:
+		c.logger.Printf("memcached: > %v key=%q vb=%d opaque=%d: %v",
+			req.Opcode, req.Key, req.VBucket, req.Opaque, err)
+	case c.logLevel >= LogAll:
+		c.logger.Printf("memcached: > %v key=%q vb=%d opaque=%d bodylen=%d",
+			req.Opcode, req.Key, req.VBucket, req.Opaque, len(req.Body))
+	}
+}
+
+func (c *Client) logResponse(res *gomemcached.MCResponse, err error) {
+	switch {
+	case res == nil || (err != nil && err != res):
+		if c.logLevel >= LogErrors {
+			c.logger.Printf("memcached: < error: %v", err)
+		}
+	case c.logLevel >= LogAll ||
+		(c.logLevel >= LogErrors && res.Status != gomemcached.SUCCESS):
+		c.logger.Printf("memcached: < %v status=%v opaque=%d cas=%d bodylen=%d",
+			res.Opcode, res.Status, res.Opaque, res.Cas, len(res.Body))
+	}
+}
@@ -0,0 +1,73 @@
+package memcached
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type lines []string
+
+func (l *lines) Printf(format string, v ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	var got lines
+	c.SetLogger(&got, LogAll)
+	if _, err := c.Set(3, "k", 0, 0, []byte("value")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.Get(3, "k"); err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+
+	exp := []string{
+		`> SET key="k" vb=3 opaque=1 bodylen=5`,
+		`< SET status=SUCCESS opaque=1 cas=1 bodylen=0`,
+		`> GET key="k" vb=3 opaque=2 bodylen=0`,
+		`< GET status=SUCCESS opaque=2 cas=1 bodylen=5`,
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("Expected %d lines, got %q", len(exp), got)
+	}
+	for i := range exp {
+		if !strings.HasSuffix(got[i], exp[i]) {
+			t.Errorf("Expected line %d to end with %q, got %q", i, exp[i], got[i])
+		}
+	}
+
+	// Only failures are logged at LogErrors.
+	got = nil
+	c.SetLogger(&got, LogErrors)
+	c.Get(3, "k")
+	c.Get(3, "missing")
+	if len(got) != 1 || !strings.Contains(got[0], "status=KEY_ENOENT") {
+		t.Errorf("Expected just the miss logged, got %q", got)
+	}
+
+	got = nil
+	c.SetLogger(nil, LogAll)
+	c.Get(3, "missing")
+	if len(got) != 0 {
+		t.Errorf("Expected nothing logged without a logger, got %q", got)
+	}
+}
+
+func TestLoggerConnError(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	var got lines
+	c.SetLogger(&got, LogErrors)
+	s.dropConnections()
+	c.Noop()
+	if len(got) == 0 || !strings.Contains(got[len(got)-1], "error") {
+		t.Errorf("Expected the connection error logged, got %q", got)
+	}
+}
@@ -2,13 +2,20 @@
 package memcached
 
 import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/gomemcached"
@@ -17,83 +24,849 @@ import (
 const bufsize = 1024
 
 // The Client itself.
+//
+// Send, and the methods built on it, may be called from multiple
+// goroutines; each request and its response are exchanged under a
+// lock.  So are the methods pipelining several requests, such as
+// GetBulk, Batch, SetMulti and Stats, which hold it until the last
+// response.  The lower level Transmit and Receive (and ReceiveBatch,
+// StatsChan and the feed methods using them) aren't synchronized, and
+// must not be mixed with concurrent use of the client.
 type Client struct {
 	conn    io.ReadWriteCloser
-	healthy bool
+	reader  io.Reader
+	writer  *bufio.Writer
+	out     io.Writer  // conn, counting what's written
+	mu      sync.Mutex // serializes Send
+	wmu     sync.Mutex
+	healthy atomic.Bool
+	opaque  uint32
+
+	// Negotiated by Hello, and replaced whole so HasFeature can read
+	// it while the client is in use.
+	features atomic.Pointer[map[gomemcached.Feature]bool]
+
+	dmu   sync.Mutex
+	demux *demux // reads responses for Go, once started
+
+	maxInFlight int // see SetMaxInFlight
+
+	// How to redial for automatic reconnects.
+	dial           func() (net.Conn, error)
+	reconnect      bool
+	retryMutations bool
+	bucket         string // selected again after reconnecting
+
+	// Session setup replayed on reconnecting, registered by Hello
+	// and Auth, and then the caller's; see SetReconnectSetup.
+	helloSetup, authSetup, setup func(*Client) error
+
+	retry *RetryPolicy // for TMPFAIL responses
+
+	maxBody int // longest request or response body, if not 0
+	maxKey  int // longest key, if not 0
 
-	hdrBuf []byte
+	checkExtras bool      // validate response extras lengths
+	decompress  bool      // see SetDecompress
+	errMap      *ErrorMap // describes failures, if set
+
+	lastUsed time.Time // when it was last put in a Pool
+
+	// 1<<32 | the collection ID keys are prefixed with, once
+	// SetCollectionID is called; see currentCollection.
+	collection atomic.Uint64
+
+	observer OpObserver
+
+	logger   Logger
+	logLevel LogLevel
+
+	tracer Tracer // for SendContext
+
+	// Buffer sizes for the connection, and any it's reconnected with.
+	readBufSize, writeBufSize int
+
+	counters connCounters // see ConnStats
 }
 
+// Errors for requests whose keys can't be sent.  See SetMaxKeyLength.
+var (
+	ErrKeyTooLong = errors.New("key too long")
+	ErrEmptyKey   = errors.New("key required")
+)
+
+// ErrSnappyNotNegotiated is returned for requests with a Snappy
+// compressed body (DATATYPE_SNAPPY) unless FEATURE_SNAPPY was
+// negotiated with Hello, since servers reject them otherwise.
+var ErrSnappyNotNegotiated = errors.New("snappy datatype not negotiated")
+
+// ErrOpaqueMismatch is returned by Send when the response doesn't
+// belong to the request that was sent, meaning the stream is out of
+// sync.
+var ErrOpaqueMismatch = errors.New("opaque mismatch")
+
 var (
 	DefaultDialTimeout = time.Duration(0) // No timeout
 
+	// How long Connect and ConnectTimeout wait on a hostname's first
+	// address family before racing a dial to the other ("Happy
+	// Eyeballs"), so a dead IPv6 or IPv4 route doesn't stall them.
+	// Use a negative value to dial the addresses one at a time.
+	DefaultFallbackDelay = 300 * time.Millisecond
+
+	// Size of the read buffer for new clients.  Use 0 to read
+	// directly from the connection.
+	DefaultReadBufferSize = bufsize
+	// Size of the write buffer for new clients.  Use 0 to write
+	// each request directly to the connection.
+	DefaultWriteBufferSize = bufsize
+
+	// Longest request or response body new clients allow, matching
+	// the servers' default item size limit.  Use 0 for no limit.
+	DefaultMaxBodySize = 20 * 1024 * 1024
+	// Longest key new clients send with key based commands.  Use 0 for
+	// no limit.
+	DefaultMaxKeyLength = 250
+
 	dialFun = func(prot, dest string) (net.Conn, error) {
-		return net.DialTimeout(prot, dest, DefaultDialTimeout)
+		return newDialer(DefaultDialTimeout).Dial(prot, dest)
 	}
 )
 
+// newDialer returns the dialer Connect and ConnectTimeout use.
+func newDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, FallbackDelay: DefaultFallbackDelay}
+}
+
 // Connect to a memcached server.
 func Connect(prot, dest string) (rv *Client, err error) {
 	conn, err := dialFun(prot, dest)
 	if err != nil {
 		return nil, err
 	}
-	return Wrap(conn)
+	rv, err = Wrap(conn)
+	if err == nil {
+		rv.dial = func() (net.Conn, error) { return dialFun(prot, dest) }
+	}
+	return rv, err
+}
+
+// ConnectTimeout connects to a memcached server, giving up with a
+// timeout error if the connection isn't made within timeout.
+// Reconnects are bounded the same way.
+//
+// A hostname with both IPv6 and IPv4 addresses is dialed on both
+// families after DefaultFallbackDelay.  IP addresses are dialed
+// directly.
+func ConnectTimeout(prot, dest string, timeout time.Duration) (*Client, error) {
+	return ConnectWithDialer(prot, dest, newDialer(timeout))
+}
+
+// ConnectWithDialer connects to a memcached server using the given
+// dialer, for control over timeouts, keepalives, the local address
+// and so on.  The dialer is used again for automatic reconnects.
+// Its FallbackDelay governs dual-stack hostnames, as for
+// ConnectTimeout.
+func ConnectWithDialer(prot, dest string, d *net.Dialer) (*Client, error) {
+	return ConnectWithDialerContext(context.Background(), prot, dest, d)
+}
+
+// ConnectWithDialerContext is ConnectWithDialer, giving up on the
+// dial when ctx is done.
+func ConnectWithDialerContext(ctx context.Context, prot, dest string, d *net.Dialer) (*Client, error) {
+	conn, err := d.DialContext(ctx, prot, dest)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := Wrap(conn)
+	if err == nil {
+		rv.dial = func() (net.Conn, error) { return d.Dial(prot, dest) }
+	}
+	return rv, err
 }
 
 // Wrap an existing transport.
 func Wrap(rwc io.ReadWriteCloser) (rv *Client, err error) {
-	return &Client{
-		conn:    rwc,
-		healthy: true,
-		hdrBuf:  make([]byte, gomemcached.HDR_LEN),
-	}, nil
+	rv = &Client{
+		maxBody: DefaultMaxBodySize,
+		maxKey:  DefaultMaxKeyLength,
+
+		readBufSize:  DefaultReadBufferSize,
+		writeBufSize: DefaultWriteBufferSize,
+	}
+	rv.setConn(rwc)
+	return rv, nil
+}
+
+// NewClient returns a client communicating over an existing
+// connection, such as a net.Pipe or TLS connection.
+//
+// It's equivalent to Wrap, which can't fail.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c, _ := Wrap(conn)
+	return c
+}
+
+// setConn points the client (and its buffers) at a new connection.
+func (c *Client) setConn(rwc io.ReadWriteCloser) {
+	c.conn = rwc
+	c.reader = countingReader{rwc, &c.counters.received}
+	if c.readBufSize > 0 {
+		c.reader = bufio.NewReaderSize(c.reader, c.readBufSize)
+	}
+	c.out = countingWriter{rwc, &c.counters.sent}
+	c.writer = nil
+	if c.writeBufSize > 0 {
+		c.writer = bufio.NewWriterSize(c.out, c.writeBufSize)
+	}
+	c.healthy.Store(true)
 }
 
 // Close the connection when you're done.
+//
+// Any buffered requests are written first.
 func (c *Client) Close() error {
-	return c.conn.Close()
+	c.FlushBuffer()
+	err := c.conn.Close()
+	c.stopDemux()
+	return err
+}
+
+// GracefulClose sends a QUIT and waits up to timeout for the server
+// to answer it or hang up before closing the connection, so the
+// server sees a clean disconnect rather than a reset.
+//
+// Failures sending the QUIT are ignored, since the connection is
+// closed regardless, and the client isn't reconnected for it.  If the
+// connection doesn't support deadlines, the QUIT is written without
+// waiting for an answer.
+func (c *Client) GracefulClose(timeout time.Duration) error {
+	req := &gomemcached.MCRequest{Opcode: gomemcached.QUIT, Opaque: c.nextOpaque()}
+	if d, err := c.deadliner(); err == nil && d.SetDeadline(time.Now().Add(timeout)) == nil {
+		c.mu.Lock()
+		c.send(req, nil)
+		c.mu.Unlock()
+	} else {
+		c.transmit(req)
+	}
+	c.healthy.Store(false)
+	return c.Close()
+}
+
+func (c *Client) transmit(req *gomemcached.MCRequest) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	req = c.inCollection(req)
+	var n int
+	var err error
+	if c.writer == nil {
+		n, err = transmitRequest(c.out, req)
+	} else {
+		n, err = transmitRequest(c.writer, req)
+	}
+	c.counters.ops.Add(1)
+	if c.logLevel != LogNone {
+		c.logRequest(req, err)
+	}
+	return n, err
+}
+
+// FlushBuffer writes any requests buffered by Transmit to the
+// connection.
+func (c *Client) FlushBuffer() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writer == nil || c.writer.Buffered() == 0 {
+		return nil
+	}
+	err := c.writer.Flush()
+	if err != nil {
+		c.healthy.Store(false)
+	}
+	return err
+}
+
+// ErrNoDeadline is returned when setting a deadline on a client
+// whose connection doesn't support them.
+var ErrNoDeadline = errors.New("connection does not support deadlines")
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+func (c *Client) deadliner() (deadliner, error) {
+	d, ok := c.conn.(deadliner)
+	if !ok {
+		return nil, ErrNoDeadline
+	}
+	return d, nil
+}
+
+// SetDeadline sets the read and write deadlines of the underlying
+// connection.  A zero value for t means I/O will not time out.
+func (c *Client) SetDeadline(t time.Time) error {
+	d, err := c.deadliner()
+	if err != nil {
+		return err
+	}
+	return d.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (c *Client) SetReadDeadline(t time.Time) error {
+	d, err := c.deadliner()
+	if err != nil {
+		return err
+	}
+	return d.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying
+// connection.
+func (c *Client) SetWriteDeadline(t time.Time) error {
+	d, err := c.deadliner()
+	if err != nil {
+		return err
+	}
+	return d.SetWriteDeadline(t)
 }
 
 // IsHealthy returns true unless the client is belived to have
 // difficulty communicating to its server.
 //
 // This is useful for connection pools where we want to
-// non-destructively determine that a connection may be reused.
-func (c Client) IsHealthy() bool {
-	return c.healthy
+// non-destructively determine that a connection may be reused.  It's
+// safe to call while the client is in use by other goroutines.
+func (c *Client) IsHealthy() bool {
+	return c.healthy.Load()
+}
+
+// ConnStats are a client's traffic counters, as returned by
+// Client.ConnStats.  They're cumulative over the client's lifetime,
+// including any connections it's been reconnected with.
+type ConnStats struct {
+	BytesSent     uint64 // written to the connection
+	BytesReceived uint64 // read from the connection
+	Ops           uint64 // requests transmitted
+}
+
+// ConnStats returns the client's traffic counters.  Unlike the
+// server's Stats, they're kept by the client, and may be read while
+// it's in use.
+//
+// Bytes are counted as they're written to and read from the
+// connection, so buffered requests aren't counted until they're
+// flushed, and responses may be counted as they're read ahead.
+func (c *Client) ConnStats() ConnStats {
+	return ConnStats{
+		BytesSent:     c.counters.sent.Load(),
+		BytesReceived: c.counters.received.Load(),
+		Ops:           c.counters.ops.Load(),
+	}
+}
+
+// SetMaxBodySize sets the longest request or response body the client
+// allows, or 0 for no limit.
+//
+// Requests with longer bodies fail with gomemcached.ErrBodyTooLarge
+// without being sent.  A response declaring a longer body fails the
+// same way instead of being read, and the client is marked unhealthy
+// since the rest of the response is still on the connection.
+func (c *Client) SetMaxBodySize(n int) {
+	c.maxBody = n
+}
+
+// SetMaxKeyLength sets the longest key the client sends with key
+// based commands, or 0 for no limit.  The default,
+// DefaultMaxKeyLength, is memcached's.
+//
+// Requests with longer keys fail with ErrKeyTooLong, and key based
+// requests without a key with ErrEmptyKey, without being sent.
+// Requests with framing extras, such as durable writes, are also
+// limited to gomemcached.MaxFlexLen bytes of key, collection prefix
+// included, whatever the setting.
+func (c *Client) SetMaxKeyLength(n int) {
+	c.maxKey = n
+}
+
+// SetCheckExtras sets whether responses read by Send and Receive
+// (and the methods built on them) are checked with
+// MCResponse.CheckExtras.  It's off by default, since servers with
+// extensions may send other extras.
+//
+// A response that fails the check is returned with an error wrapping
+// gomemcached.ErrExtrasLength, and the client is marked unhealthy.
+func (c *Client) SetCheckExtras(on bool) {
+	c.checkExtras = on
+}
+
+// SetDecompress sets whether snappy compressed values read by Send
+// and Receive (and the methods built on them, such as Get) are
+// decompressed, so callers get the plain value.  It's off by default.
+//
+// A decompressed response has the value as its body and
+// DATATYPE_SNAPPY cleared.  If decompressing fails, the response is
+// returned as it arrived, compressed, along with the error; the value
+// can also be at most the client's SetMaxBodySize once decompressed.
+func (c *Client) SetDecompress(on bool) {
+	c.decompress = on
+}
+
+// checkResponse applies the checks responses are configured to get.
+func (c *Client) checkResponse(resp *gomemcached.MCResponse, err error) error {
+	if resp == nil || (err != nil && err != resp) {
+		return err
+	}
+	if c.checkExtras {
+		if xerr := resp.CheckExtras(); xerr != nil {
+			c.healthy.Store(false)
+			return xerr
+		}
+	}
+	// A nil body was streamed elsewhere, as by GetTo.
+	if c.decompress && err == nil && resp.IsSnappy() && resp.Body != nil {
+		body, derr := resp.DecompressedMax(c.maxBody)
+		if derr != nil {
+			return fmt.Errorf("decompressing %v response: %w", resp.Opcode, derr)
+		}
+		resp.Body = body
+		resp.Datatype &^= gomemcached.DATATYPE_SNAPPY
+	}
+	return err
+}
+
+// checkRequest returns an error if a request shouldn't be sent.
+func (c *Client) checkRequest(req *gomemcached.MCRequest) error {
+	if c.maxBody > 0 && len(req.Body) > c.maxBody {
+		return fmt.Errorf("%w: request body is %d bytes (max %d)",
+			gomemcached.ErrBodyTooLarge, len(req.Body), c.maxBody)
+	}
+	if req.Datatype&gomemcached.DATATYPE_SNAPPY != 0 && !c.HasFeature(gomemcached.FEATURE_SNAPPY) {
+		return fmt.Errorf("%w for %v", ErrSnappyNotNegotiated, req.Opcode)
+	}
+	if len(req.FramingExtras) > 0 {
+		// The flexible framing header has a byte for the key's
+		// length, including any collection prefix.
+		max := gomemcached.MaxFlexLen - c.keyPrefixLen(req.Opcode)
+		if len(req.Key) > max {
+			return fmt.Errorf("%w: %v key is %d bytes (max %d with framing extras)",
+				ErrKeyTooLong, req.Opcode, len(req.Key), max)
+		}
+		if len(req.FramingExtras) > gomemcached.MaxFlexLen {
+			return fmt.Errorf("%w: %v framing extras are %d bytes (max %d)",
+				gomemcached.ErrFlexTooLong, req.Opcode, len(req.FramingExtras), gomemcached.MaxFlexLen)
+		}
+	}
+	if !hasKey(req.Opcode) {
+		return nil
+	}
+	if len(req.Key) == 0 {
+		return fmt.Errorf("%w for %v", ErrEmptyKey, req.Opcode)
+	}
+	if c.maxKey > 0 && len(req.Key) > c.maxKey {
+		return fmt.Errorf("%w: %v key is %d bytes (max %d)",
+			ErrKeyTooLong, req.Opcode, len(req.Key), c.maxKey)
+	}
+	return nil
+}
+
+// hasKey is true for commands operating on a single item, which
+// need its key.
+func hasKey(opcode gomemcached.CommandCode) bool {
+	switch opcode {
+	case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ,
+		gomemcached.SET, gomemcached.SETQ, gomemcached.ADD, gomemcached.ADDQ,
+		gomemcached.REPLACE, gomemcached.REPLACEQ,
+		gomemcached.DELETE, gomemcached.DELETEQ,
+		gomemcached.INCREMENT, gomemcached.INCREMENTQ,
+		gomemcached.DECREMENT, gomemcached.DECREMENTQ,
+		gomemcached.APPEND, gomemcached.APPENDQ,
+		gomemcached.PREPEND, gomemcached.PREPENDQ,
+		gomemcached.TOUCH, gomemcached.GAT, gomemcached.GATQ,
+		gomemcached.GET_REPLICA, gomemcached.GET_LOCKED, gomemcached.UNLOCK_KEY,
+		gomemcached.GET_META, gomemcached.SET_WITH_META, gomemcached.DEL_WITH_META:
+		return true
+	}
+	return opcode >= gomemcached.SUBDOC_GET && opcode <= gomemcached.SUBDOC_GET_COUNT
+}
+
+// nextOpaque returns a new (non-zero) opaque for this client.
+func (c *Client) nextOpaque() uint32 {
+	for {
+		if o := atomic.AddUint32(&c.opaque, 1); o != 0 {
+			return o
+		}
+	}
 }
 
 // Send a custom request and get the response.
+//
+// A request with a zero Opaque is assigned one from the client.  The
+// response must echo the request's opaque; if it doesn't,
+// ErrOpaqueMismatch is returned and the client is marked unhealthy.
 func (c *Client) Send(req *gomemcached.MCRequest) (rv *gomemcached.MCResponse, err error) {
-	_, err = transmitRequest(c.conn, req)
+	return c.retrying(context.Background(), func() (*gomemcached.MCResponse, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.sendLocked(context.Background(), req, nil)
+	})
+}
+
+// sendLocked does the work of Send with c.mu held, with the request
+// and response bodies going through body if it's not nil.  The
+// exchange is bounded by ctx, and once ctx is done a failed request
+// isn't retried on a new connection.
+func (c *Client) sendLocked(ctx context.Context, req *gomemcached.MCRequest,
+	body *bodyIO) (rv *gomemcached.MCResponse, err error) {
+
+	if c.observer != nil {
+		start := time.Now()
+		defer func() {
+			var st gomemcached.Status
+			if rv != nil {
+				st = rv.Status
+			}
+			c.observer.ObserveOp(req.Opcode, st, time.Since(start), err)
+		}()
+	}
+	if err := c.checkRequest(req); err != nil {
+		return nil, err
+	}
+	if req.Opaque == 0 {
+		req.Opaque = c.nextOpaque()
+	}
+	rv, err = c.sendWatched(ctx, req, body)
+	if contextErr(ctx) == nil && c.shouldRetry(req, err) &&
+		body.rewind() == nil && c.redial() == nil {
+		rv, err = c.sendWatched(ctx, req, body)
+	}
+	return rv, err
+}
+
+// sendWatched sends a request on the current connection, bounding
+// the exchange by ctx's deadline and cutting it short if ctx is
+// cancelled.  A context that can't be done, like Background, costs
+// nothing.
+func (c *Client) sendWatched(ctx context.Context, req *gomemcached.MCRequest,
+	body *bodyIO) (*gomemcached.MCResponse, error) {
+
+	if ctx.Done() == nil {
+		return c.send(req, body)
+	}
+	d, err := c.deadliner()
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		if err := d.SetDeadline(dl); err != nil {
+			return nil, err
+		}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// Unblock any pending I/O.
+			d.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	res, err := c.send(req, body)
+	close(done)
+	<-exited
+	d.SetDeadline(time.Time{})
+	return res, err
+}
+
+// contextErr is ctx's error, counting its deadline as exceeded once
+// it's passed: the connection's deadline can pass a moment before the
+// context notices its own.
+func contextErr(ctx context.Context) error {
+	err := ctx.Err()
+	if dl, ok := ctx.Deadline(); ok && err == nil && !time.Now().Before(dl) {
+		err = context.DeadlineExceeded
+	}
+	return err
+}
+
+func (c *Client) send(req *gomemcached.MCRequest, body *bodyIO) (rv *gomemcached.MCResponse, err error) {
+	if body != nil && body.r != nil {
+		err = c.transmitStream(req, body.r, body.length)
+	} else {
+		_, err = c.transmit(req)
+	}
+	if err == nil {
+		err = c.FlushBuffer()
+	}
 	if err != nil {
-		c.healthy = false
+		c.healthy.Store(false)
 		return
 	}
-	resp, _, err := getResponse(c.conn, c.hdrBuf)
-	c.healthy = !gomemcached.IsFatal(err)
-	return resp, err
+	return c.await(req, body)
+}
+
+// await reads the response to a request that's been sent.
+func (c *Client) await(req *gomemcached.MCRequest, body *bodyIO) (resp *gomemcached.MCResponse, err error) {
+	if body != nil && body.w != nil {
+		resp, body.n, err = getResponseTo(c.reader, nil, body.w)
+	} else {
+		resp, _, err = getResponseInto(c.reader, nil, body.buffer(), c.maxBody)
+	}
+	if c.logLevel != LogNone {
+		c.logResponse(resp, err)
+	}
+	if resp != nil && resp.Opaque != req.Opaque && (err == nil || err == resp) {
+		c.healthy.Store(false)
+		return resp, fmt.Errorf("%w: sent %d, received %d",
+			ErrOpaqueMismatch, req.Opaque, resp.Opaque)
+	}
+	c.healthy.Store(!gomemcached.IsFatal(err))
+	return resp, c.describe(resp, c.checkResponse(resp, err))
+}
+
+// SendContext sends a custom request and gets the response like
+// Send, honoring the context's deadline and cancellation.
+//
+// The connection must support deadlines.  If the context ends before
+// the response is read, the context's error is returned and the
+// client is marked unhealthy, since the response may still arrive
+// later.
+//
+// With a tracer set, the request is traced by a span that's a child
+// of any span in ctx.
+func (c *Client) SendContext(ctx context.Context,
+	req *gomemcached.MCRequest) (res *gomemcached.MCResponse, err error) {
+
+	if c.tracer != nil {
+		var span Span
+		ctx, span = c.startSpan(ctx, req)
+		defer func() { endSpan(span, res, err) }()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := c.deadliner(); err != nil {
+		return nil, err
+	}
+	return c.retrying(ctx, func() (*gomemcached.MCResponse, error) {
+		return c.sendContext(ctx, req)
+	})
+}
+
+func (c *Client) sendContext(ctx context.Context,
+	req *gomemcached.MCRequest) (*gomemcached.MCResponse, error) {
+
+	// Hold the lock across the deadline changes so they only apply
+	// to this request.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res, err := c.sendLocked(ctx, req, nil)
+	if cerr := contextErr(ctx); cerr != nil && err != nil {
+		c.healthy.Store(false)
+		return res, cerr
+	}
+	return res, err
 }
 
 // Transmit send a request, but does not wait for a response.
+//
+// The request is buffered; it's written to the connection by the
+// next FlushBuffer, Send, or Receive, or when the buffer fills.
+//
+// As with Send, a request with a zero Opaque is assigned one, so its
+// response (if any) can be matched to it by req.Opaque.
 func (c *Client) Transmit(req *gomemcached.MCRequest) error {
-	_, err := transmitRequest(c.conn, req)
+	if err := c.checkRequest(req); err != nil {
+		return err
+	}
+	if req.Opaque == 0 {
+		req.Opaque = c.nextOpaque()
+	}
+	_, err := c.transmit(req)
 	if err != nil {
-		c.healthy = false
+		c.healthy.Store(false)
 	}
 	return err
 }
 
 // Receive a response
+//
+// Any buffered requests are written before waiting.
 func (c *Client) Receive() (*gomemcached.MCResponse, error) {
-	resp, _, err := getResponse(c.conn, c.hdrBuf)
-	if err != nil && resp.Status != gomemcached.KEY_ENOENT {
-		c.healthy = false
+	resp, _, err := c.receive()
+	if err != nil && (resp == nil || resp.Status != gomemcached.KEY_ENOENT) {
+		c.healthy.Store(false)
 	}
 	return resp, err
 }
 
+// ErrReceiveTimeout is returned by ReceiveTimeout when a response
+// doesn't arrive in time.
+var ErrReceiveTimeout = errors.New("timed out waiting for a response")
+
+// ReceiveTimeout receives a response like Receive, but gives up with
+// ErrReceiveTimeout if it doesn't arrive within d.
+//
+// If nothing of the response had arrived, the client can still be
+// used, and a later Receive gets the response if it's just late.  If
+// part of it had, the stream can't be resynchronized and the client
+// is marked unhealthy.
+//
+// The read deadline is cleared afterwards, replacing any set with
+// SetReadDeadline or SetDeadline.
+func (c *Client) ReceiveTimeout(d time.Duration) (*gomemcached.MCResponse, error) {
+	dl, err := c.deadliner()
+	if err != nil {
+		return nil, err
+	}
+	if err := dl.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return nil, err
+	}
+	resp, n, err := c.receive()
+	if derr := dl.SetReadDeadline(time.Time{}); derr != nil && err == nil {
+		err = derr
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		if n > 0 {
+			c.healthy.Store(false)
+			return nil, fmt.Errorf("%w after %d bytes of the response: %v",
+				ErrReceiveTimeout, n, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrReceiveTimeout, err)
+	}
+	if err != nil && (resp == nil || resp.Status != gomemcached.KEY_ENOENT) {
+		c.healthy.Store(false)
+	}
+	return resp, err
+}
+
+// receive reads a response, writing any buffered requests first.
+func (c *Client) receive() (*gomemcached.MCResponse, int, error) {
+	if err := c.FlushBuffer(); err != nil {
+		return nil, 0, err
+	}
+	resp, n, err := getResponseInto(c.reader, nil, nil, c.maxBody)
+	if c.logLevel != LogNone {
+		c.logResponse(resp, err)
+	}
+	return resp, n, c.checkResponse(resp, err)
+}
+
+// Noop sends a NOOP and waits for the reply.
+func (c *Client) Noop() (*gomemcached.MCResponse, error) {
+	return c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.NOOP,
+	})
+}
+
+// Ping checks the connection is alive with a NOOP round trip,
+// returning an error if it fails.
+//
+// Any deadline set on the client applies, so with SetReadDeadline a
+// server that stops responding fails the ping rather than hanging
+// it.
+func (c *Client) Ping() error {
+	_, err := c.Noop()
+	return err
+}
+
+// ReceiveBatch terminates a batch of transmitted quiet commands.
+//
+// Quiet commands only produce a response when there's something to
+// report (a hit for GETQ, a failure for SETQ, etc.), so there's no
+// way to know when they're done.  ReceiveBatch sends a NOOP carrying
+// the given opaque and returns every response received before the
+// NOOP is echoed back.  Non-success statuses are returned in the
+// slice rather than as an error; the error is only set if the
+// connection fails.
+//
+// Usage is like this:
+//
+//	for i, k := range keys {
+//	    client.Transmit(&gomemcached.MCRequest{Opcode: gomemcached.GETQ, ...})
+//	}
+//	responses, err := client.ReceiveBatch(opaque)
+func (c *Client) ReceiveBatch(opaque uint32) ([]*gomemcached.MCResponse, error) {
+	err := c.Transmit(&gomemcached.MCRequest{
+		Opcode: gomemcached.NOOP,
+		Opaque: opaque,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*gomemcached.MCResponse
+	for {
+		res, err := UnwrapMemcachedError(c.Receive())
+		if err != nil {
+			return rv, err
+		}
+		if res.Opcode == gomemcached.NOOP && res.Opaque == opaque {
+			return rv, nil
+		}
+		rv = append(rv, res)
+	}
+}
+
+// Drain reads and discards responses up to and including the one
+// with the given opaque, typically that of a NOOP just transmitted,
+// to resynchronize a connection left with unread responses.
+//
+// Once the sentinel is read the client is in step with its server
+// again, and is marked healthy.  If the stream fails first, the error
+// is returned and the client is left unhealthy.
+func (c *Client) Drain(opaque uint32) error {
+	for {
+		res, _, err := c.receive()
+		if res == nil || (err != nil && err != res) {
+			c.healthy.Store(false)
+			return err
+		}
+		if res.Opaque == opaque {
+			c.healthy.Store(true)
+			return nil
+		}
+	}
+}
+
+// Version returns the server's version string.
+func (c *Client) Version() (string, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.VERSION,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(res.Body), nil
+}
+
+// Quit asks the server to close the connection and then closes it.
+//
+// The server may hang up without responding, so a closed connection
+// after the QUIT was written isn't an error.
+func (c *Client) Quit() error {
+	_, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.QUIT,
+	})
+	c.healthy.Store(false)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 // Get the value for a key.
 func (c *Client) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
 	return c.Send(&gomemcached.MCRequest{
@@ -103,6 +876,105 @@ func (c *Client) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
 	})
 }
 
+// GetReplica gets the value for a key from a replica vbucket.
+//
+// This is for reading during failover.  Replicas may be behind the
+// active vbucket, so the value may be stale, or KEY_ENOENT if the
+// replica hasn't received the mutation yet.
+func (c *Client) GetReplica(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	return c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.GET_REPLICA,
+		VBucket: vb,
+		Key:     []byte(key),
+	})
+}
+
+// GetInto gets the value for a key, reading it into buf if it fits.
+//
+// n is the number of bytes of the value written to buf.  If the value
+// is larger than buf, it's read into a new buffer instead and n is 0;
+// res.Body always holds the value.
+func (c *Client) GetInto(vb uint16, key string, buf []byte) (n int, res *gomemcached.MCResponse, err error) {
+	if buf == nil {
+		buf = []byte{}
+	}
+
+	res, err = c.retrying(context.Background(), func() (*gomemcached.MCResponse, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.sendLocked(context.Background(), &gomemcached.MCRequest{
+			Opcode:  gomemcached.GET,
+			VBucket: vb,
+			Key:     []byte(key),
+		}, &bodyIO{buf: buf})
+	})
+	if err == nil && len(res.Body) <= len(buf) {
+		// A decompressed body isn't read into buf.
+		n = copy(buf, res.Body)
+	}
+	return n, res, err
+}
+
+// GetOrError gets the value for a key like Get, but a non-success
+// status is returned as a *gomemcached.KeyError naming the key.
+func (c *Client) GetOrError(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	res, err := c.Get(vb, key)
+	if err != nil && err == res.Err() {
+		err = &gomemcached.KeyError{Key: key, Res: res}
+	}
+	return res, err
+}
+
+// GetAndTouch gets the value for a key and updates its expiration.
+func (c *Client) GetAndTouch(vb uint16, key string, exp int) (*gomemcached.MCResponse, error) {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.GAT,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(exp))
+	return c.Send(req)
+}
+
+// Touch updates the expiration of a key without fetching it.
+func (c *Client) Touch(vb uint16, key string, exp int) (*gomemcached.MCResponse, error) {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TOUCH,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(exp))
+	return c.Send(req)
+}
+
+// GetAndLock gets the value for a key and locks it for lockTime
+// seconds.
+//
+// While locked, mutations fail unless they carry the CAS returned
+// here.  Use Unlock (or a CAS mutation) to release the lock early.
+func (c *Client) GetAndLock(vb uint16, key string, lockTime int) (*gomemcached.MCResponse, error) {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET_LOCKED,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(lockTime))
+	return c.Send(req)
+}
+
+// Unlock releases a lock taken with GetAndLock.
+func (c *Client) Unlock(vb uint16, key string, cas uint64) (*gomemcached.MCResponse, error) {
+	return c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.UNLOCK_KEY,
+		VBucket: vb,
+		Key:     []byte(key),
+		Cas:     cas,
+	})
+}
+
 // Del deletes a key.
 func (c *Client) Del(vb uint16, key string) (*gomemcached.MCResponse, error) {
 	return c.Send(&gomemcached.MCRequest{
@@ -111,6 +983,55 @@ func (c *Client) Del(vb uint16, key string) (*gomemcached.MCResponse, error) {
 		Key:     []byte(key)})
 }
 
+// DelCas deletes a key only if its CAS matches.
+//
+// A mismatched CAS fails with KEY_EEXISTS (see
+// gomemcached.IsCasMismatch).
+func (c *Client) DelCas(vb uint16, key string, cas uint64) (*gomemcached.MCResponse, error) {
+	return c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: vb,
+		Key:     []byte(key),
+		Cas:     cas})
+}
+
+// DeleteQ deletes a key without waiting for a response.
+//
+// See SetQ for how to collect failures.
+func (c *Client) DeleteQ(vb uint16, key string) error {
+	return c.Transmit(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETEQ,
+		VBucket: vb,
+		Key:     []byte(key)})
+}
+
+// Flush removes all items from the server, optionally after delay
+// seconds.
+func (c *Client) Flush(vb uint16, delay int) (*gomemcached.MCResponse, error) {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.FLUSH,
+		VBucket: vb,
+	}
+	// Some servers reject extras on an immediate flush.
+	if delay > 0 {
+		req.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(req.Extras, uint32(delay))
+	}
+	return c.Send(req)
+}
+
+// SetVerbosity sets the server's logging verbosity.  Higher levels
+// log more; 0 is the server's quietest.
+func (c *Client) SetVerbosity(level int) error {
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.VERBOSITY,
+		Extras: make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(level))
+	_, err := c.Send(req)
+	return err
+}
+
 // AuthList lists SASL auth mechanisms.
 func (c *Client) AuthList() (*gomemcached.MCResponse, error) {
 	return c.Send(&gomemcached.MCRequest{
@@ -127,60 +1048,169 @@ func (c *Client) Auth(user, pass string) (*gomemcached.MCResponse, error) {
 
 	authMech := string(res.Body)
 	if strings.Index(authMech, "PLAIN") != -1 {
-		return c.Send(&gomemcached.MCRequest{
+		res, err = c.Send(&gomemcached.MCRequest{
 			Opcode: gomemcached.SASL_AUTH,
 			Key:    []byte("PLAIN"),
 			Body:   []byte(fmt.Sprintf("\x00%s\x00%s", user, pass))})
+		if err == nil {
+			c.registerSetup(&c.authSetup, func(nc *Client) error {
+				_, err := nc.Auth(user, pass)
+				return err
+			})
+		}
+		return res, err
 	}
 	return res, fmt.Errorf("auth mechanism PLAIN not supported")
 }
 
-// select bucket
+// AuthCRAMMD5 performs SASL CRAM-MD5 authentication against the
+// server.
+//
+// The server's challenge is answered with the HMAC-MD5 digest of the
+// challenge keyed by the password, so the password itself is never
+// sent.
+func (c *Client) AuthCRAMMD5(user, pass string) (*gomemcached.MCResponse, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte("CRAM-MD5")})
+	if res == nil || res.Status != gomemcached.AUTH_CONTINUE {
+		if err == nil {
+			err = fmt.Errorf("expected a CRAM-MD5 challenge, got %v", res.Status)
+		}
+		return res, err
+	}
+
+	mac := hmac.New(md5.New, []byte(pass))
+	mac.Write(res.Body)
+	res, err = c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_STEP,
+		Key:    []byte("CRAM-MD5"),
+		Body:   []byte(user + " " + hex.EncodeToString(mac.Sum(nil)))})
+	if err == nil {
+		c.registerSetup(&c.authSetup, func(nc *Client) error {
+			_, err := nc.AuthCRAMMD5(user, pass)
+			return err
+		})
+	}
+	return res, err
+}
+
+// Hello identifies the client to the server and negotiates protocol
+// features.
+//
+// The server replies with the subset of the requested features it
+// supports, which is returned and remembered for HasFeature.
+func (c *Client) Hello(agent string, features ...gomemcached.Feature) ([]gomemcached.Feature, error) {
+	body := make([]byte, 2*len(features))
+	for i, f := range features {
+		binary.BigEndian.PutUint16(body[2*i:], uint16(f))
+	}
+
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.HELLO,
+		Key:    []byte(agent),
+		Body:   body})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Body)%2 != 0 {
+		return nil, fmt.Errorf("invalid HELLO response length %d", len(res.Body))
+	}
+
+	accepted := make([]gomemcached.Feature, 0, len(res.Body)/2)
+	negotiated := map[gomemcached.Feature]bool{}
+	for i := 0; i < len(res.Body); i += 2 {
+		f := gomemcached.Feature(binary.BigEndian.Uint16(res.Body[i:]))
+		accepted = append(accepted, f)
+		negotiated[f] = true
+	}
+	c.features.Store(&negotiated)
+	c.registerSetup(&c.helloSetup, func(nc *Client) error {
+		_, err := nc.Hello(agent, features...)
+		return err
+	})
+	return accepted, nil
+}
+
+// HasFeature is true if the feature was accepted by the last Hello.
+func (c *Client) HasFeature(f gomemcached.Feature) bool {
+	features := c.features.Load()
+	return features != nil && (*features)[f]
+}
+
+// SelectBucket chooses the bucket subsequent requests apply to.
+//
+// Servers hosting several buckets require this after authenticating.
+// The bucket is remembered and selected again if the client
+// reconnects.
 func (c *Client) SelectBucket(bucket string) (*gomemcached.MCResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return c.Send(&gomemcached.MCRequest{
+	res, err := c.sendLocked(context.Background(), selectBucketRequest(bucket), nil)
+	if err == nil {
+		c.bucket = bucket
+	}
+	return res, err
+}
+
+func selectBucketRequest(bucket string) *gomemcached.MCRequest {
+	return &gomemcached.MCRequest{
 		Opcode: gomemcached.SELECT_BUCKET,
-		Key:    []byte(fmt.Sprintf("%s", bucket))})
+		Key:    []byte(bucket)}
 }
 
-func (c *Client) store(opcode gomemcached.CommandCode, vb uint16,
-	key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+// StoreOptions are the optional parts of a store request.
+type StoreOptions struct {
+	Flags uint32 // Item flags
+	// Expiration; see Expiry for encoding durations.
+	Exp int
+	// Store only if the item's CAS matches, unless 0.
+	Cas uint64
+	// Datatype of the body (gomemcached.DATATYPE_JSON, etc.), sent
+	// in the request header.  DATATYPE_SNAPPY also requires
+	// FEATURE_SNAPPY to have been negotiated with Hello.
+	Datatype uint8
+	// Replication and persistence required before the store is
+	// acknowledged, if any.
+	Durability Durability
+}
+
+func storeRequest(opcode gomemcached.CommandCode, vb uint16,
+	key []byte, body []byte, opts StoreOptions) *gomemcached.MCRequest {
 
 	req := &gomemcached.MCRequest{
-		Opcode:  opcode,
-		VBucket: vb,
-		Key:     []byte(key),
-		Cas:     0,
-		Opaque:  0,
-		Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-		Body:    body}
+		Opcode:   opcode,
+		VBucket:  vb,
+		Key:      key,
+		Cas:      opts.Cas,
+		Opaque:   0,
+		Datatype: opts.Datatype,
+		Extras:   []byte{0, 0, 0, 0, 0, 0, 0, 0},
+		Body:     body}
+
+	binary.BigEndian.PutUint64(req.Extras, uint64(opts.Flags)<<32|uint64(uint32(opts.Exp)))
+	req.FramingExtras = opts.Durability.appendFrame(nil)
+	return req
+}
 
-	binary.BigEndian.PutUint64(req.Extras, uint64(flags)<<32|uint64(exp))
-	return c.Send(req)
+func (c *Client) store(opcode gomemcached.CommandCode, vb uint16,
+	key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	return c.Send(storeRequest(opcode, vb, []byte(key), body,
+		StoreOptions{Flags: uint32(flags), Exp: exp}))
 }
 
 func (c *Client) storeCas(opcode gomemcached.CommandCode, vb uint16,
 	key string, flags int, exp int, cas uint64, body []byte) (*gomemcached.MCResponse, error) {
-
-	req := &gomemcached.MCRequest{
-		Opcode:  opcode,
-		VBucket: vb,
-		Key:     []byte(key),
-		Cas:     cas,
-		Opaque:  0,
-		Extras:  []byte{0, 0, 0, 0, 0, 0, 0, 0},
-		Body:    body}
-
-	binary.BigEndian.PutUint64(req.Extras, uint64(flags)<<32|uint64(exp))
-	return c.Send(req)
+	return c.Send(storeRequest(opcode, vb, []byte(key), body,
+		StoreOptions{Flags: uint32(flags), Exp: exp, Cas: cas}))
 }
 
-// Incr increments the value at the given key.
-func (c *Client) Incr(vb uint16, key string,
-	amt, def uint64, exp int) (uint64, error) {
+func (c *Client) incrdecr(opcode gomemcached.CommandCode, vb uint16, key string,
+	amt, def uint64, exp int) (uint64, *gomemcached.MCResponse, error) {
 
 	req := &gomemcached.MCRequest{
-		Opcode:  gomemcached.INCREMENT,
+		Opcode:  opcode,
 		VBucket: vb,
 		Key:     []byte(key),
 		Extras:  make([]byte, 8+8+4),
@@ -191,10 +1221,62 @@ func (c *Client) Incr(vb uint16, key string,
 
 	resp, err := c.Send(req)
 	if err != nil {
-		return 0, err
+		return 0, resp, err
 	}
+	v, err := CounterValue(resp)
+	return v, resp, err
+}
+
+// Incr increments the value at the given key.
+//
+// If the key doesn't exist, it's created with the value def.  Pass
+// an exp of 0xffffffff to fail with KEY_ENOENT instead of creating.
+func (c *Client) Incr(vb uint16, key string,
+	amt, def uint64, exp int) (uint64, error) {
+	v, _, err := c.incrdecr(gomemcached.INCREMENT, vb, key, amt, def, exp)
+	return v, err
+}
+
+// IncrResponse is Incr, also returning the response, which carries
+// the counter's new CAS.
+func (c *Client) IncrResponse(vb uint16, key string,
+	amt, def uint64, exp int) (uint64, *gomemcached.MCResponse, error) {
+	return c.incrdecr(gomemcached.INCREMENT, vb, key, amt, def, exp)
+}
+
+// Decr decrements the value at the given key.
+//
+// Creation semantics are the same as Incr.
+func (c *Client) Decr(vb uint16, key string,
+	amt, def uint64, exp int) (uint64, error) {
+	v, _, err := c.incrdecr(gomemcached.DECREMENT, vb, key, amt, def, exp)
+	return v, err
+}
 
-	return binary.BigEndian.Uint64(resp.Body), nil
+// DecrResponse is Decr, also returning the response.
+func (c *Client) DecrResponse(vb uint16, key string,
+	amt, def uint64, exp int) (uint64, *gomemcached.MCResponse, error) {
+	return c.incrdecr(gomemcached.DECREMENT, vb, key, amt, def, exp)
+}
+
+// SetOpts sets the value for a key, with the given options.
+func (c *Client) SetOpts(vb uint16, key string, body []byte,
+	opts StoreOptions) (*gomemcached.MCResponse, error) {
+	return c.Send(storeRequest(gomemcached.SET, vb, []byte(key), body, opts))
+}
+
+// AddOpts adds a value for a key (store if not exists), with the
+// given options.
+func (c *Client) AddOpts(vb uint16, key string, body []byte,
+	opts StoreOptions) (*gomemcached.MCResponse, error) {
+	return c.Send(storeRequest(gomemcached.ADD, vb, []byte(key), body, opts))
+}
+
+// ReplaceOpts replaces the value for a key (store only if exists),
+// with the given options.
+func (c *Client) ReplaceOpts(vb uint16, key string, body []byte,
+	opts StoreOptions) (*gomemcached.MCResponse, error) {
+	return c.Send(storeRequest(gomemcached.REPLACE, vb, []byte(key), body, opts))
 }
 
 // Add a value for a key (store if not exists).
@@ -209,7 +1291,74 @@ func (c *Client) Set(vb uint16, key string, flags int, exp int,
 	return c.store(gomemcached.SET, vb, key, flags, exp, body)
 }
 
+// SetQ sets the value for a key without waiting for a response.
+//
+// Quiet commands only respond on failure, so errors aren't returned
+// here.  Follow a run of quiet commands with ReceiveBatch (or a Noop
+// after draining with Receive) to collect any failures; a quiet
+// command that isn't followed by one may leave its error response
+// unread on the connection.
+func (c *Client) SetQ(vb uint16, key string, flags int, exp int,
+	body []byte) error {
+	return c.Transmit(storeRequest(gomemcached.SETQ, vb, []byte(key), body,
+		StoreOptions{Flags: uint32(flags), Exp: exp}))
+}
+
+// AddQ adds a value for a key without waiting for a response.
+//
+// See SetQ for how to collect failures.
+func (c *Client) AddQ(vb uint16, key string, flags int, exp int,
+	body []byte) error {
+	return c.Transmit(storeRequest(gomemcached.ADDQ, vb, []byte(key), body,
+		StoreOptions{Flags: uint32(flags), Exp: exp}))
+}
+
+// Replace the value for a key (store only if exists).
+func (c *Client) Replace(vb uint16, key string, flags int, exp int,
+	body []byte) (*gomemcached.MCResponse, error) {
+	return c.store(gomemcached.REPLACE, vb, key, flags, exp, body)
+}
+
+// casOf returns just the CAS of a store's response.
+func casOf(res *gomemcached.MCResponse, err error) (uint64, error) {
+	if err != nil {
+		return 0, err
+	}
+	return res.Cas, nil
+}
+
+// SetReturnCas sets the value for a key like Set, returning just the
+// item's new CAS.
+func (c *Client) SetReturnCas(vb uint16, key string, flags int, exp int,
+	body []byte) (uint64, error) {
+	return casOf(c.Set(vb, key, flags, exp, body))
+}
+
+// AddReturnCas adds a value for a key like Add, returning just the
+// item's new CAS.
+func (c *Client) AddReturnCas(vb uint16, key string, flags int, exp int,
+	body []byte) (uint64, error) {
+	return casOf(c.Add(vb, key, flags, exp, body))
+}
+
+// ReplaceReturnCas replaces the value for a key like Replace,
+// returning just the item's new CAS.
+func (c *Client) ReplaceReturnCas(vb uint16, key string, flags int, exp int,
+	body []byte) (uint64, error) {
+	return casOf(c.Replace(vb, key, flags, exp, body))
+}
+
+// SetCasReturnCas sets the value for a key with cas like SetCas,
+// returning just the item's new CAS.
+func (c *Client) SetCasReturnCas(vb uint16, key string, flags int, exp int, cas uint64,
+	body []byte) (uint64, error) {
+	return casOf(c.SetCas(vb, key, flags, exp, cas, body))
+}
+
 // SetCas set the value for a key with cas
+//
+// A mismatched CAS fails with KEY_EEXISTS (see
+// gomemcached.IsCasMismatch).
 func (c *Client) SetCas(vb uint16, key string, flags int, exp int, cas uint64,
 	body []byte) (*gomemcached.MCResponse, error) {
 	return c.storeCas(gomemcached.SET, vb, key, flags, exp, cas, body)
@@ -228,59 +1377,61 @@ func (c *Client) Append(vb uint16, key string, data []byte) (*gomemcached.MCResp
 	return c.Send(req)
 }
 
-// GetBulk gets keys in bulk
-func (c *Client) GetBulk(vb uint16, keys []string) (map[string]*gomemcached.MCResponse, error) {
-	rv := map[string]*gomemcached.MCResponse{}
-	going := true
-
-	defer func() {
-		going = false
-	}()
-
-	errch := make(chan error, 2)
+// Prepend data to the value of a key.
+func (c *Client) Prepend(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error) {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.PREPEND,
+		VBucket: vb,
+		Key:     []byte(key),
+		Cas:     0,
+		Opaque:  0,
+		Body:    data}
 
-	go func() {
-		defer func() { errch <- nil }()
-		for going {
-			res, err := c.Receive()
-			if err != nil {
-				if res.Status != gomemcached.KEY_ENOENT {
-					errch <- err
-				}
-				return
-			}
-			switch res.Opcode {
-			case gomemcached.GET:
-				going = false
-			case gomemcached.GETQ:
-			default:
-				log.Panicf("Unexpected opcode in GETQ response: %+v",
-					res)
-			}
-			if res.Opaque >= uint32(len(keys)) {
-				log.Panicf(" Invalid opaque Value. Debug info : Res.opaque : %v, Keys %v, Response received %v", res.Opaque, len(keys), res)
-			}
-			rv[keys[res.Opaque]] = res
-		}
-	}()
+	return c.Send(req)
+}
 
-	for i, k := range keys {
-		op := gomemcached.GETQ
-		if i == len(keys)-1 {
-			op = gomemcached.GET
-		}
-		err := c.Transmit(&gomemcached.MCRequest{
-			Opcode:  op,
+// GetBulk gets keys in bulk.
+//
+// A GETKQ is pipelined for every key and the batch is terminated with
+// a NOOP, so the whole lookup costs a single round trip.  Keys that
+// aren't found are simply absent from the returned map.  Any other
+// failure status is returned as the error alongside the keys that
+// were found.
+func (c *Client) GetBulk(vb uint16, keys []string) (map[string]*gomemcached.MCResponse, error) {
+	// Responses are matched to keys by opaque, since their keys
+	// carry any collection prefix.
+	byOpaque := make(map[uint32]string, len(keys))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		req := &gomemcached.MCRequest{
+			Opcode:  gomemcached.GETKQ,
 			VBucket: vb,
 			Key:     []byte(k),
-			Opaque:  uint32(i),
-		})
-		if err != nil {
-			return rv, err
+			Opaque:  c.nextOpaque(),
 		}
+		if err := c.Transmit(req); err != nil {
+			return nil, err
+		}
+		byOpaque[req.Opaque] = k
 	}
 
-	return rv, <-errch
+	responses, err := c.ReceiveBatch(c.nextOpaque())
+	rv := make(map[string]*gomemcached.MCResponse, len(responses))
+	for _, res := range responses {
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			if k, ok := byOpaque[res.Opaque]; ok {
+				rv[k] = res
+			}
+		case gomemcached.KEY_ENOENT:
+		default:
+			if err == nil {
+				err = res
+			}
+		}
+	}
+	return rv, err
 }
 
 // ObservedStatus is the type reported by the Observe method
@@ -305,10 +1456,12 @@ type ObserveResult struct {
 // Observe gets the persistence/replication/CAS state of a key
 func (c *Client) Observe(vb uint16, key string) (result ObserveResult, err error) {
 	// http://www.couchbase.com/wiki/display/couchbase/Observe
-	body := make([]byte, 4+len(key))
+	// The key is in the body, so it's put in the collection here.
+	wireKey := string(c.key(key))
+	body := make([]byte, 4+len(wireKey))
 	binary.BigEndian.PutUint16(body[0:2], vb)
-	binary.BigEndian.PutUint16(body[2:4], uint16(len(key)))
-	copy(body[4:4+len(key)], key)
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(wireKey)))
+	copy(body[4:], wireKey)
 
 	res, err := c.Send(&gomemcached.MCRequest{
 		Opcode:  gomemcached.OBSERVE,
@@ -331,7 +1484,7 @@ func (c *Client) Observe(vb uint16, key string) (result ObserveResult, err error
 		return
 	}
 	outKey := string(res.Body[4 : 4+keyLen])
-	if outVb != vb || outKey != key {
+	if outVb != vb || outKey != wireKey {
 		err = fmt.Errorf("observe returned wrong vbucket/key: %d/%q", outVb, outKey)
 		return
 	}
@@ -397,13 +1550,13 @@ type CASState struct {
 
 // CASNext is a non-callback, loop-based version of CAS method.
 //
-//  Usage is like this:
+// Usage is like this:
 //
-// var state memcached.CASState
-// for client.CASNext(vb, key, exp, &state) {
-//     state.Value = some_mutation(state.Value)
-// }
-// if state.Err != nil { ... }
+//	var state memcached.CASState
+//	for client.CASNext(vb, key, exp, &state) {
+//	    state.Value = some_mutation(state.Value)
+//	}
+//	if state.Err != nil { ... }
 func (c *Client) CASNext(vb uint16, k string, exp int, state *CASState) bool {
 	if state.initialized {
 		if !state.Exists {
@@ -437,7 +1590,9 @@ func (c *Client) CASNext(vb uint16, k string, exp int, state *CASState) bool {
 		// get the new value (below). Otherwise, we're done (either success or failure) so return:
 		if !(state.resp != nil && (state.resp.Status == gomemcached.KEY_EEXISTS ||
 			state.resp.Status == gomemcached.NOT_STORED)) {
-			state.Cas = state.resp.Cas
+			if state.resp != nil {
+				state.Cas = state.resp.Cas
+			}
 			return false // either success or fatal error
 		}
 	}
@@ -465,13 +1620,28 @@ func (c *Client) CASNext(vb uint16, k string, exp int, state *CASState) bool {
 // The function should return the new value (if any) to set, and the store/quit/delete operation.
 type CasFunc func(current []byte) ([]byte, CasOp)
 
+// ErrTooManyCASRetries is returned by CASWithRetries when the value
+// keeps changing underneath it.
+var ErrTooManyCASRetries = errors.New("too many CAS retries")
+
 // CAS performs a CAS transform with the given function.
 //
 // If the value does not exist, a nil current value will be sent to f.
 func (c *Client) CAS(vb uint16, k string, f CasFunc,
 	initexp int) (*gomemcached.MCResponse, error) {
+	return c.CASWithRetries(vb, k, f, initexp, -1)
+}
+
+// CASWithRetries performs a CAS transform like CAS, but gives up with
+// ErrTooManyCASRetries if the value is changed by someone else more
+// than maxRetries times.  A negative maxRetries retries forever.
+func (c *Client) CASWithRetries(vb uint16, k string, f CasFunc,
+	initexp int, maxRetries int) (*gomemcached.MCResponse, error) {
 	var state CASState
-	for c.CASNext(vb, k, initexp, &state) {
+	for tries := 0; c.CASNext(vb, k, initexp, &state); tries++ {
+		if maxRetries >= 0 && tries > maxRetries {
+			return state.resp, ErrTooManyCASRetries
+		}
 		newValue, operation := f(state.Value)
 		if operation == CASQuit || (operation == CASDelete && state.Value == nil) {
 			return nil, operation
@@ -492,36 +1662,117 @@ type StatValue struct {
 // Stats requests server-side stats.
 //
 // Use "" as the stat key for toplevel stats.
+//
+// The stats are read in place rather than through StatsChan, with
+// each response's buffer reused for the next, so frequent polling
+// only allocates the returned strings.
 func (c *Client) Stats(key string) ([]StatValue, error) {
 	rv := make([]StatValue, 0, 128)
 
 	req := &gomemcached.MCRequest{
 		Opcode: gomemcached.STAT,
 		Key:    []byte(key),
-		Opaque: 918494,
+		Opaque: c.nextOpaque(),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.transmit(req)
+	if err == nil {
+		err = c.FlushBuffer()
 	}
-
-	_, err := transmitRequest(c.conn, req)
 	if err != nil {
 		return rv, err
 	}
 
+	hdr := hdrPool.Get().(*[gomemcached.HDR_LEN]byte)
+	defer hdrPool.Put(hdr)
+	res := &gomemcached.MCResponse{}
 	for {
-		res, _, err := getResponse(c.conn, c.hdrBuf)
+		n, err := res.ReceiveLimit(c.reader, hdr[:], nil, c.maxBody)
+		if ReceiveHook != nil {
+			ReceiveHook(res, n, err)
+		}
 		if err != nil {
 			return rv, err
 		}
-		k := string(res.Key)
-		if k == "" {
-			break
+		if res.Status != gomemcached.SUCCESS {
+			return rv, res
 		}
+		if len(res.Key) == 0 {
+			res.Release()
+			return rv, nil
+		}
+		// The key and value share one allocation.
+		kv := string(res.Key) + string(res.Body)
 		rv = append(rv, StatValue{
-			Key: k,
-			Val: string(res.Body),
+			Key: kv[:len(res.Key)],
+			Val: kv[len(res.Key):],
 		})
+		res.Release()
 	}
+}
 
-	return rv, nil
+// StatsChan requests server-side stats like Stats, but delivers each
+// stat as it's read.
+//
+// The stat channel is closed when the server finishes the group, and
+// then the error channel yields the error that stopped the stream (or
+// nil) before it's closed as well.  The stat channel must be drained,
+// and no other request may be made on the client until it's closed.
+func (c *Client) StatsChan(key string) (<-chan StatValue, <-chan error) {
+	ch := make(chan StatValue)
+	errch := make(chan error, 1)
+
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.STAT,
+		Key:    []byte(key),
+		Opaque: c.nextOpaque(),
+	}
+
+	_, err := c.transmit(req)
+	if err == nil {
+		err = c.FlushBuffer()
+	}
+	if err != nil {
+		errch <- err
+		close(ch)
+		close(errch)
+		return ch, errch
+	}
+
+	go func() {
+		defer close(errch)
+		defer close(ch)
+		for {
+			res, _, err := getResponseInto(c.reader, nil, nil, c.maxBody)
+			if err != nil {
+				errch <- err
+				return
+			}
+			k := string(res.Key)
+			if k == "" {
+				return
+			}
+			ch <- StatValue{
+				Key: k,
+				Val: string(res.Body),
+			}
+		}
+	}()
+
+	return ch, errch
+}
+
+// StatsReset resets the server's stats counters.
+//
+// The server answers with a single response rather than a group of
+// stats, so this isn't Stats("reset").
+func (c *Client) StatsReset() error {
+	_, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.STAT,
+		Key:    []byte("reset"),
+	})
+	return err
 }
 
 // StatsMap requests server-side stats similarly to Stats, but returns
@@ -540,12 +1791,41 @@ func (c *Client) StatsMap(key string) (map[string]string, error) {
 	return rv, nil
 }
 
+type hijacked struct {
+	io.Reader
+	io.WriteCloser
+}
+
 // Hijack exposes the underlying connection from this client.
 //
 // It also marks the connection as unhealthy since the client will
 // have lost control over the connection and can't otherwise verify
 // things are in good shape for connection pools.
+//
+// Buffered requests are written before returning.  If the client
+// has buffered data that hasn't been read yet, reads
+// from the returned connection will see that data first.
 func (c *Client) Hijack() io.ReadWriteCloser {
-	c.healthy = false
+	c.FlushBuffer()
+	c.healthy.Store(false)
+	if br, ok := c.reader.(*bufio.Reader); ok && br.Buffered() > 0 {
+		return hijacked{c.reader, c.conn}
+	}
 	return c.conn
 }
+
+// Conn returns the client's current connection, for inspecting or
+// tuning it.  Unlike Hijack, the client keeps using the connection,
+// so reading from or writing to it will corrupt the stream.
+//
+// Reconnects replace the connection, so don't hold on to it.
+func (c *Client) Conn() io.ReadWriteCloser {
+	return c.conn
+}
+
+// NetConn returns the client's current connection if it's a
+// net.Conn, with the same caveats as Conn.
+func (c *Client) NetConn() (net.Conn, bool) {
+	nc, ok := c.conn.(net.Conn)
+	return nc, ok
+}
@@ -3,13 +3,29 @@ package memcached
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/couchbase/gomemcached"
+	mcserver "github.com/couchbase/gomemcached/server"
+	"github.com/couchbase/gomemcached/testserver"
+	"github.com/golang/snappy"
 )
 
 func TestConnect(t *testing.T) {
@@ -33,6 +49,164 @@ func TestConnect(t *testing.T) {
 	}
 }
 
+func TestConnectWithDialer(t *testing.T) {
+	s := newFakeServer()
+	addr := s.listen(t)
+
+	c, err := ConnectWithDialer("tcp", addr, &net.Dialer{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+
+	// A Control function stalling past the timeout stands in for an
+	// unreachable server.
+	slow := &net.Dialer{
+		Timeout: 10 * time.Millisecond,
+		Control: func(network, address string, c syscall.RawConn) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		},
+	}
+	_, err = ConnectWithDialer("tcp", addr, slow)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ConnectWithDialerContext(ctx, "tcp", addr, &net.Dialer{}); err == nil {
+		t.Errorf("Expected an error with a canceled context")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectTimeout("tcp", s.listen(t), time.Second)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+
+	// Nothing listens on a port that was just closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	addr := l.Addr().String()
+	l.Close()
+
+	start := time.Now()
+	if _, err := ConnectTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		t.Errorf("Expected an error connecting to %v", addr)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected a prompt error, took %v", d)
+	}
+}
+
+// dnsResolver returns a resolver answering every A query with ip4
+// and every AAAA query with ip6.
+func dnsResolver(ip4, ip6 net.IP) *net.Resolver {
+	answer := func(q []byte) []byte {
+		// Skip the header and question name to the type.
+		i := 12
+		for i < len(q) && q[i] != 0 {
+			i += int(q[i]) + 1
+		}
+		if i+5 > len(q) {
+			return nil
+		}
+		qtype := binary.BigEndian.Uint16(q[i+1:])
+		res := append([]byte{}, q[:i+5]...)
+		binary.BigEndian.PutUint16(res[2:], 0x8180) // response, no error
+		binary.BigEndian.PutUint16(res[6:], 0)      // answers
+		binary.BigEndian.PutUint16(res[8:], 0)      // authorities
+		binary.BigEndian.PutUint16(res[10:], 0)     // additional
+		var ip net.IP
+		switch qtype {
+		case 1:
+			ip = ip4.To4()
+		case 28:
+			ip = ip6.To16()
+		}
+		if ip == nil {
+			return res
+		}
+		binary.BigEndian.PutUint16(res[6:], 1)
+		res = append(res, 0xc0, 12) // the question's name
+		res = binary.BigEndian.AppendUint16(res, qtype)
+		res = append(res, 0, 1, 0, 0, 0, 60) // class IN, ttl
+		res = binary.BigEndian.AppendUint16(res, uint16(len(ip)))
+		return append(res, ip...)
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			cconn, sconn := net.Pipe()
+			// A conn that isn't a PacketConn is spoken to as over
+			// TCP, with lengths before messages.
+			go func() {
+				defer sconn.Close()
+				for {
+					var l [2]byte
+					if _, err := io.ReadFull(sconn, l[:]); err != nil {
+						return
+					}
+					q := make([]byte, binary.BigEndian.Uint16(l[:]))
+					if _, err := io.ReadFull(sconn, q); err != nil {
+						return
+					}
+					res := answer(q)
+					if _, err := sconn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(res)))); err != nil {
+						return
+					}
+					if _, err := sconn.Write(res); err != nil {
+						return
+					}
+				}
+			}()
+			return cconn, nil
+		},
+	}
+}
+
+func TestConnectDualStack(t *testing.T) {
+	s := newFakeServer()
+	_, port, err := net.SplitHostPort(s.listen(t))
+	must(err)
+
+	// The hostname's IPv6 address, which is preferred, is a black
+	// hole: dials to it hang until abandoned.
+	d := newDialer(5 * time.Second)
+	d.Resolver = dnsResolver(net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	d.ControlContext = func(ctx context.Context, network, address string, _ syscall.RawConn) error {
+		if network == "tcp6" {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}
+
+	start := time.Now()
+	c, err := ConnectWithDialer("tcp", net.JoinHostPort("memcached.test.", port), d)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected to fall back to IPv4 promptly, took %v", elapsed)
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+}
+
 type tracked bool
 
 func (t *tracked) Close() error {
@@ -67,7 +241,7 @@ func TestHealthy(t *testing.T) {
 		t.Errorf("Expected healthy.  Wasn't.")
 	}
 
-	res, err := c.Send(&gomemcached.MCRequest{})
+	res, err := c.Send(&gomemcached.MCRequest{Key: []byte("k")})
 	if err == nil {
 		t.Errorf("Expected error transmitting, got %v", res)
 	}
@@ -77,6 +251,274 @@ func TestHealthy(t *testing.T) {
 	}
 }
 
+// Run with -race: IsHealthy may be called while Sends are in flight.
+func TestIsHealthyConcurrent(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.Get(0, "missing")
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			c.IsHealthy()
+			time.Sleep(time.Microsecond)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetMaxBodySize(8)
+
+	_, err := c.Set(0, "k", 0, 0, []byte("longer than eight"))
+	if !errors.Is(err, gomemcached.ErrBodyTooLarge) {
+		t.Fatalf("Expected ErrBodyTooLarge, got %v", err)
+	}
+	if len(s.reqs) != 0 {
+		t.Errorf("Expected nothing sent, got %v", s.reqs)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("short")); err != nil {
+		t.Fatalf("Error setting a short value: %v", err)
+	}
+	if err := c.Transmit(&gomemcached.MCRequest{
+		Opcode: gomemcached.SETQ,
+		Body:   []byte("longer than eight"),
+	}); !errors.Is(err, gomemcached.ErrBodyTooLarge) {
+		t.Errorf("Expected ErrBodyTooLarge transmitting, got %v", err)
+	}
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	_, err := c.Set(0, "", 0, 0, []byte("v"))
+	if !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey setting, got %v", err)
+	}
+	if _, err := c.Get(0, ""); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey getting, got %v", err)
+	}
+	if _, err := c.Del(0, ""); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey deleting, got %v", err)
+	}
+
+	long := strings.Repeat("k", DefaultMaxKeyLength+1)
+	if _, err := c.Set(0, long, 0, 0, []byte("v")); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong setting, got %v", err)
+	}
+	if _, err := c.Get(0, long); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong getting, got %v", err)
+	}
+	if len(s.reqs) != 0 {
+		t.Errorf("Expected nothing sent, got %v", s.reqs)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+
+	longest := long[:DefaultMaxKeyLength]
+	if _, err := c.Set(0, longest, 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting the longest key: %v", err)
+	}
+	if res, err := c.Get(0, longest); err != nil || string(res.Body) != "v" {
+		t.Errorf("Expected v, got %v/%v", res, err)
+	}
+
+	// Commands without keys are unaffected.
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+
+	c.SetMaxKeyLength(0)
+	if _, err := c.Set(0, long, 0, 0, []byte("v")); err != nil {
+		t.Errorf("Error setting a long key without a limit: %v", err)
+	}
+}
+
+func TestFlexKeyLength(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetMaxKeyLength(0)
+
+	durable := func(key string) *gomemcached.MCRequest {
+		return &gomemcached.MCRequest{
+			Opcode:        gomemcached.SET,
+			Key:           []byte(key),
+			Extras:        make([]byte, 8),
+			FramingExtras: []byte{0x11, 0x01},
+		}
+	}
+	long := strings.Repeat("k", gomemcached.MaxFlexLen+1)
+	if _, err := c.Send(durable(long)); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong with framing extras, got %v", err)
+	}
+	if err := c.Transmit(durable(long)); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong transmitting, got %v", err)
+	}
+	if len(s.reqs) != 0 {
+		t.Errorf("Expected nothing sent, got %v", s.reqs)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+	if _, err := c.Send(durable(long[1:])); err != nil {
+		t.Errorf("Error sending the longest key with framing extras: %v", err)
+	}
+
+	// The collection prefix counts too: 200 takes two bytes.
+	c.SetCollectionID(200)
+	if _, err := c.Send(durable(long[2:])); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong with a collection prefix, got %v", err)
+	}
+	if _, err := c.Send(durable(long[3:])); err != nil {
+		t.Errorf("Error sending the longest key in a collection: %v", err)
+	}
+	if req := s.lastRequest(); len(req.Key) != gomemcached.MaxFlexLen {
+		t.Errorf("Expected a %d byte key on the wire, got %d", gomemcached.MaxFlexLen, len(req.Key))
+	}
+
+	req := durable("k")
+	req.FramingExtras = make([]byte, gomemcached.MaxFlexLen+1)
+	if _, err := c.Send(req); !errors.Is(err, gomemcached.ErrFlexTooLong) {
+		t.Errorf("Expected ErrFlexTooLong for long framing extras, got %v", err)
+	}
+}
+
+func TestCheckExtras(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetCheckExtras(true)
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.Get(0, "k"); err != nil {
+		t.Fatalf("Error getting with checked extras: %v", err)
+	}
+
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	// Answer GETs without the flags extras.
+	go func() {
+		for {
+			req, err := mcserver.ReadPacket(sconn)
+			if err != nil {
+				return
+			}
+			res := &gomemcached.MCResponse{
+				Opcode: gomemcached.GET,
+				Opaque: req.Opaque,
+				Body:   []byte("v"),
+			}
+			if _, err := res.Transmit(sconn); err != nil {
+				return
+			}
+		}
+	}()
+
+	if _, err := c.Get(0, "k"); err != nil {
+		t.Fatalf("Error getting unchecked: %v", err)
+	}
+	c.SetCheckExtras(true)
+	if _, err := c.Get(0, "k"); !errors.Is(err, gomemcached.ErrExtrasLength) {
+		t.Fatalf("Expected ErrExtrasLength, got %v", err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected the client marked unhealthy")
+	}
+}
+
+func TestMaxBodySizeResponse(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+	c.SetMaxBodySize(1024)
+
+	// Answer with a header declaring a huge body, and nothing else.
+	go func() {
+		req, err := mcserver.ReadPacket(sconn)
+		if err != nil {
+			return
+		}
+		hdr := make([]byte, gomemcached.HDR_LEN)
+		hdr[0] = gomemcached.RES_MAGIC
+		hdr[1] = byte(gomemcached.GET)
+		binary.BigEndian.PutUint32(hdr[8:], 1<<31)
+		binary.BigEndian.PutUint32(hdr[12:], req.Opaque)
+		sconn.Write(hdr)
+	}()
+
+	_, err = c.Get(0, "k")
+	if !errors.Is(err, gomemcached.ErrBodyTooLarge) {
+		t.Fatalf("Expected ErrBodyTooLarge, got %v", err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy")
+	}
+}
+
+// shortWriter claims success while writing one byte less than asked.
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return len(p) - 1, nil
+}
+
+func TestTransmitReqShortWrite(t *testing.T) {
+	for _, body := range []string{"small", strings.Repeat("x", 200)} {
+		req := gomemcached.MCRequest{
+			Opcode: gomemcached.SET,
+			Key:    []byte("somekey"),
+			Body:   []byte(body),
+		}
+		n, err := transmitRequest(shortWriter{}, &req)
+		if err != io.ErrShortWrite {
+			t.Errorf("Expected io.ErrShortWrite, got %v (wrote %v)", err, n)
+		}
+	}
+
+	c, err := Wrap(struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{&bytes.Buffer{}, shortWriter{}, ioutil.NopCloser(nil)})
+	must(err)
+	if _, err := c.Get(0, "k"); err != io.ErrShortWrite {
+		t.Errorf("Expected io.ErrShortWrite from Get, got %v", err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy after a short write")
+	}
+}
+
 func TestTransmitReq(t *testing.T) {
 	b := bytes.NewBuffer([]byte{})
 	buf := bufio.NewWriter(b)
@@ -375,3 +817,2480 @@ func TestCasOpError(t *testing.T) {
 		}
 	}
 }
+
+// fakeServer is a tiny in-memory memcached used to drive a real
+// Client over a loopback socket.  It covers the protocol the exported
+// testserver doesn't, and tests needing only the latter's operations
+// use it instead, with connectTest.
+type fakeServer struct {
+	mu     sync.Mutex
+	data   map[string]gomemcached.MCItem
+	locked map[string]bool
+	cas    uint64
+	reqs   []gomemcached.MCRequest
+	conns  []io.Closer
+
+	version   string
+	mechs     string            // SASL mechanisms to advertise
+	users     map[string]string // SASL user -> password
+	challenge string            // CRAM-MD5 challenge
+
+	features map[gomemcached.Feature]bool // accepted in HELLO
+
+	stats []StatValue // streamed in response to STAT
+
+	buckets map[string]bool // may be selected
+
+	tmpfails int // requests to answer with TMPFAIL before serving
+
+	verbosity uint32 // set by VERBOSITY
+
+	maxValue int // longest value stored, if not 0
+
+	errorMap      []byte // returned by GET_ERROR_MAP
+	clusterConfig []byte // returned by GET_CLUSTER_CONFIG, if set
+
+	collections map[string]uint32 // "scope.collection" -> ID
+	manifest    uint64            // UID returned with collection IDs
+
+	// OBSERVE_SEQNO state.  Each observation persists persistStep
+	// more seqnos, up to seqno.  Observations of any UUID but vbuuid
+	// report a failover, with the old history ending at oldSeqno.
+	vbuuid, seqno, persisted, persistStep, oldSeqno uint64
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		data:   map[string]gomemcached.MCItem{},
+		locked: map[string]bool{},
+	}
+}
+
+func (s *fakeServer) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, *req)
+
+	if s.tmpfails > 0 {
+		s.tmpfails--
+		return &gomemcached.MCResponse{Status: gomemcached.TMPFAIL}
+	}
+
+	if req.Opcode == gomemcached.STAT && string(req.Key) == "reset" {
+		s.stats = nil
+		return &gomemcached.MCResponse{}
+	}
+	if req.Opcode == gomemcached.STAT {
+		for _, st := range s.stats {
+			res := &gomemcached.MCResponse{
+				Opcode: req.Opcode,
+				Opaque: req.Opaque,
+				Key:    []byte(st.Key),
+				Body:   []byte(st.Val),
+			}
+			if _, err := res.Transmit(w); err != nil {
+				return &gomemcached.MCResponse{Fatal: true}
+			}
+		}
+		// The empty key terminates the group.
+		return &gomemcached.MCResponse{}
+	}
+
+	res := s.dispatch(req)
+	if req.Opcode.IsQuiet() {
+		switch req.Opcode {
+		case gomemcached.GETQ, gomemcached.GETKQ:
+			if res.Status == gomemcached.KEY_ENOENT {
+				return nil
+			}
+		default:
+			if res.Status == gomemcached.SUCCESS {
+				return nil
+			}
+		}
+	}
+	return res
+}
+
+func (s *fakeServer) dispatch(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	res := &gomemcached.MCResponse{}
+	key := string(req.Key)
+	item, exists := s.data[key]
+
+	if s.locked[key] {
+		switch req.Opcode {
+		case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ,
+			gomemcached.GET_REPLICA, gomemcached.GET_LOCKED, gomemcached.UNLOCK_KEY:
+		default:
+			if req.Cas != item.Cas {
+				res.Status = gomemcached.LOCKED
+				return res
+			}
+			delete(s.locked, key)
+		}
+	}
+
+	switch req.Opcode {
+	case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ,
+		gomemcached.GET_REPLICA:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		res.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(res.Extras, item.Flags)
+		res.Cas = item.Cas
+		res.Body = item.Data
+		if req.Opcode == gomemcached.GETK || req.Opcode == gomemcached.GETKQ {
+			res.Key = req.Key
+		}
+	case gomemcached.SET_WITH_META, gomemcached.DEL_WITH_META:
+		if len(req.Extras) < 24 {
+			res.Status = gomemcached.EINVAL
+			return res
+		}
+		// Resolve conflicts by CAS alone.
+		cas := binary.BigEndian.Uint64(req.Extras[16:])
+		if exists && item.Cas >= cas {
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		}
+		if req.Opcode == gomemcached.DEL_WITH_META {
+			delete(s.data, key)
+			return res
+		}
+		s.data[key] = gomemcached.MCItem{
+			Cas:        cas,
+			Flags:      binary.BigEndian.Uint32(req.Extras),
+			Expiration: binary.BigEndian.Uint32(req.Extras[4:]),
+			Data:       req.Body,
+		}
+		res.Cas = cas
+	case gomemcached.OBSERVE_SEQNO:
+		if len(req.Body) != 8 {
+			res.Status = gomemcached.EINVAL
+			return res
+		}
+		s.persisted += s.persistStep
+		if s.persisted > s.seqno {
+			s.persisted = s.seqno
+		}
+		res.Body = make([]byte, 27, 43)
+		binary.BigEndian.PutUint16(res.Body[1:], req.VBucket)
+		binary.BigEndian.PutUint64(res.Body[3:], s.vbuuid)
+		binary.BigEndian.PutUint64(res.Body[11:], s.persisted)
+		binary.BigEndian.PutUint64(res.Body[19:], s.seqno)
+		if uuid := binary.BigEndian.Uint64(req.Body); uuid != s.vbuuid {
+			res.Body[0] = 1
+			res.Body = res.Body[:43]
+			binary.BigEndian.PutUint64(res.Body[27:], uuid)
+			binary.BigEndian.PutUint64(res.Body[35:], s.oldSeqno)
+		}
+	case gomemcached.GET_META:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		// The fake has no seqnos, so the CAS stands in.
+		res.Extras = make([]byte, 20, 21)
+		binary.BigEndian.PutUint32(res.Extras[4:], item.Flags)
+		binary.BigEndian.PutUint32(res.Extras[8:], item.Expiration)
+		binary.BigEndian.PutUint64(res.Extras[12:], item.Cas)
+		if len(req.Extras) == 1 && req.Extras[0] == 1 {
+			res.Extras = append(res.Extras, gomemcached.DATATYPE_JSON)
+		}
+		res.Cas = item.Cas
+	case gomemcached.SET, gomemcached.SETQ,
+		gomemcached.ADD, gomemcached.ADDQ,
+		gomemcached.REPLACE, gomemcached.REPLACEQ:
+		switch {
+		case (req.Opcode == gomemcached.ADD || req.Opcode == gomemcached.ADDQ) && exists:
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		case (req.Opcode == gomemcached.REPLACE || req.Opcode == gomemcached.REPLACEQ) && !exists:
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		case req.Cas != 0 && (!exists || req.Cas != item.Cas):
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		case s.maxValue > 0 && len(req.Body) > s.maxValue:
+			res.Status = gomemcached.E2BIG
+			return res
+		}
+		s.cas++
+		item = gomemcached.MCItem{Cas: s.cas, Data: req.Body}
+		if len(req.Extras) >= 8 {
+			item.Flags = binary.BigEndian.Uint32(req.Extras)
+			item.Expiration = binary.BigEndian.Uint32(req.Extras[4:])
+		}
+		s.data[key] = item
+		res.Cas = item.Cas
+	case gomemcached.APPEND, gomemcached.APPENDQ,
+		gomemcached.PREPEND, gomemcached.PREPENDQ:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		if req.Opcode == gomemcached.APPEND || req.Opcode == gomemcached.APPENDQ {
+			item.Data = append(append([]byte{}, item.Data...), req.Body...)
+		} else {
+			item.Data = append(append([]byte{}, req.Body...), item.Data...)
+		}
+		s.cas++
+		item.Cas = s.cas
+		s.data[key] = item
+		res.Cas = item.Cas
+	case gomemcached.INCREMENT, gomemcached.DECREMENT:
+		amt := binary.BigEndian.Uint64(req.Extras[:8])
+		var v uint64
+		switch {
+		case !exists && binary.BigEndian.Uint32(req.Extras[16:]) == 0xffffffff:
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		case !exists:
+			v = binary.BigEndian.Uint64(req.Extras[8:16])
+		default:
+			v, _ = strconv.ParseUint(string(item.Data), 10, 64)
+			if req.Opcode == gomemcached.INCREMENT {
+				v += amt
+			} else if amt > v {
+				v = 0
+			} else {
+				v -= amt
+			}
+		}
+		s.cas++
+		item = gomemcached.MCItem{Cas: s.cas, Data: []byte(strconv.FormatUint(v, 10))}
+		s.data[key] = item
+		res.Cas = item.Cas
+		res.Body = make([]byte, 8)
+		binary.BigEndian.PutUint64(res.Body, v)
+	case gomemcached.GET_LOCKED:
+		switch {
+		case !exists:
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		case s.locked[key]:
+			res.Status = gomemcached.TMPFAIL
+			return res
+		}
+		s.cas++
+		item.Cas = s.cas
+		s.data[key] = item
+		s.locked[key] = true
+		res.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(res.Extras, item.Flags)
+		res.Cas = item.Cas
+		res.Body = item.Data
+	case gomemcached.UNLOCK_KEY:
+		switch {
+		case !exists:
+			res.Status = gomemcached.KEY_ENOENT
+		case !s.locked[key]:
+			res.Status = gomemcached.TMPFAIL
+		case req.Cas != item.Cas:
+			res.Status = gomemcached.LOCKED
+		default:
+			delete(s.locked, key)
+		}
+	case gomemcached.TOUCH, gomemcached.GAT, gomemcached.GATQ:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		item.Expiration = binary.BigEndian.Uint32(req.Extras)
+		s.data[key] = item
+		res.Cas = item.Cas
+		if req.Opcode != gomemcached.TOUCH {
+			res.Extras = make([]byte, 4)
+			binary.BigEndian.PutUint32(res.Extras, item.Flags)
+			res.Body = item.Data
+		}
+	case gomemcached.DELETE, gomemcached.DELETEQ:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		if req.Cas != 0 && req.Cas != item.Cas {
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		}
+		delete(s.data, key)
+	case gomemcached.FLUSH:
+		s.data = map[string]gomemcached.MCItem{}
+		s.locked = map[string]bool{}
+	case gomemcached.SASL_LIST_MECHS:
+		res.Body = []byte(s.mechs)
+	case gomemcached.SASL_AUTH, gomemcached.SASL_STEP:
+		if req.Opcode == gomemcached.SASL_AUTH && key == "CRAM-MD5" {
+			res.Status = gomemcached.AUTH_CONTINUE
+			res.Body = []byte(s.challenge)
+			return res
+		}
+		res.Status = gomemcached.AUTH_ERROR
+		if req.Opcode == gomemcached.SASL_STEP {
+			parts := strings.Split(string(req.Body), " ")
+			if pass, ok := s.users[parts[0]]; ok && len(parts) == 2 {
+				mac := hmac.New(md5.New, []byte(pass))
+				mac.Write([]byte(s.challenge))
+				if parts[1] == hex.EncodeToString(mac.Sum(nil)) {
+					res.Status = gomemcached.SUCCESS
+				}
+			}
+			return res
+		}
+		parts := strings.Split(string(req.Body), "\x00")
+		if key == "PLAIN" && len(parts) == 3 {
+			if pass, ok := s.users[parts[1]]; ok && pass == parts[2] {
+				res.Status = gomemcached.SUCCESS
+			}
+		}
+	case gomemcached.SUBDOC_GET:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		plen := binary.BigEndian.Uint16(req.Extras)
+		res.Body, res.Status = subdocGet(item.Data, string(req.Body[:plen]))
+		res.Cas = item.Cas
+	case gomemcached.SUBDOC_MULTI_LOOKUP:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		res.Body, res.Status = subdocMultiLookup(item.Data, req.Body)
+		res.Cas = item.Cas
+	case gomemcached.SUBDOC_MULTI_MUTATION:
+		if !exists {
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		var data []byte
+		data, res.Body, res.Status = subdocMultiMutation(item.Data, req.Body)
+		if res.Status == gomemcached.SUCCESS {
+			s.cas++
+			item.Cas = s.cas
+			item.Data = data
+			s.data[key] = item
+		}
+		res.Cas = item.Cas
+	case gomemcached.SELECT_BUCKET:
+		if !s.buckets[key] {
+			res.Status = gomemcached.EACCESS
+		}
+	case gomemcached.HELLO:
+		for i := 0; i+1 < len(req.Body); i += 2 {
+			if s.features[gomemcached.Feature(binary.BigEndian.Uint16(req.Body[i:]))] {
+				res.Body = append(res.Body, req.Body[i:i+2]...)
+			}
+		}
+	case gomemcached.VERSION:
+		res.Body = []byte(s.version)
+	case gomemcached.GET_CLUSTER_CONFIG:
+		if s.clusterConfig == nil {
+			res.Status = gomemcached.NOT_SUPPORTED
+			break
+		}
+		res.Body = s.clusterConfig
+	case gomemcached.GET_ERROR_MAP:
+		if len(req.Body) != 2 || s.errorMap == nil {
+			res.Status = gomemcached.EINVAL
+			break
+		}
+		res.Body = s.errorMap
+	case gomemcached.COLLECTIONS_GET_ID:
+		cid, ok := s.collections[string(req.Key)]
+		if !ok {
+			res.Status = gomemcached.UNKNOWN_COLLECTION
+			break
+		}
+		res.Extras = make([]byte, 12)
+		binary.BigEndian.PutUint64(res.Extras[0:8], s.manifest)
+		binary.BigEndian.PutUint32(res.Extras[8:12], cid)
+	case gomemcached.VERBOSITY:
+		if len(req.Extras) != 4 {
+			res.Status = gomemcached.EINVAL
+			break
+		}
+		if v := binary.BigEndian.Uint32(req.Extras); v > 3 {
+			res.Status = gomemcached.EINVAL
+		} else {
+			s.verbosity = v
+		}
+	case gomemcached.QUIT:
+		res.Fatal = true
+	case gomemcached.NOOP:
+	default:
+		res.Status = gomemcached.UNKNOWN_COMMAND
+	}
+	return res
+}
+
+// lastRequest returns the most recent request the server received.
+func (s *fakeServer) lastRequest() gomemcached.MCRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqs[len(s.reqs)-1]
+}
+
+// item returns the stored item for a key.
+func (s *fakeServer) item(key string) gomemcached.MCItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data[key]
+}
+
+// listen starts serving connections until the test ends and returns
+// the address to dial.
+func (s *fakeServer) listen(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	s.serve(t, ln)
+	return ln.Addr().String()
+}
+
+// serve connections from ln until the test ends.
+func (s *fakeServer) serve(t *testing.T, ln net.Listener) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			oc := &onceCloser{Conn: conn}
+			s.mu.Lock()
+			s.conns = append(s.conns, oc)
+			s.mu.Unlock()
+			go mcserver.HandleIO(oc, s)
+		}
+	}()
+}
+
+// onceCloser lets the fake server hang up on a connection that
+// HandleIO will also close.
+type onceCloser struct {
+	net.Conn
+	once sync.Once
+}
+
+func (o *onceCloser) Close() error {
+	o.once.Do(func() { o.Conn.Close() })
+	return nil
+}
+
+// dropConnections hangs up on every connected client.
+func (s *fakeServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// connect returns a client dialed to a new fake server listener.
+func (s *fakeServer) connect(t *testing.T) *Client {
+	c, err := Connect("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return c
+}
+
+// connectTest returns a client dialed to a new listener of the
+// exported test server, for tests its operations are enough for.
+func connectTest(t *testing.T, s *testserver.Server) *Client {
+	addr, err := s.Start()
+	if err != nil {
+		t.Fatalf("Error starting server: %v", err)
+	}
+	c, err := Connect("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return c
+}
+
+func TestAppendPrepend(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	res, err := c.Append(0, "missing", []byte("x"))
+	if !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected KEY_ENOENT appending to a missing key, got %v/%v", res, err)
+	}
+
+	res, err = c.Set(0, "k", 0, 0, []byte("mid"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	cas := res.Cas
+
+	res, err = c.Append(0, "k", []byte("-end"))
+	if err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if req := s.lastRequest(); len(req.Extras) != 0 {
+		t.Errorf("Expected no extras on append, got %v", req.Extras)
+	}
+	if res.Cas == 0 || res.Cas == cas {
+		t.Errorf("Expected a new CAS after append, got %v (was %v)", res.Cas, cas)
+	}
+
+	res, err = c.Prepend(0, "k", []byte("start-"))
+	if err != nil {
+		t.Fatalf("Error prepending: %v", err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.PREPEND || len(req.Extras) != 0 {
+		t.Errorf("Expected PREPEND with no extras, got %v", req)
+	}
+
+	res, err = c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != "start-mid-end" {
+		t.Errorf("Expected start-mid-end, got %q", res.Body)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	res, err := c.Replace(0, "k", 0, 0, []byte("nope"))
+	if !gomemcached.IsNotFound(err) || res.Status != gomemcached.KEY_ENOENT {
+		t.Fatalf("Expected KEY_ENOENT replacing a missing key, got %v/%v", res, err)
+	}
+
+	res, err = c.Set(0, "k", 0, 0, []byte("old"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	cas := res.Cas
+
+	res, err = c.Replace(0, "k", 0, 0, []byte("new"))
+	if err != nil {
+		t.Fatalf("Error replacing: %v", err)
+	}
+	if res.Cas == cas {
+		t.Errorf("Expected CAS to change on replace, still %v", cas)
+	}
+
+	res, err = c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != "new" {
+		t.Errorf("Expected new, got %q", res.Body)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	_, err := c.Incr(0, "ctr", 1, 5, 0xffffffff)
+	if !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected KEY_ENOENT with do-not-create exp, got %v", err)
+	}
+
+	v, err := c.Incr(0, "ctr", 1, 5, 0)
+	if err != nil || v != 5 {
+		t.Fatalf("Expected initial value 5, got %v/%v", v, err)
+	}
+	if req := s.lastRequest(); len(req.Extras) != 20 {
+		t.Errorf("Expected 20 bytes of extras, got %v", req.Extras)
+	}
+
+	v, err = c.Incr(0, "ctr", 10, 5, 0)
+	if err != nil || v != 15 {
+		t.Fatalf("Expected 15, got %v/%v", v, err)
+	}
+
+	v, err = c.Decr(0, "ctr", 3, 5, 0)
+	if err != nil || v != 12 {
+		t.Fatalf("Expected 12, got %v/%v", v, err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.DECREMENT {
+		t.Errorf("Expected DECREMENT, got %v", req.Opcode)
+	}
+
+	v, res, err := c.IncrResponse(0, "ctr", 1, 0, 0)
+	if err != nil || v != 13 || res == nil || res.Cas != s.item("ctr").Cas {
+		t.Errorf("Expected 13 with the counter's CAS, got %v/%v/%v", v, res, err)
+	}
+	v, res, err = c.DecrResponse(0, "ctr", 1, 0, 0)
+	if err != nil || v != 12 || res == nil || res.Cas != s.item("ctr").Cas {
+		t.Errorf("Expected 12 with the counter's CAS, got %v/%v/%v", v, res, err)
+	}
+	_, res, err = c.IncrResponse(0, "none", 1, 0, 0xffffffff)
+	if !gomemcached.IsNotFound(err) || res == nil || res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected a KEY_ENOENT response, got %v/%v", res, err)
+	}
+}
+
+// fixedResponse is a transport that discards writes and replays
+// canned response bytes.
+type fixedResponse struct {
+	*bytes.Reader
+}
+
+func newFixedResponse(data []byte) fixedResponse {
+	return fixedResponse{bytes.NewReader(data)}
+}
+
+func (f fixedResponse) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (f fixedResponse) Close() error {
+	return nil
+}
+
+func TestIncrBadBody(t *testing.T) {
+	res := gomemcached.MCResponse{
+		Opcode: gomemcached.INCREMENT,
+		Body:   []byte{1, 2, 3},
+	}
+	c, err := Wrap(newFixedResponse(res.Bytes()))
+	must(err)
+
+	_, err = c.Incr(0, "ctr", 1, 0, 0)
+	if err == nil {
+		t.Fatalf("Expected error decoding a short counter body")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	_, err := c.Touch(0, "k", 10)
+	if !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected KEY_ENOENT touching a missing key, got %v", err)
+	}
+
+	_, err = c.Set(0, "k", 0, 0, []byte("v"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	res, err := c.Touch(0, "k", 0x01020304)
+	if err != nil {
+		t.Fatalf("Error touching: %v", err)
+	}
+	if len(res.Body) != 0 {
+		t.Errorf("Expected no body from touch, got %q", res.Body)
+	}
+	exp := []byte{1, 2, 3, 4}
+	if req := s.lastRequest(); !bytes.Equal(req.Extras, exp) {
+		t.Errorf("Expected extras %v, got %v", exp, req.Extras)
+	}
+
+	res, err = c.GetAndTouch(0, "k", 60)
+	if err != nil {
+		t.Fatalf("Error in get and touch: %v", err)
+	}
+	if string(res.Body) != "v" {
+		t.Errorf("Expected v, got %q", res.Body)
+	}
+	exp = []byte{0, 0, 0, 60}
+	if req := s.lastRequest(); req.Opcode != gomemcached.GAT || !bytes.Equal(req.Extras, exp) {
+		t.Errorf("Expected GAT with extras %v, got %v", exp, req)
+	}
+	if got := s.item("k").Expiration; got != 60 {
+		t.Errorf("Expected expiration 60, got %v", got)
+	}
+}
+
+func TestGetAndLock(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	_, err := c.Set(0, "k", 0, 0, []byte("v"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	res, err := c.GetAndLock(0, "k", 15)
+	if err != nil {
+		t.Fatalf("Error locking: %v", err)
+	}
+	if string(res.Body) != "v" || res.Cas == 0 {
+		t.Fatalf("Expected value with a CAS, got %v", res)
+	}
+	cas := res.Cas
+	exp := []byte{0, 0, 0, 15}
+	if req := s.lastRequest(); !bytes.Equal(req.Extras, exp) {
+		t.Errorf("Expected extras %v, got %v", exp, req.Extras)
+	}
+
+	res, err = c.Set(0, "k", 0, 0, []byte("w"))
+	if err == nil || res.Status != gomemcached.LOCKED {
+		t.Fatalf("Expected set of a locked key to fail, got %v/%v", res, err)
+	}
+
+	res, err = c.Unlock(0, "k", cas+1)
+	if err == nil || res.Status != gomemcached.LOCKED {
+		t.Fatalf("Expected unlock with the wrong CAS to fail, got %v/%v", res, err)
+	}
+
+	_, err = c.Unlock(0, "k", cas)
+	if err != nil {
+		t.Fatalf("Error unlocking: %v", err)
+	}
+	if req := s.lastRequest(); req.Cas != cas {
+		t.Errorf("Expected unlock to carry CAS %v, got %v", cas, req.Cas)
+	}
+
+	_, err = c.Set(0, "k", 0, 0, []byte("w"))
+	if err != nil {
+		t.Fatalf("Error setting after unlock: %v", err)
+	}
+}
+
+func TestSetVerbosity(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if err := c.SetVerbosity(2); err != nil {
+		t.Fatalf("Error setting verbosity: %v", err)
+	}
+	if req := s.lastRequest(); !bytes.Equal(req.Extras, []byte{0, 0, 0, 2}) {
+		t.Errorf("Expected a 4 byte level, got %v", req.Extras)
+	}
+	if s.verbosity != 2 {
+		t.Errorf("Expected verbosity 2, got %v", s.verbosity)
+	}
+
+	err := c.SetVerbosity(99)
+	if res, ok := err.(*gomemcached.MCResponse); !ok || res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected EINVAL, got %v", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	keys := []string{"a", "b", "c"}
+	for _, k := range keys {
+		if _, err := c.Set(0, k, 0, 0, []byte(k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	if _, err := c.Flush(0, 0); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	if req := s.lastRequest(); len(req.Extras) != 0 {
+		t.Errorf("Expected no extras on immediate flush, got %v", req.Extras)
+	}
+
+	for _, k := range keys {
+		if _, err := c.Get(0, k); !gomemcached.IsNotFound(err) {
+			t.Errorf("Expected %v to be gone after flush, got %v", k, err)
+		}
+	}
+
+	if _, err := c.Flush(0, 30); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	exp := []byte{0, 0, 0, 30}
+	if req := s.lastRequest(); !bytes.Equal(req.Extras, exp) {
+		t.Errorf("Expected extras %v for delayed flush, got %v", exp, req.Extras)
+	}
+}
+
+func TestNoop(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	res, err := c.Noop()
+	if err != nil || res.Opcode != gomemcached.NOOP {
+		t.Fatalf("Expected NOOP response, got %v/%v", res, err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+	c := connectTest(t, s)
+	defer c.Close()
+
+	var ops []gomemcached.CommandCode
+	c.SetObserver(OpObserverFunc(func(opcode gomemcached.CommandCode, status gomemcached.Status,
+		latency time.Duration, err error) {
+		ops = append(ops, opcode)
+	}))
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Error pinging: %v", err)
+	}
+	if len(ops) != 1 || ops[0] != gomemcached.NOOP {
+		t.Errorf("Expected a NOOP, got %v", ops)
+	}
+
+	s.Close()
+	start := time.Now()
+	if err := c.Ping(); err == nil {
+		t.Errorf("Expected ping to fail after the server hung up")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Took too long to fail: %v", d)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy")
+	}
+}
+
+func TestPingReadDeadline(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	// Read the ping, but never answer.
+	go mcserver.ReadPacket(sconn)
+
+	must(c.SetReadDeadline(time.Now().Add(10 * time.Millisecond)))
+	err = c.Ping()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	respond := func(opaque uint32) {
+		res := &gomemcached.MCResponse{Opcode: gomemcached.NOOP, Opaque: opaque}
+		res.Transmit(sconn)
+	}
+
+	go respond(1)
+	res, err := c.ReceiveTimeout(time.Second)
+	if err != nil || res.Opaque != 1 {
+		t.Fatalf("Expected a response, got %v/%v", res, err)
+	}
+
+	start := time.Now()
+	_, err = c.ReceiveTimeout(10 * time.Millisecond)
+	if !errors.Is(err, ErrReceiveTimeout) {
+		t.Fatalf("Expected ErrReceiveTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected a prompt timeout, took %v", d)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+
+	// A late response is still there to be read.
+	go respond(2)
+	res, err = c.Receive()
+	if err != nil || res.Opaque != 2 {
+		t.Fatalf("Expected the late response, got %v/%v", res, err)
+	}
+
+	// Timing out partway through a response leaves the stream
+	// unusable.
+	go sconn.Write(make([]byte, 10))
+	_, err = c.ReceiveTimeout(50 * time.Millisecond)
+	if !errors.Is(err, ErrReceiveTimeout) {
+		t.Fatalf("Expected ErrReceiveTimeout, got %v", err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy")
+	}
+
+	c2, err := Wrap(new(tracked))
+	must(err)
+	if _, err := c2.ReceiveTimeout(time.Second); err != ErrNoDeadline {
+		t.Errorf("Expected ErrNoDeadline, got %v", err)
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	s := newFakeServer()
+	addr := s.listen(t)
+	c, err := Connect("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	nc, ok := c.NetConn()
+	if !ok {
+		t.Fatalf("Expected a net.Conn, got %T", c.Conn())
+	}
+	if got := nc.RemoteAddr().String(); got != addr {
+		t.Errorf("Expected remote address %v, got %v", addr, got)
+	}
+	if c.Conn() != nc {
+		t.Errorf("Expected Conn to be the same connection")
+	}
+
+	w := NewClient(new(tracked))
+	if _, ok := w.NetConn(); ok {
+		t.Errorf("Expected no net.Conn for a wrapped non-network transport")
+	}
+}
+
+func TestReceiveBatch(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "present", 0, 0, []byte("here")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	for i, k := range []string{"missing", "present", "also-missing"} {
+		err := c.Transmit(&gomemcached.MCRequest{
+			Opcode: gomemcached.GETQ,
+			Key:    []byte(k),
+			Opaque: uint32(i),
+		})
+		if err != nil {
+			t.Fatalf("Error transmitting: %v", err)
+		}
+	}
+
+	got, err := c.ReceiveBatch(1234)
+	if err != nil {
+		t.Fatalf("Error receiving batch: %v", err)
+	}
+	if len(got) != 1 || got[0].Opaque != 1 || string(got[0].Body) != "here" {
+		t.Fatalf("Expected only the hit before the noop, got %v", got)
+	}
+
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to remain healthy")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	// Responses left unread, then the sentinel, then one more.
+	for _, k := range []string{"k", "missing", "k"} {
+		must(c.Transmit(&gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte(k)}))
+	}
+	must(c.Transmit(&gomemcached.MCRequest{Opcode: gomemcached.NOOP, Opaque: 1234}))
+	after := &gomemcached.MCRequest{Opcode: gomemcached.VERSION}
+	must(c.Transmit(after))
+
+	if err := c.Drain(1234); err != nil {
+		t.Fatalf("Error draining: %v", err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to be healthy")
+	}
+	res, err := c.Receive()
+	if err != nil || res.Opaque != after.Opaque || res.Opcode != gomemcached.VERSION {
+		t.Errorf("Expected the response after the sentinel, got %v/%v", res, err)
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop after draining: %v", err)
+	}
+
+	// Never finding the sentinel.
+	must(c.Transmit(&gomemcached.MCRequest{Opcode: gomemcached.NOOP}))
+	must(c.FlushBuffer())
+	s.dropConnections()
+	if err := c.Drain(99); err == nil {
+		t.Errorf("Expected an error when the stream ends")
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy")
+	}
+}
+
+func TestQuietPipeline(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := c.SetQ(0, fmt.Sprintf("k%d", i), 0, 0, []byte("v")); err != nil {
+			t.Fatalf("Error in SetQ: %v", err)
+		}
+	}
+	// One failure of each kind.
+	if err := c.AddQ(0, "k7", 0, 0, []byte("again")); err != nil {
+		t.Fatalf("Error in AddQ: %v", err)
+	}
+	if err := c.DeleteQ(0, "k3"); err != nil {
+		t.Fatalf("Error in DeleteQ: %v", err)
+	}
+	if err := c.DeleteQ(0, "nothere"); err != nil {
+		t.Fatalf("Error in DeleteQ: %v", err)
+	}
+
+	got, err := c.ReceiveBatch(99)
+	if err != nil {
+		t.Fatalf("Error receiving batch: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected only the two failures, got %v", got)
+	}
+	if got[0].Opcode != gomemcached.ADDQ || got[0].Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected ADDQ KEY_EEXISTS, got %v", got[0])
+	}
+	if got[1].Opcode != gomemcached.DELETEQ || got[1].Status != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected DELETEQ KEY_ENOENT, got %v", got[1])
+	}
+
+	if s.item("k99").Data == nil || s.item("k3").Data != nil {
+		t.Errorf("Unexpected server state k99=%v k3=%v", s.item("k99"), s.item("k3"))
+	}
+	if string(s.item("k7").Data) != "v" {
+		t.Errorf("Expected AddQ not to overwrite k7, got %q", s.item("k7").Data)
+	}
+}
+
+func TestGetBulk(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	for _, k := range []string{"a", "c"} {
+		if _, err := c.Set(0, k, 0, 0, []byte("val-"+k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	s.mu.Lock()
+	before := len(s.reqs)
+	s.mu.Unlock()
+
+	got, err := c.GetBulk(0, []string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatalf("Error in GetBulk: %v", err)
+	}
+	if len(got) != 2 || string(got["a"].Body) != "val-a" ||
+		string(got["c"].Body) != "val-c" {
+		t.Fatalf("Expected only a and c, got %v", got)
+	}
+
+	s.mu.Lock()
+	reqs := s.reqs[before:]
+	s.mu.Unlock()
+	if len(reqs) != 5 {
+		t.Fatalf("Expected 4 gets and a noop, got %v", reqs)
+	}
+	for _, req := range reqs[:4] {
+		if req.Opcode != gomemcached.GETKQ {
+			t.Errorf("Expected GETKQ, got %v", req.Opcode)
+		}
+	}
+	if reqs[4].Opcode != gomemcached.NOOP {
+		t.Errorf("Expected trailing NOOP, got %v", reqs[4].Opcode)
+	}
+
+	if got, err := c.GetBulk(0, []string{"b", "d"}); err != nil || len(got) != 0 {
+		t.Errorf("Expected empty result for absent keys, got %v/%v", got, err)
+	}
+}
+
+func TestGetBulkConcurrent(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	keys := []string{"a", "b", "c"}
+	for _, k := range keys {
+		if _, err := c.Set(0, k, 0, 0, []byte("val-"+k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				got, err := c.GetBulk(0, keys)
+				if err != nil {
+					t.Errorf("Error in GetBulk: %v", err)
+					return
+				}
+				for _, k := range keys {
+					if got[k] == nil || string(got[k].Body) != "val-"+k {
+						t.Errorf("Expected val-%v, got %v", k, got)
+						return
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				res, err := c.Get(0, "b")
+				if err != nil {
+					t.Errorf("Error getting: %v", err)
+					return
+				}
+				if string(res.Body) != "val-b" {
+					t.Errorf("Expected val-b, got %q", res.Body)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !c.IsHealthy() {
+		t.Errorf("Expected the client healthy after concurrent use")
+	}
+}
+
+func TestStatsChan(t *testing.T) {
+	s := newFakeServer()
+	for i := 0; i < 500; i++ {
+		s.stats = append(s.stats, StatValue{
+			Key: fmt.Sprintf("stat_%d", i),
+			Val: strconv.Itoa(i),
+		})
+	}
+	c := s.connect(t)
+	defer c.Close()
+
+	stats, errs := c.StatsChan("")
+	n := 0
+	for sv := range stats {
+		if sv != s.stats[n] {
+			t.Fatalf("Expected %v at %d, got %v", s.stats[n], n, sv)
+		}
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Error streaming stats: %v", err)
+	}
+	if n != len(s.stats) {
+		t.Fatalf("Expected %d stats, got %d", len(s.stats), n)
+	}
+	if _, ok := <-errs; ok {
+		t.Errorf("Expected error channel to be closed")
+	}
+
+	// The connection is still usable afterwards.
+	m, err := c.StatsMap("")
+	if err != nil || len(m) != len(s.stats) || m["stat_42"] != "42" {
+		t.Errorf("Unexpected StatsMap result: %d stats, %v", len(m), err)
+	}
+}
+
+func TestStatsChanError(t *testing.T) {
+	s := newFakeServer()
+	s.stats = []StatValue{{"a", "1"}, {"b", "2"}}
+	c := s.connect(t)
+	defer c.Close()
+
+	s.dropConnections()
+	stats, errs := c.StatsChan("")
+	for range stats {
+	}
+	if err := <-errs; err == nil {
+		t.Errorf("Expected an error from a dropped connection")
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := newFakeServer()
+	for i := 0; i < 500; i++ {
+		s.stats = append(s.stats, StatValue{
+			Key: fmt.Sprintf("stat_%d", i),
+			Val: strings.Repeat("v", i),
+		})
+	}
+	c := s.connect(t)
+	defer c.Close()
+
+	// Reused buffers mustn't show through in earlier values.
+	for i := 0; i < 2; i++ {
+		stats, err := c.Stats("")
+		if err != nil {
+			t.Fatalf("Error getting stats: %v", err)
+		}
+		if !reflect.DeepEqual(stats, s.stats) {
+			t.Fatalf("Expected %d stats, got %d differing", len(s.stats), len(stats))
+		}
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop after stats: %v", err)
+	}
+
+	s.dropConnections()
+	if stats, err := c.Stats(""); err == nil || stats == nil {
+		t.Errorf("Expected an error and an empty slice, got %v, %v", stats, err)
+	}
+}
+
+func statsResponses(n int) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		res := gomemcached.MCResponse{
+			Opcode: gomemcached.STAT,
+			Key:    []byte(fmt.Sprintf("stat_%d", i)),
+			Body:   []byte(strconv.Itoa(i * 1000)),
+		}
+		data = append(data, res.Bytes()...)
+	}
+	end := gomemcached.MCResponse{Opcode: gomemcached.STAT}
+	return append(data, end.Bytes()...)
+}
+
+func BenchmarkStats(b *testing.B) {
+	c, err := Wrap(&repeatedResponse{data: statsResponses(500)})
+	must(err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Stats(""); err != nil {
+			b.Fatalf("Error getting stats: %v", err)
+		}
+	}
+}
+
+// For comparison with BenchmarkStats.
+func BenchmarkStatsChan(b *testing.B) {
+	c, err := Wrap(&repeatedResponse{data: statsResponses(500)})
+	must(err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats, errs := c.StatsChan("")
+		for range stats {
+		}
+		if err := <-errs; err != nil {
+			b.Fatalf("Error getting stats: %v", err)
+		}
+	}
+}
+
+// observeResponse is the response to an OBSERVE of key, reporting
+// status and cas, and persistence and replication times of 10ms and
+// 20ms.
+func observeResponse(req *gomemcached.MCRequest, key string, status ObservedStatus, cas uint64) *gomemcached.MCResponse {
+	body := make([]byte, 4+len(key)+1+8)
+	binary.BigEndian.PutUint16(body, req.VBucket)
+	binary.BigEndian.PutUint16(body[2:], uint16(len(key)))
+	copy(body[4:], key)
+	body[4+len(key)] = byte(status)
+	binary.BigEndian.PutUint64(body[5+len(key):], cas)
+	return &gomemcached.MCResponse{
+		Opcode: gomemcached.OBSERVE,
+		Opaque: req.Opaque,
+		Cas:    10<<32 | 20,
+		Body:   body,
+	}
+}
+
+func TestObserve(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	respond := func(f func(req *gomemcached.MCRequest) *gomemcached.MCResponse) {
+		go func() {
+			req, err := mcserver.ReadPacket(sconn)
+			if err != nil {
+				return
+			}
+			f(&req).Transmit(sconn)
+		}()
+	}
+
+	for _, st := range []ObservedStatus{ObservedNotPersisted, ObservedPersisted,
+		ObservedNotFound, ObservedLogicallyDeleted} {
+		var body []byte
+		respond(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+			body = req.Body
+			return observeResponse(req, "k", st, 42)
+		})
+		res, err := c.Observe(3, "k")
+		if err != nil {
+			t.Fatalf("Error observing with %v: %v", st, err)
+		}
+		exp := ObserveResult{
+			Status:          st,
+			Cas:             42,
+			PersistenceTime: 10 * time.Millisecond,
+			ReplicationTime: 20 * time.Millisecond,
+		}
+		if res != exp {
+			t.Errorf("Expected %+v, got %+v", exp, res)
+		}
+		if !bytes.Equal(body, []byte{0, 3, 0, 1, 'k'}) {
+			t.Errorf("Expected the vbucket and key in the body, got %v", body)
+		}
+	}
+
+	respond(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		return observeResponse(req, "other", ObservedPersisted, 42)
+	})
+	if _, err := c.Observe(3, "k"); err == nil {
+		t.Errorf("Expected an error observing the wrong key")
+	}
+
+	respond(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		res := observeResponse(req, "k", ObservedPersisted, 42)
+		res.Body = res.Body[:6]
+		return res
+	})
+	if _, err := c.Observe(3, "k"); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF from a short body, got %v", err)
+	}
+}
+
+func TestCheckPersistence(t *testing.T) {
+	tests := []struct {
+		res                  ObserveResult
+		deletion             bool
+		persisted, overwrote bool
+	}{
+		{ObserveResult{Status: ObservedNotPersisted, Cas: 1}, false, false, false},
+		{ObserveResult{Status: ObservedPersisted, Cas: 1}, false, true, false},
+		{ObserveResult{Status: ObservedPersisted, Cas: 2}, false, false, true},
+		{ObserveResult{Status: ObservedNotFound}, true, true, false},
+		{ObserveResult{Status: ObservedLogicallyDeleted}, true, false, true},
+	}
+	for _, test := range tests {
+		persisted, overwrote := test.res.CheckPersistence(1, test.deletion)
+		if persisted != test.persisted || overwrote != test.overwrote {
+			t.Errorf("Expected %v/%v for %+v, got %v/%v", test.persisted, test.overwrote,
+				test.res, persisted, overwrote)
+		}
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	s := newFakeServer()
+	s.stats = []StatValue{{"a", "1"}, {"b", "2"}}
+	c := s.connect(t)
+	defer c.Close()
+
+	if err := c.StatsReset(); err != nil {
+		t.Fatalf("Error resetting stats: %v", err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.STAT || string(req.Key) != "reset" {
+		t.Errorf("Expected STAT reset, got %v", req)
+	}
+	if len(s.stats) != 0 {
+		t.Errorf("Expected stats reset, got %v", s.stats)
+	}
+
+	// The connection is still in step.
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+}
+
+func TestConcurrentSend(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	const workers, keys = 20, 50
+	for i := 0; i < keys; i++ {
+		k := strconv.Itoa(i)
+		if _, err := c.Set(0, k, 0, 0, []byte("val-"+k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				k := strconv.Itoa((i + w) % keys)
+				res, err := c.Get(0, k)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(res.Body) != "val-"+k {
+					errs <- fmt.Errorf("get %v returned %q", k, res.Body)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to remain healthy")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	s := newFakeServer()
+	s.version = "1.4.15-fake"
+	c := s.connect(t)
+	defer c.Close()
+
+	v, err := c.Version()
+	if err != nil {
+		t.Fatalf("Error getting version: %v", err)
+	}
+	if v != s.version {
+		t.Errorf("Expected version %q, got %q", s.version, v)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Error quitting: %v", err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.QUIT {
+		t.Errorf("Expected QUIT, got %v", req.Opcode)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy after quit")
+	}
+}
+
+func TestGracefulClose(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+
+	if err := c.GracefulClose(time.Second); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.QUIT {
+		t.Errorf("Expected QUIT before closing, got %v", req.Opcode)
+	}
+	if _, err := c.Noop(); err == nil {
+		t.Errorf("Expected an error using a closed client")
+	}
+
+	// A server that never answers doesn't hold the close up.
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c = NewClient(cconn)
+	quit := make(chan *gomemcached.MCRequest, 1)
+	go func() {
+		req, err := mcserver.ReadPacket(sconn)
+		if err == nil {
+			quit <- &req
+		}
+	}()
+
+	start := time.Now()
+	c.GracefulClose(50 * time.Millisecond)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected the close to give up waiting, took %v", d)
+	}
+	select {
+	case req := <-quit:
+		if req.Opcode != gomemcached.QUIT {
+			t.Errorf("Expected QUIT, got %v", req.Opcode)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected a QUIT to be sent")
+	}
+}
+
+func TestCasMismatch(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	res, err := c.Set(0, "k", 0, 0, []byte("v1"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	stale := res.Cas
+
+	res, err = c.SetCas(0, "k", 0, 0, stale, []byte("v2"))
+	if err != nil {
+		t.Fatalf("Error setting with current cas: %v", err)
+	}
+	current := res.Cas
+
+	if _, err := c.SetCas(0, "k", 0, 0, stale, []byte("v3")); !gomemcached.IsCasMismatch(err) {
+		t.Errorf("Expected cas mismatch for stale set, got %v", err)
+	}
+	if _, err := c.DelCas(0, "k", stale); !gomemcached.IsCasMismatch(err) {
+		t.Errorf("Expected cas mismatch for stale delete, got %v", err)
+	}
+	if got := string(s.item("k").Data); got != "v2" {
+		t.Errorf("Expected stale operations to leave v2, got %q", got)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.DELETE || req.Cas != stale {
+		t.Errorf("Expected cas in delete header, got %v", req)
+	}
+
+	if _, err := c.DelCas(0, "k", current); err != nil {
+		t.Fatalf("Error deleting with current cas: %v", err)
+	}
+	if s.item("k").Data != nil {
+		t.Errorf("Expected k to be deleted")
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to remain healthy")
+	}
+}
+
+func TestCASRetry(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	other := s.connect(t)
+	defer other.Close()
+
+	if _, err := c.Set(0, "ctr", 0, 0, []byte("1")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	// Another writer gets in first on the first attempt.
+	calls := 0
+	res, err := c.CASWithRetries(0, "ctr", func(old []byte) ([]byte, CasOp) {
+		calls++
+		if calls == 1 {
+			if _, err := other.Set(0, "ctr", 0, 0, []byte("10")); err != nil {
+				t.Fatalf("Error in concurrent set: %v", err)
+			}
+		}
+		n, _ := strconv.Atoi(string(old))
+		return []byte(strconv.Itoa(n + 1)), CASStore
+	}, 0, 3)
+	if err != nil {
+		t.Fatalf("Error in CAS: %v", err)
+	}
+	if calls != 2 || string(s.item("ctr").Data) != "11" || res.Cas != s.item("ctr").Cas {
+		t.Errorf("Expected a retry to store 11, got %d calls, %q",
+			calls, s.item("ctr").Data)
+	}
+
+	// A writer that always wins exhausts the retries.
+	calls = 0
+	_, err = c.CASWithRetries(0, "ctr", func(old []byte) ([]byte, CasOp) {
+		calls++
+		if _, err := other.Set(0, "ctr", 0, 0, []byte("x")); err != nil {
+			t.Fatalf("Error in concurrent set: %v", err)
+		}
+		return []byte("mine"), CASStore
+	}, 0, 2)
+	if err != ErrTooManyCASRetries || calls != 3 {
+		t.Errorf("Expected too many retries after 3 calls, got %v after %d", err, calls)
+	}
+
+	// CASDelete deletes with the fetched CAS.
+	if _, err := c.CAS(0, "ctr", func([]byte) ([]byte, CasOp) {
+		return nil, CASDelete
+	}, 0); err != nil {
+		t.Fatalf("Error deleting via CAS: %v", err)
+	}
+	if s.item("ctr").Data != nil {
+		t.Errorf("Expected ctr to be deleted")
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.DELETE || req.Cas == 0 {
+		t.Errorf("Expected a delete with cas, got %v", req)
+	}
+}
+
+func TestStoreOptions(t *testing.T) {
+	tests := []struct {
+		opts   StoreOptions
+		extras []byte
+		cas    uint64
+		dt     uint8
+	}{
+		{StoreOptions{}, []byte{0, 0, 0, 0, 0, 0, 0, 0}, 0, 0},
+		{StoreOptions{Flags: 0xdeadbeef}, []byte{0xde, 0xad, 0xbe, 0xef, 0, 0, 0, 0}, 0, 0},
+		{StoreOptions{Exp: 3600}, []byte{0, 0, 0, 0, 0, 0, 0x0e, 0x10}, 0, 0},
+		{StoreOptions{Flags: 1, Exp: -1}, []byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}, 0, 0},
+		{StoreOptions{Cas: 938424885}, []byte{0, 0, 0, 0, 0, 0, 0, 0}, 938424885, 0},
+		{StoreOptions{Datatype: gomemcached.DATATYPE_JSON}, []byte{0, 0, 0, 0, 0, 0, 0, 0},
+			0, gomemcached.DATATYPE_JSON},
+	}
+
+	for _, x := range tests {
+		req := storeRequest(gomemcached.SET, 3, []byte("k"), []byte("v"), x.opts)
+		if !bytes.Equal(req.Extras, x.extras) || req.Cas != x.cas || req.Datatype != x.dt ||
+			req.VBucket != 3 || string(req.Key) != "k" || string(req.Body) != "v" {
+			t.Errorf("Unexpected request for %+v: %#v", x.opts, req)
+		}
+	}
+}
+
+func TestSetOpts(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	set, err := c.SetOpts(0, "k", []byte(`{}`), StoreOptions{
+		Flags:    7,
+		Exp:      60,
+		Datatype: gomemcached.DATATYPE_JSON,
+	})
+	if err != nil {
+		t.Fatalf("Error in SetOpts: %v", err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.SET || req.Datatype != gomemcached.DATATYPE_JSON {
+		t.Errorf("Unexpected request: %v", req)
+	}
+	if item := s.item("k"); item.Flags != 7 || item.Expiration != 60 {
+		t.Errorf("Expected flags and expiration stored, got %+v", item)
+	}
+
+	if _, err := c.SetOpts(0, "k", []byte("v"), StoreOptions{Cas: set.Cas + 1}); !gomemcached.IsCasMismatch(err) {
+		t.Errorf("Expected CAS mismatch, got %v", err)
+	}
+	if _, err := c.AddOpts(0, "k", []byte("v"), StoreOptions{}); !gomemcached.IsExists(err) {
+		t.Errorf("Expected exists from AddOpts, got %v", err)
+	}
+	if _, err := c.ReplaceOpts(0, "missing", []byte("v"), StoreOptions{}); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found from ReplaceOpts, got %v", err)
+	}
+}
+
+func TestStoreDatatype(t *testing.T) {
+	s := newFakeServer()
+	s.features = map[gomemcached.Feature]bool{gomemcached.FEATURE_SNAPPY: true}
+	c := s.connect(t)
+	defer c.Close()
+
+	// Read the header off the wire, rather than trusting the fake
+	// server's decoding.
+	hdrs := make(chan []byte, 1)
+	cconn, sconn := net.Pipe()
+	go func() {
+		defer sconn.Close()
+		buf := make([]byte, gomemcached.HDR_LEN)
+		io.ReadFull(sconn, buf)
+		hdrs <- buf
+	}()
+	w, err := Wrap(cconn)
+	must(err)
+	w.Transmit(storeRequest(gomemcached.SET, 0, []byte("k"), []byte("{}"),
+		StoreOptions{Datatype: gomemcached.DATATYPE_JSON}))
+	go w.Close()
+	if hdr := <-hdrs; hdr[5] != gomemcached.DATATYPE_JSON {
+		t.Errorf("Expected the JSON datatype in header byte 5, got %v", hdr)
+	}
+
+	compressed := StoreOptions{Datatype: gomemcached.DATATYPE_SNAPPY | gomemcached.DATATYPE_JSON}
+	if _, err := c.SetOpts(0, "k", []byte("v"), compressed); !errors.Is(err, ErrSnappyNotNegotiated) {
+		t.Fatalf("Expected ErrSnappyNotNegotiated before Hello, got %v", err)
+	}
+	if item := s.item("k"); item.Data != nil {
+		t.Errorf("Expected nothing stored, got %+v", item)
+	}
+
+	if _, err := c.Hello("test", gomemcached.FEATURE_SNAPPY); err != nil {
+		t.Fatalf("Error in hello: %v", err)
+	}
+	if _, err := c.SetOpts(0, "k", []byte("v"), compressed); err != nil {
+		t.Fatalf("Error storing with snappy negotiated: %v", err)
+	}
+	if req := s.lastRequest(); req.Datatype != compressed.Datatype {
+		t.Errorf("Expected datatype %#x sent, got %#x", compressed.Datatype, req.Datatype)
+	}
+}
+
+func TestReturnCas(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	cas1, err := c.AddReturnCas(0, "k", 0, 0, []byte("v1"))
+	if err != nil || cas1 == 0 {
+		t.Fatalf("Error adding: %v/%v", cas1, err)
+	}
+	cas2, err := c.SetReturnCas(0, "k", 0, 0, []byte("v2"))
+	if err != nil || cas2 == cas1 {
+		t.Fatalf("Expected a new cas from set, got %v/%v", cas2, err)
+	}
+	cas3, err := c.ReplaceReturnCas(0, "k", 0, 0, []byte("v3"))
+	if err != nil || cas3 == cas2 {
+		t.Fatalf("Expected a new cas from replace, got %v/%v", cas3, err)
+	}
+	cas4, err := c.SetCasReturnCas(0, "k", 0, 0, cas3, []byte("v4"))
+	if err != nil || cas4 == cas3 {
+		t.Fatalf("Expected a new cas from set with cas, got %v/%v", cas4, err)
+	}
+
+	res, err := c.Get(0, "k")
+	if err != nil || res.Cas != cas4 || s.item("k").Cas != cas4 {
+		t.Errorf("Expected cas %v, got %v/%v", cas4, res, err)
+	}
+
+	if cas, err := c.SetCasReturnCas(0, "k", 0, 0, cas1, []byte("v5")); cas != 0 ||
+		!gomemcached.IsCasMismatch(err) {
+		t.Errorf("Expected cas mismatch, got %v/%v", cas, err)
+	}
+	if cas, err := c.AddReturnCas(0, "k", 0, 0, []byte("v6")); cas != 0 || err == nil {
+		t.Errorf("Expected add of an existing key to fail, got %v/%v", cas, err)
+	}
+}
+
+func TestGetReplica(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(3, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	res, err := c.GetReplica(3, "k")
+	if err != nil || string(res.Body) != "v" {
+		t.Fatalf("Expected v from replica, got %v/%v", res, err)
+	}
+	req := s.lastRequest()
+	if req.Opcode != gomemcached.GET_REPLICA || req.VBucket != 3 || string(req.Key) != "k" {
+		t.Errorf("Unexpected request %v", req)
+	}
+
+	if _, err := c.GetReplica(3, "missing"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	for k, v := range map[string]string{"small": "abc", "big": "0123456789", "empty": ""} {
+		if _, err := c.Set(0, k, 0, 0, []byte(v)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	buf := make([]byte, 8)
+	n, res, err := c.GetInto(0, "small", buf)
+	if err != nil || n != 3 || string(buf[:n]) != "abc" {
+		t.Fatalf("Expected abc in buf, got %d %q %v", n, buf[:n], err)
+	}
+	if &res.Body[0] != &buf[0] {
+		t.Errorf("Expected body to be read into buf")
+	}
+
+	n, res, err = c.GetInto(0, "big", buf)
+	if err != nil || n != 0 || string(res.Body) != "0123456789" {
+		t.Fatalf("Expected fallback for big value, got %d %q %v", n, res.Body, err)
+	}
+
+	n, res, err = c.GetInto(0, "empty", buf)
+	if err != nil || n != 0 || len(res.Body) != 0 {
+		t.Fatalf("Expected empty value, got %d %q %v", n, res.Body, err)
+	}
+
+	n, _, err = c.GetInto(0, "missing", buf)
+	if !gomemcached.IsNotFound(err) || n != 0 {
+		t.Fatalf("Expected not found, got %d %v", n, err)
+	}
+
+	// The stream is still in sync.
+	if res, err := c.Get(0, "small"); err != nil || string(res.Body) != "abc" {
+		t.Errorf("Expected abc after GetInto, got %v/%v", res, err)
+	}
+}
+
+func TestGetSnappy(t *testing.T) {
+	value := []byte(strings.Repeat("abc", 100))
+	compressed := snappy.Encode(nil, value)
+	corrupt := compressed[:len(compressed)-1]
+
+	// Responses to the client's first few requests, which get
+	// opaques from 1.
+	var wire []byte
+	for i, body := range [][]byte{compressed, compressed, corrupt, compressed} {
+		res := gomemcached.MCResponse{
+			Opcode:   gomemcached.GET,
+			Opaque:   uint32(i + 1),
+			Datatype: gomemcached.DATATYPE_SNAPPY | gomemcached.DATATYPE_JSON,
+			Extras:   []byte{0, 0, 0, 0},
+			Body:     body,
+		}
+		wire = append(wire, res.Bytes()...)
+	}
+	c, err := Wrap(newFixedResponse(wire))
+	must(err)
+
+	// Off by default, the value comes back compressed.
+	got, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if !got.IsSnappy() || !bytes.Equal(got.Body, compressed) {
+		t.Fatalf("Expected the compressed value, got %#x/%q", got.Datatype, got.Body)
+	}
+	body, err := got.Decompressed()
+	if err != nil || !bytes.Equal(body, value) {
+		t.Errorf("Expected decompressed value, got %q/%v", body, err)
+	}
+
+	c.SetDecompress(true)
+	got, err = c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting with decompression: %v", err)
+	}
+	if got.Datatype != gomemcached.DATATYPE_JSON || !bytes.Equal(got.Body, value) {
+		t.Errorf("Expected the plain JSON value, got %#x/%q", got.Datatype, got.Body)
+	}
+
+	got, err = c.Get(0, "k")
+	if !errors.Is(err, gomemcached.ErrCorruptSnappy) {
+		t.Errorf("Expected ErrCorruptSnappy, got %v", err)
+	}
+	if got == nil || !got.IsSnappy() || !bytes.Equal(got.Body, corrupt) {
+		t.Errorf("Expected the original bytes with the error, got %v", got)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected a bad value to leave the client healthy")
+	}
+
+	buf := make([]byte, len(value))
+	n, got, err := c.GetInto(0, "k", buf)
+	if err != nil || n != len(value) || !bytes.Equal(buf, value) || !bytes.Equal(got.Body, value) {
+		t.Errorf("Expected GetInto to fill buf with the plain value, got %v/%q/%v", n, buf, err)
+	}
+}
+
+func TestGetOrError(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	_, err := c.GetOrError(0, "nothere")
+	kerr, ok := err.(*gomemcached.KeyError)
+	if !ok {
+		t.Fatalf("Expected a KeyError, got %#v", err)
+	}
+	if kerr.Key != "nothere" || !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found for nothere, got %v", kerr)
+	}
+
+	if _, err := c.Set(0, "here", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	res, err := c.GetOrError(0, "here")
+	if err != nil || string(res.Body) != "v" {
+		t.Errorf("Expected v, got %v/%v", res, err)
+	}
+}
+
+func TestSendAssignsOpaque(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	seen := map[uint32]bool{}
+	for i := 0; i < 5; i++ {
+		res, err := c.Get(0, "k")
+		if !gomemcached.IsNotFound(err) {
+			t.Fatalf("Expected not found, got %v", err)
+		}
+		req := s.lastRequest()
+		if req.Opaque == 0 || seen[req.Opaque] {
+			t.Fatalf("Expected a fresh opaque, got %v (seen %v)", req.Opaque, seen)
+		}
+		if res.Opaque != req.Opaque {
+			t.Errorf("Expected response opaque %v, got %v", req.Opaque, res.Opaque)
+		}
+		seen[req.Opaque] = true
+	}
+}
+
+func TestTransmitAssignsOpaque(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	// Two failing REPLACEQs, whose responses can be told apart.
+	reqs := []*gomemcached.MCRequest{
+		{Opcode: gomemcached.REPLACEQ, Key: []byte("a"), Extras: make([]byte, 8)},
+		{Opcode: gomemcached.REPLACEQ, Key: []byte("b"), Extras: make([]byte, 8)},
+	}
+	for _, req := range reqs {
+		if err := c.Transmit(req); err != nil {
+			t.Fatalf("Error transmitting: %v", err)
+		}
+	}
+	if reqs[0].Opaque == 0 || reqs[1].Opaque == 0 || reqs[0].Opaque == reqs[1].Opaque {
+		t.Fatalf("Expected distinct opaques, got %v and %v", reqs[0].Opaque, reqs[1].Opaque)
+	}
+	res, err := c.ReceiveBatch(c.nextOpaque())
+	if err != nil || len(res) != 2 {
+		t.Fatalf("Expected two failures, got %v/%v", res, err)
+	}
+	for i, r := range res {
+		if r.Opaque != reqs[i].Opaque {
+			t.Errorf("Expected opaque %v echoed, got %v", reqs[i].Opaque, r.Opaque)
+		}
+	}
+
+	// Stats requests get fresh opaques too.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Stats(""); err != nil {
+			t.Fatalf("Error getting stats: %v", err)
+		}
+	}
+	if a, b := s.reqs[len(s.reqs)-2].Opaque, s.reqs[len(s.reqs)-1].Opaque; a == b {
+		t.Errorf("Expected distinct stats opaques, got %v twice", a)
+	}
+}
+
+func TestSendOpaqueMismatch(t *testing.T) {
+	res := gomemcached.MCResponse{
+		Opcode: gomemcached.GET,
+		Opaque: 99,
+		Body:   []byte("someone else's"),
+	}
+	c, err := Wrap(newFixedResponse(res.Bytes()))
+	must(err)
+
+	_, err = c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("k"),
+		Opaque: 5,
+	})
+	if !errors.Is(err, ErrOpaqueMismatch) {
+		t.Fatalf("Expected opaque mismatch, got %v", err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy after a mismatch")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	if err := c.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("Error setting deadline: %v", err)
+	}
+
+	// The server side never writes anything.
+	_, err = c.Receive()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestDeadlineUnsupported(t *testing.T) {
+	var tr tracked
+	c, err := Wrap(&tr)
+	must(err)
+
+	if err := c.SetDeadline(time.Now()); err != ErrNoDeadline {
+		t.Errorf("Expected ErrNoDeadline, got %v", err)
+	}
+	if err := c.SetReadDeadline(time.Now()); err != ErrNoDeadline {
+		t.Errorf("Expected ErrNoDeadline, got %v", err)
+	}
+	if err := c.SetWriteDeadline(time.Now()); err != ErrNoDeadline {
+		t.Errorf("Expected ErrNoDeadline, got %v", err)
+	}
+}
+
+func TestSendContextCancel(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	// Read the request, but never respond.
+	go mcserver.ReadPacket(sconn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err = c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Took too long to cancel: %v", d)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy after cancel")
+	}
+}
+
+func TestSendContextDeadline(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	defer sconn.Close()
+	c, err := Wrap(cconn)
+	must(err)
+	defer c.Close()
+
+	go mcserver.ReadPacket(sconn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.NOOP})
+	if err != nil || res.Opcode != gomemcached.NOOP {
+		t.Fatalf("Expected NOOP response, got %v/%v", res, err)
+	}
+}
+
+func TestHijackBuffered(t *testing.T) {
+	res := gomemcached.MCResponse{Opcode: gomemcached.NOOP}
+	data := append(res.Bytes(), "leftover"...)
+	c, err := Wrap(newFixedResponse(data))
+	must(err)
+
+	if _, err := c.Receive(); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(c.Hijack())
+	if err != nil {
+		t.Fatalf("Error reading hijacked conn: %v", err)
+	}
+	if string(got) != "leftover" {
+		t.Errorf("Expected buffered data after hijack, got %q", got)
+	}
+}
+
+// repeatedResponse is a transport that discards writes and serves an
+// endless stream of the same response, counting reads.
+type repeatedResponse struct {
+	data  []byte
+	pos   int
+	reads int
+}
+
+func (r *repeatedResponse) Read(p []byte) (int, error) {
+	r.reads++
+	n := 0
+	for n < len(p) {
+		m := copy(p[n:], r.data[r.pos:])
+		n += m
+		r.pos = (r.pos + m) % len(r.data)
+	}
+	return n, nil
+}
+
+func (r *repeatedResponse) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (r *repeatedResponse) Close() error {
+	return nil
+}
+
+func benchmarkGet(b *testing.B, bufSize int, release bool) {
+	defer func(s int) { DefaultReadBufferSize = s }(DefaultReadBufferSize)
+	DefaultReadBufferSize = bufSize
+
+	res := gomemcached.MCResponse{
+		Opcode: gomemcached.GET,
+		Opaque: 1,
+		Extras: []byte{0, 0, 0, 0},
+		Body:   []byte("somevalue"),
+	}
+	rr := &repeatedResponse{data: res.Bytes()}
+	c, err := Wrap(rr)
+	must(err)
+
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("somekey"),
+		Opaque: 1,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := c.Send(req)
+		if err != nil {
+			b.Fatalf("Error getting: %v", err)
+		}
+		if release {
+			res.Release()
+		}
+	}
+	b.ReportMetric(float64(rr.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkGetBuffered(b *testing.B) {
+	benchmarkGet(b, bufsize, false)
+}
+
+func BenchmarkGetUnbuffered(b *testing.B) {
+	benchmarkGet(b, 0, false)
+}
+
+func BenchmarkGetRelease(b *testing.B) {
+	benchmarkGet(b, bufsize, true)
+}
+
+// recordingConn is a transport that replays canned response bytes
+// and records everything written to it.
+type recordingConn struct {
+	r      *bytes.Reader
+	w      bytes.Buffer
+	writes int
+}
+
+func newRecordingConn(data []byte) *recordingConn {
+	return &recordingConn{r: bytes.NewReader(data)}
+}
+
+func (rc *recordingConn) Read(p []byte) (int, error) {
+	return rc.r.Read(p)
+}
+
+func (rc *recordingConn) Write(p []byte) (int, error) {
+	rc.writes++
+	return rc.w.Write(p)
+}
+
+func (rc *recordingConn) Close() error {
+	return nil
+}
+
+func TestTransmitBuffered(t *testing.T) {
+	res := gomemcached.MCResponse{Opcode: gomemcached.NOOP, Opaque: 42}
+	rc := newRecordingConn(res.Bytes())
+	c, err := Wrap(rc)
+	must(err)
+
+	setq := &gomemcached.MCRequest{
+		Opcode: gomemcached.SETQ,
+		Key:    []byte("k"),
+		Extras: make([]byte, 8),
+		Body:   []byte("v"),
+	}
+	if err := c.Transmit(setq); err != nil {
+		t.Fatalf("Error transmitting: %v", err)
+	}
+	if rc.w.Len() != 0 {
+		t.Fatalf("Expected nothing written before a flush, got %v", rc.w.Bytes())
+	}
+
+	if err := c.FlushBuffer(); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+	if rc.w.Len() != setq.Size() {
+		t.Fatalf("Expected %v bytes after flush, got %v", setq.Size(), rc.w.Len())
+	}
+
+	if err := c.Transmit(setq); err != nil {
+		t.Fatalf("Error transmitting: %v", err)
+	}
+	_, err = c.Send(&gomemcached.MCRequest{Opcode: gomemcached.NOOP, Opaque: 42})
+	if err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if rc.w.Len() != 2*setq.Size()+gomemcached.HDR_LEN {
+		t.Fatalf("Expected everything written after send, got %v bytes", rc.w.Len())
+	}
+}
+
+func benchmarkTransmitQuiet(b *testing.B, bufSize int) {
+	defer func(s int) { DefaultWriteBufferSize = s }(DefaultWriteBufferSize)
+	DefaultWriteBufferSize = bufSize
+
+	rc := newRecordingConn(nil)
+	c, err := Wrap(rc)
+	must(err)
+
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.SETQ,
+		Key:    []byte("somekey"),
+		Extras: make([]byte, 8),
+		Body:   []byte("somevalue"),
+	}
+	b.SetBytes(int64(req.Size()))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Transmit(req); err != nil {
+			b.Fatalf("Error transmitting: %v", err)
+		}
+		if rc.w.Len() > 1<<20 {
+			rc.w.Reset()
+		}
+	}
+	c.FlushBuffer()
+	b.ReportMetric(float64(rc.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkTransmitQuietBuffered(b *testing.B) {
+	benchmarkTransmitQuiet(b, bufsize)
+}
+
+func BenchmarkTransmitQuietUnbuffered(b *testing.B) {
+	benchmarkTransmitQuiet(b, 0)
+}
+
+func TestNewClientPipe(t *testing.T) {
+	cconn, sconn := net.Pipe()
+	c := NewClient(cconn)
+	defer c.Close()
+
+	go func() {
+		defer sconn.Close()
+		req, err := mcserver.ReadPacket(sconn)
+		if err != nil {
+			return
+		}
+		res := &gomemcached.MCResponse{
+			Opcode: req.Opcode,
+			Opaque: req.Opaque,
+			Extras: []byte{0, 0, 0, 0},
+			Body:   append([]byte("value of "), req.Key...),
+		}
+		res.Transmit(sconn)
+	}()
+
+	res, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting over a pipe: %v", err)
+	}
+	if string(res.Body) != "value of k" {
+		t.Errorf("Expected \"value of k\", got %q", res.Body)
+	}
+}
+
+func TestAuthPlain(t *testing.T) {
+	s := newFakeServer()
+	s.mechs = "CRAM-MD5 PLAIN"
+	s.users = map[string]string{"user": "pass"}
+	c := s.connect(t)
+	defer c.Close()
+
+	res, err := c.AuthList()
+	if err != nil || string(res.Body) != s.mechs {
+		t.Fatalf("Expected mechanisms %q, got %v/%v", s.mechs, res, err)
+	}
+
+	res, err = c.Auth("user", "wrong")
+	if err == nil || res.Status != gomemcached.AUTH_ERROR {
+		t.Fatalf("Expected AUTH_ERROR, got %v/%v", res, err)
+	}
+
+	if _, err = c.Auth("user", "pass"); err != nil {
+		t.Fatalf("Error authenticating: %v", err)
+	}
+	req := s.lastRequest()
+	if string(req.Key) != "PLAIN" || string(req.Body) != "\x00user\x00pass" {
+		t.Errorf("Unexpected PLAIN request: %q %q", req.Key, req.Body)
+	}
+}
+
+func TestAuthPlainUnsupported(t *testing.T) {
+	s := newFakeServer()
+	s.mechs = "CRAM-MD5"
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Auth("user", "pass"); err == nil {
+		t.Fatalf("Expected an error when PLAIN isn't offered")
+	}
+}
+
+func TestAuthCRAMMD5(t *testing.T) {
+	s := newFakeServer()
+	s.users = map[string]string{"tim": "tanstaaftanstaaf"}
+	// The example exchange from RFC 2195.
+	s.challenge = "<1896.697170952@postoffice.reston.mci.net>"
+	c := s.connect(t)
+	defer c.Close()
+
+	res, err := c.AuthCRAMMD5("tim", "wrong")
+	if err == nil || res.Status != gomemcached.AUTH_ERROR {
+		t.Fatalf("Expected AUTH_ERROR, got %v/%v", res, err)
+	}
+
+	if _, err := c.AuthCRAMMD5("tim", "tanstaaftanstaaf"); err != nil {
+		t.Fatalf("Error authenticating: %v", err)
+	}
+	req := s.lastRequest()
+	exp := "tim b913a602c7eda7a495b4e6e7334d3890"
+	if req.Opcode != gomemcached.SASL_STEP || string(req.Body) != exp {
+		t.Errorf("Expected SASL_STEP with %q, got %v %q", exp, req.Opcode, req.Body)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to be healthy after authenticating")
+	}
+}
+
+func TestSelectBucket(t *testing.T) {
+	s := newFakeServer()
+	s.buckets = map[string]bool{"default": true}
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.SelectBucket("default"); err != nil {
+		t.Fatalf("Error selecting bucket: %v", err)
+	}
+	req := s.lastRequest()
+	if req.Opcode != gomemcached.SELECT_BUCKET || string(req.Key) != "default" {
+		t.Errorf("Expected bucket name as key, got %v", req)
+	}
+
+	_, err := c.SelectBucket("secret")
+	res, ok := err.(*gomemcached.MCResponse)
+	if !ok || res.Status != gomemcached.EACCESS {
+		t.Fatalf("Expected EACCESS, got %v", err)
+	}
+	if c.bucket != "default" {
+		t.Errorf("Expected failed select to keep %q, got %q", "default", c.bucket)
+	}
+}
+
+func TestHello(t *testing.T) {
+	s := newFakeServer()
+	s.features = map[gomemcached.Feature]bool{
+		gomemcached.FEATURE_JSON:       true,
+		gomemcached.FEATURE_TCPNODELAY: true,
+	}
+	c := s.connect(t)
+	defer c.Close()
+
+	got, err := c.Hello("test-agent", gomemcached.FEATURE_TCPNODELAY,
+		gomemcached.FEATURE_SNAPPY, gomemcached.FEATURE_JSON)
+	if err != nil {
+		t.Fatalf("Error in hello: %v", err)
+	}
+
+	req := s.lastRequest()
+	if string(req.Key) != "test-agent" {
+		t.Errorf("Expected agent as key, got %q", req.Key)
+	}
+	expBody := []byte{0, 0x03, 0, 0x0a, 0, 0x0b}
+	if !bytes.Equal(req.Body, expBody) {
+		t.Errorf("Expected body %v, got %v", expBody, req.Body)
+	}
+
+	exp := []gomemcached.Feature{gomemcached.FEATURE_TCPNODELAY, gomemcached.FEATURE_JSON}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+	if !c.HasFeature(gomemcached.FEATURE_JSON) || c.HasFeature(gomemcached.FEATURE_SNAPPY) {
+		t.Errorf("Unexpected negotiated features: %v", *c.features.Load())
+	}
+}
+
+func TestHelloConcurrent(t *testing.T) {
+	s := newFakeServer()
+	s.features = map[gomemcached.Feature]bool{gomemcached.FEATURE_JSON: true}
+	c := s.connect(t)
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if _, err := c.Hello("test", gomemcached.FEATURE_JSON); err != nil {
+				t.Errorf("Error saying hello: %v", err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if !c.HasFeature(gomemcached.FEATURE_JSON) {
+				t.Errorf("Expected FEATURE_JSON to be negotiated")
+			}
+			return
+		default:
+			c.HasFeature(gomemcached.FEATURE_JSON)
+			time.Sleep(time.Microsecond)
+		}
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("hello")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	before := c.ConnStats()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.ConnStats() // safe while the client's in use
+	}()
+	req := &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")}
+	res, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	<-done
+
+	got := c.ConnStats()
+	exp := ConnStats{
+		BytesSent:     before.BytesSent + uint64(req.Size()),
+		BytesReceived: before.BytesReceived + uint64(res.Size()),
+		Ops:           before.Ops + 1,
+	}
+	if got != exp {
+		t.Errorf("Expected %+v after a get, got %+v", exp, got)
+	}
+	if exp.BytesSent != before.BytesSent+25 || exp.BytesReceived != before.BytesReceived+33 {
+		t.Errorf("Expected a 25 byte request and 33 byte response, got %v and %v",
+			req.Size(), res.Size())
+	}
+}
@@ -0,0 +1,143 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Request extras asking GET_META for the extended format, which adds
+// the item's datatype.
+const getMetaExtended = 0x01
+
+// Lengths of GET_META response extras.
+const (
+	getMetaLen         = 20 // deleted, flags, expiration, seqno
+	getMetaExtendedLen = 21 // ... and datatype
+)
+
+// ItemMeta is an item's metadata, as returned by GetMeta.
+type ItemMeta struct {
+	Deleted    bool   // The item is a deletion tombstone
+	Flags      uint32 // Item flags
+	Expiration uint32 // Expiration, as a unix time
+	Seqno      uint64 // Revision sequence number
+	Cas        uint64
+	// Datatype of the value, if the server sent extended metadata.
+	Datatype uint8
+	Extended bool // Datatype is set
+}
+
+// GetMeta gets an item's metadata without its value.
+//
+// Extended metadata is requested, and returned by the servers that
+// support it.  Tombstones of deleted items are found too, with
+// Deleted set.
+func (c *Client) GetMeta(vb uint16, key string) (ItemMeta, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.GET_META,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  []byte{getMetaExtended},
+	})
+	if err != nil {
+		return ItemMeta{}, err
+	}
+	return parseItemMeta(res)
+}
+
+// SetPreserveFlags sets the value for a key, keeping the flags the
+// item already has.  They're read with GetMeta first; a key that
+// doesn't exist (or is only a tombstone) is stored with flags 0.
+//
+// The read and the store aren't atomic, so a concurrent change to
+// the item's flags may be overwritten.
+func (c *Client) SetPreserveFlags(vb uint16, key string, exp int,
+	body []byte) (*gomemcached.MCResponse, error) {
+	var flags uint32
+	meta, err := c.GetMeta(vb, key)
+	switch {
+	case err == nil:
+		if !meta.Deleted {
+			flags = meta.Flags
+		}
+	case !gomemcached.IsNotFound(err):
+		return nil, err
+	}
+	return c.SetOpts(vb, key, body, StoreOptions{Flags: flags, Exp: exp})
+}
+
+// MetaArgs is the metadata a mutation is replayed with by
+// SetWithMeta and DelWithMeta.
+type MetaArgs struct {
+	Flags      uint32 // Item flags
+	Expiration uint32 // Expiration, as a unix time
+	Seqno      uint64 // Revision sequence number
+	Cas        uint64 // CAS the item will have
+}
+
+// Length of the extras MetaArgs encodes to.
+const metaArgsLen = 24
+
+// extras encodes the args as SET_WITH_META and DEL_WITH_META extras.
+func (m MetaArgs) extras() []byte {
+	ex := make([]byte, metaArgsLen)
+	binary.BigEndian.PutUint32(ex[0:4], m.Flags)
+	binary.BigEndian.PutUint32(ex[4:8], m.Expiration)
+	binary.BigEndian.PutUint64(ex[8:16], m.Seqno)
+	binary.BigEndian.PutUint64(ex[16:24], m.Cas)
+	return ex
+}
+
+// SetWithMeta stores a value with the given metadata rather than
+// metadata generated by the server, so tools can replay mutations
+// from elsewhere.
+//
+// The server resolves conflicts with the item it has; if the
+// existing item wins (by seqno or CAS), KEY_EEXISTS is returned.
+func (c *Client) SetWithMeta(vb uint16, key string, meta MetaArgs,
+	body []byte) (*gomemcached.MCResponse, error) {
+	return c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SET_WITH_META,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  meta.extras(),
+		Body:    body,
+	})
+}
+
+// DelWithMeta deletes a value, leaving a tombstone with the given
+// metadata.
+//
+// As with SetWithMeta, KEY_EEXISTS is returned if the existing item
+// wins the conflict.
+func (c *Client) DelWithMeta(vb uint16, key string, meta MetaArgs) (*gomemcached.MCResponse, error) {
+	return c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DEL_WITH_META,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  meta.extras(),
+	})
+}
+
+// parseItemMeta decodes a GET_META response in either format.
+func parseItemMeta(res *gomemcached.MCResponse) (ItemMeta, error) {
+	ex := res.Extras
+	if len(ex) < getMetaLen {
+		return ItemMeta{}, fmt.Errorf("get meta extras is %d bytes, expected at least %d",
+			len(ex), getMetaLen)
+	}
+	m := ItemMeta{
+		Deleted:    binary.BigEndian.Uint32(ex[0:4]) != 0,
+		Flags:      binary.BigEndian.Uint32(ex[4:8]),
+		Expiration: binary.BigEndian.Uint32(ex[8:12]),
+		Seqno:      binary.BigEndian.Uint64(ex[12:20]),
+		Cas:        res.Cas,
+	}
+	if len(ex) >= getMetaExtendedLen {
+		m.Datatype = ex[20]
+		m.Extended = true
+	}
+	return m, nil
+}
@@ -0,0 +1,174 @@
+package memcached
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestParseItemMeta(t *testing.T) {
+	extras := []byte{
+		0x0, 0x0, 0x0, 0x1, // deleted
+		0xde, 0xad, 0xbe, 0xef, // flags
+		0x5f, 0x5e, 0x10, 0x00, // expiration
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x02, // seqno
+	}
+	res := &gomemcached.MCResponse{Cas: 8475, Extras: extras}
+
+	m, err := parseItemMeta(res)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	exp := ItemMeta{
+		Deleted:    true,
+		Flags:      0xdeadbeef,
+		Expiration: 0x5f5e1000,
+		Seqno:      258,
+		Cas:        8475,
+	}
+	if m != exp {
+		t.Errorf("Expected %+v, got %+v", exp, m)
+	}
+
+	res.Extras = append(extras, gomemcached.DATATYPE_JSON)
+	m, err = parseItemMeta(res)
+	if err != nil {
+		t.Fatalf("Error parsing extended: %v", err)
+	}
+	exp.Datatype, exp.Extended = gomemcached.DATATYPE_JSON, true
+	if m != exp {
+		t.Errorf("Expected %+v, got %+v", exp, m)
+	}
+
+	res.Extras = extras[:16]
+	if _, err := parseItemMeta(res); err == nil {
+		t.Errorf("Expected an error for short extras")
+	}
+}
+
+func TestGetMeta(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.GetMeta(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	set, err := c.Set(0, "k", 42, 3600, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	m, err := c.GetMeta(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting meta: %v", err)
+	}
+	if m.Flags != 42 || m.Expiration != 3600 || m.Cas != set.Cas || m.Deleted ||
+		!m.Extended || m.Datatype != gomemcached.DATATYPE_JSON {
+		t.Errorf("Unexpected meta: %+v", m)
+	}
+	if req := s.lastRequest(); len(req.Body) != 0 || len(req.Extras) != 1 {
+		t.Errorf("Expected a value-less request with one byte extras, got %v", req)
+	}
+}
+
+func TestSetPreserveFlags(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "k", 0xbeef, 0, []byte("old")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.SetPreserveFlags(0, "k", 60, []byte("new")); err != nil {
+		t.Fatalf("Error setting with preserved flags: %v", err)
+	}
+	if item := s.item("k"); item.Flags != 0xbeef || string(item.Data) != "new" || item.Expiration != 60 {
+		t.Errorf("Expected new value with flags 0xbeef, got %+v", item)
+	}
+
+	if _, err := c.SetPreserveFlags(0, "missing", 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting a missing key: %v", err)
+	}
+	if item := s.item("missing"); item.Flags != 0 || string(item.Data) != "v" {
+		t.Errorf("Expected flags 0 for a new key, got %+v", item)
+	}
+}
+
+func TestMetaArgsExtras(t *testing.T) {
+	m := MetaArgs{
+		Flags:      0xdeadbeef,
+		Expiration: 0x5f5e1000,
+		Seqno:      258,
+		Cas:        0x0102030405060708,
+	}
+	exp := []byte{
+		0xde, 0xad, 0xbe, 0xef, // flags
+		0x5f, 0x5e, 0x10, 0x00, // expiration
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0x02, // seqno
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, // CAS
+	}
+	if got := m.extras(); !bytes.Equal(got, exp) {
+		t.Errorf("Expected extras %v, got %v", exp, got)
+	}
+}
+
+func TestSetDelWithMeta(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	meta := MetaArgs{Flags: 7, Expiration: 3600, Seqno: 3, Cas: 1000}
+	if _, err := c.SetWithMeta(0, "k", meta, []byte("v")); err != nil {
+		t.Fatalf("Error in SetWithMeta: %v", err)
+	}
+	req := s.lastRequest()
+	if req.Opcode != gomemcached.SET_WITH_META || !bytes.Equal(req.Extras, meta.extras()) ||
+		string(req.Body) != "v" {
+		t.Errorf("Unexpected request: %v", req)
+	}
+	if item := s.item("k"); item.Cas != 1000 || item.Flags != 7 || item.Expiration != 3600 {
+		t.Errorf("Expected metadata preserved, got %+v", item)
+	}
+
+	// An older mutation loses.
+	old := MetaArgs{Seqno: 2, Cas: 999}
+	if _, err := c.SetWithMeta(0, "k", old, []byte("old")); !gomemcached.IsExists(err) {
+		t.Errorf("Expected KEY_EEXISTS for a losing set, got %v", err)
+	}
+	if _, err := c.DelWithMeta(0, "k", old); !gomemcached.IsExists(err) {
+		t.Errorf("Expected KEY_EEXISTS for a losing delete, got %v", err)
+	}
+
+	if _, err := c.DelWithMeta(0, "k", MetaArgs{Seqno: 4, Cas: 1001}); err != nil {
+		t.Fatalf("Error in DelWithMeta: %v", err)
+	}
+	if req := s.lastRequest(); req.Opcode != gomemcached.DEL_WITH_META || len(req.Body) != 0 {
+		t.Errorf("Unexpected request: %v", req)
+	}
+	if _, err := c.Get(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected k deleted, got %v", err)
+	}
+}
+
+func TestSetPreserveFlagsInCollection(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetCollectionID(9)
+
+	if _, err := c.Set(0, "k", 0xbeef, 0, []byte("old")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.SetPreserveFlags(0, "k", 0, []byte("new")); err != nil {
+		t.Fatalf("Error setting with preserved flags: %v", err)
+	}
+	item := s.item(string(CollectionKey(9, "k")))
+	if item.Flags != 0xbeef || string(item.Data) != "new" {
+		t.Errorf("Expected the collection's item's flags kept, got %+v", item)
+	}
+	if item := s.item("k"); item.Data != nil {
+		t.Errorf("Expected nothing outside the collection, got %+v", item)
+	}
+}
@@ -0,0 +1,225 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// MultiError reports the keys that failed in a batch operation.
+//
+// errors.Is and errors.As look through it to the keys' errors, so
+// gomemcached.IsNotFound and friends are true if they are for any key.
+type MultiError struct {
+	errs map[string]error
+}
+
+// Failed keys listed in a MultiError's message before the rest are
+// just counted.
+const multiErrorKeys = 3
+
+func (e *MultiError) Error() string {
+	keys := e.keys()
+	n := len(keys)
+	if n > multiErrorKeys {
+		keys = keys[:multiErrorKeys]
+	}
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("%q: %v", k, e.errs[k])
+	}
+	msg := fmt.Sprintf("%d keys failed: %s", n, strings.Join(msgs, "; "))
+	if n > len(keys) {
+		msg += fmt.Sprintf("; and %d more", n-len(keys))
+	}
+	return msg
+}
+
+// Errors returns the failed keys' errors, by key.
+func (e *MultiError) Errors() map[string]error {
+	rv := make(map[string]error, len(e.errs))
+	for k, err := range e.errs {
+		rv[k] = err
+	}
+	return rv
+}
+
+// Unwrap returns the failed keys' errors, in key order.
+func (e *MultiError) Unwrap() []error {
+	keys := e.keys()
+	rv := make([]error, len(keys))
+	for i, k := range keys {
+		rv[i] = e.errs[k]
+	}
+	return rv
+}
+
+// keys returns the failed keys, sorted.
+func (e *MultiError) keys() []string {
+	keys := make([]string, 0, len(e.errs))
+	for k := range e.errs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// add records a key's failure.
+func (e *MultiError) add(key string, err error) {
+	if e.errs == nil {
+		e.errs = map[string]error{}
+	}
+	e.errs[key] = err
+}
+
+// err returns e, or nil if nothing failed.
+func (e *MultiError) err() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+// SetMulti stores many items, pipelining a SETQ for each and
+// collecting the failures.
+//
+// Each item's Key, Value, Flags, and Expiry are stored; a non-zero Cas
+// makes its store conditional as with SetCas.  Failed keys are
+// reported in a *MultiError, each as a *gomemcached.KeyError (or the
+// client side error that kept it from being sent).  Any other error
+// means the connection failed, and which items were stored is unknown.
+func (c *Client) SetMulti(vb uint16, items []Item) error {
+	reqs := make([]*gomemcached.MCRequest, len(items))
+	for i, it := range items {
+		reqs[i] = storeRequest(gomemcached.SETQ, vb, it.Key, it.Value,
+			StoreOptions{Flags: it.Flags, Exp: it.Expiry, Cas: it.Cas})
+	}
+	return c.pipeline(reqs, nil)
+}
+
+// DeleteMulti deletes many keys, pipelining a DELETEQ for each and
+// collecting the failures as SetMulti does.
+//
+// Keys that don't exist are ignored; use DeleteMultiStrict to have
+// them reported too.
+func (c *Client) DeleteMulti(vb uint16, keys []string) error {
+	return c.deleteMulti(vb, keys, gomemcached.IsNotFound)
+}
+
+// DeleteMultiStrict is DeleteMulti, but reports keys that don't
+// exist as failures (with KEY_ENOENT).
+func (c *Client) DeleteMultiStrict(vb uint16, keys []string) error {
+	return c.deleteMulti(vb, keys, nil)
+}
+
+func (c *Client) deleteMulti(vb uint16, keys []string, ignore func(error) bool) error {
+	reqs := make([]*gomemcached.MCRequest, len(keys))
+	for i, k := range keys {
+		reqs[i] = &gomemcached.MCRequest{
+			Opcode:  gomemcached.DELETEQ,
+			VBucket: vb,
+			Key:     []byte(k),
+		}
+	}
+	return c.pipeline(reqs, ignore)
+}
+
+// TouchMulti updates the expiration of many keys, pipelining a TOUCH
+// for each and collecting the failures as SetMulti does.  Keys that
+// don't exist are reported, with KEY_ENOENT.
+//
+// TOUCH has no quiet form, and GATQ hides misses, so every key gets a
+// response; they're still read in a single round trip.
+func (c *Client) TouchMulti(vb uint16, keys []string, exp int) error {
+	reqs := make([]*gomemcached.MCRequest, len(keys))
+	for i, k := range keys {
+		reqs[i] = &gomemcached.MCRequest{
+			Opcode:  gomemcached.TOUCH,
+			VBucket: vb,
+			Key:     []byte(k),
+			Extras:  make([]byte, 4),
+		}
+		binary.BigEndian.PutUint32(reqs[i].Extras, uint32(exp))
+	}
+	return c.pipeline(reqs, nil)
+}
+
+// pipeline transmits requests followed by a NOOP, and returns the
+// failures, by key, as a *MultiError.  Failures ignore is true for
+// aren't reported.  The requests are usually quiet, but needn't be.
+func (c *Client) pipeline(reqs []*gomemcached.MCRequest, ignore func(error) bool) error {
+	var merr MultiError
+	keys := make(map[uint32]string, len(reqs))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, req := range reqs {
+		req.Opaque = c.nextOpaque()
+		if err := c.checkRequest(req); err != nil {
+			merr.add(string(req.Key), err)
+			continue
+		}
+		if err := c.Transmit(req); err != nil {
+			return err
+		}
+		keys[req.Opaque] = string(req.Key)
+	}
+
+	responses, err := c.ReceiveBatch(c.nextOpaque())
+	for _, res := range responses {
+		key, ok := keys[res.Opaque]
+		if !ok || res.Status == gomemcached.SUCCESS {
+			continue
+		}
+		if ignore != nil && ignore(res) {
+			continue
+		}
+		merr.add(key, &gomemcached.KeyError{Key: key, Res: res})
+	}
+	if err != nil {
+		return err
+	}
+	return merr.err()
+}
+
+// Batch sends arbitrary requests in a single round trip and returns
+// their responses in the same order.
+//
+// Each request is given a new opaque, replacing any it had, so its
+// response can be matched to it; they're all transmitted, followed by
+// a NOOP, and the responses read until the NOOP's comes back.  A
+// quiet request that got no response has nil in its place.  Failure
+// statuses are returned as responses rather than as an error, as
+// with ReceiveBatch.
+//
+// If a request is invalid, nothing is sent and its error returned.
+// If the connection fails, the responses read so far are returned
+// along with the error.
+func (c *Client) Batch(reqs []*gomemcached.MCRequest) ([]*gomemcached.MCResponse, error) {
+	for _, req := range reqs {
+		if err := c.checkRequest(req); err != nil {
+			return nil, err
+		}
+	}
+	index := make(map[uint32]int, len(reqs))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, req := range reqs {
+		req.Opaque = c.nextOpaque()
+		index[req.Opaque] = i
+		if err := c.Transmit(req); err != nil {
+			return nil, err
+		}
+	}
+
+	rv := make([]*gomemcached.MCResponse, len(reqs))
+	responses, err := c.ReceiveBatch(c.nextOpaque())
+	for _, res := range responses {
+		if i, ok := index[res.Opaque]; ok {
+			rv[i] = res
+		}
+	}
+	return rv, err
+}
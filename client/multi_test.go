@@ -0,0 +1,250 @@
+package memcached
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestSetMulti(t *testing.T) {
+	s := newFakeServer()
+	s.maxValue = 8
+	c := s.connect(t)
+	defer c.Close()
+
+	items := []Item{
+		{Key: []byte("a"), Value: []byte("1"), Flags: 3},
+		{Key: []byte("big"), Value: []byte("longer than eight")},
+		{Key: []byte("b"), Value: []byte("2"), Expiry: 60},
+		{Key: []byte("huge"), Value: []byte("also longer than eight")},
+		{Key: []byte(strings.Repeat("k", DefaultMaxKeyLength+1)), Value: []byte("3")},
+	}
+	err := c.SetMulti(0, items)
+	var merr *MultiError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected a MultiError, got %v", err)
+	}
+	errs := merr.Errors()
+	if len(errs) != 3 {
+		t.Errorf("Expected 3 failures, got %v", merr)
+	}
+	for _, k := range []string{"big", "huge"} {
+		var kerr *gomemcached.KeyError
+		if !errors.As(errs[k], &kerr) || kerr.Key != k || kerr.Res.Status != gomemcached.E2BIG {
+			t.Errorf("Expected E2BIG for %v, got %v", k, errs[k])
+		}
+	}
+	if e := errs[string(items[4].Key)]; !errors.Is(e, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong for the long key, got %v", e)
+	}
+
+	if item := s.item("a"); string(item.Data) != "1" || item.Flags != 3 {
+		t.Errorf("Expected a stored, got %+v", item)
+	}
+	if item := s.item("b"); string(item.Data) != "2" || item.Expiration != 60 {
+		t.Errorf("Expected b stored, got %+v", item)
+	}
+
+	if err := c.SetMulti(0, items[:1]); err != nil {
+		t.Errorf("Error in SetMulti: %v", err)
+	}
+	if err := c.SetMulti(0, nil); err != nil {
+		t.Errorf("Error in an empty SetMulti: %v", err)
+	}
+}
+
+func TestDeleteMulti(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		if _, err := c.Set(0, k, 0, 0, []byte(k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	if err := c.DeleteMulti(0, []string{"a", "missing", "b"}); err != nil {
+		t.Fatalf("Error in DeleteMulti: %v", err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if _, err := c.Get(0, k); !gomemcached.IsNotFound(err) {
+			t.Errorf("Expected %v deleted, got %v", k, err)
+		}
+	}
+	if _, err := c.Get(0, "c"); err != nil {
+		t.Errorf("Expected c to remain, got %v", err)
+	}
+
+	err := c.DeleteMultiStrict(0, []string{"c", "missing", ""})
+	var merr *MultiError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected a MultiError, got %v", err)
+	}
+	errs := merr.Errors()
+	if len(errs) != 2 || !gomemcached.IsNotFound(errs["missing"]) || !errors.Is(errs[""], ErrEmptyKey) {
+		t.Errorf("Expected missing and empty keys to fail, got %v", errs)
+	}
+	if _, err := c.Get(0, "c"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected c deleted, got %v", err)
+	}
+}
+
+func TestTouchMulti(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	for _, k := range []string{"a", "b"} {
+		if _, err := c.Set(0, k, 0, 0, []byte(k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	err := c.TouchMulti(0, []string{"a", "missing", "b", "gone"}, 300)
+	var merr *MultiError
+	if !errors.As(err, &merr) {
+		t.Fatalf("Expected a MultiError, got %v", err)
+	}
+	errs := merr.Errors()
+	if len(errs) != 2 || !gomemcached.IsNotFound(errs["missing"]) || !gomemcached.IsNotFound(errs["gone"]) {
+		t.Errorf("Expected the absent keys to fail, got %v", errs)
+	}
+	for _, k := range []string{"a", "b"} {
+		if item := s.item(k); item.Expiration != 300 {
+			t.Errorf("Expected %v touched, got %+v", k, item)
+		}
+	}
+
+	if err := c.TouchMulti(0, []string{"a", "b"}, 600); err != nil {
+		t.Errorf("Error touching present keys: %v", err)
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop after TouchMulti: %v", err)
+	}
+}
+
+func TestMultiError(t *testing.T) {
+	var merr MultiError
+	if err := merr.err(); err != nil {
+		t.Errorf("Expected nil for no failures, got %v", err)
+	}
+	if errs := merr.Errors(); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+
+	notFound := &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	merr.add("b", &gomemcached.KeyError{Key: "b", Res: notFound})
+	merr.add("a", ErrKeyTooLong)
+	err := merr.err()
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	exp := `2 keys failed: "a": key too long; "b": ` + merr.errs["b"].Error()
+	if err.Error() != exp {
+		t.Errorf("Expected %q, got %q", exp, err.Error())
+	}
+
+	// Errors is a copy.
+	merr.Errors()["c"] = ErrEmptyKey
+	if len(merr.errs) != 2 {
+		t.Errorf("Expected Errors to be a copy, got %v", merr.errs)
+	}
+
+	if !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected errors.Is to find ErrKeyTooLong")
+	}
+	if !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected IsNotFound to see through the MultiError")
+	}
+	var kerr *gomemcached.KeyError
+	if !errors.As(err, &kerr) || kerr.Key != "b" {
+		t.Errorf("Expected errors.As to find b's KeyError, got %v", kerr)
+	}
+
+	for _, k := range []string{"c", "d", "e"} {
+		merr.add(k, ErrEmptyKey)
+	}
+	if msg := merr.Error(); !strings.HasPrefix(msg, `5 keys failed: "a"`) ||
+		!strings.HasSuffix(msg, `"c": key required; and 2 more`) {
+		t.Errorf("Unexpected message: %q", msg)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "a", 0, 0, []byte("1")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	reqs := []*gomemcached.MCRequest{
+		{Opcode: gomemcached.GET, Key: []byte("a")},
+		{Opcode: gomemcached.SETQ, Key: []byte("b"), Body: []byte("2"),
+			Extras: make([]byte, 8)},
+		{Opcode: gomemcached.GET, Key: []byte("missing")},
+		{Opcode: gomemcached.DELETE, Key: []byte("a")},
+		{Opcode: gomemcached.GETQ, Key: []byte("missing")},
+		{Opcode: gomemcached.GET, Key: []byte("b")},
+	}
+	got, err := c.Batch(reqs)
+	if err != nil {
+		t.Fatalf("Error sending batch: %v", err)
+	}
+	if len(got) != len(reqs) {
+		t.Fatalf("Expected %d responses, got %v", len(reqs), got)
+	}
+	exp := []struct {
+		status gomemcached.Status
+		body   string
+	}{
+		{gomemcached.SUCCESS, "1"},
+		{},
+		{gomemcached.KEY_ENOENT, ""},
+		{gomemcached.SUCCESS, ""},
+		{},
+		{gomemcached.SUCCESS, "2"},
+	}
+	for i, e := range exp {
+		res := got[i]
+		if reqs[i].Opcode.IsQuiet() {
+			if res != nil {
+				t.Errorf("Expected no response to quiet %v, got %v", reqs[i], res)
+			}
+			continue
+		}
+		if res == nil {
+			t.Errorf("Expected a response to %v", reqs[i])
+			continue
+		}
+		if res.Opcode != reqs[i].Opcode || res.Opaque != reqs[i].Opaque ||
+			res.Status != e.status || string(res.Body) != e.body {
+			t.Errorf("Expected %v %q for %v, got %v", e.status, e.body, reqs[i], res)
+		}
+	}
+	if item := s.item("a"); item.Data != nil {
+		t.Errorf("Expected a to be deleted, got %+v", item)
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	reqs := []*gomemcached.MCRequest{
+		{Opcode: gomemcached.SET, Key: []byte("a"), Body: []byte("1"),
+			Extras: make([]byte, 8)},
+		{Opcode: gomemcached.GET, Key: []byte(strings.Repeat("k", DefaultMaxKeyLength+1))},
+	}
+	if _, err := c.Batch(reqs); !errors.Is(err, ErrKeyTooLong) {
+		t.Fatalf("Expected ErrKeyTooLong, got %v", err)
+	}
+	if item := s.item("a"); item.Data != nil {
+		t.Errorf("Expected nothing sent, but a was stored: %+v", item)
+	}
+}
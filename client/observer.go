@@ -0,0 +1,36 @@
+package memcached
+
+import (
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// OpObserver is told about each request sent by Send (and the methods
+// built on it), for collecting metrics.
+type OpObserver interface {
+	// ObserveOp is called once a request's response has been read
+	// or the exchange has failed.  status is the response's status;
+	// when there's no response it's zero, and err says what went
+	// wrong.  A non-success status is also err.
+	//
+	// It's called with the client locked, so it should be quick.
+	ObserveOp(opcode gomemcached.CommandCode, status gomemcached.Status,
+		latency time.Duration, err error)
+}
+
+// OpObserverFunc adapts a function to an OpObserver.
+type OpObserverFunc func(opcode gomemcached.CommandCode, status gomemcached.Status,
+	latency time.Duration, err error)
+
+// ObserveOp calls f.
+func (f OpObserverFunc) ObserveOp(opcode gomemcached.CommandCode, status gomemcached.Status,
+	latency time.Duration, err error) {
+	f(opcode, status, latency, err)
+}
+
+// SetObserver sets (or, with nil, clears) the client's observer.
+// Without one, requests aren't timed.
+func (c *Client) SetObserver(o OpObserver) {
+	c.observer = o
+}
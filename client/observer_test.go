@@ -0,0 +1,50 @@
+package memcached
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+type observed struct {
+	opcode  gomemcached.CommandCode
+	status  gomemcached.Status
+	latency time.Duration
+	err     error
+}
+
+func TestObserver(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	var ops []observed
+	c.SetObserver(OpObserverFunc(func(opcode gomemcached.CommandCode, status gomemcached.Status,
+		latency time.Duration, err error) {
+		ops = append(ops, observed{opcode, status, latency, err})
+	}))
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	c.Get(0, "missing")
+
+	if len(ops) != 2 {
+		t.Fatalf("Expected 2 observations, got %v", ops)
+	}
+	if o := ops[0]; o.opcode != gomemcached.SET || o.status != gomemcached.SUCCESS ||
+		o.err != nil || o.latency <= 0 {
+		t.Errorf("Unexpected observation of set: %+v", o)
+	}
+	if o := ops[1]; o.opcode != gomemcached.GET || o.status != gomemcached.KEY_ENOENT ||
+		!gomemcached.IsNotFound(o.err) {
+		t.Errorf("Unexpected observation of get: %+v", o)
+	}
+
+	c.SetObserver(nil)
+	c.Noop()
+	if len(ops) != 2 {
+		t.Errorf("Expected no observations once cleared, got %v", ops)
+	}
+}
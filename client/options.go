@@ -0,0 +1,108 @@
+package memcached
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ClientOptions tune the TCP connections made by ConnectWithOptions.
+//
+// The zero value disables Nagle's algorithm, since memcached requests
+// are small and latency sensitive, and enables keepalives so idle
+// pooled connections aren't silently dropped by NATs and load
+// balancers.
+type ClientOptions struct {
+	// How long to wait for a connection.  0 means
+	// DefaultDialTimeout.
+	DialTimeout time.Duration
+	// Interval between keepalive probes on idle connections.  0
+	// means DefaultKeepAlive, and a negative value disables them.
+	KeepAlive time.Duration
+	// Use Nagle's algorithm, batching small writes at the cost of
+	// latency.
+	Nagle bool
+	// Sizes of the client's read and write buffers.  0 means
+	// DefaultReadBufferSize or DefaultWriteBufferSize, and a negative
+	// value reads or writes the connection directly.
+	ReadBufferSize, WriteBufferSize int
+}
+
+// DefaultKeepAlive is the keepalive interval used when ClientOptions
+// doesn't set one.
+var DefaultKeepAlive = 15 * time.Second
+
+// ConnectWithOptions connects to a memcached server, configuring TCP
+// connections as the options say.  Reconnects are configured the same
+// way.
+func ConnectWithOptions(prot, dest string, opts ClientOptions) (*Client, error) {
+	return ConnectWithOptionsContext(context.Background(), prot, dest, opts)
+}
+
+// ConnectWithOptionsContext is ConnectWithOptions, giving up on the
+// dial when ctx is done.
+func ConnectWithOptionsContext(ctx context.Context, prot, dest string, opts ClientOptions) (*Client, error) {
+	timeout := opts.DialTimeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	// Keepalives are set by apply, so the dialer leaves them alone.
+	d := &net.Dialer{Timeout: timeout, KeepAlive: -1}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, prot, dest)
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.apply(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := Wrap(conn)
+	if err == nil {
+		if opts.ReadBufferSize != 0 || opts.WriteBufferSize != 0 {
+			rv.readBufSize = bufferSize(opts.ReadBufferSize, rv.readBufSize)
+			rv.writeBufSize = bufferSize(opts.WriteBufferSize, rv.writeBufSize)
+			rv.setConn(conn)
+		}
+		rv.dial = func() (net.Conn, error) { return dial(context.Background()) }
+	}
+	return rv, err
+}
+
+// bufferSize is the buffer size an option gives, or def if it's 0.
+func bufferSize(opt, def int) int {
+	if opt == 0 {
+		return def
+	}
+	return opt
+}
+
+// apply configures a TCP connection.  Other connections are left
+// as they are.
+func (o ClientOptions) apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tc.SetNoDelay(!o.Nagle); err != nil {
+		return err
+	}
+	if o.KeepAlive < 0 {
+		return tc.SetKeepAlive(false)
+	}
+	period := o.KeepAlive
+	if period == 0 {
+		period = DefaultKeepAlive
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package memcached
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func sockopt(t *testing.T, conn net.Conn, level, opt int) int {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Error getting raw conn: %v", err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatalf("Error in control: %v", err)
+	}
+	if serr != nil {
+		t.Fatalf("Error getting socket option %v: %v", opt, serr)
+	}
+	return v
+}
+
+func TestConnectWithOptions(t *testing.T) {
+	s := newFakeServer()
+	addr := s.listen(t)
+
+	c, err := ConnectWithOptions("tcp", addr, ClientOptions{KeepAlive: 42 * time.Second})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+
+	tc, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("Expected a *net.TCPConn, got %T", c.conn)
+	}
+	if v := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v == 0 {
+		t.Errorf("Expected TCP_NODELAY set")
+	}
+	if v := sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v == 0 {
+		t.Errorf("Expected SO_KEEPALIVE set")
+	}
+	if v := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != 42 {
+		t.Errorf("Expected a 42s keepalive, got %v", v)
+	}
+}
+
+func TestClientOptionsApply(t *testing.T) {
+	s := newFakeServer()
+	conn, err := net.Dial("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	if err := (ClientOptions{Nagle: true, KeepAlive: -1}).apply(conn); err != nil {
+		t.Fatalf("Error applying options: %v", err)
+	}
+	if v := sockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != 0 {
+		t.Errorf("Expected TCP_NODELAY cleared")
+	}
+	if v := sockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != 0 {
+		t.Errorf("Expected SO_KEEPALIVE cleared")
+	}
+
+	// Anything that isn't TCP is left alone.
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	if err := (ClientOptions{}).apply(cconn); err != nil {
+		t.Errorf("Error applying options to a pipe: %v", err)
+	}
+}
+
+func TestConnectWithBufferSizes(t *testing.T) {
+	s := newFakeServer()
+	addr := s.listen(t)
+
+	c, err := ConnectWithOptions("tcp", addr, ClientOptions{ReadBufferSize: 64 * 1024})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if r, ok := c.reader.(*bufio.Reader); !ok || r.Size() != 64*1024 {
+		t.Errorf("Expected a 64KB read buffer, got %T", c.reader)
+	}
+	if c.writer == nil || c.writer.Size() != DefaultWriteBufferSize {
+		t.Errorf("Expected the default write buffer")
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+
+	c, err = ConnectWithOptions("tcp", addr, ClientOptions{ReadBufferSize: -1, WriteBufferSize: -1})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if r, ok := c.reader.(countingReader); !ok || r.r != io.Reader(c.conn) || c.writer != nil {
+		t.Errorf("Expected unbuffered reads and writes, got %T and %v", c.reader, c.writer)
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in unbuffered noop: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package memcached
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolClosed is returned when getting a client from a closed Pool.
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool is a fixed size pool of clients connected to a single server.
+type Pool struct {
+	prot, dest string
+	idle       atomic.Int64 // a time.Duration; see SetIdleTimeout
+
+	mu      sync.Mutex
+	closed  bool
+	clients chan *Client // a nil entry is a slot that needs a new connection
+}
+
+// NewPool dials size connections to dest and returns a Pool of them.
+func NewPool(prot, dest string, size int) (*Pool, error) {
+	p := &Pool{
+		prot:    prot,
+		dest:    dest,
+		clients: make(chan *Client, size),
+	}
+	for i := 0; i < size; i++ {
+		c, err := Connect(prot, dest)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		c.lastUsed = timeNow()
+		p.clients <- c
+	}
+	return p, nil
+}
+
+// SetIdleTimeout has the pool close clients left in it longer than d
+// rather than handing them out again, since servers may reap idle
+// connections.  0, the default, keeps them indefinitely.
+//
+// Idle clients are closed when Get comes to them, or by CloseIdle.
+// It may be changed while the pool is in use.
+func (p *Pool) SetIdleTimeout(d time.Duration) {
+	p.idle.Store(int64(d))
+}
+
+// idleTooLong is true if a client in the pool has passed the idle
+// timeout.
+func (p *Pool) idleTooLong(c *Client) bool {
+	idle := time.Duration(p.idle.Load())
+	return idle > 0 && timeNow().Sub(c.lastUsed) > idle
+}
+
+// CloseIdle closes the clients that have been waiting in the pool
+// longer than the idle timeout, leaving their slots to be redialed
+// when needed.  Call it periodically to free the connections of a
+// pool that's not in use.
+func (p *Pool) CloseIdle() {
+	for n := len(p.clients); n > 0; n-- {
+		var c *Client
+		select {
+		case cl, ok := <-p.clients:
+			if !ok {
+				return
+			}
+			c = cl
+		default:
+			return
+		}
+		if c != nil && p.idleTooLong(c) {
+			c.Close()
+			c = nil
+		}
+		p.release(c)
+	}
+}
+
+// Get a client from the pool, waiting for one to be returned if
+// they're all in use.
+//
+// If the slot's previous client was discarded, or has been idle
+// longer than the idle timeout, a new connection is dialed.
+func (p *Pool) Get() (*Client, error) {
+	c, ok := <-p.clients
+	if !ok {
+		return nil, ErrPoolClosed
+	}
+	if c != nil && p.idleTooLong(c) {
+		c.Close()
+		c = nil
+	}
+	if c == nil {
+		var err error
+		c, err = Connect(p.prot, p.dest)
+		if err != nil {
+			p.release(nil)
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Put a client back into the pool.
+//
+// Clients that aren't healthy are closed rather than reused, and
+// putting nil gives back the slot of a client that was lost, to be
+// redialed.  If the pool is already full, as when a client is put
+// twice or didn't come from it, the client is closed.
+func (p *Pool) Put(c *Client) {
+	if c == nil {
+		p.release(nil)
+		return
+	}
+	if !c.IsHealthy() {
+		c.Close()
+		c = nil
+	} else {
+		c.lastUsed = timeNow()
+	}
+	p.release(c)
+}
+
+// release returns a client, or with nil an empty slot, to the pool.
+// It never blocks with p.mu held: a client that doesn't fit is
+// closed.
+func (p *Pool) release(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		select {
+		case p.clients <- c:
+			return
+		default:
+		}
+	}
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Close the pool and all of the clients in it.
+//
+// Clients that are checked out are closed when they're Put back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.clients)
+	p.mu.Unlock()
+
+	for c := range p.clients {
+		if c != nil {
+			c.Close()
+		}
+	}
+	return nil
+}
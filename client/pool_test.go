@@ -0,0 +1,260 @@
+package memcached
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	s := newFakeServer()
+	p, err := NewPool("tcp", s.listen(t), 4)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := p.Get()
+			if err != nil {
+				t.Errorf("Error getting client: %v", err)
+				return
+			}
+			defer p.Put(c)
+			k := fmt.Sprintf("k%d", i)
+			if _, err := c.Set(0, k, 0, 0, []byte(k)); err != nil {
+				t.Errorf("Error setting %v: %v", k, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.data) != 16 {
+		t.Errorf("Expected 16 items, got %v", len(s.data))
+	}
+}
+
+func TestPoolDiscardsBroken(t *testing.T) {
+	s := newFakeServer()
+	p, err := NewPool("tcp", s.listen(t), 2)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	defer p.Close()
+
+	broken, err := p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	broken.Hijack() // marks it unhealthy
+	p.Put(broken)
+
+	for i := 0; i < 4; i++ {
+		a, err := p.Get()
+		if err != nil {
+			t.Fatalf("Error getting client: %v", err)
+		}
+		b, err := p.Get()
+		if err != nil {
+			t.Fatalf("Error getting client: %v", err)
+		}
+		if a == broken || b == broken {
+			t.Fatalf("Got the broken client back from the pool")
+		}
+		if _, err := a.Noop(); err != nil {
+			t.Errorf("Error on replacement client: %v", err)
+		}
+		p.Put(a)
+		p.Put(b)
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	s := newFakeServer()
+	p, err := NewPool("tcp", s.listen(t), 1)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	p.Close()
+	p.Put(c)
+
+	if _, err := p.Get(); err != ErrPoolClosed {
+		t.Errorf("Expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	now := time.Now()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	s := newFakeServer()
+	p, err := NewPool("tcp", s.listen(t), 1)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	defer p.Close()
+	p.SetIdleTimeout(time.Minute)
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	p.Put(c)
+
+	now = now.Add(30 * time.Second)
+	if got, err := p.Get(); err != nil || got != c {
+		t.Fatalf("Expected the client back within the timeout, got %p (%v)", got, err)
+	}
+	p.Put(c)
+
+	now = now.Add(2 * time.Minute)
+	fresh, err := p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	if fresh == c {
+		t.Fatalf("Expected the idle client to be replaced")
+	}
+	if _, err := c.Noop(); err == nil {
+		t.Errorf("Expected the idle client to be closed")
+	}
+	if _, err := fresh.Noop(); err != nil {
+		t.Errorf("Error on replacement client: %v", err)
+	}
+	p.Put(fresh)
+
+	// CloseIdle closes it without waiting for a Get.
+	p.CloseIdle()
+	if _, err := fresh.Noop(); err != nil {
+		t.Errorf("Expected a recently used client left open: %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	p.CloseIdle()
+	if _, err := fresh.Noop(); err == nil {
+		t.Errorf("Expected CloseIdle to close the idle client")
+	}
+	c, err = p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client after CloseIdle: %v", err)
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error on redialed client: %v", err)
+	}
+	p.Put(c)
+}
+
+func TestPoolOverfull(t *testing.T) {
+	s := newFakeServer()
+	addr := s.listen(t)
+	p, err := NewPool("tcp", addr, 1)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	p.Put(c)
+
+	// Putting it twice, or a client from elsewhere, mustn't block.
+	other, err := Connect("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Put(c)
+		p.Put(other)
+		p.Put(nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Put blocked on a full pool")
+	}
+	if _, err := other.Noop(); err == nil {
+		t.Errorf("Expected the extra client to be closed")
+	}
+
+	closed := make(chan error)
+	go func() { closed <- p.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("Error closing pool: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close blocked after an extra Put")
+	}
+}
+
+func TestPoolPutNil(t *testing.T) {
+	s := newFakeServer()
+	p, err := NewPool("tcp", s.listen(t), 1)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	defer p.Close()
+
+	c, err := p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client: %v", err)
+	}
+	c.Close()
+	p.Put(nil)
+
+	// The slot is redialed.
+	c, err = p.Get()
+	if err != nil {
+		t.Fatalf("Error getting client after putting nil: %v", err)
+	}
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error on redialed client: %v", err)
+	}
+	p.Put(c)
+}
+
+func TestPoolIdleTimeoutConcurrent(t *testing.T) {
+	s := newFakeServer()
+	p, err := NewPool("tcp", s.listen(t), 2)
+	if err != nil {
+		t.Fatalf("Error creating pool: %v", err)
+	}
+	defer p.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			p.SetIdleTimeout(time.Duration(i+1) * time.Hour)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		c, err := p.Get()
+		if err != nil {
+			t.Fatalf("Error getting client: %v", err)
+		}
+		p.Put(c)
+		p.CloseIdle()
+		time.Sleep(time.Microsecond)
+	}
+}
@@ -0,0 +1,77 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrRangeNotSupported is returned by Range from servers without the
+// range extension, which includes Couchbase Server and the usual
+// builds of memcached.
+var ErrRangeNotSupported = errors.New("server doesn't support range gets")
+
+// Range gets up to limit items in a vbucket, in key order, starting
+// with startKey (or the first key after it), using RGET.  A limit of
+// 0 asks for every key from startKey on.
+//
+// If limit items were returned there may be more, and next is the key
+// to start the following page from; otherwise it's "".
+//
+// Only servers with the range extension, some memcached engines,
+// implement RGET.  Others fail with ErrRangeNotSupported.
+func (c *Client) Range(vb uint16, startKey string, limit int) (items []Item, next string, err error) {
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.RGET,
+		VBucket: vb,
+		Key:     []byte(startKey),
+		Extras:  make([]byte, 4),
+	}
+	binary.BigEndian.PutUint32(req.Extras, uint32(limit))
+	if err := c.checkRequest(req); err != nil {
+		return nil, "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req.Opaque = c.nextOpaque()
+	_, err = c.transmit(req)
+	if err == nil {
+		err = c.FlushBuffer()
+	}
+	if err != nil {
+		c.healthy.Store(false)
+		return nil, "", err
+	}
+
+	// Items come in a response each, the last followed by one with
+	// no key, as for STAT.
+	for {
+		res, _, err := c.receive()
+		if gomemcached.IsNotSupported(err) {
+			return nil, "", fmt.Errorf("%w: %v", ErrRangeNotSupported, err)
+		}
+		if err != nil {
+			if err != res {
+				c.healthy.Store(false)
+			}
+			return nil, "", err
+		}
+		if len(res.Key) == 0 {
+			break
+		}
+		it := Item{Key: res.Key, Value: res.Body, Cas: res.Cas}
+		if len(res.Extras) >= 4 {
+			it.Flags = binary.BigEndian.Uint32(res.Extras)
+		}
+		items = append(items, it)
+	}
+
+	if limit > 0 && len(items) == limit {
+		// The smallest key after the last one returned.
+		next = string(items[len(items)-1].Key) + "\x00"
+	}
+	return items, next, nil
+}
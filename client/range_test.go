@@ -0,0 +1,72 @@
+package memcached
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/gomemcached/testserver"
+)
+
+func TestRange(t *testing.T) {
+	s := testserver.New()
+	defer s.Close()
+	c := connectTest(t, s)
+	defer c.Close()
+
+	var exp []string
+	for i := 0; i < 7; i++ {
+		k := fmt.Sprintf("key%02d", i)
+		if _, err := c.Set(0, k, i, 0, []byte(k+"-value")); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+		exp = append(exp, k)
+	}
+
+	var got []string
+	cursor, pages := "key", 0
+	for {
+		items, next, err := c.Range(0, cursor, 3)
+		if err != nil {
+			t.Fatalf("Error getting range from %q: %v", cursor, err)
+		}
+		pages++
+		for _, it := range items {
+			k := string(it.Key)
+			if string(it.Value) != k+"-value" || it.Flags != uint32(len(got)) {
+				t.Errorf("Unexpected item %+v", it)
+			}
+			got = append(got, k)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected keys %v, got %v", exp, got)
+	}
+	if pages != 3 {
+		t.Errorf("Expected 3 pages of 3, got %v", pages)
+	}
+
+	items, next, err := c.Range(0, "key05", 0)
+	if err != nil || len(items) != 2 || next != "" {
+		t.Errorf("Expected the last 2 keys and no cursor, got %v items, %q, %v",
+			len(items), next, err)
+	}
+}
+
+func TestRangeNotSupported(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, _, err := c.Range(0, "", 10); !errors.Is(err, ErrRangeNotSupported) {
+		t.Fatalf("Expected ErrRangeNotSupported, got %v", err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected the client to stay healthy")
+	}
+}
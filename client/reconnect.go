@@ -0,0 +1,151 @@
+package memcached
+
+import (
+	"errors"
+
+	"github.com/couchbase/gomemcached"
+)
+
+var errNoReconnectAddr = errors.New("client has no address to reconnect to")
+
+// ConnectReconnecting connects to a memcached server with automatic
+// reconnects enabled.
+//
+// See SetReconnect.
+func ConnectReconnecting(prot, dest string) (*Client, error) {
+	c, err := Connect(prot, dest)
+	if err != nil {
+		return nil, err
+	}
+	c.SetReconnect(true, false)
+	return c, nil
+}
+
+// SetReconnect controls automatic reconnects.
+//
+// When enabled, a Send that fails because of a connection error
+// (rather than a server status) redials the server once and retries
+// the request once.  Only requests that are safe to repeat are
+// retried unless retryMutations is true, since a mutation may have
+// been applied before the connection failed.
+//
+// The new connection is set up as the old one was before the request
+// is retried: the last Hello, Auth, and SelectBucket to succeed are
+// repeated, in that order, followed by any SetReconnectSetup hook.
+//
+// Only clients that dialed their own connection (rather than being
+// created with Wrap) know how to redial.
+func (c *Client) SetReconnect(enabled, retryMutations bool) {
+	c.reconnect = enabled
+	c.retryMutations = retryMutations
+}
+
+// SetReconnectSetup sets a hook run on each new connection made by an
+// automatic reconnect, for session setup beyond what the client
+// repeats itself (see SetReconnect).  A nil hook clears it.
+//
+// setup is given a client for the new connection, whose methods it
+// can use as usual; it mustn't use the reconnecting client, which is
+// locked.  If it fails, the new connection is closed and the request
+// fails with the error that prompted the reconnect.
+func (c *Client) SetReconnectSetup(setup func(*Client) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setup = setup
+}
+
+// registerSetup records a step to repeat on reconnecting, replacing
+// any registered in the same place before.
+func (c *Client) registerSetup(step *func(*Client) error, f func(*Client) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*step = f
+}
+
+// isIdempotent is true for commands that can safely be repeated.
+func isIdempotent(opcode gomemcached.CommandCode) bool {
+	switch opcode {
+	case gomemcached.GET, gomemcached.GETK, gomemcached.GET_REPLICA,
+		gomemcached.NOOP, gomemcached.VERSION, gomemcached.STAT,
+		gomemcached.SASL_LIST_MECHS, gomemcached.SELECT_BUCKET,
+		gomemcached.OBSERVE:
+		return true
+	}
+	return false
+}
+
+// shouldRetry is true if a Send should be retried on a new
+// connection after failing with err.
+func (c *Client) shouldRetry(req *gomemcached.MCRequest, err error) bool {
+	if !c.reconnect || err == nil || c.dial == nil {
+		return false
+	}
+	var res *gomemcached.MCResponse
+	if errors.As(err, &res) {
+		// The server answered; the connection is fine.
+		return false
+	}
+	return c.retryMutations || isIdempotent(req.Opcode)
+}
+
+// redial replaces the client's connection with a new one to the
+// same server, set up the way the old one was.
+//
+// c.mu must be held.
+func (c *Client) redial() error {
+	if c.dial == nil {
+		return errNoReconnectAddr
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	// The setup runs on a client of its own, so it can use the
+	// usual methods without c.mu.
+	nc := &Client{
+		maxBody:      c.maxBody,
+		maxKey:       c.maxKey,
+		checkExtras:  c.checkExtras,
+		errMap:       c.errMap,
+		logger:       c.logger,
+		logLevel:     c.logLevel,
+		readBufSize:  c.readBufSize,
+		writeBufSize: c.writeBufSize,
+	}
+	nc.setConn(conn)
+	if err := c.setUp(nc); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.wmu.Lock()
+	c.conn.Close()
+	c.setConn(conn)
+	c.wmu.Unlock()
+	c.features.Store(nc.features.Load())
+	c.counters.sent.Add(nc.counters.sent.Load())
+	c.counters.received.Add(nc.counters.received.Load())
+	c.counters.ops.Add(nc.counters.ops.Load())
+	return nil
+}
+
+// setUp repeats the client's session setup on nc.
+func (c *Client) setUp(nc *Client) error {
+	for _, step := range []func(*Client) error{c.helloSetup, c.authSetup} {
+		if step != nil {
+			if err := step(nc); err != nil {
+				return err
+			}
+		}
+	}
+	if c.bucket != "" {
+		if _, err := nc.SelectBucket(c.bucket); err != nil {
+			return err
+		}
+	}
+	if c.setup != nil {
+		return c.setup(nc)
+	}
+	return nil
+}
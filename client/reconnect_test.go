@@ -0,0 +1,281 @@
+package memcached
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	mcserver "github.com/couchbase/gomemcached/server"
+)
+
+func TestReconnect(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	s.dropConnections()
+
+	res, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Expected get to succeed after reconnect, got %v", err)
+	}
+	if string(res.Body) != "v" {
+		t.Errorf("Expected v, got %q", res.Body)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to be healthy after reconnect")
+	}
+}
+
+func TestReconnectSelectsBucket(t *testing.T) {
+	s := newFakeServer()
+	s.buckets = map[string]bool{"b": true}
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.SelectBucket("b"); err != nil {
+		t.Fatalf("Error selecting bucket: %v", err)
+	}
+
+	s.dropConnections()
+	s.mu.Lock()
+	before := len(s.reqs)
+	s.mu.Unlock()
+
+	if _, err := c.Noop(); err != nil {
+		t.Fatalf("Expected noop to succeed after reconnect, got %v", err)
+	}
+
+	s.mu.Lock()
+	reqs := s.reqs[before:]
+	s.mu.Unlock()
+	if len(reqs) != 2 || reqs[0].Opcode != gomemcached.SELECT_BUCKET ||
+		string(reqs[0].Key) != "b" || reqs[1].Opcode != gomemcached.NOOP {
+		t.Errorf("Expected bucket to be selected before the retry, got %v", reqs)
+	}
+}
+
+func TestReconnectSkipsMutations(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Noop(); err != nil {
+		t.Fatalf("Error on noop: %v", err)
+	}
+
+	s.dropConnections()
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err == nil {
+		t.Fatalf("Expected set to fail without retrying")
+	}
+
+	c.SetReconnect(true, true)
+	s.dropConnections()
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Expected set to be retried, got %v", err)
+	}
+}
+
+func TestNoReconnectForStatus(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.Get(0, "missing")
+	if !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	s.mu.Lock()
+	n := len(s.conns)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected a single connection, got %v", n)
+	}
+}
+
+func TestReconnectSetup(t *testing.T) {
+	s := newFakeServer()
+	s.mechs = "PLAIN"
+	s.users = map[string]string{"user": "pass"}
+	s.buckets = map[string]bool{"b": true}
+	s.features = map[gomemcached.Feature]bool{gomemcached.FEATURE_JSON: true}
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Hello("agent", gomemcached.FEATURE_JSON); err != nil {
+		t.Fatalf("Error in hello: %v", err)
+	}
+	if _, err := c.Auth("user", "pass"); err != nil {
+		t.Fatalf("Error authenticating: %v", err)
+	}
+	if _, err := c.SelectBucket("b"); err != nil {
+		t.Fatalf("Error selecting bucket: %v", err)
+	}
+	setups := 0
+	c.SetReconnectSetup(func(nc *Client) error {
+		setups++
+		_, err := nc.Version()
+		return err
+	})
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	s.dropConnections()
+	s.mu.Lock()
+	before := len(s.reqs)
+	s.features = nil
+	s.mu.Unlock()
+
+	if _, err := c.Get(0, "k"); err != nil {
+		t.Fatalf("Expected get to succeed after reconnect, got %v", err)
+	}
+	if setups != 1 {
+		t.Errorf("Expected the setup hook to run once, ran %v times", setups)
+	}
+
+	s.mu.Lock()
+	var got []gomemcached.CommandCode
+	for _, req := range s.reqs[before:] {
+		got = append(got, req.Opcode)
+	}
+	s.mu.Unlock()
+	exp := []gomemcached.CommandCode{gomemcached.HELLO, gomemcached.SASL_LIST_MECHS,
+		gomemcached.SASL_AUTH, gomemcached.SELECT_BUCKET, gomemcached.VERSION, gomemcached.GET}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected setup before the retry, %v; got %v", exp, got)
+	}
+	if c.HasFeature(gomemcached.FEATURE_JSON) {
+		t.Errorf("Expected the features the new connection negotiated")
+	}
+}
+
+func TestReconnectSetupFails(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	errSetup := errors.New("setup failed")
+	c.SetReconnectSetup(func(*Client) error { return errSetup })
+	if _, err := c.Noop(); err != nil {
+		t.Fatalf("Error on noop: %v", err)
+	}
+
+	s.dropConnections()
+	if _, err := c.Noop(); err == nil {
+		t.Fatalf("Expected the noop to fail when setup does")
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected the client to be unhealthy")
+	}
+}
+
+// unresponsiveServer reads requests but never answers them, except
+// that it hangs up on the first connection after its first request if
+// dropFirst is set.  It counts the connections it accepts.
+func unresponsiveServer(t *testing.T, dropFirst bool) (string, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			n := accepted.Add(1)
+			go func() {
+				for {
+					if _, err := mcserver.ReadPacket(conn); err != nil {
+						return
+					}
+					if dropFirst && n == 1 {
+						conn.Close()
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestReconnectSendContextCancel(t *testing.T) {
+	addr, accepted := unresponsiveServer(t, false)
+	c, err := ConnectReconnecting("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	if err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Took too long to cancel: %v", d)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Expected a cancelled request not to reconnect, got %v connections", n)
+	}
+}
+
+func TestReconnectSendContextDeadline(t *testing.T) {
+	// The retry goes to a connection that never answers, and must
+	// still give up at the context's deadline.
+	addr, accepted := unresponsiveServer(t, true)
+	c, err := ConnectReconnecting("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Took too long to time out: %v", d)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("Expected the request to be retried on a new connection, got %v connections", n)
+	}
+}
@@ -0,0 +1,79 @@
+package memcached
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// RetryPolicy says how requests failing with a temporary failure
+// (TMPFAIL) are retried.
+//
+// Servers return TMPFAIL under memory pressure or while a vbucket is
+// moving, and expect clients to back off and try again.
+type RetryPolicy struct {
+	// Attempts allowed per request, including the first.  Values
+	// below 2 disable retries.
+	MaxAttempts int
+	// Delay before the first retry.
+	Backoff time.Duration
+	// Each later delay is the previous one times Multiplier.  Values
+	// of 1 or less keep the delay constant.
+	Multiplier float64
+	// Upper bound on a single delay, if not zero.
+	MaxBackoff time.Duration
+	// Fraction (0 to 1) of each delay that's randomized, so clients
+	// don't retry in lockstep.
+	Jitter float64
+}
+
+// delay returns how long to wait before the given retry (starting at
+// 1).
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	d := float64(p.Backoff)
+	if p.Multiplier > 1 {
+		d *= math.Pow(p.Multiplier, float64(retry-1))
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d -= d * math.Min(p.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// SetRetryPolicy makes Send, and the methods built on it, retry
+// requests that fail with TMPFAIL according to the given policy.
+// Other statuses and connection errors are returned immediately.
+//
+// A nil policy disables retries, which is the default.
+func (c *Client) SetRetryPolicy(p *RetryPolicy) {
+	c.retry = p
+}
+
+// retrying calls send until it returns something other than TMPFAIL
+// or the retry policy gives up, waiting between attempts.  The wait
+// ends early if ctx does, returning the last failure.
+//
+// c.mu must not be held, so other requests may proceed meanwhile.
+func (c *Client) retrying(ctx context.Context,
+	send func() (*gomemcached.MCResponse, error)) (*gomemcached.MCResponse, error) {
+
+	p := c.retry
+	res, err := send()
+	for i := 1; p != nil && i < p.MaxAttempts && gomemcached.IsTempFail(err); i++ {
+		t := time.NewTimer(p.delay(i))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return res, err
+		}
+		res, err = send()
+	}
+	return res, err
+}
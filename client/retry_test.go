@@ -0,0 +1,132 @@
+package memcached
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestRetryTempFail(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond})
+
+	s.mu.Lock()
+	s.tmpfails = 3
+	s.mu.Unlock()
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Expected set to succeed after retries, got %v", err)
+	}
+	s.mu.Lock()
+	n := len(s.reqs)
+	s.mu.Unlock()
+	if n != 4 {
+		t.Errorf("Expected 4 attempts, got %v", n)
+	}
+	if got := s.item("k"); string(got.Data) != "v" {
+		t.Errorf("Expected v stored, got %q", got.Data)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	s.mu.Lock()
+	s.tmpfails = 10
+	s.mu.Unlock()
+
+	_, err := c.Get(0, "k")
+	if !gomemcached.IsTempFail(err) {
+		t.Fatalf("Expected TMPFAIL, got %v", err)
+	}
+	s.mu.Lock()
+	n := len(s.reqs)
+	s.mu.Unlock()
+	if n != 3 {
+		t.Errorf("Expected 3 attempts, got %v", n)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+}
+
+func TestRetryPassesThrough(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond})
+
+	_, err := c.Get(0, "missing")
+	if !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+	s.mu.Lock()
+	n := len(s.reqs)
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected a single attempt, got %v", n)
+	}
+}
+
+func TestRetryDisabled(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	s.mu.Lock()
+	s.tmpfails = 1
+	s.mu.Unlock()
+
+	if _, err := c.Get(0, "k"); !gomemcached.IsTempFail(err) {
+		t.Fatalf("Expected TMPFAIL without a policy, got %v", err)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 5, Backoff: time.Hour})
+
+	s.mu.Lock()
+	s.tmpfails = 10
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.SendContext(ctx, &gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("k"),
+	})
+	if !gomemcached.IsTempFail(err) {
+		t.Errorf("Expected the last TMPFAIL, got %v", err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{
+		Backoff:    10 * time.Millisecond,
+		Multiplier: 2,
+		MaxBackoff: 50 * time.Millisecond,
+	}
+	exp := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range exp {
+		if got := p.delay(i + 1); got != e*time.Millisecond {
+			t.Errorf("Expected delay %v for retry %v, got %v", e*time.Millisecond, i+1, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 1; i < 10; i++ {
+		if d := p.delay(1); d < 5*time.Millisecond || d > 10*time.Millisecond {
+			t.Errorf("Expected jittered delay within [5ms, 10ms], got %v", d)
+		}
+	}
+}
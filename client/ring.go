@@ -0,0 +1,242 @@
+package memcached
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// ErrNoServers is returned when a Ring has no healthy node for a key.
+var ErrNoServers = errors.New("no servers available")
+
+// Number of points each node gets on the ring.  Ketama uses 40 md5
+// digests of 4 points each.
+const ringPointsPerNode = 160
+
+type ringPoint struct {
+	hash uint32
+	node string
+}
+
+// Ring spreads keys across several servers using ketama style
+// consistent hashing, so adding or removing a node only remaps the
+// keys that belong to it.
+//
+// Keys whose node is unhealthy are routed to the next healthy node
+// on the ring.  Ring methods don't use vbuckets; requests are sent
+// with vbucket 0.
+type Ring struct {
+	mu     sync.RWMutex
+	nodes  map[string]*Client
+	points []ringPoint // sorted by hash
+}
+
+// NewRing returns a Ring of the given clients, keyed by node name
+// (typically the server address).
+func NewRing(nodes map[string]*Client) *Ring {
+	r := &Ring{nodes: map[string]*Client{}}
+	for name, c := range nodes {
+		r.nodes[name] = c
+	}
+	r.rebuild()
+	return r
+}
+
+// ConnectRing connects to each of the given servers and returns a Ring
+// of them.
+func ConnectRing(prot string, dests []string) (*Ring, error) {
+	nodes := map[string]*Client{}
+	for _, dest := range dests {
+		c, err := Connect(prot, dest)
+		if err != nil {
+			for _, c := range nodes {
+				c.Close()
+			}
+			return nil, err
+		}
+		nodes[dest] = c
+	}
+	return NewRing(nodes), nil
+}
+
+// AddNode adds a node to the ring, replacing any node of the same
+// name.
+func (r *Ring) AddNode(name string, c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes[name] = c
+	r.rebuild()
+}
+
+// RemoveNode removes a node from the ring, returning its client (if
+// any) so the caller can close it.
+func (r *Ring) RemoveNode(name string) *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.nodes[name]
+	delete(r.nodes, name)
+	r.rebuild()
+	return c
+}
+
+// Close every node's client.
+func (r *Ring) Close() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var rv error
+	for _, c := range r.nodes {
+		if err := c.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	return rv
+}
+
+// rebuild recomputes the points with r.mu held.
+func (r *Ring) rebuild() {
+	points := make([]ringPoint, 0, len(r.nodes)*ringPointsPerNode)
+	for name := range r.nodes {
+		for i := 0; i < ringPointsPerNode/4; i++ {
+			d := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				points = append(points, ringPoint{
+					hash: binary.LittleEndian.Uint32(d[4*j:]),
+					node: name,
+				})
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].node < points[j].node
+		}
+		return points[i].hash < points[j].hash
+	})
+	r.points = points
+}
+
+func ringHash(key string) uint32 {
+	d := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(d[:4])
+}
+
+// Node returns the name and client of the node that owns the key.
+func (r *Ring) Node(key string) (string, *Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	tried := map[string]bool{}
+	for i := 0; i < len(r.points) && len(tried) < len(r.nodes); i++ {
+		name := r.points[(start+i)%len(r.points)].node
+		if tried[name] {
+			continue
+		}
+		tried[name] = true
+		if c := r.nodes[name]; c != nil && c.IsHealthy() {
+			return name, c, nil
+		}
+	}
+	return "", nil, ErrNoServers
+}
+
+func (r *Ring) client(key string) (*Client, error) {
+	_, c, err := r.Node(key)
+	return c, err
+}
+
+// Get the value for a key from its node.
+func (r *Ring) Get(key string) (*gomemcached.MCResponse, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Get(0, key)
+}
+
+// GetBulk gets keys in bulk, batching the keys for each node.
+func (r *Ring) GetBulk(keys []string) (map[string]*gomemcached.MCResponse, error) {
+	byNode := map[*Client][]string{}
+	for _, k := range keys {
+		c, err := r.client(k)
+		if err != nil {
+			return nil, err
+		}
+		byNode[c] = append(byNode[c], k)
+	}
+
+	rv := make(map[string]*gomemcached.MCResponse, len(keys))
+	for c, ks := range byNode {
+		m, err := c.GetBulk(0, ks)
+		for k, res := range m {
+			rv[k] = res
+		}
+		if err != nil {
+			return rv, err
+		}
+	}
+	return rv, nil
+}
+
+// Set the value for a key on its node.
+func (r *Ring) Set(key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Set(0, key, flags, exp, body)
+}
+
+// Add a value for a key on its node (store if not exists).
+func (r *Ring) Add(key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Add(0, key, flags, exp, body)
+}
+
+// Replace the value for a key on its node (store only if exists).
+func (r *Ring) Replace(key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Replace(0, key, flags, exp, body)
+}
+
+// Del deletes a key from its node.
+func (r *Ring) Del(key string) (*gomemcached.MCResponse, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.Del(0, key)
+}
+
+// Incr increments the value at the given key on its node.
+func (r *Ring) Incr(key string, amt, def uint64, exp int) (uint64, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Incr(0, key, amt, def, exp)
+}
+
+// Decr decrements the value at the given key on its node.
+func (r *Ring) Decr(key string, amt, def uint64, exp int) (uint64, error) {
+	c, err := r.client(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.Decr(0, key, amt, def, exp)
+}
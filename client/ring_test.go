@@ -0,0 +1,190 @@
+package memcached
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ringKeys maps keys to node names.
+func ringKeys(t *testing.T, r *Ring, n int) map[string]string {
+	rv := map[string]string{}
+	for i := 0; i < n; i++ {
+		k := "key-" + strconv.Itoa(i)
+		name, _, err := r.Node(k)
+		if err != nil {
+			t.Fatalf("Error finding node for %v: %v", k, err)
+		}
+		rv[k] = name
+	}
+	return rv
+}
+
+func testRingNodes(names ...string) map[string]*Client {
+	nodes := map[string]*Client{}
+	for _, name := range names {
+		nodes[name] = NewClient(new(tracked))
+	}
+	return nodes
+}
+
+func TestRingDistribution(t *testing.T) {
+	r := NewRing(testRingNodes("a:11211", "b:11211", "c:11211", "d:11211"))
+
+	const n = 10000
+	before := ringKeys(t, r, n)
+	counts := map[string]int{}
+	for _, name := range before {
+		counts[name]++
+	}
+	for name, count := range counts {
+		if count < n/8 || count > n/2 {
+			t.Errorf("Uneven distribution: %v has %d of %d keys", name, count, n)
+		}
+	}
+
+	// Adding a node only moves keys to it.
+	r.AddNode("e:11211", NewClient(new(tracked)))
+	after := ringKeys(t, r, n)
+	moved := 0
+	for k, name := range after {
+		if name != before[k] {
+			moved++
+			if name != "e:11211" {
+				t.Fatalf("Key %v moved from %v to %v", k, before[k], name)
+			}
+		}
+	}
+	if moved < n/10 || moved > n*3/10 {
+		t.Errorf("Expected about a fifth of the keys to move, moved %d of %d", moved, n)
+	}
+
+	// Removing it again restores the original mapping.
+	r.RemoveNode("e:11211")
+	for k, name := range ringKeys(t, r, n) {
+		if name != before[k] {
+			t.Fatalf("Key %v mapped to %v, expected %v", k, name, before[k])
+		}
+	}
+}
+
+func TestRingSkipsUnhealthy(t *testing.T) {
+	nodes := testRingNodes("a:11211", "b:11211", "c:11211")
+	r := NewRing(nodes)
+
+	before := ringKeys(t, r, 1000)
+	nodes["b:11211"].healthy.Store(false)
+	for k, name := range ringKeys(t, r, 1000) {
+		switch {
+		case name == "b:11211":
+			t.Fatalf("Key %v routed to unhealthy node", k)
+		case before[k] != "b:11211" && name != before[k]:
+			t.Fatalf("Key %v moved from healthy %v to %v", k, before[k], name)
+		}
+	}
+
+	for _, c := range nodes {
+		c.healthy.Store(false)
+	}
+	if _, _, err := r.Node("x"); err != ErrNoServers {
+		t.Errorf("Expected ErrNoServers, got %v", err)
+	}
+	if _, _, err := NewRing(nil).Node("x"); err != ErrNoServers {
+		t.Errorf("Expected ErrNoServers from an empty ring, got %v", err)
+	}
+}
+
+func TestRingRouting(t *testing.T) {
+	servers := map[string]*fakeServer{}
+	nodes := map[string]*Client{}
+	for _, name := range []string{"a", "b", "c"} {
+		s := newFakeServer()
+		servers[name] = s
+		nodes[name] = s.connect(t)
+	}
+	r := NewRing(nodes)
+	defer r.Close()
+
+	var keys []string
+	for i := 0; i < 50; i++ {
+		k := "key-" + strconv.Itoa(i)
+		keys = append(keys, k)
+		if _, err := r.Set(k, 0, 0, []byte("val-"+k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+
+	for _, k := range keys {
+		name, _, err := r.Node(k)
+		if err != nil {
+			t.Fatalf("Error finding node for %v: %v", k, err)
+		}
+		for sname, s := range servers {
+			if has := s.item(k).Data != nil; has != (sname == name) {
+				t.Errorf("Key %v on %v: %v, expected node %v", k, sname, has, name)
+			}
+		}
+		res, err := r.Get(k)
+		if err != nil || string(res.Body) != "val-"+k {
+			t.Errorf("Expected val-%v, got %v/%v", k, res, err)
+		}
+	}
+
+	got, err := r.GetBulk(append(keys, "missing"))
+	if err != nil || len(got) != len(keys) {
+		t.Fatalf("Expected %d keys from GetBulk, got %d/%v", len(keys), len(got), err)
+	}
+
+	if _, err := r.Del(keys[0]); err != nil {
+		t.Errorf("Error deleting: %v", err)
+	}
+	if _, err := r.Get(keys[0]); err == nil {
+		t.Errorf("Expected %v to be deleted", keys[0])
+	}
+}
+
+// Run with -race: Node checks its members' health while they're in
+// use.
+func TestRingNodeConcurrent(t *testing.T) {
+	servers := map[string]*fakeServer{"a": newFakeServer(), "b": newFakeServer()}
+	nodes := map[string]*Client{}
+	for name, s := range servers {
+		c := s.connect(t)
+		defer c.Close()
+		nodes[name] = c
+	}
+	r := NewRing(nodes)
+
+	var wg sync.WaitGroup
+	for name, c := range nodes {
+		wg.Add(1)
+		go func(name string, c *Client) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				c.Set(0, "k", 0, 0, []byte("v"))
+				if name == "b" && i == 25 {
+					// Sends fail from here, marking b unhealthy.
+					servers[name].dropConnections()
+				}
+			}
+		}(name, c)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for n := 0; ; n++ {
+		select {
+		case <-done:
+			if name, _, err := r.Node("key-" + strconv.Itoa(n)); err != nil || name != "a" {
+				t.Errorf("Expected keys routed to a once b failed, got %v/%v", name, err)
+			}
+			return
+		default:
+			r.Node("key-" + strconv.Itoa(n))
+			time.Sleep(time.Microsecond)
+		}
+	}
+}
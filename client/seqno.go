@@ -0,0 +1,115 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// SeqNoObservation is a vbucket's state, as returned by
+// ObserveSeqNo.
+type SeqNoObservation struct {
+	VBUUID         uint64 // Current vbucket UUID
+	PersistedSeqNo uint64 // Last seqno persisted to disk
+	CurrentSeqNo   uint64 // Last seqno in memory
+
+	// Set if the vbucket failed over since the UUID given to
+	// ObserveSeqNo.  LastReceivedSeqNo is the last seqno the old
+	// UUID's history got to before the failover; anything after it
+	// was lost.
+	FailedOver        bool
+	OldVBUUID         uint64
+	LastReceivedSeqNo uint64
+}
+
+// Lengths of OBSERVE_SEQNO response bodies.
+const (
+	observeSeqNoLen         = 27 // format, vbucket, uuid, persisted and current seqnos
+	observeSeqNoFailoverLen = 43 // ... and the old uuid and its last seqno
+)
+
+// ObserveSeqNo gets a vbucket's persisted and current seqnos.
+//
+// vbUUID is the UUID of the vbucket's history the caller knows, as
+// returned with a mutation's seqno.  If the vbucket has since failed
+// over, FailedOver is set.
+func (c *Client) ObserveSeqNo(vb uint16, vbUUID uint64) (*SeqNoObservation, error) {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, vbUUID)
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.OBSERVE_SEQNO,
+		VBucket: vb,
+		Body:    body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseSeqNoObservation(res.Body)
+}
+
+func parseSeqNoObservation(b []byte) (*SeqNoObservation, error) {
+	if len(b) < observeSeqNoLen {
+		return nil, fmt.Errorf("observe seqno body is %d bytes, expected at least %d",
+			len(b), observeSeqNoLen)
+	}
+	o := &SeqNoObservation{
+		VBUUID:         binary.BigEndian.Uint64(b[3:11]),
+		PersistedSeqNo: binary.BigEndian.Uint64(b[11:19]),
+		CurrentSeqNo:   binary.BigEndian.Uint64(b[19:27]),
+	}
+	if b[0] != 0 {
+		if len(b) < observeSeqNoFailoverLen {
+			return nil, fmt.Errorf("observe seqno failover body is %d bytes, expected %d",
+				len(b), observeSeqNoFailoverLen)
+		}
+		o.FailedOver = true
+		o.OldVBUUID = binary.BigEndian.Uint64(b[27:35])
+		o.LastReceivedSeqNo = binary.BigEndian.Uint64(b[35:43])
+	}
+	return o, nil
+}
+
+// Errors from WaitForPersistence.
+var (
+	ErrPersistenceTimeout = errors.New("timed out waiting for persistence")
+	ErrRolledBack         = errors.New("mutation lost in a failover")
+)
+
+// How often WaitForPersistence polls.
+var persistencePoll = 10 * time.Millisecond
+
+// WaitForPersistence waits until a vbucket has persisted the mutation
+// with the given seqno, polling with ObserveSeqNo.
+//
+// vbUUID is the vbucket UUID returned with the mutation.  If the
+// vbucket failed over before persisting the mutation, it's lost and
+// ErrRolledBack is returned.  ErrPersistenceTimeout is returned if it
+// isn't persisted within timeout.
+func (c *Client) WaitForPersistence(vb uint16, vbUUID, seqno uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		o, err := c.ObserveSeqNo(vb, vbUUID)
+		if err != nil {
+			return err
+		}
+		if o.FailedOver {
+			if o.LastReceivedSeqNo < seqno {
+				return fmt.Errorf("%w: vbucket %d's history ended at %d, before %d",
+					ErrRolledBack, vb, o.LastReceivedSeqNo, seqno)
+			}
+			// The mutation survived into the new history.
+			vbUUID = o.VBUUID
+		}
+		if o.PersistedSeqNo >= seqno {
+			return nil
+		}
+		if !time.Now().Add(persistencePoll).Before(deadline) {
+			return fmt.Errorf("%w: vbucket %d has persisted %d of %d",
+				ErrPersistenceTimeout, vb, o.PersistedSeqNo, seqno)
+		}
+		time.Sleep(persistencePoll)
+	}
+}
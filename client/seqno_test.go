@@ -0,0 +1,85 @@
+package memcached
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestObserveSeqNo(t *testing.T) {
+	s := newFakeServer()
+	s.vbuuid, s.seqno, s.persisted = 0xabc, 10, 7
+	c := s.connect(t)
+	defer c.Close()
+
+	o, err := c.ObserveSeqNo(3, 0xabc)
+	if err != nil {
+		t.Fatalf("Error observing seqno: %v", err)
+	}
+	exp := SeqNoObservation{VBUUID: 0xabc, PersistedSeqNo: 7, CurrentSeqNo: 10}
+	if *o != exp {
+		t.Errorf("Expected %+v, got %+v", exp, *o)
+	}
+	if req := s.lastRequest(); req.VBucket != 3 || len(req.Body) != 8 {
+		t.Errorf("Unexpected request: %v", req)
+	}
+
+	s.oldSeqno = 5
+	o, err = c.ObserveSeqNo(3, 0x123)
+	if err != nil {
+		t.Fatalf("Error observing seqno: %v", err)
+	}
+	exp = SeqNoObservation{VBUUID: 0xabc, PersistedSeqNo: 7, CurrentSeqNo: 10,
+		FailedOver: true, OldVBUUID: 0x123, LastReceivedSeqNo: 5}
+	if *o != exp {
+		t.Errorf("Expected %+v, got %+v", exp, *o)
+	}
+
+	if _, err := parseSeqNoObservation(make([]byte, 20)); err == nil {
+		t.Errorf("Expected an error from a short body")
+	}
+	short := make([]byte, observeSeqNoLen)
+	short[0] = 1
+	if _, err := parseSeqNoObservation(short); err == nil {
+		t.Errorf("Expected an error from a short failover body")
+	}
+}
+
+func TestWaitForPersistence(t *testing.T) {
+	defer func(d time.Duration) { persistencePoll = d }(persistencePoll)
+	persistencePoll = time.Millisecond
+
+	s := newFakeServer()
+	s.vbuuid, s.seqno, s.persistStep = 0xabc, 100, 10
+	c := s.connect(t)
+	defer c.Close()
+
+	if err := c.WaitForPersistence(0, 0xabc, 45, time.Second); err != nil {
+		t.Fatalf("Error waiting for persistence: %v", err)
+	}
+	if s.persisted != 50 {
+		t.Errorf("Expected to stop polling once 45 was persisted, at %d", s.persisted)
+	}
+
+	s.persistStep = 0
+	err := c.WaitForPersistence(0, 0xabc, 90, 20*time.Millisecond)
+	if !errors.Is(err, ErrPersistenceTimeout) {
+		t.Errorf("Expected ErrPersistenceTimeout, got %v", err)
+	}
+
+	// A failover losing the mutation.
+	s.oldSeqno = 60
+	err = c.WaitForPersistence(0, 0x123, 70, time.Second)
+	if !errors.Is(err, ErrRolledBack) {
+		t.Errorf("Expected ErrRolledBack, got %v", err)
+	}
+
+	// And one keeping it, which carries on with the new UUID.
+	s.oldSeqno, s.persistStep = 80, 10
+	if err := c.WaitForPersistence(0, 0x123, 75, time.Second); err != nil {
+		t.Errorf("Error waiting across a failover: %v", err)
+	}
+	if req := s.lastRequest(); req.Body[7] != 0xbc {
+		t.Errorf("Expected the new UUID to be observed, got %v", req.Body)
+	}
+}
@@ -0,0 +1,156 @@
+package memcached
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// bodyIO says where a request's body comes from and its response's
+// body goes, for the methods that don't simply hold them in memory.
+// A nil *bodyIO means the request's Body and a new buffer.
+type bodyIO struct {
+	buf []byte // the response body is read into buf if it fits
+
+	r      io.Reader // the request body is the next length bytes of r
+	length int
+	start  int64 // where in r the body starts, if r is an io.Seeker
+
+	w io.Writer // a successful response's body is copied to w
+	n int64     // bytes of it written so far
+}
+
+func (b *bodyIO) buffer() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.buf
+}
+
+// rewind readies the request to be sent again, returning an error if
+// it can't be: its body can't be read again, or part of the response
+// has already been written out.
+func (b *bodyIO) rewind() error {
+	if b == nil {
+		return nil
+	}
+	if b.n > 0 {
+		return errors.New("value already partly written")
+	}
+	if b.r == nil {
+		return nil
+	}
+	seeker, ok := b.r.(io.Seeker)
+	if !ok {
+		return errors.New("streamed value can't be sent again")
+	}
+	_, err := seeker.Seek(b.start, io.SeekStart)
+	return err
+}
+
+// SetReader sets the value for a key like Set, streaming the value's
+// length bytes from r to the connection rather than holding it all
+// in memory.
+//
+// Sending the value again, after a TMPFAIL under the client's
+// RetryPolicy or on a new connection after a reconnect, requires r
+// to be an io.Seeker; otherwise the first attempt's result is
+// returned.
+//
+// If r runs out before length bytes, the server is left waiting for
+// the rest of the request, so the error is returned and the client
+// marked unhealthy.
+func (c *Client) SetReader(vb uint16, key string, flags, exp int,
+	r io.Reader, length int) (*gomemcached.MCResponse, error) {
+
+	if length < 0 {
+		return nil, fmt.Errorf("invalid body length %d", length)
+	}
+	if c.maxBody > 0 && length > c.maxBody {
+		return nil, fmt.Errorf("%w: request body is %d bytes (max %d)",
+			gomemcached.ErrBodyTooLarge, length, c.maxBody)
+	}
+	body := &bodyIO{r: r, length: length}
+	send := func() (*gomemcached.MCResponse, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.sendLocked(context.Background(), storeRequest(gomemcached.SET, vb, []byte(key), nil,
+			StoreOptions{Flags: uint32(flags), Exp: exp}), body)
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return send()
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return send()
+	}
+	body.start = start
+	attempts := 0
+	return c.retrying(context.Background(), func() (*gomemcached.MCResponse, error) {
+		if attempts++; attempts > 1 {
+			if err := body.rewind(); err != nil {
+				return nil, err
+			}
+		}
+		return send()
+	})
+}
+
+// transmitStream writes a request whose body is the next length bytes
+// of r.
+func (c *Client) transmitStream(req *gomemcached.MCRequest, r io.Reader, length int) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	req = c.inCollection(req)
+	w := c.out
+	if c.writer != nil {
+		w = c.writer
+	}
+	c.counters.ops.Add(1)
+
+	// The header's total length counts the body that follows it.
+	hdr := req.HeaderBytes()
+	binary.BigEndian.PutUint32(hdr[8:12], binary.BigEndian.Uint32(hdr[8:12])+uint32(length))
+	_, err := w.Write(hdr)
+	if err == nil {
+		var n int64
+		n, err = io.CopyN(w, r, int64(length))
+		if err == io.EOF {
+			err = fmt.Errorf("%w: value ended after %d of %d bytes",
+				io.ErrUnexpectedEOF, n, length)
+		}
+	}
+	if c.logLevel != LogNone {
+		c.logRequest(req, err)
+	}
+	return err
+}
+
+// GetTo gets the value for a key like Get, but copies it to w rather
+// than reading it into memory.  res.Body is nil unless the get
+// failed, in which case it holds the server's message and nothing is
+// written to w.  The value is written as stored, even if the client
+// is set to decompress values.
+//
+// n is the number of bytes of the value written to w.  If writing
+// fails partway through, the rest of the value is left unread, so the
+// error is returned and the client marked unhealthy.
+func (c *Client) GetTo(vb uint16, key string, w io.Writer) (n int64, res *gomemcached.MCResponse, err error) {
+	body := &bodyIO{w: w}
+	res, err = c.retrying(context.Background(), func() (*gomemcached.MCResponse, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.sendLocked(context.Background(), &gomemcached.MCRequest{
+			Opcode:  gomemcached.GET,
+			VBucket: vb,
+			Key:     []byte(key),
+		}, body)
+	})
+	return body.n, res, err
+}
@@ -0,0 +1,265 @@
+package memcached
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+func TestSetReader(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	// Large, but within the server's gomemcached.MaxBodyLen.
+	value := make([]byte, 768*1024)
+	rand.New(rand.NewSource(1)).Read(value)
+	res, err := c.SetReader(0, "k", 7, 0, bytes.NewReader(value), len(value))
+	if err != nil {
+		t.Fatalf("Error streaming a set: %v", err)
+	}
+	if res.Cas == 0 {
+		t.Errorf("Expected a CAS, got %v", res)
+	}
+	got, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if !bytes.Equal(got.Body, value) {
+		t.Errorf("Value didn't survive the round trip")
+	}
+	if item := s.item("k"); item.Flags != 7 {
+		t.Errorf("Expected flags 7, got %v", item.Flags)
+	}
+
+	// Only length bytes are sent.
+	if _, err := c.SetReader(0, "k", 0, 0, bytes.NewReader(value), 10); err != nil {
+		t.Fatalf("Error streaming a prefix: %v", err)
+	}
+	if item := s.item("k"); !bytes.Equal(item.Data, value[:10]) {
+		t.Errorf("Expected the first 10 bytes, got %v", item.Data)
+	}
+
+	if _, err := c.SetReader(0, "k", 0, 0, bytes.NewReader(value), -1); err == nil {
+		t.Errorf("Expected an error streaming a negative length")
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+	if item := s.item("k"); !bytes.Equal(item.Data, value[:10]) {
+		t.Errorf("Expected a negative length not to store anything, got %v", item.Data)
+	}
+
+	c.SetMaxBodySize(100)
+	if _, err := c.SetReader(0, "k", 0, 0, bytes.NewReader(value), 101); !errors.Is(err, gomemcached.ErrBodyTooLarge) {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+
+	_, err = c.SetReader(0, "k", 0, 0, bytes.NewReader(value[:5]), 10)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected ErrUnexpectedEOF from a short reader, got %v", err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy")
+	}
+}
+
+func TestSetReaderSendPath(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	c.SetReconnect(true, true)
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	var ops []gomemcached.CommandCode
+	c.SetObserver(OpObserverFunc(func(opcode gomemcached.CommandCode, status gomemcached.Status,
+		latency time.Duration, err error) {
+		ops = append(ops, opcode)
+	}))
+
+	// Retries send the value again from where it started in r.
+	r := strings.NewReader("skip:value")
+	r.Seek(5, io.SeekStart)
+	s.mu.Lock()
+	s.tmpfails = 1
+	s.mu.Unlock()
+	if _, err := c.SetReader(0, "k", 0, 0, r, 5); err != nil {
+		t.Fatalf("Expected SetReader to succeed after a TMPFAIL, got %v", err)
+	}
+	if item := s.item("k"); string(item.Data) != "value" {
+		t.Errorf("Expected value stored, got %q", item.Data)
+	}
+	if len(ops) != 2 || ops[0] != gomemcached.SET {
+		t.Errorf("Expected two observed sets, got %v", ops)
+	}
+
+	r = strings.NewReader("again")
+	s.dropConnections()
+	if _, err := c.SetReader(0, "k", 0, 0, r, 5); err != nil {
+		t.Fatalf("Expected SetReader to succeed after reconnecting, got %v", err)
+	}
+	if item := s.item("k"); string(item.Data) != "again" {
+		t.Errorf("Expected again stored, got %q", item.Data)
+	}
+
+	// Without a Seeker, the value can only be sent once.
+	s.mu.Lock()
+	s.tmpfails = 1
+	before := len(s.reqs)
+	s.mu.Unlock()
+	onlyReader := struct{ io.Reader }{strings.NewReader("once!")}
+	if _, err := c.SetReader(0, "k", 0, 0, onlyReader, 5); !gomemcached.IsTempFail(err) {
+		t.Errorf("Expected the TMPFAIL, got %v", err)
+	}
+	s.mu.Lock()
+	n := len(s.reqs) - before
+	s.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected a single attempt, got %v", n)
+	}
+
+	// Failures are described like any other.
+	c.SetErrorMap(&ErrorMap{Errors: map[gomemcached.Status]ErrorInfo{
+		gomemcached.TMPFAIL: {Name: "ETMPFAIL", Desc: "try again"},
+	}})
+	s.mu.Lock()
+	s.tmpfails = 1
+	s.mu.Unlock()
+	_, err = c.SetReader(0, "k", 0, 0, struct{ io.Reader }{strings.NewReader("once!")}, 5)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.Info.Name != "ETMPFAIL" {
+		t.Errorf("Expected a described StatusError, got %v", err)
+	}
+}
+
+// failingWriter fails after accepting n bytes.
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errors.New("write failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestGetTo(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	value := make([]byte, 768*1024)
+	rand.New(rand.NewSource(2)).Read(value)
+	if _, err := c.Set(0, "k", 7, 0, value); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, res, err := c.GetTo(0, "k", buf)
+	if err != nil {
+		t.Fatalf("Error streaming a get: %v", err)
+	}
+	if n != int64(len(value)) || !bytes.Equal(buf.Bytes(), value) {
+		t.Errorf("Expected %d bytes intact, got %d", len(value), n)
+	}
+	if res.Body != nil || len(res.Extras) != 4 || res.Cas == 0 {
+		t.Errorf("Unexpected response: %v", res)
+	}
+
+	n, _, err = c.GetTo(0, "k", io.Discard)
+	if err != nil || n != int64(len(value)) {
+		t.Errorf("Expected %d bytes discarded, got %d/%v", len(value), n, err)
+	}
+
+	buf.Reset()
+	n, res, err = c.GetTo(0, "missing", buf)
+	if !gomemcached.IsNotFound(err) || n != 0 || buf.Len() != 0 {
+		t.Errorf("Expected not found and nothing written, got %v/%d/%v", res, n, err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to stay healthy")
+	}
+
+	n, _, err = c.GetTo(0, "k", &failingWriter{n: 1000})
+	if err == nil || n != 1000 {
+		t.Errorf("Expected a write error after 1000 bytes, got %d/%v", n, err)
+	}
+	if c.IsHealthy() {
+		t.Errorf("Expected client to be unhealthy")
+	}
+}
+
+func TestGetToSendPath(t *testing.T) {
+	s := newFakeServer()
+	c, err := ConnectReconnecting("tcp", s.listen(t))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	c.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond})
+	if _, err := c.Set(0, "k", 0, 0, []byte("value")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	var ops []gomemcached.CommandCode
+	c.SetObserver(OpObserverFunc(func(opcode gomemcached.CommandCode, status gomemcached.Status,
+		latency time.Duration, err error) {
+		ops = append(ops, opcode)
+	}))
+
+	buf := &bytes.Buffer{}
+	s.mu.Lock()
+	s.tmpfails = 1
+	s.mu.Unlock()
+	n, _, err := c.GetTo(0, "k", buf)
+	if err != nil || n != 5 || buf.String() != "value" {
+		t.Fatalf("Expected the value after a TMPFAIL, got %d/%q/%v", n, buf, err)
+	}
+	if len(ops) != 2 || ops[0] != gomemcached.GET {
+		t.Errorf("Expected two observed gets, got %v", ops)
+	}
+
+	buf.Reset()
+	s.dropConnections()
+	n, _, err = c.GetTo(0, "k", buf)
+	if err != nil || n != 5 || buf.String() != "value" {
+		t.Fatalf("Expected the value after reconnecting, got %d/%q/%v", n, buf, err)
+	}
+
+	c.SetErrorMap(&ErrorMap{Errors: map[gomemcached.Status]ErrorInfo{
+		gomemcached.KEY_ENOENT: {Name: "KEY_ENOENT", Desc: "not found"},
+	}})
+	_, res, err := c.GetTo(0, "missing", buf)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.Res != res || !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected a described not found, got %v", err)
+	}
+
+	// Once part of the value is written, it can't be fetched again.
+	s.mu.Lock()
+	before := len(s.reqs)
+	s.mu.Unlock()
+	if n, _, err := c.GetTo(0, "k", &failingWriter{n: 2}); err == nil || n != 2 {
+		t.Errorf("Expected a write error after 2 bytes, got %d/%v", n, err)
+	}
+	s.mu.Lock()
+	attempts := len(s.reqs) - before
+	s.mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, got %v", attempts)
+	}
+}
@@ -0,0 +1,164 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// SubdocGet gets the value at a path within a JSON document.
+//
+// The response body holds the JSON encoded value.  A path that
+// doesn't exist is reported with a SUBDOC_PATH_ENOENT status (see
+// gomemcached.IsPathNotFound), distinct from the KEY_ENOENT of a
+// missing document.
+func (c *Client) SubdocGet(vb uint16, key, path string) (*gomemcached.MCResponse, error) {
+	extras := make([]byte, 3)
+	binary.BigEndian.PutUint16(extras, uint16(len(path)))
+
+	return c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SUBDOC_GET,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  extras,
+		Body:    []byte(path),
+	})
+}
+
+// LookupSpec is one path to look up with SubdocMultiLookup.
+type LookupSpec struct {
+	// SUBDOC_GET, SUBDOC_EXISTS, or SUBDOC_GET_COUNT
+	Opcode gomemcached.CommandCode
+	// Path flags (SUBDOC_FLAG_*)
+	Flags uint8
+	Path  string
+}
+
+// MutationSpec is one change to make with SubdocMultiMutation.
+type MutationSpec struct {
+	// SUBDOC_DICT_UPSERT, SUBDOC_COUNTER, etc.
+	Opcode gomemcached.CommandCode
+	// Path flags (SUBDOC_FLAG_*)
+	Flags uint8
+	Path  string
+	// The JSON encoded value, or counter delta
+	Value []byte
+}
+
+// SubdocResult is the outcome of one spec in a multi-path request.
+type SubdocResult struct {
+	Status gomemcached.Status
+	Value  []byte
+}
+
+// SubdocMultiLookup looks up several paths within a document in one
+// request.
+//
+// There's a result for each spec, carrying its own status.  If only
+// some of the paths fail, the results are returned without an error;
+// the error is for failures of the document as a whole (e.g. a
+// missing key).
+func (c *Client) SubdocMultiLookup(vb uint16, key string, specs []LookupSpec) ([]SubdocResult, error) {
+	var body []byte
+	for _, spec := range specs {
+		body = append(body, byte(spec.Opcode), spec.Flags, 0, 0)
+		binary.BigEndian.PutUint16(body[len(body)-2:], uint16(len(spec.Path)))
+		body = append(body, spec.Path...)
+	}
+
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SUBDOC_MULTI_LOOKUP,
+		VBucket: vb,
+		Key:     []byte(key),
+		Body:    body,
+	})
+	if err != nil && !isMultiPathFailure(err) {
+		return nil, err
+	}
+
+	rv := make([]SubdocResult, 0, len(specs))
+	for b := res.Body; len(b) > 0; {
+		if len(b) < 6 {
+			return rv, fmt.Errorf("short subdoc lookup result: %d bytes", len(b))
+		}
+		vlen := int(binary.BigEndian.Uint32(b[2:6]))
+		if len(b) < 6+vlen {
+			return rv, fmt.Errorf("subdoc lookup value length %d exceeds %d remaining bytes",
+				vlen, len(b)-6)
+		}
+		rv = append(rv, SubdocResult{
+			Status: gomemcached.Status(binary.BigEndian.Uint16(b)),
+			Value:  b[6 : 6+vlen],
+		})
+		b = b[6+vlen:]
+	}
+	if len(rv) != len(specs) {
+		return rv, fmt.Errorf("expected %d subdoc lookup results, got %d",
+			len(specs), len(rv))
+	}
+	return rv, nil
+}
+
+// isMultiPathFailure is true if err is a multi-path response saying
+// only some of its specs failed, rather than the request as a whole.
+func isMultiPathFailure(err error) bool {
+	var res *gomemcached.MCResponse
+	return errors.As(err, &res) && res.Status == gomemcached.SUBDOC_MULTI_PATH_FAILURE
+}
+
+// SubdocMultiMutation applies several changes to a document
+// atomically.
+//
+// There's a result for each spec.  Specs that produce a value (such
+// as SUBDOC_COUNTER) have it in their result.  If a spec fails, none
+// of the changes are made; its result carries the failure status and
+// the response is returned as the error.
+func (c *Client) SubdocMultiMutation(vb uint16, key string, specs []MutationSpec) ([]SubdocResult, error) {
+	var body []byte
+	for _, spec := range specs {
+		body = append(body, byte(spec.Opcode), spec.Flags, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(body[len(body)-6:], uint16(len(spec.Path)))
+		binary.BigEndian.PutUint32(body[len(body)-4:], uint32(len(spec.Value)))
+		body = append(body, spec.Path...)
+		body = append(body, spec.Value...)
+	}
+
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.SUBDOC_MULTI_MUTATION,
+		VBucket: vb,
+		Key:     []byte(key),
+		Body:    body,
+	})
+	if err != nil && !isMultiPathFailure(err) {
+		return nil, err
+	}
+
+	rv := make([]SubdocResult, len(specs))
+	if err != nil {
+		// The body names the first spec that failed.
+		if len(res.Body) < 3 || int(res.Body[0]) >= len(specs) {
+			return nil, fmt.Errorf("invalid subdoc mutation failure: %v", res.Body)
+		}
+		rv[res.Body[0]].Status = gomemcached.Status(binary.BigEndian.Uint16(res.Body[1:3]))
+		return rv, err
+	}
+
+	for b := res.Body; len(b) > 0; {
+		if len(b) < 7 {
+			return rv, fmt.Errorf("short subdoc mutation result: %d bytes", len(b))
+		}
+		idx := int(b[0])
+		vlen := int(binary.BigEndian.Uint32(b[3:7]))
+		if idx >= len(specs) || len(b) < 7+vlen {
+			return rv, fmt.Errorf("invalid subdoc mutation result for spec %d", idx)
+		}
+		rv[idx] = SubdocResult{
+			Status: gomemcached.Status(binary.BigEndian.Uint16(b[1:3])),
+			Value:  b[7 : 7+vlen],
+		}
+		b = b[7+vlen:]
+	}
+	return rv, nil
+}
@@ -0,0 +1,388 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// splitSubdocPath splits a path like a.b[1].c into field names and
+// array indexes.
+func splitSubdocPath(path string) ([]interface{}, bool) {
+	var rv []interface{}
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+		}
+		if name != "" {
+			rv = append(rv, name)
+		}
+		for rest := part[len(name):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, false
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil {
+				return nil, false
+			}
+			rv = append(rv, n)
+			rest = rest[end+1:]
+		}
+	}
+	return rv, len(rv) > 0
+}
+
+// subdocFind resolves a path within a decoded document.
+func subdocFind(doc interface{}, path []interface{}) (interface{}, gomemcached.Status) {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, gomemcached.SUBDOC_PATH_MISMATCH
+			}
+			if doc, ok = m[p]; !ok {
+				return nil, gomemcached.SUBDOC_PATH_ENOENT
+			}
+		case int:
+			a, ok := doc.([]interface{})
+			if !ok {
+				return nil, gomemcached.SUBDOC_PATH_MISMATCH
+			}
+			if p < 0 || p >= len(a) {
+				return nil, gomemcached.SUBDOC_PATH_ENOENT
+			}
+			doc = a[p]
+		}
+	}
+	return doc, gomemcached.SUCCESS
+}
+
+func subdocGet(data []byte, path string) ([]byte, gomemcached.Status) {
+	var doc interface{}
+	if json.Unmarshal(data, &doc) != nil {
+		return nil, gomemcached.SUBDOC_DOC_NOT_JSON
+	}
+	parts, ok := splitSubdocPath(path)
+	if !ok {
+		return nil, gomemcached.SUBDOC_PATH_EINVAL
+	}
+	v, st := subdocFind(doc, parts)
+	if st != gomemcached.SUCCESS {
+		return nil, st
+	}
+	b, _ := json.Marshal(v)
+	return b, gomemcached.SUCCESS
+}
+
+func subdocMultiLookup(data, body []byte) ([]byte, gomemcached.Status) {
+	var doc interface{}
+	if json.Unmarshal(data, &doc) != nil {
+		return nil, gomemcached.SUBDOC_DOC_NOT_JSON
+	}
+
+	var rv []byte
+	status := gomemcached.SUCCESS
+	for len(body) >= 4 {
+		op := gomemcached.CommandCode(body[0])
+		plen := int(binary.BigEndian.Uint16(body[2:]))
+		path := string(body[4 : 4+plen])
+		body = body[4+plen:]
+
+		var val []byte
+		parts, ok := splitSubdocPath(path)
+		v, st := subdocFind(doc, parts)
+		switch {
+		case !ok:
+			st = gomemcached.SUBDOC_PATH_EINVAL
+		case st != gomemcached.SUCCESS:
+		case op == gomemcached.SUBDOC_GET:
+			val, _ = json.Marshal(v)
+		case op == gomemcached.SUBDOC_GET_COUNT:
+			switch v := v.(type) {
+			case []interface{}:
+				val = []byte(strconv.Itoa(len(v)))
+			case map[string]interface{}:
+				val = []byte(strconv.Itoa(len(v)))
+			default:
+				st = gomemcached.SUBDOC_PATH_MISMATCH
+			}
+		}
+		if st != gomemcached.SUCCESS {
+			status = gomemcached.SUBDOC_MULTI_PATH_FAILURE
+		}
+
+		hdr := make([]byte, 6)
+		binary.BigEndian.PutUint16(hdr, uint16(st))
+		binary.BigEndian.PutUint32(hdr[2:], uint32(len(val)))
+		rv = append(append(rv, hdr...), val...)
+	}
+	return rv, status
+}
+
+// subdocMutate applies one mutation to a decoded document, returning
+// the value to report (for counters).
+func subdocMutate(doc interface{}, op gomemcached.CommandCode, path string, value []byte) ([]byte, gomemcached.Status) {
+	parts, ok := splitSubdocPath(path)
+	if !ok {
+		return nil, gomemcached.SUBDOC_PATH_EINVAL
+	}
+	parent, st := subdocFind(doc, parts[:len(parts)-1])
+	if st != gomemcached.SUCCESS {
+		return nil, st
+	}
+	cur, exists := subdocFind(parent, parts[len(parts)-1:])
+
+	var v interface{}
+	if op != gomemcached.SUBDOC_DELETE && op != gomemcached.SUBDOC_COUNTER &&
+		json.Unmarshal(value, &v) != nil {
+		return nil, gomemcached.SUBDOC_VALUE_CANTINSERT
+	}
+
+	var rv []byte
+	switch op {
+	case gomemcached.SUBDOC_DICT_ADD:
+		if exists == gomemcached.SUCCESS {
+			return nil, gomemcached.SUBDOC_PATH_EEXISTS
+		}
+	case gomemcached.SUBDOC_DICT_UPSERT:
+	case gomemcached.SUBDOC_REPLACE, gomemcached.SUBDOC_DELETE:
+		if exists != gomemcached.SUCCESS {
+			return nil, exists
+		}
+	case gomemcached.SUBDOC_ARRAY_PUSH_LAST:
+		a, ok := cur.([]interface{})
+		if !ok {
+			return nil, gomemcached.SUBDOC_PATH_MISMATCH
+		}
+		v = append(a, v)
+	case gomemcached.SUBDOC_COUNTER:
+		delta, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, gomemcached.SUBDOC_DELTA_ERANGE
+		}
+		n, _ := cur.(float64)
+		if exists == gomemcached.SUCCESS {
+			if _, ok := cur.(float64); !ok {
+				return nil, gomemcached.SUBDOC_PATH_MISMATCH
+			}
+		}
+		v = n + float64(delta)
+		rv, _ = json.Marshal(v)
+	default:
+		return nil, gomemcached.SUBDOC_INVALID_COMBO
+	}
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		name, ok := parts[len(parts)-1].(string)
+		if !ok {
+			return nil, gomemcached.SUBDOC_PATH_MISMATCH
+		}
+		if op == gomemcached.SUBDOC_DELETE {
+			delete(container, name)
+		} else {
+			container[name] = v
+		}
+	case []interface{}:
+		i, ok := parts[len(parts)-1].(int)
+		if !ok || op == gomemcached.SUBDOC_DELETE || exists != gomemcached.SUCCESS {
+			return nil, gomemcached.SUBDOC_PATH_MISMATCH
+		}
+		container[i] = v
+	default:
+		return nil, gomemcached.SUBDOC_PATH_MISMATCH
+	}
+	return rv, gomemcached.SUCCESS
+}
+
+// subdocMultiMutation applies every mutation in body to the document,
+// or none of them.
+func subdocMultiMutation(data, body []byte) ([]byte, []byte, gomemcached.Status) {
+	var doc interface{}
+	if json.Unmarshal(data, &doc) != nil {
+		return nil, nil, gomemcached.SUBDOC_DOC_NOT_JSON
+	}
+
+	var rv []byte
+	for i := 0; len(body) >= 8; i++ {
+		op := gomemcached.CommandCode(body[0])
+		plen := int(binary.BigEndian.Uint16(body[2:]))
+		vlen := int(binary.BigEndian.Uint32(body[4:]))
+		path := string(body[8 : 8+plen])
+		value := body[8+plen : 8+plen+vlen]
+		body = body[8+plen+vlen:]
+
+		val, st := subdocMutate(doc, op, path, value)
+		if st != gomemcached.SUCCESS {
+			return nil, []byte{byte(i), byte(st >> 8), byte(st)},
+				gomemcached.SUBDOC_MULTI_PATH_FAILURE
+		}
+		if val != nil {
+			hdr := make([]byte, 7)
+			hdr[0] = byte(i)
+			binary.BigEndian.PutUint32(hdr[3:], uint32(len(val)))
+			rv = append(append(rv, hdr...), val...)
+		}
+	}
+
+	newData, _ := json.Marshal(doc)
+	return newData, rv, gomemcached.SUCCESS
+}
+
+const testSubdoc = `{"name":"thing","owner":{"first":"a","langs":["go","c"]},"count":3}`
+
+func TestSubdocGet(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "doc", 0, 0, []byte(testSubdoc)); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	res, err := c.SubdocGet(0, "doc", "owner.langs[1]")
+	if err != nil {
+		t.Fatalf("Error in SubdocGet: %v", err)
+	}
+	if string(res.Body) != `"c"` {
+		t.Errorf(`Expected "c", got %s`, res.Body)
+	}
+
+	req := s.lastRequest()
+	if string(req.Key) != "doc" || string(req.Body) != "owner.langs[1]" ||
+		len(req.Extras) != 3 || req.Extras[0] != 0 || req.Extras[1] != 14 {
+		t.Errorf("Unexpected request encoding: %#v", req)
+	}
+
+	_, err = c.SubdocGet(0, "doc", "owner.last")
+	if !gomemcached.IsPathNotFound(err) || gomemcached.IsNotFound(err) {
+		t.Errorf("Expected path not found, got %v", err)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to remain healthy after a missing path")
+	}
+
+	_, err = c.SubdocGet(0, "nodoc", "owner")
+	if !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected document not found, got %v", err)
+	}
+}
+
+func TestSubdocMultiLookup(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "doc", 0, 0, []byte(testSubdoc)); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	got, err := c.SubdocMultiLookup(0, "doc", []LookupSpec{
+		{Opcode: gomemcached.SUBDOC_GET, Path: "name"},
+		{Opcode: gomemcached.SUBDOC_EXISTS, Path: "owner.first"},
+		{Opcode: gomemcached.SUBDOC_EXISTS, Path: "owner.last"},
+		{Opcode: gomemcached.SUBDOC_GET_COUNT, Path: "owner.langs"},
+	})
+	if err != nil {
+		t.Fatalf("Error in SubdocMultiLookup: %v", err)
+	}
+	exp := []SubdocResult{
+		{gomemcached.SUCCESS, []byte(`"thing"`)},
+		{gomemcached.SUCCESS, []byte{}},
+		{gomemcached.SUBDOC_PATH_ENOENT, []byte{}},
+		{gomemcached.SUCCESS, []byte("2")},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	if _, err := c.SubdocMultiLookup(0, "nodoc", []LookupSpec{
+		{Opcode: gomemcached.SUBDOC_GET, Path: "name"},
+	}); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected document not found, got %v", err)
+	}
+}
+
+func TestSubdocMultiMutation(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+
+	if _, err := c.Set(0, "doc", 0, 0, []byte(testSubdoc)); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	got, err := c.SubdocMultiMutation(0, "doc", []MutationSpec{
+		{Opcode: gomemcached.SUBDOC_COUNTER, Path: "count", Value: []byte("5")},
+		{Opcode: gomemcached.SUBDOC_DICT_UPSERT, Path: "owner.last", Value: []byte(`"b"`)},
+		{Opcode: gomemcached.SUBDOC_ARRAY_PUSH_LAST, Path: "owner.langs", Value: []byte(`"rust"`)},
+	})
+	if err != nil {
+		t.Fatalf("Error in SubdocMultiMutation: %v", err)
+	}
+	if len(got) != 3 || string(got[0].Value) != "8" || got[1].Value != nil {
+		t.Errorf("Unexpected results %v", got)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(s.item("doc").Data, &doc); err != nil {
+		t.Fatalf("Error decoding stored doc: %v", err)
+	}
+	owner := doc["owner"].(map[string]interface{})
+	if doc["count"] != 8.0 || owner["last"] != "b" || len(owner["langs"].([]interface{})) != 3 {
+		t.Errorf("Unexpected document after mutation: %v", doc)
+	}
+
+	// A failing spec makes the whole thing fail, changing nothing.
+	before := string(s.item("doc").Data)
+	got, err = c.SubdocMultiMutation(0, "doc", []MutationSpec{
+		{Opcode: gomemcached.SUBDOC_COUNTER, Path: "count", Value: []byte("1")},
+		{Opcode: gomemcached.SUBDOC_DICT_ADD, Path: "name", Value: []byte(`"x"`)},
+	})
+	if res, ok := err.(*gomemcached.MCResponse); !ok ||
+		res.Status != gomemcached.SUBDOC_MULTI_PATH_FAILURE {
+		t.Fatalf("Expected multi path failure, got %v", err)
+	}
+	if len(got) != 2 || got[0].Status != gomemcached.SUCCESS ||
+		got[1].Status != gomemcached.SUBDOC_PATH_EEXISTS {
+		t.Errorf("Expected the second spec to fail, got %v", got)
+	}
+	if after := string(s.item("doc").Data); after != before {
+		t.Errorf("Expected document unchanged, got %s", after)
+	}
+	if !c.IsHealthy() {
+		t.Errorf("Expected client to remain healthy")
+	}
+}
+
+func TestSubdocMultiRequestErrors(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+
+	lookup := []LookupSpec{{Opcode: gomemcached.SUBDOC_GET, Path: "name"}}
+	mutation := []MutationSpec{{Opcode: gomemcached.SUBDOC_DICT_UPSERT, Path: "name", Value: []byte(`"x"`)}}
+
+	if _, err := c.SubdocMultiLookup(0, "", lookup); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from lookup, got %v", err)
+	}
+	if _, err := c.SubdocMultiMutation(0, "", mutation); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Expected ErrEmptyKey from mutation, got %v", err)
+	}
+
+	c.Close()
+	if _, err := c.SubdocMultiLookup(0, "doc", lookup); err == nil {
+		t.Errorf("Expected an error looking up on a closed connection")
+	}
+	if _, err := c.SubdocMultiMutation(0, "doc", mutation); err == nil {
+		t.Errorf("Expected an error mutating on a closed connection")
+	}
+}
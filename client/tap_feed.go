@@ -239,6 +239,9 @@ func (mc *Client) StartTapFeed(args TapArguments) (*TapFeed, error) {
 		Body:   args.bytes()}
 
 	err := mc.Transmit(rq)
+	if err == nil {
+		err = mc.FlushBuffer()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -267,7 +270,7 @@ loop:
 		//  (Can't call mc.Receive() because it reads a
 		//  _response_ not a request.)
 		var pkt gomemcached.MCRequest
-		n, err := pkt.Receive(mc.conn, headerBuf[:])
+		n, err := pkt.Receive(mc.reader, headerBuf[:])
 		if TapRecvHook != nil {
 			TapRecvHook(&pkt, n, err)
 		}
@@ -322,7 +325,7 @@ func (mc *Client) sendAck(pkt *gomemcached.MCRequest) (int, error) {
 		Opaque: pkt.Opaque,
 		Status: gomemcached.SUCCESS,
 	}
-	return res.Transmit(mc.conn)
+	return res.Transmit(mc.out)
 }
 
 // Close terminates a TapFeed.
@@ -0,0 +1,35 @@
+package memcached
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// ConnectTLS connects to a memcached server over TLS.
+//
+// The config's ServerName, RootCAs, and Certificates are used as
+// given; if ServerName is empty, it's derived from dest.
+func ConnectTLS(dest string, cfg *tls.Config) (*Client, error) {
+	return ConnectTLSContext(context.Background(), dest, cfg)
+}
+
+// ConnectTLSContext connects to a memcached server over TLS, giving
+// up on the dial and handshake when ctx is done.
+func ConnectTLSContext(ctx context.Context, dest string, cfg *tls.Config) (*Client, error) {
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: DefaultDialTimeout},
+		Config:    cfg,
+	}
+	conn, err := d.DialContext(ctx, "tcp", dest)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := Wrap(conn)
+	if err == nil {
+		rv.dial = func() (net.Conn, error) {
+			return d.Dial("tcp", dest)
+		}
+	}
+	return rv, err
+}
@@ -0,0 +1,63 @@
+package memcached
+
+import (
+	"context"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// Tracer starts spans for requests sent with SendContext.  It's an
+// interface so a tracing system (such as OpenTelemetry) can be wired
+// in without this package depending on it.
+type Tracer interface {
+	// StartSpan starts a span as a child of any span in ctx,
+	// returning a context carrying the new one.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Span attribute keys.
+const (
+	SpanAttrSystem  = "db.system"         // always "memcached"
+	SpanAttrOpcode  = "db.operation"      // the request's opcode name
+	SpanAttrKey     = "memcached.key"     // the request's key, if any
+	SpanAttrVBucket = "memcached.vbucket" // the request's vbucket, as an int
+	SpanAttrStatus  = "memcached.status"  // the response's status name
+)
+
+// SetTracer makes SendContext trace each request with a span, or
+// with nil, stops tracing.
+func (c *Client) SetTracer(t Tracer) {
+	c.tracer = t
+}
+
+func (c *Client) startSpan(ctx context.Context,
+	req *gomemcached.MCRequest) (context.Context, Span) {
+
+	ctx, span := c.tracer.StartSpan(ctx, "memcached "+req.Opcode.String())
+	span.SetAttribute(SpanAttrSystem, "memcached")
+	span.SetAttribute(SpanAttrOpcode, req.Opcode.String())
+	if len(req.Key) > 0 {
+		span.SetAttribute(SpanAttrKey, string(req.Key))
+	}
+	span.SetAttribute(SpanAttrVBucket, int(req.VBucket))
+	return ctx, span
+}
+
+// endSpan finishes a request's span.  Misses are ordinary answers,
+// not errors; they're only visible in the status.
+func endSpan(span Span, res *gomemcached.MCResponse, err error) {
+	if res != nil {
+		span.SetAttribute(SpanAttrStatus, res.Status.String())
+	}
+	if err != nil && !gomemcached.IsNotFound(err) {
+		span.RecordError(err)
+	}
+	span.End()
+}
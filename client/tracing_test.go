@@ -0,0 +1,95 @@
+package memcached
+
+import (
+	"context"
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+)
+
+type fakeSpan struct {
+	name   string
+	attrs  map[string]interface{}
+	errs   []error
+	ended  bool
+	parent *fakeSpan
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *fakeSpan) RecordError(err error)                      { s.errs = append(s.errs, err) }
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+type spanKey struct{}
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*fakeSpan)
+	s := &fakeSpan{name: name, attrs: map[string]interface{}{}, parent: parent}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestTracer(t *testing.T) {
+	s := newFakeServer()
+	c := s.connect(t)
+	defer c.Close()
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	tr := &fakeTracer{}
+	c.SetTracer(tr)
+	root := &fakeSpan{}
+	ctx := context.WithValue(context.Background(), spanKey{}, root)
+
+	res, err := c.SendContext(ctx, &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: 5,
+		Key:     []byte("k"),
+	})
+	if err != nil || string(res.Body) != "v" {
+		t.Fatalf("Expected v, got %v, %v", res, err)
+	}
+
+	if len(tr.spans) != 1 {
+		t.Fatalf("Expected one span, got %v", len(tr.spans))
+	}
+	sp := tr.spans[0]
+	exp := map[string]interface{}{
+		SpanAttrSystem:  "memcached",
+		SpanAttrOpcode:  "GET",
+		SpanAttrKey:     "k",
+		SpanAttrVBucket: 5,
+		SpanAttrStatus:  "SUCCESS",
+	}
+	for k, v := range exp {
+		if sp.attrs[k] != v {
+			t.Errorf("Expected %v=%v, got %v", k, v, sp.attrs[k])
+		}
+	}
+	if sp.name != "memcached GET" || !sp.ended || sp.parent != root || len(sp.errs) != 0 {
+		t.Errorf("Unexpected span: %+v", sp)
+	}
+
+	// Misses aren't errors, but other failures are.
+	c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("missing")})
+	c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.ADD, Key: []byte("k")})
+	if len(tr.spans) != 3 {
+		t.Fatalf("Expected three spans, got %v", len(tr.spans))
+	}
+	if sp := tr.spans[1]; sp.attrs[SpanAttrStatus] != "KEY_ENOENT" || len(sp.errs) != 0 {
+		t.Errorf("Unexpected span for a miss: %+v", sp)
+	}
+	if sp := tr.spans[2]; sp.attrs[SpanAttrStatus] != "KEY_EEXISTS" || len(sp.errs) != 1 {
+		t.Errorf("Unexpected span for a failed add: %+v", sp)
+	}
+
+	c.SetTracer(nil)
+	c.SendContext(ctx, &gomemcached.MCRequest{Opcode: gomemcached.NOOP})
+	if len(tr.spans) != 3 {
+		t.Errorf("Expected no spans once cleared, got %v", len(tr.spans))
+	}
+}
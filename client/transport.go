@@ -1,8 +1,11 @@
 package memcached
 
 import (
+	"bufio"
 	"errors"
 	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/couchbase/gomemcached"
 )
@@ -23,16 +26,63 @@ func UnwrapMemcachedError(rv *gomemcached.MCResponse,
 	return rv, err
 }
 
+// Header buffers for reads that aren't given one.  A client's reads
+// each take their own, so none is shared between goroutines.
+var hdrPool = sync.Pool{New: func() interface{} { return new([gomemcached.HDR_LEN]byte) }}
+
+// connCounters are the client's counters for ConnStats, updated
+// atomically since they may be read concurrently.
+type connCounters struct {
+	sent, received, ops atomic.Uint64
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(uint64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n.Add(uint64(n))
+	return n, err
+}
+
 // ReceiveHook is called after every packet is received (or attempted to be)
 var ReceiveHook func(*gomemcached.MCResponse, int, error)
 
 func getResponse(s io.Reader, hdrBytes []byte) (rv *gomemcached.MCResponse, n int, err error) {
+	return getResponseInto(s, hdrBytes, nil, 0)
+}
+
+// getResponseInto is getResponse reading the body into the given
+// buffer if it's not nil and the body fits, and refusing bodies
+// longer than limit (if not 0).  A nil hdrBytes reads the header into
+// a pooled buffer.
+func getResponseInto(s io.Reader, hdrBytes, body []byte, limit int) (rv *gomemcached.MCResponse, n int, err error) {
 	if s == nil {
 		return nil, 0, errNoConn
 	}
+	if hdrBytes == nil {
+		hdr := hdrPool.Get().(*[gomemcached.HDR_LEN]byte)
+		defer hdrPool.Put(hdr)
+		hdrBytes = hdr[:]
+	}
 
 	rv = &gomemcached.MCResponse{}
-	n, err = rv.Receive(s, hdrBytes)
+	n, err = rv.ReceiveLimit(s, hdrBytes, body, limit)
 
 	if ReceiveHook != nil {
 		ReceiveHook(rv, n, err)
@@ -44,6 +94,31 @@ func getResponse(s io.Reader, hdrBytes []byte) (rv *gomemcached.MCResponse, n in
 	return rv, n, err
 }
 
+// getResponseTo is getResponse copying a successful response's body
+// to w.  n is the number of body bytes written.
+func getResponseTo(s io.Reader, hdrBytes []byte, w io.Writer) (rv *gomemcached.MCResponse, n int64, err error) {
+	if s == nil {
+		return nil, 0, errNoConn
+	}
+	if hdrBytes == nil {
+		hdr := hdrPool.Get().(*[gomemcached.HDR_LEN]byte)
+		defer hdrPool.Put(hdr)
+		hdrBytes = hdr[:]
+	}
+
+	rv = &gomemcached.MCResponse{}
+	n, err = rv.ReceiveTo(s, hdrBytes, w)
+
+	if ReceiveHook != nil {
+		ReceiveHook(rv, int(n), err)
+	}
+
+	if err == nil && rv.Status != gomemcached.SUCCESS {
+		err = rv
+	}
+	return rv, n, err
+}
+
 // TransmitHook is called after each packet is transmitted.
 var TransmitHook func(*gomemcached.MCRequest, int, error)
 
@@ -51,7 +126,22 @@ func transmitRequest(o io.Writer, req *gomemcached.MCRequest) (int, error) {
 	if o == nil {
 		return 0, errNoConn
 	}
-	n, err := req.Transmit(o)
+	var n int
+	var err error
+	if bw, ok := o.(*bufio.Writer); ok {
+		// Piecewise writes are cheap into a buffer, and save
+		// assembling the whole request.
+		var n64 int64
+		n64, err = req.WriteTo(bw)
+		n = int(n64)
+	} else {
+		n, err = req.Transmit(o)
+	}
+	// A writer breaking its contract with a short count and no
+	// error would leave the stream out of sync.
+	if err == nil && n != req.Size() {
+		err = io.ErrShortWrite
+	}
 	if TransmitHook != nil {
 		TransmitHook(req, n, err)
 	}
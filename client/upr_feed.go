@@ -147,7 +147,11 @@ loop:
 	for {
 		select {
 		case command := <-ch:
-			if err := mc.Transmit(command); err != nil {
+			err := mc.Transmit(command)
+			if err == nil {
+				err = mc.FlushBuffer()
+			}
+			if err != nil {
 				log.Printf("Failed to transmit command %s. Error %s", command.Opcode.String(), err.Error())
 				break loop
 			}
@@ -289,7 +293,11 @@ func (feed *UprFeed) UprRequestStream(vbno, opaqueMSB uint16, flags uint32,
 	feed.mu.Lock()
 	defer feed.mu.Unlock()
 
-	if err := feed.conn.Transmit(rq); err != nil {
+	err := feed.conn.Transmit(rq)
+	if err == nil {
+		err = feed.conn.FlushBuffer()
+	}
+	if err != nil {
 		log.Printf("Error in StreamRequest %s", err.Error())
 		return err
 	}
@@ -0,0 +1,95 @@
+package gomemcached
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// FrameID identifies an element of flexible framing extras.
+type FrameID uint8
+
+// Request framing extras.
+const (
+	FRAME_BARRIER    = FrameID(0x00)
+	FRAME_DURABILITY = FrameID(0x01)
+)
+
+// Response framing extras.
+const (
+	FRAME_SERVER_DURATION = FrameID(0x00)
+)
+
+// An id or length nibble of this value is continued in the next byte.
+const frameEscape = 0x0f
+
+// AppendFrame appends a framing extras element to b, for a request's
+// FramingExtras.
+func AppendFrame(b []byte, id FrameID, data []byte) []byte {
+	hdr := len(b)
+	b = append(b, 0)
+	if id < frameEscape {
+		b[hdr] = byte(id) << 4
+	} else {
+		b[hdr] = frameEscape << 4
+		b = append(b, byte(id-frameEscape))
+	}
+	if len(data) < frameEscape {
+		b[hdr] |= byte(len(data))
+	} else {
+		b[hdr] |= frameEscape
+		b = append(b, byte(len(data)-frameEscape))
+	}
+	return append(b, data...)
+}
+
+// frame returns the data of the first framing extras element with the
+// given id, if there is one.
+//
+// Each element starts with a byte holding its id in the high nibble
+// and data length in the low one.  An escaped nibble is 15 plus the
+// byte after it.
+func frame(extras []byte, id FrameID) ([]byte, bool) {
+	for len(extras) > 0 {
+		fid, flen := int(extras[0]>>4), int(extras[0]&0x0f)
+		extras = extras[1:]
+		if fid == frameEscape {
+			if len(extras) == 0 {
+				return nil, false
+			}
+			fid += int(extras[0])
+			extras = extras[1:]
+		}
+		if flen == frameEscape {
+			if len(extras) == 0 {
+				return nil, false
+			}
+			flen += int(extras[0])
+			extras = extras[1:]
+		}
+		if flen > len(extras) {
+			return nil, false
+		}
+		if FrameID(fid) == id {
+			return extras[:flen], true
+		}
+		extras = extras[flen:]
+	}
+	return nil, false
+}
+
+// ServerDuration is how long the server spent on the request, or 0
+// if the response doesn't say.
+//
+// Servers only report it on flexible framing responses once tracing
+// has been enabled with HELLO.
+func (res *MCResponse) ServerDuration() time.Duration {
+	b, ok := frame(res.FramingExtras, FRAME_SERVER_DURATION)
+	if !ok || len(b) != 2 {
+		return 0
+	}
+	// The duration is encoded as micros**(1/1.74), giving a wide
+	// range in two bytes.
+	us := math.Pow(float64(binary.BigEndian.Uint16(b)), 1.74)
+	return time.Duration(us * float64(time.Microsecond))
+}
@@ -0,0 +1,81 @@
+package gomemcached
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestServerDuration(t *testing.T) {
+	// A flexible framing response carrying an encoded duration of 100.
+	data := []byte{
+		FLEX_RES_MAGIC, byte(GET),
+		3,    // framing extras length
+		0,    // key length
+		0,    // extras length
+		0,    // datatype
+		0, 0, // status
+		0, 0, 0, 3, // total body length
+		0, 0, 0, 0, // opaque
+		0, 0, 0, 0, 0, 0, 0, 0, // cas
+		0x02, 0x00, 0x64, // server duration
+	}
+	res := MCResponse{}
+	if _, err := res.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	got := res.ServerDuration()
+	if exp := 3019951 * time.Nanosecond; got < exp-time.Microsecond || got > exp+time.Microsecond {
+		t.Errorf("Expected about %v, got %v", exp, got)
+	}
+
+	tests := []struct {
+		extras []byte
+		exp    time.Duration
+	}{
+		{nil, 0},
+		{[]byte{0x02, 0x00, 0x01}, time.Microsecond},
+		// After an unrelated element.
+		{[]byte{0x11, 0xff, 0x02, 0x00, 0x01}, time.Microsecond},
+		// After an element with an escaped id.
+		{[]byte{0xf1, 0x03, 0xff, 0x02, 0x00, 0x01}, time.Microsecond},
+		// Wrong length.
+		{[]byte{0x01, 0x01}, 0},
+		// Truncated.
+		{[]byte{0x02, 0x00}, 0},
+		{[]byte{0xf2}, 0},
+	}
+	for _, test := range tests {
+		res := MCResponse{FramingExtras: test.extras}
+		if got := res.ServerDuration(); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.extras, got)
+		}
+	}
+}
+
+func TestAppendFrame(t *testing.T) {
+	tests := []struct {
+		id   FrameID
+		data []byte
+		exp  []byte
+	}{
+		{FRAME_BARRIER, nil, []byte{0x00}},
+		{FRAME_DURABILITY, []byte{1}, []byte{0x11, 1}},
+		{FrameID(20), []byte{1, 2}, []byte{0xf2, 5, 1, 2}},
+		{FrameID(1), make([]byte, 16), append([]byte{0x1f, 1}, make([]byte, 16)...)},
+	}
+	for _, test := range tests {
+		got := AppendFrame(nil, test.id, test.data)
+		if !bytes.Equal(got, test.exp) {
+			t.Errorf("Expected %v for %v/%v, got %v", test.exp, test.id, test.data, got)
+		}
+		if data, ok := frame(got, test.id); !ok || !bytes.Equal(data, test.data) {
+			t.Errorf("Expected %v back, got %v/%v", test.data, data, ok)
+		}
+	}
+
+	b := AppendFrame(AppendFrame(nil, FRAME_BARRIER, nil), FRAME_DURABILITY, []byte{2})
+	if !bytes.Equal(b, []byte{0x00, 0x11, 2}) {
+		t.Errorf("Expected both elements, got %v", b)
+	}
+}
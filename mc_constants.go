@@ -8,6 +8,11 @@ import (
 const (
 	REQ_MAGIC = 0x80
 	RES_MAGIC = 0x81
+	// Requests with framing extras.
+	FLEX_MAGIC = 0x08
+	// Responses with framing extras, which servers send once a
+	// feature using them has been negotiated with HELLO.
+	FLEX_RES_MAGIC = 0x18
 )
 
 // CommandCode for memcached packets.
@@ -41,6 +46,11 @@ const (
 	FLUSHQ     = CommandCode(0x18)
 	APPENDQ    = CommandCode(0x19)
 	PREPENDQ   = CommandCode(0x1a)
+	VERBOSITY  = CommandCode(0x1b)
+	TOUCH      = CommandCode(0x1c)
+	GAT        = CommandCode(0x1d)
+	GATQ       = CommandCode(0x1e)
+	HELLO      = CommandCode(0x1f)
 	RGET       = CommandCode(0x30)
 	RSET       = CommandCode(0x31)
 	RSETQ      = CommandCode(0x32)
@@ -83,9 +93,44 @@ const (
 	UPR_BUFFERACK   = CommandCode(0x5d) // UPR Buffer Acknowledgement
 	UPR_CONTROL     = CommandCode(0x5e) // Set flow control params
 
+	GET_REPLICA   = CommandCode(0x83) // Get a value from a replica vbucket
 	SELECT_BUCKET = CommandCode(0x89) // Select bucket
 
-	OBSERVE = CommandCode(0x92)
+	OBSERVE_SEQNO = CommandCode(0x91) // Get a vbucket's persisted and current seqnos
+	OBSERVE       = CommandCode(0x92)
+	GET_LOCKED    = CommandCode(0x94) // Get a value and lock it
+	UNLOCK_KEY    = CommandCode(0x95) // Release a lock taken by GET_LOCKED
+
+	GET_META      = CommandCode(0xa0) // Get an item's metadata without its value
+	SET_WITH_META = CommandCode(0xa2) // Set a value, preserving given metadata
+	DEL_WITH_META = CommandCode(0xa8) // Delete a value, preserving given metadata
+
+	GET_CLUSTER_CONFIG = CommandCode(0xb5) // Get the cluster map, as JSON
+	GET_RANDOM_KEY     = CommandCode(0xb6) // Get a random item
+	COLLECTIONS_GET_ID = CommandCode(0xbb) // Look up a collection's ID
+
+	SUBDOC_GET              = CommandCode(0xc5) // Get a single path from a JSON document
+	SUBDOC_EXISTS           = CommandCode(0xc6) // Check whether a path exists
+	SUBDOC_DICT_ADD         = CommandCode(0xc7) // Add a dictionary entry
+	SUBDOC_DICT_UPSERT      = CommandCode(0xc8) // Set a dictionary entry
+	SUBDOC_DELETE           = CommandCode(0xc9) // Remove a path
+	SUBDOC_REPLACE          = CommandCode(0xca) // Replace an existing path
+	SUBDOC_ARRAY_PUSH_LAST  = CommandCode(0xcb) // Append to an array
+	SUBDOC_ARRAY_PUSH_FIRST = CommandCode(0xcc) // Prepend to an array
+	SUBDOC_ARRAY_INSERT     = CommandCode(0xcd) // Insert into an array
+	SUBDOC_ARRAY_ADD_UNIQUE = CommandCode(0xce) // Append to an array if not present
+	SUBDOC_COUNTER          = CommandCode(0xcf) // Add to a number
+	SUBDOC_MULTI_LOOKUP     = CommandCode(0xd0) // Several lookups in one request
+	SUBDOC_MULTI_MUTATION   = CommandCode(0xd1) // Several mutations applied atomically
+	SUBDOC_GET_COUNT        = CommandCode(0xd2) // Count the elements at a path
+
+	GET_ERROR_MAP = CommandCode(0xfe) // Get the server's descriptions of its statuses
+)
+
+// Subdocument path flags.
+const (
+	SUBDOC_FLAG_MKDIR_P = uint8(0x01) // Create missing parents of the path
+	SUBDOC_FLAG_XATTR   = uint8(0x04) // The path is in the extended attributes
 )
 
 // Status field for memcached response.
@@ -100,11 +145,98 @@ const (
 	NOT_STORED      = Status(0x05)
 	DELTA_BADVAL    = Status(0x06)
 	NOT_MY_VBUCKET  = Status(0x07)
+	LOCKED          = Status(0x09)
+	AUTH_ERROR      = Status(0x20)
+	AUTH_CONTINUE   = Status(0x21)
 	ERANGE          = Status(0x22)
 	ROLLBACK        = Status(0x23)
+	EACCESS         = Status(0x24)
 	UNKNOWN_COMMAND = Status(0x81)
 	ENOMEM          = Status(0x82)
+	NOT_SUPPORTED   = Status(0x83)
 	TMPFAIL         = Status(0x86)
+
+	// Collections statuses.
+	UNKNOWN_COLLECTION = Status(0x88) // No such collection
+	UNKNOWN_SCOPE      = Status(0x8c) // No such scope
+
+	// Synchronous replication statuses.
+	DURABILITY_INVALID_LEVEL = Status(0xa0) // Unknown durability level
+	DURABILITY_IMPOSSIBLE    = Status(0xa1) // Not enough nodes to meet the durability level
+	SYNC_WRITE_IN_PROGRESS   = Status(0xa2) // A durable write to the key is still pending
+	SYNC_WRITE_AMBIGUOUS     = Status(0xa3) // A durable write's outcome is unknown
+
+	// Subdocument statuses.
+	SUBDOC_PATH_ENOENT        = Status(0xc0) // Path doesn't exist
+	SUBDOC_PATH_MISMATCH      = Status(0xc1) // Path doesn't match the document structure
+	SUBDOC_PATH_EINVAL        = Status(0xc2) // Path syntax is invalid
+	SUBDOC_PATH_E2BIG         = Status(0xc3) // Path is too long
+	SUBDOC_DOC_E2DEEP         = Status(0xc4) // Document is too deeply nested
+	SUBDOC_VALUE_CANTINSERT   = Status(0xc5) // Value can't be inserted
+	SUBDOC_DOC_NOT_JSON       = Status(0xc6) // Document isn't JSON
+	SUBDOC_NUM_ERANGE         = Status(0xc7) // Existing number is out of range
+	SUBDOC_DELTA_ERANGE       = Status(0xc8) // Counter delta is out of range
+	SUBDOC_PATH_EEXISTS       = Status(0xc9) // Path already exists
+	SUBDOC_VALUE_ETOODEEP     = Status(0xca) // Value would make the document too deep
+	SUBDOC_INVALID_COMBO      = Status(0xcb) // Invalid combination of commands
+	SUBDOC_MULTI_PATH_FAILURE = Status(0xcc) // One or more paths in a multi op failed
+)
+
+// Feature is a protocol feature negotiated with HELLO.
+type Feature uint16
+
+const (
+	FEATURE_DATATYPE         = Feature(0x01)
+	FEATURE_TLS              = Feature(0x02)
+	FEATURE_TCPNODELAY       = Feature(0x03)
+	FEATURE_MUTATION_SEQNO   = Feature(0x04)
+	FEATURE_TCPDELAY         = Feature(0x05)
+	FEATURE_XATTR            = Feature(0x06)
+	FEATURE_XERROR           = Feature(0x07)
+	FEATURE_SELECT_BUCKET    = Feature(0x08)
+	FEATURE_SNAPPY           = Feature(0x0a)
+	FEATURE_JSON             = Feature(0x0b)
+	FEATURE_DUPLEX           = Feature(0x0c)
+	FEATURE_TRACING          = Feature(0x0f)
+	FEATURE_ALT_REQUEST      = Feature(0x10)
+	FEATURE_SYNC_REPLICATION = Feature(0x11)
+	FEATURE_COLLECTIONS      = Feature(0x12)
+)
+
+// FeatureNames human readable names for HELLO features.
+var FeatureNames = map[Feature]string{
+	FEATURE_DATATYPE:         "DATATYPE",
+	FEATURE_TLS:              "TLS",
+	FEATURE_TCPNODELAY:       "TCPNODELAY",
+	FEATURE_MUTATION_SEQNO:   "MUTATION_SEQNO",
+	FEATURE_TCPDELAY:         "TCPDELAY",
+	FEATURE_XATTR:            "XATTR",
+	FEATURE_XERROR:           "XERROR",
+	FEATURE_SELECT_BUCKET:    "SELECT_BUCKET",
+	FEATURE_SNAPPY:           "SNAPPY",
+	FEATURE_JSON:             "JSON",
+	FEATURE_DUPLEX:           "DUPLEX",
+	FEATURE_TRACING:          "TRACING",
+	FEATURE_ALT_REQUEST:      "ALT_REQUEST",
+	FEATURE_SYNC_REPLICATION: "SYNC_REPLICATION",
+	FEATURE_COLLECTIONS:      "COLLECTIONS",
+}
+
+// String a feature.
+func (f Feature) String() (rv string) {
+	rv = FeatureNames[f]
+	if rv == "" {
+		rv = fmt.Sprintf("0x%02x", int(f))
+	}
+	return rv
+}
+
+// Datatype flags, found in byte 5 of the header.
+const (
+	DATATYPE_RAW    = uint8(0x00)
+	DATATYPE_JSON   = uint8(0x01)
+	DATATYPE_SNAPPY = uint8(0x02)
+	DATATYPE_XATTR  = uint8(0x04)
 )
 
 // MCItem is an internal representation of an item.
@@ -152,6 +284,11 @@ func init() {
 	CommandNames[FLUSHQ] = "FLUSHQ"
 	CommandNames[APPENDQ] = "APPENDQ"
 	CommandNames[PREPENDQ] = "PREPENDQ"
+	CommandNames[VERBOSITY] = "VERBOSITY"
+	CommandNames[TOUCH] = "TOUCH"
+	CommandNames[GAT] = "GAT"
+	CommandNames[GATQ] = "GATQ"
+	CommandNames[HELLO] = "HELLO"
 	CommandNames[RGET] = "RGET"
 	CommandNames[RSET] = "RSET"
 	CommandNames[RSETQ] = "RSETQ"
@@ -194,6 +331,36 @@ func init() {
 	CommandNames[UPR_BUFFERACK] = "UPR_BUFFERACK"
 	CommandNames[UPR_CONTROL] = "UPR_CONTROL"
 
+	CommandNames[GET_REPLICA] = "GET_REPLICA"
+	CommandNames[SELECT_BUCKET] = "SELECT_BUCKET"
+	CommandNames[OBSERVE_SEQNO] = "OBSERVE_SEQNO"
+	CommandNames[OBSERVE] = "OBSERVE"
+	CommandNames[GET_LOCKED] = "GET_LOCKED"
+	CommandNames[UNLOCK_KEY] = "UNLOCK_KEY"
+	CommandNames[GET_META] = "GET_META"
+	CommandNames[SET_WITH_META] = "SET_WITH_META"
+	CommandNames[DEL_WITH_META] = "DEL_WITH_META"
+	CommandNames[GET_CLUSTER_CONFIG] = "GET_CLUSTER_CONFIG"
+	CommandNames[GET_RANDOM_KEY] = "GET_RANDOM_KEY"
+	CommandNames[COLLECTIONS_GET_ID] = "COLLECTIONS_GET_ID"
+
+	CommandNames[SUBDOC_GET] = "SUBDOC_GET"
+	CommandNames[SUBDOC_EXISTS] = "SUBDOC_EXISTS"
+	CommandNames[SUBDOC_DICT_ADD] = "SUBDOC_DICT_ADD"
+	CommandNames[SUBDOC_DICT_UPSERT] = "SUBDOC_DICT_UPSERT"
+	CommandNames[SUBDOC_DELETE] = "SUBDOC_DELETE"
+	CommandNames[SUBDOC_REPLACE] = "SUBDOC_REPLACE"
+	CommandNames[SUBDOC_ARRAY_PUSH_LAST] = "SUBDOC_ARRAY_PUSH_LAST"
+	CommandNames[SUBDOC_ARRAY_PUSH_FIRST] = "SUBDOC_ARRAY_PUSH_FIRST"
+	CommandNames[SUBDOC_ARRAY_INSERT] = "SUBDOC_ARRAY_INSERT"
+	CommandNames[SUBDOC_ARRAY_ADD_UNIQUE] = "SUBDOC_ARRAY_ADD_UNIQUE"
+	CommandNames[SUBDOC_COUNTER] = "SUBDOC_COUNTER"
+	CommandNames[SUBDOC_MULTI_LOOKUP] = "SUBDOC_MULTI_LOOKUP"
+	CommandNames[SUBDOC_MULTI_MUTATION] = "SUBDOC_MULTI_MUTATION"
+	CommandNames[SUBDOC_GET_COUNT] = "SUBDOC_GET_COUNT"
+
+	CommandNames[GET_ERROR_MAP] = "GET_ERROR_MAP"
+
 	StatusNames = make(map[Status]string)
 	StatusNames[SUCCESS] = "SUCCESS"
 	StatusNames[KEY_ENOENT] = "KEY_ENOENT"
@@ -203,11 +370,37 @@ func init() {
 	StatusNames[NOT_STORED] = "NOT_STORED"
 	StatusNames[DELTA_BADVAL] = "DELTA_BADVAL"
 	StatusNames[NOT_MY_VBUCKET] = "NOT_MY_VBUCKET"
+	StatusNames[LOCKED] = "LOCKED"
+	StatusNames[AUTH_ERROR] = "AUTH_ERROR"
+	StatusNames[AUTH_CONTINUE] = "AUTH_CONTINUE"
 	StatusNames[UNKNOWN_COMMAND] = "UNKNOWN_COMMAND"
 	StatusNames[ERANGE] = "ERANGE"
 	StatusNames[ROLLBACK] = "ROLLBACK"
+	StatusNames[EACCESS] = "EACCESS"
 	StatusNames[ENOMEM] = "ENOMEM"
+	StatusNames[NOT_SUPPORTED] = "NOT_SUPPORTED"
 	StatusNames[TMPFAIL] = "TMPFAIL"
+	StatusNames[UNKNOWN_COLLECTION] = "UNKNOWN_COLLECTION"
+	StatusNames[UNKNOWN_SCOPE] = "UNKNOWN_SCOPE"
+
+	StatusNames[DURABILITY_INVALID_LEVEL] = "DURABILITY_INVALID_LEVEL"
+	StatusNames[DURABILITY_IMPOSSIBLE] = "DURABILITY_IMPOSSIBLE"
+	StatusNames[SYNC_WRITE_IN_PROGRESS] = "SYNC_WRITE_IN_PROGRESS"
+	StatusNames[SYNC_WRITE_AMBIGUOUS] = "SYNC_WRITE_AMBIGUOUS"
+
+	StatusNames[SUBDOC_PATH_ENOENT] = "SUBDOC_PATH_ENOENT"
+	StatusNames[SUBDOC_PATH_MISMATCH] = "SUBDOC_PATH_MISMATCH"
+	StatusNames[SUBDOC_PATH_EINVAL] = "SUBDOC_PATH_EINVAL"
+	StatusNames[SUBDOC_PATH_E2BIG] = "SUBDOC_PATH_E2BIG"
+	StatusNames[SUBDOC_DOC_E2DEEP] = "SUBDOC_DOC_E2DEEP"
+	StatusNames[SUBDOC_VALUE_CANTINSERT] = "SUBDOC_VALUE_CANTINSERT"
+	StatusNames[SUBDOC_DOC_NOT_JSON] = "SUBDOC_DOC_NOT_JSON"
+	StatusNames[SUBDOC_NUM_ERANGE] = "SUBDOC_NUM_ERANGE"
+	StatusNames[SUBDOC_DELTA_ERANGE] = "SUBDOC_DELTA_ERANGE"
+	StatusNames[SUBDOC_PATH_EEXISTS] = "SUBDOC_PATH_EEXISTS"
+	StatusNames[SUBDOC_VALUE_ETOODEEP] = "SUBDOC_VALUE_ETOODEEP"
+	StatusNames[SUBDOC_INVALID_COMBO] = "SUBDOC_INVALID_COMBO"
+	StatusNames[SUBDOC_MULTI_PATH_FAILURE] = "SUBDOC_MULTI_PATH_FAILURE"
 
 }
 
@@ -220,7 +413,7 @@ func (o CommandCode) String() (rv string) {
 	return rv
 }
 
-// String an op code.
+// String a status.
 func (s Status) String() (rv string) {
 	rv = StatusNames[s]
 	if rv == "" {
@@ -244,6 +437,7 @@ func (o CommandCode) IsQuiet() bool {
 		FLUSHQ,
 		APPENDQ,
 		PREPENDQ,
+		GATQ,
 		RSETQ,
 		RAPPENDQ,
 		RPREPENDQ,
@@ -28,6 +28,170 @@ func TestStatusNameString(t *testing.T) {
 	}
 }
 
+func TestCommandCodeStringAll(t *testing.T) {
+	tests := []struct {
+		c   CommandCode
+		exp string
+	}{
+		{GET, "GET"},
+		{SET, "SET"},
+		{ADD, "ADD"},
+		{REPLACE, "REPLACE"},
+		{DELETE, "DELETE"},
+		{INCREMENT, "INCREMENT"},
+		{DECREMENT, "DECREMENT"},
+		{QUIT, "QUIT"},
+		{FLUSH, "FLUSH"},
+		{GETQ, "GETQ"},
+		{NOOP, "NOOP"},
+		{VERSION, "VERSION"},
+		{GETK, "GETK"},
+		{GETKQ, "GETKQ"},
+		{APPEND, "APPEND"},
+		{PREPEND, "PREPEND"},
+		{STAT, "STAT"},
+		{SETQ, "SETQ"},
+		{ADDQ, "ADDQ"},
+		{REPLACEQ, "REPLACEQ"},
+		{DELETEQ, "DELETEQ"},
+		{INCREMENTQ, "INCREMENTQ"},
+		{DECREMENTQ, "DECREMENTQ"},
+		{QUITQ, "QUITQ"},
+		{FLUSHQ, "FLUSHQ"},
+		{APPENDQ, "APPENDQ"},
+		{PREPENDQ, "PREPENDQ"},
+		{VERBOSITY, "VERBOSITY"},
+		{TOUCH, "TOUCH"},
+		{GAT, "GAT"},
+		{GATQ, "GATQ"},
+		{HELLO, "HELLO"},
+		{RGET, "RGET"},
+		{RSET, "RSET"},
+		{RSETQ, "RSETQ"},
+		{RAPPEND, "RAPPEND"},
+		{RAPPENDQ, "RAPPENDQ"},
+		{RPREPEND, "RPREPEND"},
+		{RPREPENDQ, "RPREPENDQ"},
+		{RDELETE, "RDELETE"},
+		{RDELETEQ, "RDELETEQ"},
+		{RINCR, "RINCR"},
+		{RINCRQ, "RINCRQ"},
+		{RDECR, "RDECR"},
+		{RDECRQ, "RDECRQ"},
+		{SASL_LIST_MECHS, "SASL_LIST_MECHS"},
+		{SASL_AUTH, "SASL_AUTH"},
+		{SASL_STEP, "SASL_STEP"},
+		{TAP_CONNECT, "TAP_CONNECT"},
+		{TAP_MUTATION, "TAP_MUTATION"},
+		{TAP_DELETE, "TAP_DELETE"},
+		{TAP_FLUSH, "TAP_FLUSH"},
+		{TAP_OPAQUE, "TAP_OPAQUE"},
+		{TAP_VBUCKET_SET, "TAP_VBUCKET_SET"},
+		{TAP_CHECKPOINT_START, "TAP_CHECKPOINT_START"},
+		{TAP_CHECKPOINT_END, "TAP_CHECKPOINT_END"},
+		{UPR_OPEN, "UPR_OPEN"},
+		{UPR_ADDSTREAM, "UPR_ADDSTREAM"},
+		{UPR_CLOSESTREAM, "UPR_CLOSESTREAM"},
+		{UPR_FAILOVERLOG, "UPR_FAILOVERLOG"},
+		{UPR_STREAMREQ, "UPR_STREAMREQ"},
+		{UPR_STREAMEND, "UPR_STREAMEND"},
+		{UPR_SNAPSHOT, "UPR_SNAPSHOT"},
+		{UPR_MUTATION, "UPR_MUTATION"},
+		{UPR_DELETION, "UPR_DELETION"},
+		{UPR_EXPIRATION, "UPR_EXPIRATION"},
+		{UPR_FLUSH, "UPR_FLUSH"},
+		{UPR_NOOP, "UPR_NOOP"},
+		{UPR_BUFFERACK, "UPR_BUFFERACK"},
+		{UPR_CONTROL, "UPR_CONTROL"},
+		{GET_REPLICA, "GET_REPLICA"},
+		{SELECT_BUCKET, "SELECT_BUCKET"},
+		{OBSERVE_SEQNO, "OBSERVE_SEQNO"},
+		{OBSERVE, "OBSERVE"},
+		{GET_LOCKED, "GET_LOCKED"},
+		{UNLOCK_KEY, "UNLOCK_KEY"},
+		{GET_META, "GET_META"},
+		{SET_WITH_META, "SET_WITH_META"},
+		{DEL_WITH_META, "DEL_WITH_META"},
+		{GET_CLUSTER_CONFIG, "GET_CLUSTER_CONFIG"},
+		{GET_RANDOM_KEY, "GET_RANDOM_KEY"},
+		{COLLECTIONS_GET_ID, "COLLECTIONS_GET_ID"},
+		{SUBDOC_GET, "SUBDOC_GET"},
+		{SUBDOC_EXISTS, "SUBDOC_EXISTS"},
+		{SUBDOC_DICT_ADD, "SUBDOC_DICT_ADD"},
+		{SUBDOC_DICT_UPSERT, "SUBDOC_DICT_UPSERT"},
+		{SUBDOC_DELETE, "SUBDOC_DELETE"},
+		{SUBDOC_REPLACE, "SUBDOC_REPLACE"},
+		{SUBDOC_ARRAY_PUSH_LAST, "SUBDOC_ARRAY_PUSH_LAST"},
+		{SUBDOC_ARRAY_PUSH_FIRST, "SUBDOC_ARRAY_PUSH_FIRST"},
+		{SUBDOC_ARRAY_INSERT, "SUBDOC_ARRAY_INSERT"},
+		{SUBDOC_ARRAY_ADD_UNIQUE, "SUBDOC_ARRAY_ADD_UNIQUE"},
+		{SUBDOC_COUNTER, "SUBDOC_COUNTER"},
+		{SUBDOC_MULTI_LOOKUP, "SUBDOC_MULTI_LOOKUP"},
+		{SUBDOC_MULTI_MUTATION, "SUBDOC_MULTI_MUTATION"},
+		{SUBDOC_GET_COUNT, "SUBDOC_GET_COUNT"},
+		{GET_ERROR_MAP, "GET_ERROR_MAP"},
+		{CommandCode(0xfd), "0xfd"},
+	}
+
+	for _, x := range tests {
+		if x.c.String() != x.exp {
+			t.Errorf("Expected %q for 0x%02x, got %q", x.exp, int(x.c), x.c.String())
+		}
+	}
+}
+
+func TestStatusStringAll(t *testing.T) {
+	tests := []struct {
+		s   Status
+		exp string
+	}{
+		{SUCCESS, "SUCCESS"},
+		{KEY_ENOENT, "KEY_ENOENT"},
+		{KEY_EEXISTS, "KEY_EEXISTS"},
+		{E2BIG, "E2BIG"},
+		{EINVAL, "EINVAL"},
+		{NOT_STORED, "NOT_STORED"},
+		{DELTA_BADVAL, "DELTA_BADVAL"},
+		{NOT_MY_VBUCKET, "NOT_MY_VBUCKET"},
+		{LOCKED, "LOCKED"},
+		{AUTH_ERROR, "AUTH_ERROR"},
+		{AUTH_CONTINUE, "AUTH_CONTINUE"},
+		{ERANGE, "ERANGE"},
+		{ROLLBACK, "ROLLBACK"},
+		{EACCESS, "EACCESS"},
+		{UNKNOWN_COMMAND, "UNKNOWN_COMMAND"},
+		{ENOMEM, "ENOMEM"},
+		{NOT_SUPPORTED, "NOT_SUPPORTED"},
+		{TMPFAIL, "TMPFAIL"},
+		{UNKNOWN_COLLECTION, "UNKNOWN_COLLECTION"},
+		{UNKNOWN_SCOPE, "UNKNOWN_SCOPE"},
+		{DURABILITY_INVALID_LEVEL, "DURABILITY_INVALID_LEVEL"},
+		{DURABILITY_IMPOSSIBLE, "DURABILITY_IMPOSSIBLE"},
+		{SYNC_WRITE_IN_PROGRESS, "SYNC_WRITE_IN_PROGRESS"},
+		{SYNC_WRITE_AMBIGUOUS, "SYNC_WRITE_AMBIGUOUS"},
+		{SUBDOC_PATH_ENOENT, "SUBDOC_PATH_ENOENT"},
+		{SUBDOC_PATH_MISMATCH, "SUBDOC_PATH_MISMATCH"},
+		{SUBDOC_PATH_EINVAL, "SUBDOC_PATH_EINVAL"},
+		{SUBDOC_PATH_E2BIG, "SUBDOC_PATH_E2BIG"},
+		{SUBDOC_DOC_E2DEEP, "SUBDOC_DOC_E2DEEP"},
+		{SUBDOC_VALUE_CANTINSERT, "SUBDOC_VALUE_CANTINSERT"},
+		{SUBDOC_DOC_NOT_JSON, "SUBDOC_DOC_NOT_JSON"},
+		{SUBDOC_NUM_ERANGE, "SUBDOC_NUM_ERANGE"},
+		{SUBDOC_DELTA_ERANGE, "SUBDOC_DELTA_ERANGE"},
+		{SUBDOC_PATH_EEXISTS, "SUBDOC_PATH_EEXISTS"},
+		{SUBDOC_VALUE_ETOODEEP, "SUBDOC_VALUE_ETOODEEP"},
+		{SUBDOC_INVALID_COMBO, "SUBDOC_INVALID_COMBO"},
+		{SUBDOC_MULTI_PATH_FAILURE, "SUBDOC_MULTI_PATH_FAILURE"},
+		{Status(0xfe), "0xfe"},
+	}
+
+	for _, x := range tests {
+		if x.s.String() != x.exp {
+			t.Errorf("Expected %q for 0x%02x, got %q", x.exp, int(x.s), x.s.String())
+		}
+	}
+}
+
 func TestIsQuiet(t *testing.T) {
 	for v, k := range CommandNames {
 		isq := strings.HasSuffix(k, "Q") && (k != CommandNames[UPR_STREAMREQ])
@@ -36,3 +200,15 @@ func TestIsQuiet(t *testing.T) {
 		}
 	}
 }
+
+func TestFeatureString(t *testing.T) {
+	if FEATURE_SNAPPY.String() != "SNAPPY" {
+		t.Fatalf("Expected \"SNAPPY\" for FEATURE_SNAPPY, got \"%v\"",
+			FEATURE_SNAPPY.String())
+	}
+
+	f := Feature(0x80)
+	if f.String() != "0x80" {
+		t.Fatalf("Expected \"0x80\" for 0x80, got \"%v\"", f.String())
+	}
+}
@@ -2,14 +2,27 @@ package gomemcached
 
 import (
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"sync"
 )
 
 // The maximum reasonable body length to expect.
 // Anything larger than this will result in an error.
 var MaxBodyLen = int(1e6)
 
+// MaxFlexLen is the longest key, and the most framing extras, a
+// request with framing extras can have: the flexible framing header
+// gives each length in a single byte.
+const MaxFlexLen = 255
+
+// ErrFlexTooLong is returned for a request with framing extras whose
+// key or framing extras are longer than MaxFlexLen.
+var ErrFlexTooLong = errors.New("too long for flexible framing")
+
 // MCRequest is memcached Request
 type MCRequest struct {
 	// The command being issued
@@ -20,43 +33,118 @@ type MCRequest struct {
 	Opaque uint32
 	// The vbucket to which this command belongs
 	VBucket uint16
+	// Datatype flags describing the body (DATATYPE_JSON, etc.)
+	Datatype uint8
 	// Command extras, key, and body
 	Extras, Key, Body []byte
+	// Framing extras, sent with the flexible framing (FLEX_MAGIC)
+	// header when set
+	FramingExtras []byte
 }
 
-// Size gives the number of bytes this request requires.
+// Size gives the number of bytes this request requires on the wire,
+// as written by Bytes, WriteTo and Transmit, without encoding it.
 func (req *MCRequest) Size() int {
-	return HDR_LEN + len(req.Extras) + len(req.Key) + len(req.Body)
+	return HDR_LEN + len(req.FramingExtras) + len(req.Extras) + len(req.Key) + len(req.Body)
 }
 
 // A debugging string representation of this request
 func (req MCRequest) String() string {
-	return fmt.Sprintf("{MCRequest opcode=%s, bodylen=%d, key='%s'}",
-		req.Opcode, len(req.Body), req.Key)
+	return fmt.Sprintf("{MCRequest opcode=%s, key=%s, vbucket=%d, cas=%d, opaque=%d, bodylen=%d}",
+		req.Opcode, debugKey(req.Key), req.VBucket, req.Cas, req.Opaque, len(req.Body))
+}
+
+// HexDump is a hex dump of the request as sent on the wire.
+func (req *MCRequest) HexDump() string {
+	return hex.Dump(req.Bytes())
+}
+
+// debugKey renders a key for String: quoted if it's printable, such
+// as a plain key, or in hex if not, such as one prefixed with a
+// collection ID.
+func debugKey(k []byte) string {
+	s := string(k)
+	for _, r := range s {
+		if !strconv.IsPrint(r) {
+			return "0x" + hex.EncodeToString(k)
+		}
+	}
+	return strconv.Quote(s)
 }
 
 func (req *MCRequest) fillHeaderBytes(data []byte) int {
+	pos := req.fillHeader(data)
+
+	if len(req.FramingExtras) > 0 {
+		copy(data[pos:pos+len(req.FramingExtras)], req.FramingExtras)
+		pos += len(req.FramingExtras)
+	}
+
+	if len(req.Extras) > 0 {
+		copy(data[pos:pos+len(req.Extras)], req.Extras)
+		pos += len(req.Extras)
+	}
+
+	if len(req.Key) > 0 {
+		copy(data[pos:pos+len(req.Key)], req.Key)
+		pos += len(req.Key)
+	}
+	return pos
+}
+
+// checkFlex returns ErrFlexTooLong if the request can't be framed.
+func (req *MCRequest) checkFlex() error {
+	if len(req.FramingExtras) == 0 {
+		return nil
+	}
+	if len(req.Key) > MaxFlexLen {
+		return fmt.Errorf("%w: key is %d bytes (max %d)", ErrFlexTooLong, len(req.Key), MaxFlexLen)
+	}
+	if len(req.FramingExtras) > MaxFlexLen {
+		return fmt.Errorf("%w: framing extras are %d bytes (max %d)",
+			ErrFlexTooLong, len(req.FramingExtras), MaxFlexLen)
+	}
+	return nil
+}
 
+// fillHeader fills in just the fixed size header, in the flexible
+// framing form if the request has framing extras.  It panics if the
+// lengths don't fit that form, rather than writing a corrupt header.
+func (req *MCRequest) fillHeader(data []byte) int {
 	pos := 0
-	data[pos] = REQ_MAGIC
-	pos++
-	data[pos] = byte(req.Opcode)
-	pos++
-	binary.BigEndian.PutUint16(data[pos:pos+2],
-		uint16(len(req.Key)))
-	pos += 2
+	if len(req.FramingExtras) > 0 {
+		if err := req.checkFlex(); err != nil {
+			panic(err)
+		}
+		data[pos] = FLEX_MAGIC
+		pos++
+		data[pos] = byte(req.Opcode)
+		pos++
+		data[pos] = byte(len(req.FramingExtras))
+		pos++
+		data[pos] = byte(len(req.Key))
+		pos++
+	} else {
+		data[pos] = REQ_MAGIC
+		pos++
+		data[pos] = byte(req.Opcode)
+		pos++
+		binary.BigEndian.PutUint16(data[pos:pos+2],
+			uint16(len(req.Key)))
+		pos += 2
+	}
 
 	// 4
 	data[pos] = byte(len(req.Extras))
 	pos++
-	// data[pos] = 0
+	data[pos] = req.Datatype
 	pos++
 	binary.BigEndian.PutUint16(data[pos:pos+2], req.VBucket)
 	pos += 2
 
 	// 8
 	binary.BigEndian.PutUint32(data[pos:pos+4],
-		uint32(len(req.Body)+len(req.Key)+len(req.Extras)))
+		uint32(len(req.Body)+len(req.Key)+len(req.Extras)+len(req.FramingExtras)))
 	pos += 4
 
 	// 12
@@ -69,22 +157,14 @@ func (req *MCRequest) fillHeaderBytes(data []byte) int {
 	}
 	pos += 8
 
-	if len(req.Extras) > 0 {
-		copy(data[pos:pos+len(req.Extras)], req.Extras)
-		pos += len(req.Extras)
-	}
-
-	if len(req.Key) > 0 {
-		copy(data[pos:pos+len(req.Key)], req.Key)
-		pos += len(req.Key)
-	}
 	return pos
 }
 
 // HeaderBytes will return the wire representation of the request header
-// (with the extras and key).
+// (with the extras and key).  Like Bytes, it panics with
+// ErrFlexTooLong if the request can't be framed.
 func (req *MCRequest) HeaderBytes() []byte {
-	data := make([]byte, HDR_LEN+len(req.Extras)+len(req.Key))
+	data := make([]byte, HDR_LEN+len(req.FramingExtras)+len(req.Extras)+len(req.Key))
 
 	req.fillHeaderBytes(data)
 
@@ -92,6 +172,10 @@ func (req *MCRequest) HeaderBytes() []byte {
 }
 
 // Bytes will return the wire representation of this request.
+//
+// It panics with ErrFlexTooLong if the request has framing extras and
+// a key or framing extras longer than MaxFlexLen; Transmit and
+// WriteTo return the error instead.
 func (req *MCRequest) Bytes() []byte {
 	data := make([]byte, req.Size())
 
@@ -106,6 +190,9 @@ func (req *MCRequest) Bytes() []byte {
 
 // Transmit will send this request message across a writer.
 func (req *MCRequest) Transmit(w io.Writer) (n int, err error) {
+	if err := req.checkFlex(); err != nil {
+		return 0, err
+	}
 	if len(req.Body) < 128 {
 		n, err = w.Write(req.Bytes())
 	} else {
@@ -119,6 +206,37 @@ func (req *MCRequest) Transmit(w io.Writer) (n int, err error) {
 	return
 }
 
+// WriteTo writes this request to w without first assembling it into
+// a single buffer.
+//
+// The header, extras, key, and body are written separately, so w
+// should be buffered.
+func (req *MCRequest) WriteTo(w io.Writer) (n int64, err error) {
+	if err := req.checkFlex(); err != nil {
+		return 0, err
+	}
+	hdr := hdrPool.Get().(*[HDR_LEN]byte)
+	defer hdrPool.Put(hdr)
+	*hdr = [HDR_LEN]byte{}
+	req.fillHeader(hdr[:])
+
+	for _, b := range [][]byte{hdr[:], req.FramingExtras, req.Extras, req.Key, req.Body} {
+		if len(b) == 0 {
+			continue
+		}
+		m, err := w.Write(b)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Scratch headers for WriteTo, which would otherwise escape to the
+// heap on every call.
+var hdrPool = sync.Pool{New: func() interface{} { return new([HDR_LEN]byte) }}
+
 // Receive will fill this MCRequest with the data from a reader.
 func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	if len(hdrBytes) < HDR_LEN {
@@ -132,18 +250,28 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 		return n, err
 	}
 
-	if hdrBytes[0] != RES_MAGIC && hdrBytes[0] != REQ_MAGIC {
+	var flen, klen int
+	switch hdrBytes[0] {
+	case RES_MAGIC, REQ_MAGIC:
+		klen = int(binary.BigEndian.Uint16(hdrBytes[2:]))
+	case FLEX_MAGIC:
+		flen = int(hdrBytes[2])
+		klen = int(hdrBytes[3])
+	default:
 		return n, fmt.Errorf("bad magic: 0x%02x", hdrBytes[0])
 	}
-
-	klen := int(binary.BigEndian.Uint16(hdrBytes[2:]))
 	elen := int(hdrBytes[4])
 
 	req.Opcode = CommandCode(hdrBytes[1])
+	req.Datatype = hdrBytes[5]
 	// Vbucket at 6:7
 	req.VBucket = binary.BigEndian.Uint16(hdrBytes[6:])
-	bodyLen := int(binary.BigEndian.Uint32(hdrBytes[8:]) -
-		uint32(klen) - uint32(elen))
+	totalLen := int(binary.BigEndian.Uint32(hdrBytes[8:]))
+	if totalLen < flen+klen+elen {
+		return n, fmt.Errorf("total body length %d is less than key+extras length %d",
+			totalLen, flen+klen+elen)
+	}
+	bodyLen := totalLen - flen - klen - elen
 	if bodyLen > MaxBodyLen {
 		return n, fmt.Errorf("%d is too big (max %d)",
 			bodyLen, MaxBodyLen)
@@ -151,10 +279,15 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	req.Opaque = binary.BigEndian.Uint32(hdrBytes[12:])
 	req.Cas = binary.BigEndian.Uint64(hdrBytes[16:])
 
-	buf := make([]byte, klen+elen+bodyLen)
+	buf := make([]byte, flen+klen+elen+bodyLen)
 	m, err := io.ReadFull(r, buf)
 	n += m
 	if err == nil {
+		req.FramingExtras = nil
+		if flen > 0 {
+			req.FramingExtras = buf[:flen]
+			buf = buf[flen:]
+		}
 		if req.Opcode >= TAP_MUTATION &&
 			req.Opcode <= TAP_CHECKPOINT_END &&
 			len(buf) > 1 {
@@ -1,7 +1,10 @@
 package gomemcached
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"reflect"
@@ -42,7 +45,7 @@ func TestEncodingRequest(t *testing.T) {
 			expected, got)
 	}
 
-	exp := `{MCRequest opcode=SET, bodylen=9, key='somekey'}`
+	exp := `{MCRequest opcode=SET, key="somekey", vbucket=824, cas=938424885, opaque=7242, bodylen=9}`
 	if req.String() != exp {
 		t.Errorf("Expected string=%q, got %q", exp, req.String())
 	}
@@ -178,6 +181,137 @@ func BenchmarkEncodingRequest1Extra(b *testing.B) {
 	}
 }
 
+func TestRequestDatatype(t *testing.T) {
+	req := MCRequest{
+		Opcode:   SET,
+		Datatype: DATATYPE_JSON,
+		Key:      []byte("k"),
+		Body:     []byte("{}"),
+	}
+	data := req.Bytes()
+	if data[5] != DATATYPE_JSON {
+		t.Fatalf("Expected datatype in byte 5, got %v", data[:HDR_LEN])
+	}
+	var buf bytes.Buffer
+	if _, err := req.WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Expected WriteTo to write %v, got %v/%v", data, buf.Bytes(), err)
+	}
+
+	got := MCRequest{}
+	if _, err := got.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if got.Datatype != DATATYPE_JSON {
+		t.Errorf("Expected datatype to round trip, got %#x", got.Datatype)
+	}
+}
+
+func TestRequestSize(t *testing.T) {
+	for _, req := range []MCRequest{
+		{},
+		{Opcode: NOOP},
+		{Opcode: GET, Key: []byte("somekey")},
+		{Opcode: SET, Extras: make([]byte, 8), Key: []byte("k")},
+		{Opcode: APPEND, Key: []byte("k"), Body: []byte("somevalue")},
+		{Opcode: SET, Body: make([]byte, 300)},
+		{
+			Opcode:        SET,
+			FramingExtras: []byte{0x11, 1},
+			Extras:        make([]byte, 8),
+			Key:           []byte("somekey"),
+			Body:          []byte("somevalue"),
+		},
+	} {
+		if n := len(req.Bytes()); req.Size() != n {
+			t.Errorf("Expected size %d for %v, got %d", n, req, req.Size())
+		}
+	}
+}
+
+func TestRequestDebug(t *testing.T) {
+	tests := []struct {
+		req MCRequest
+		exp string
+	}{
+		{MCRequest{Opcode: NOOP},
+			`{MCRequest opcode=NOOP, key="", vbucket=0, cas=0, opaque=0, bodylen=0}`},
+		{MCRequest{Opcode: GET, Key: []byte{0x80, 0x01, 'k'}, VBucket: 3, Opaque: 9},
+			`{MCRequest opcode=GET, key=0x80016b, vbucket=3, cas=0, opaque=9, bodylen=0}`},
+		{MCRequest{Opcode: SET, Key: []byte("a\nb"), Body: []byte("v")},
+			`{MCRequest opcode=SET, key=0x610a62, vbucket=0, cas=0, opaque=0, bodylen=1}`},
+	}
+	for _, test := range tests {
+		if got := test.req.String(); got != test.exp {
+			t.Errorf("Expected %q, got %q", test.exp, got)
+		}
+	}
+
+	req := MCRequest{Opcode: GET, Key: []byte("k"), Opaque: 1}
+	exp := "00000000  80 00 00 01 00 00 00 00  00 00 00 01 00 00 00 01  |................|\n" +
+		"00000010  00 00 00 00 00 00 00 00  6b                       |........k|\n"
+	if got := req.HexDump(); got != exp {
+		t.Errorf("Expected dump:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestRequestWriteTo(t *testing.T) {
+	for _, req := range []MCRequest{
+		{Opcode: NOOP},
+		{Opcode: GET, Key: []byte("somekey"), Opaque: 7242},
+		{
+			Opcode:  SET,
+			Cas:     938424885,
+			Opaque:  7242,
+			VBucket: 824,
+			Extras:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Key:     []byte("somekey"),
+			Body:    []byte("somevalue"),
+		},
+	} {
+		buf := &bytes.Buffer{}
+		n, err := req.WriteTo(buf)
+		if err != nil {
+			t.Fatalf("Error writing %v: %v", req, err)
+		}
+		if n != int64(req.Size()) || !bytes.Equal(buf.Bytes(), req.Bytes()) {
+			t.Errorf("Expected %v (%d), got %v (%d)",
+				req.Bytes(), req.Size(), buf.Bytes(), n)
+		}
+	}
+}
+
+func benchmarkRequestWrite(b *testing.B, write func(*MCRequest, *bufio.Writer)) {
+	req := MCRequest{
+		Opcode:  SET,
+		Cas:     938424885,
+		Opaque:  7242,
+		VBucket: 824,
+		Extras:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Key:     []byte("somekey"),
+		Body:    []byte("somevalue"),
+	}
+	w := bufio.NewWriter(ioutil.Discard)
+
+	b.SetBytes(int64(req.Size()))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		write(&req, w)
+	}
+}
+
+func BenchmarkRequestWriteBytes(b *testing.B) {
+	benchmarkRequestWrite(b, func(req *MCRequest, w *bufio.Writer) {
+		w.Write(req.Bytes())
+	})
+}
+
+func BenchmarkRequestWriteTo(b *testing.B) {
+	benchmarkRequestWrite(b, func(req *MCRequest, w *bufio.Writer) {
+		req.WriteTo(w)
+	})
+}
+
 func TestRequestTransmit(t *testing.T) {
 	res := MCRequest{Key: []byte("thekey")}
 	_, err := res.Transmit(ioutil.Discard)
@@ -220,6 +354,82 @@ func TestReceiveRequest(t *testing.T) {
 	}
 }
 
+func TestFlexRequest(t *testing.T) {
+	req := MCRequest{
+		Opcode:        SET,
+		Opaque:        7,
+		VBucket:       3,
+		FramingExtras: []byte{0x11, 0x01},
+		Extras:        []byte{1},
+		Key:           []byte("ky"),
+		Body:          []byte("value"),
+	}
+	exp := []byte{
+		FLEX_MAGIC, byte(SET),
+		2,    // framing extras length
+		2,    // key length
+		1,    // extras length
+		0,    // datatype
+		0, 3, // vbucket
+		0, 0, 0, 10, // total body length
+		0, 0, 0, 7, // opaque
+		0, 0, 0, 0, 0, 0, 0, 0, // cas
+		0x11, 0x01, // framing extras
+		1,        // extras
+		'k', 'y', // key
+		'v', 'a', 'l', 'u', 'e',
+	}
+	data := req.Bytes()
+	if !bytes.Equal(data, exp) {
+		t.Fatalf("Expected %v, got %v", exp, data)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := req.WriteTo(buf); err != nil || !bytes.Equal(buf.Bytes(), exp) {
+		t.Errorf("Expected %v writing, got %v/%v", exp, buf.Bytes(), err)
+	}
+
+	req2 := MCRequest{}
+	if _, err := req2.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if !reflect.DeepEqual(req, req2) {
+		t.Fatalf("Expected %#v == %#v", req, req2)
+	}
+}
+
+func TestFlexRequestTooLong(t *testing.T) {
+	for _, req := range []MCRequest{
+		{Opcode: SET, FramingExtras: []byte{0x11, 0x01}, Key: bytes.Repeat([]byte("k"), 256)},
+		{Opcode: SET, FramingExtras: make([]byte, 256), Key: []byte("k")},
+	} {
+		buf := &bytes.Buffer{}
+		if _, err := req.Transmit(buf); !errors.Is(err, ErrFlexTooLong) || buf.Len() != 0 {
+			t.Errorf("Expected ErrFlexTooLong and nothing written from Transmit, got %v/%d", err, buf.Len())
+		}
+		if _, err := req.WriteTo(buf); !errors.Is(err, ErrFlexTooLong) || buf.Len() != 0 {
+			t.Errorf("Expected ErrFlexTooLong and nothing written from WriteTo, got %v/%d", err, buf.Len())
+		}
+		func() {
+			defer func() {
+				if err, _ := recover().(error); !errors.Is(err, ErrFlexTooLong) {
+					t.Errorf("Expected Bytes to panic with ErrFlexTooLong, got %v", err)
+				}
+			}()
+			req.Bytes()
+		}()
+	}
+
+	// Without framing extras, the key length has two bytes.
+	req := MCRequest{Opcode: SET, Key: bytes.Repeat([]byte("k"), 256)}
+	if _, err := req.Transmit(&bytes.Buffer{}); err != nil {
+		t.Errorf("Error sending a long key without framing extras: %v", err)
+	}
+	req = MCRequest{Opcode: SET, FramingExtras: []byte{0x11, 0x01}, Key: bytes.Repeat([]byte("k"), 255)}
+	if data := req.Bytes(); data[3] != 255 {
+		t.Errorf("Expected key length 255, got %v", data[3])
+	}
+}
+
 func TestReceiveRequestNoContent(t *testing.T) {
 	req := MCRequest{
 		Opcode:  SET,
@@ -322,6 +532,25 @@ func TestReceiveRequestLongBody(t *testing.T) {
 	}
 }
 
+func TestReceiveRequestUnderflow(t *testing.T) {
+	req := MCRequest{
+		Opcode: SET,
+		Extras: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Key:    []byte("somekey"),
+		Body:   []byte("somevalue"),
+	}
+
+	data := req.Bytes()
+	// Claim a total body shorter than the key and extras.
+	binary.BigEndian.PutUint32(data[8:12], 1)
+
+	req2 := MCRequest{}
+	_, err := req2.Receive(bytes.NewReader(data), nil)
+	if err == nil {
+		t.Fatalf("Expected error, got %#v", req2)
+	}
+}
+
 func BenchmarkReceiveRequest(b *testing.B) {
 	req := MCRequest{
 		Opcode:  SET,
@@ -403,7 +632,7 @@ func TestReceivingTapRequest(t *testing.T) {
 		t.Errorf("Expected to read %v bytes, read %v", len(content), n)
 	}
 
-	exp := `{MCRequest opcode=TAP_MUTATION, bodylen=9, key='somekey'}`
+	exp := `{MCRequest opcode=TAP_MUTATION, key="somekey", vbucket=824, cas=938424885, opaque=7242, bodylen=9}`
 	if req.String() != exp {
 		t.Errorf("Expected string=%q, got %q", exp, req.String())
 	}
@@ -2,8 +2,11 @@ package gomemcached
 
 import (
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"sync"
 )
 
 // MCResponse is memcached response
@@ -16,16 +19,26 @@ type MCResponse struct {
 	Opaque uint32
 	// The CAS identifier (if applicable)
 	Cas uint64
+	// Datatype flags describing the body (DATATYPE_JSON, etc.)
+	Datatype uint8
 	// Extras, key, and body for this response
 	Extras, Key, Body []byte
+	// Framing extras of a flexible framing (FLEX_RES_MAGIC)
+	// response, or nil for a classic one
+	FramingExtras []byte
 	// If true, this represents a fatal condition and we should hang up
 	Fatal bool
 }
 
 // A debugging string representation of this response
 func (res MCResponse) String() string {
-	return fmt.Sprintf("{MCResponse status=%v keylen=%d, extralen=%d, bodylen=%d}",
-		res.Status, len(res.Key), len(res.Extras), len(res.Body))
+	return fmt.Sprintf("{MCResponse status=%v, opcode=%v, key=%s, cas=%d, opaque=%d, bodylen=%d}",
+		res.Status, res.Opcode, debugKey(res.Key), res.Cas, res.Opaque, len(res.Body))
+}
+
+// HexDump is a hex dump of the response as sent on the wire.
+func (res *MCResponse) HexDump() string {
+	return hex.Dump(res.Bytes())
 }
 
 // Response as an error.
@@ -34,9 +47,36 @@ func (res *MCResponse) Error() string {
 		res.Status, res.Opcode, res.Opaque, string(res.Body))
 }
 
+// Err returns nil for a successful response, or the response itself
+// as an error otherwise.
+func (res *MCResponse) Err() error {
+	if res == nil || res.Status == SUCCESS {
+		return nil
+	}
+	return res
+}
+
+// KeyError is a non-success response along with the key of the
+// request that caused it.
+type KeyError struct {
+	Key string
+	Res *MCResponse
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("MCResponse status=%v, opcode=%v, key=%q, msg: %s",
+		e.Res.Status, e.Res.Opcode, e.Key, string(e.Res.Body))
+}
+
+// Unwrap returns the underlying response.
+func (e *KeyError) Unwrap() error {
+	return e.Res
+}
+
 func errStatus(e error) Status {
 	status := Status(0xffff)
-	if res, ok := e.(*MCResponse); ok {
+	var res *MCResponse
+	if errors.As(e, &res) {
 		status = res.Status
 	}
 	return status
@@ -47,13 +87,89 @@ func IsNotFound(e error) bool {
 	return errStatus(e) == KEY_ENOENT
 }
 
+// IsExists is true if this error represents a "key exists" response,
+// as from an add of a key that's already there.
+func IsExists(e error) bool {
+	return errStatus(e) == KEY_EEXISTS
+}
+
+// IsNotStored is true if this error represents a "not stored"
+// response.
+func IsNotStored(e error) bool {
+	return errStatus(e) == NOT_STORED
+}
+
+// IsTempFail is true if this error represents a temporary failure
+// that may succeed if retried.
+func IsTempFail(e error) bool {
+	return errStatus(e) == TMPFAIL
+}
+
+// IsAuthError is true if this error represents a failure to
+// authenticate or a lack of access.
+func IsAuthError(e error) bool {
+	st := errStatus(e)
+	return st == AUTH_ERROR || st == EACCESS
+}
+
+// IsCasMismatch is true if this error is the KEY_EEXISTS a server
+// returns when a request's CAS doesn't match the item's.
+func IsCasMismatch(e error) bool {
+	return errStatus(e) == KEY_EEXISTS
+}
+
+// IsPathNotFound is true if this error represents a subdocument
+// "path not found" response.
+func IsPathNotFound(e error) bool {
+	return errStatus(e) == SUBDOC_PATH_ENOENT
+}
+
+// IsDurabilityImpossible is true if this error represents a durable
+// write failing because the cluster can't meet its durability level.
+func IsDurabilityImpossible(e error) bool {
+	return errStatus(e) == DURABILITY_IMPOSSIBLE
+}
+
+// IsSyncWriteInProgress is true if this error represents a write
+// refused because a durable write to the same key is pending.  It
+// may succeed if retried.
+func IsSyncWriteInProgress(e error) bool {
+	return errStatus(e) == SYNC_WRITE_IN_PROGRESS
+}
+
+// IsNotSupported is true if this error represents a server not
+// supporting a command, either because it doesn't know it or because
+// it's not configured for it.
+func IsNotSupported(e error) bool {
+	st := errStatus(e)
+	return st == UNKNOWN_COMMAND || st == NOT_SUPPORTED
+}
+
+// IsUnknownCollection is true if this error represents a request
+// naming a collection or scope the server doesn't have.
+func IsUnknownCollection(e error) bool {
+	st := errStatus(e)
+	return st == UNKNOWN_COLLECTION || st == UNKNOWN_SCOPE
+}
+
 // IsFatal is false if this error isn't believed to be fatal to a connection.
 func IsFatal(e error) bool {
 	if e == nil {
 		return false
 	}
-	switch errStatus(e) {
-	case KEY_ENOENT, KEY_EEXISTS, NOT_STORED, TMPFAIL:
+	st := errStatus(e)
+	switch st {
+	case KEY_ENOENT, KEY_EEXISTS, NOT_STORED, TMPFAIL, LOCKED, AUTH_CONTINUE,
+		UNKNOWN_COLLECTION, UNKNOWN_SCOPE, UNKNOWN_COMMAND, NOT_SUPPORTED:
+		return false
+	}
+	// Durability failures are about the write, not the connection.
+	if st >= DURABILITY_INVALID_LEVEL && st <= SYNC_WRITE_AMBIGUOUS {
+		return false
+	}
+	// Subdocument failures are about the document, not the
+	// connection.
+	if st >= SUBDOC_PATH_ENOENT && st <= SUBDOC_MULTI_PATH_FAILURE {
 		return false
 	}
 	return true
@@ -61,30 +177,43 @@ func IsFatal(e error) bool {
 
 // Size is number of bytes this response consumes on the wire.
 func (res *MCResponse) Size() int {
-	return HDR_LEN + len(res.Extras) + len(res.Key) + len(res.Body)
+	return HDR_LEN + len(res.FramingExtras) + len(res.Extras) + len(res.Key) + len(res.Body)
 }
 
+// fillHeaderBytes writes a flexible framing header if the response
+// has framing extras, and a classic one otherwise.
 func (res *MCResponse) fillHeaderBytes(data []byte) int {
 	pos := 0
-	data[pos] = RES_MAGIC
-	pos++
-	data[pos] = byte(res.Opcode)
-	pos++
-	binary.BigEndian.PutUint16(data[pos:pos+2],
-		uint16(len(res.Key)))
-	pos += 2
+	if len(res.FramingExtras) > 0 {
+		data[pos] = FLEX_RES_MAGIC
+		pos++
+		data[pos] = byte(res.Opcode)
+		pos++
+		data[pos] = byte(len(res.FramingExtras))
+		pos++
+		data[pos] = byte(len(res.Key))
+		pos++
+	} else {
+		data[pos] = RES_MAGIC
+		pos++
+		data[pos] = byte(res.Opcode)
+		pos++
+		binary.BigEndian.PutUint16(data[pos:pos+2],
+			uint16(len(res.Key)))
+		pos += 2
+	}
 
 	// 4
 	data[pos] = byte(len(res.Extras))
 	pos++
-	data[pos] = 0
+	data[pos] = res.Datatype
 	pos++
 	binary.BigEndian.PutUint16(data[pos:pos+2], uint16(res.Status))
 	pos += 2
 
 	// 8
 	binary.BigEndian.PutUint32(data[pos:pos+4],
-		uint32(len(res.Body)+len(res.Key)+len(res.Extras)))
+		uint32(len(res.Body)+len(res.Key)+len(res.Extras)+len(res.FramingExtras)))
 	pos += 4
 
 	// 12
@@ -95,6 +224,11 @@ func (res *MCResponse) fillHeaderBytes(data []byte) int {
 	binary.BigEndian.PutUint64(data[pos:pos+8], res.Cas)
 	pos += 8
 
+	if len(res.FramingExtras) > 0 {
+		copy(data[pos:pos+len(res.FramingExtras)], res.FramingExtras)
+		pos += len(res.FramingExtras)
+	}
+
 	if len(res.Extras) > 0 {
 		copy(data[pos:pos+len(res.Extras)], res.Extras)
 		pos += len(res.Extras)
@@ -108,9 +242,24 @@ func (res *MCResponse) fillHeaderBytes(data []byte) int {
 	return pos
 }
 
+// IsJSON is true if the body is flagged as JSON.
+func (res *MCResponse) IsJSON() bool {
+	return res.Datatype&DATATYPE_JSON != 0
+}
+
+// IsSnappy is true if the body is snappy compressed.
+func (res *MCResponse) IsSnappy() bool {
+	return res.Datatype&DATATYPE_SNAPPY != 0
+}
+
+// HasXattrs is true if the body begins with extended attributes.
+func (res *MCResponse) HasXattrs() bool {
+	return res.Datatype&DATATYPE_XATTR != 0
+}
+
 // HeaderBytes will get just the header bytes for this response.
 func (res *MCResponse) HeaderBytes() []byte {
-	data := make([]byte, HDR_LEN+len(res.Extras)+len(res.Key))
+	data := make([]byte, HDR_LEN+len(res.FramingExtras)+len(res.Extras)+len(res.Key))
 
 	res.fillHeaderBytes(data)
 
@@ -145,6 +294,151 @@ func (res *MCResponse) Transmit(w io.Writer) (n int, err error) {
 
 // Receive will fill this MCResponse with the data from this reader.
 func (res *MCResponse) Receive(r io.Reader, hdrBytes []byte) (int, error) {
+	return res.receive(r, hdrBytes, nil, 0)
+}
+
+// ReceiveInto fills this MCResponse like Receive, but reads the body
+// into the given buffer when it fits.
+//
+// If the body is no longer than len(body), res.Body is a prefix of
+// body.  Otherwise a new buffer is used, as with Receive.
+func (res *MCResponse) ReceiveInto(r io.Reader, hdrBytes, body []byte) (int, error) {
+	if body == nil {
+		body = []byte{}
+	}
+	return res.receive(r, hdrBytes, body, 0)
+}
+
+// ErrBodyTooLarge is returned when a body is longer than allowed.
+var ErrBodyTooLarge = errors.New("body too large")
+
+// ErrExtrasLength is returned by CheckExtras for a response whose
+// extras aren't the length its opcode's responses carry.
+var ErrExtrasLength = errors.New("unexpected extras length")
+
+// ResponseExtrasLen is the extras length of successful responses to
+// each opcode, as checked by CheckExtras.  Opcodes whose responses
+// vary, such as mutations that return seqnos once MUTATION_SEQNO is
+// negotiated, aren't listed.
+var ResponseExtrasLen = map[CommandCode]int{
+	GET: 4, GETQ: 4, GETK: 4, GETKQ: 4,
+	GAT: 4, GATQ: 4,
+	GET_REPLICA: 4, GET_LOCKED: 4, GET_RANDOM_KEY: 4,
+	NOOP: 0, VERSION: 0,
+	COLLECTIONS_GET_ID: 12,
+}
+
+// CheckExtras returns an error wrapping ErrExtrasLength if this is a
+// successful response with extras of a different length than
+// ResponseExtrasLen gives for its opcode, which suggests a corrupt
+// stream or a protocol bug.  Failures and opcodes that aren't listed
+// aren't checked.
+func (res *MCResponse) CheckExtras() error {
+	if res.Status != SUCCESS {
+		return nil
+	}
+	if exp, ok := ResponseExtrasLen[res.Opcode]; ok && len(res.Extras) != exp {
+		return fmt.Errorf("%w: %v response has %d bytes of extras, expected %d",
+			ErrExtrasLength, res.Opcode, len(res.Extras), exp)
+	}
+	return nil
+}
+
+// ReceiveLimit fills this MCResponse like ReceiveInto (or Receive, if
+// body is nil), but fails with ErrBodyTooLarge rather than reading a
+// body longer than limit bytes.  A limit of 0 means no limit.
+//
+// The oversized body is left unread, so the stream can't be used
+// afterwards.
+func (res *MCResponse) ReceiveLimit(r io.Reader, hdrBytes, body []byte, limit int) (int, error) {
+	return res.receive(r, hdrBytes, body, limit)
+}
+
+func (res *MCResponse) receive(r io.Reader, hdrBytes, body []byte, limit int) (int, error) {
+	n, l, err := res.receiveHeader(r, hdrBytes)
+	if err != nil {
+		return n, err
+	}
+	if limit > 0 && l.body > limit {
+		return n, fmt.Errorf("%w: response body is %d bytes (max %d)",
+			ErrBodyTooLarge, l.body, limit)
+	}
+
+	if body == nil || l.body > len(body) {
+		buf := getBuf(l.front() + l.body)
+		m, err := io.ReadFull(r, buf)
+		if err == nil {
+			res.setHeaderBufs(buf, l)
+			res.Body = buf[l.front():]
+		}
+		return n + m, err
+	}
+
+	buf := getBuf(l.front())
+	m, err := io.ReadFull(r, buf)
+	n += m
+	if err != nil {
+		return n, err
+	}
+	m, err = io.ReadFull(r, body[:l.body])
+	if err == nil {
+		res.setHeaderBufs(buf, l)
+		res.Body = body[:l.body]
+	}
+	return n + m, err
+}
+
+// ReceiveTo fills this MCResponse like Receive, but copies a
+// successful response's body to w rather than reading it into
+// memory.  Body is left nil.  Other responses' bodies are short
+// messages, and are read into Body as usual.
+//
+// n is the number of bytes of the body written to w.  If copying the
+// body fails partway through, the rest of it is left unread, so the
+// stream can't be used afterwards.
+func (res *MCResponse) ReceiveTo(r io.Reader, hdrBytes []byte, w io.Writer) (n int64, err error) {
+	_, l, err := res.receiveHeader(r, hdrBytes)
+	if err != nil {
+		return 0, err
+	}
+	if res.Status != SUCCESS {
+		buf := getBuf(l.front() + l.body)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+		res.setHeaderBufs(buf, l)
+		res.Body = buf[l.front():]
+		return 0, nil
+	}
+
+	buf := getBuf(l.front())
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	res.setHeaderBufs(buf, l)
+	res.Body = nil
+	n, err = io.CopyN(w, r, int64(l.body))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// bodyLens are the lengths of the parts of a response following its
+// header.
+type bodyLens struct {
+	frame, extras, key, body int
+}
+
+// front is the length of the parts before the body.
+func (l bodyLens) front() int {
+	return l.frame + l.extras + l.key
+}
+
+// receiveHeader reads a response header, filling in the fields it
+// holds, and returns the lengths of the parts that follow it.
+func (res *MCResponse) receiveHeader(r io.Reader, hdrBytes []byte) (int, bodyLens, error) {
+	var l bodyLens
 	if len(hdrBytes) < HDR_LEN {
 		hdrBytes = []byte{
 			0, 0, 0, 0, 0, 0, 0, 0,
@@ -153,30 +447,91 @@ func (res *MCResponse) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	}
 	n, err := io.ReadFull(r, hdrBytes)
 	if err != nil {
-		return n, err
+		return n, l, err
 	}
 
-	if hdrBytes[0] != RES_MAGIC && hdrBytes[0] != REQ_MAGIC {
-		return n, fmt.Errorf("bad magic: 0x%02x", hdrBytes[0])
+	// Flexible framing splits the classic key length into framing
+	// extras and key lengths.
+	switch hdrBytes[0] {
+	case RES_MAGIC, REQ_MAGIC:
+		l.key = int(binary.BigEndian.Uint16(hdrBytes[2:4]))
+	case FLEX_RES_MAGIC:
+		l.frame = int(hdrBytes[2])
+		l.key = int(hdrBytes[3])
+	default:
+		return n, l, fmt.Errorf("bad magic: 0x%02x", hdrBytes[0])
 	}
-
-	klen := int(binary.BigEndian.Uint16(hdrBytes[2:4]))
-	elen := int(hdrBytes[4])
+	l.extras = int(hdrBytes[4])
 
 	res.Opcode = CommandCode(hdrBytes[1])
+	res.Datatype = hdrBytes[5]
 	res.Status = Status(binary.BigEndian.Uint16(hdrBytes[6:8]))
 	res.Opaque = binary.BigEndian.Uint32(hdrBytes[12:16])
 	res.Cas = binary.BigEndian.Uint64(hdrBytes[16:24])
 
-	bodyLen := int(binary.BigEndian.Uint32(hdrBytes[8:12])) - (klen + elen)
+	totalLen := int(binary.BigEndian.Uint32(hdrBytes[8:12]))
+	if totalLen < l.front() {
+		return n, l, fmt.Errorf("total body length %d is less than key+extras length %d",
+			totalLen, l.front())
+	}
+	l.body = totalLen - l.front()
+	return n, l, nil
+}
+
+// setHeaderBufs slices the framing extras, extras, and key from the
+// start of buf, where they're read in that order.
+func (res *MCResponse) setHeaderBufs(buf []byte, l bodyLens) {
+	res.FramingExtras = nil
+	if l.frame > 0 {
+		res.FramingExtras = buf[0:l.frame]
+	}
+	res.Extras = buf[l.frame : l.frame+l.extras]
+	res.Key = buf[l.frame+l.extras : l.front()]
+}
 
-	buf := make([]byte, klen+elen+bodyLen)
-	m, err := io.ReadFull(r, buf)
-	if err == nil {
-		res.Extras = buf[0:elen]
-		res.Key = buf[elen : klen+elen]
-		res.Body = buf[klen+elen:]
+// Responses no larger than this are read into pooled buffers.
+const maxPooledLen = 64 * 1024
+
+var (
+	// Buffers released by Release, as *[]byte.
+	bufPool sync.Pool
+	// Empty *[]byte holders, so putting a buffer back doesn't
+	// allocate.
+	holderPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+)
+
+func getBuf(n int) []byte {
+	if n > maxPooledLen {
+		return make([]byte, n)
+	}
+	if h, ok := bufPool.Get().(*[]byte); ok {
+		b := *h
+		*h = nil
+		holderPool.Put(h)
+		if cap(b) >= n {
+			return b[:n]
+		}
 	}
+	return make([]byte, n)
+}
 
-	return n + m, err
+// Release returns the buffer holding this response's extras, key,
+// and body to a pool for reuse by later calls to Receive.
+//
+// It must only be called on a response filled by Receive, and none of
+// Extras, Key, or Body (or anything sliced from them) may be used
+// after the call.  They're set to nil.  Releasing is optional;
+// responses that aren't released are garbage collected as usual.
+func (res *MCResponse) Release() {
+	b := res.Extras[:cap(res.Extras)]
+	if res.FramingExtras != nil {
+		b = res.FramingExtras[:cap(res.FramingExtras)]
+	}
+	res.FramingExtras, res.Extras, res.Key, res.Body = nil, nil, nil, nil
+	if cap(b) == 0 || cap(b) > maxPooledLen {
+		return
+	}
+	h := holderPool.Get().(*[]byte)
+	*h = b
+	bufPool.Put(h)
 }
@@ -2,10 +2,13 @@ package gomemcached
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -43,10 +46,13 @@ func TestEncodingResponse(t *testing.T) {
 			expected, got)
 	}
 
-	exp := `{MCResponse status=0x62e keylen=7, extralen=0, bodylen=9}`
+	exp := `{MCResponse status=0x62e, opcode=SET, key="somekey", cas=938424885, opaque=7242, bodylen=9}`
 	if req.String() != exp {
 		t.Errorf("Expected string=%q, got %q", exp, req.String())
 	}
+	if dump := req.HexDump(); !strings.HasPrefix(dump, "00000000  81 01 00 07 00 00 06 2e") {
+		t.Errorf("Expected a dump of the response header, got\n%s", dump)
+	}
 
 	exp = `MCResponse status=0x62e, opcode=SET, opaque=7242, msg: somevalue`
 	if req.Error() != exp {
@@ -177,6 +183,8 @@ func TestIsNotFound(t *testing.T) {
 		{errors.New("something"), false},
 		{&MCResponse{}, false},
 		{&MCResponse{Status: KEY_ENOENT}, true},
+		{&KeyError{"k", &MCResponse{Status: KEY_ENOENT}}, true},
+		{&KeyError{"k", &MCResponse{Status: KEY_EEXISTS}}, false},
 	}
 
 	for i, x := range tests {
@@ -186,6 +194,105 @@ func TestIsNotFound(t *testing.T) {
 	}
 }
 
+func TestStatusPredicates(t *testing.T) {
+	preds := []struct {
+		name string
+		f    func(error) bool
+		sts  []Status
+	}{
+		{"IsNotFound", IsNotFound, []Status{KEY_ENOENT}},
+		{"IsExists", IsExists, []Status{KEY_EEXISTS}},
+		{"IsNotStored", IsNotStored, []Status{NOT_STORED}},
+		{"IsTempFail", IsTempFail, []Status{TMPFAIL}},
+		{"IsAuthError", IsAuthError, []Status{AUTH_ERROR, EACCESS}},
+		{"IsDurabilityImpossible", IsDurabilityImpossible, []Status{DURABILITY_IMPOSSIBLE}},
+		{"IsSyncWriteInProgress", IsSyncWriteInProgress, []Status{SYNC_WRITE_IN_PROGRESS}},
+		{"IsUnknownCollection", IsUnknownCollection, []Status{UNKNOWN_COLLECTION, UNKNOWN_SCOPE}},
+		{"IsNotSupported", IsNotSupported, []Status{UNKNOWN_COMMAND, NOT_SUPPORTED}},
+	}
+
+	for _, p := range preds {
+		want := map[Status]bool{}
+		for _, st := range p.sts {
+			want[st] = true
+		}
+		for st := range StatusNames {
+			res := &MCResponse{Status: st}
+			if got := p.f(res); got != want[st] {
+				t.Errorf("Expected %v(%v) = %v, got %v", p.name, st, want[st], got)
+			}
+			if got := p.f(&KeyError{"k", res}); got != want[st] {
+				t.Errorf("Expected %v(KeyError %v) = %v, got %v", p.name, st, want[st], got)
+			}
+		}
+		if p.f(nil) || p.f(errors.New("something")) {
+			t.Errorf("Expected %v to be false for non-response errors", p.name)
+		}
+	}
+}
+
+func TestIsCasMismatch(t *testing.T) {
+	tests := []struct {
+		e  error
+		is bool
+	}{
+		{nil, false},
+		{errors.New("something"), false},
+		{&MCResponse{Status: KEY_ENOENT}, false},
+		{&MCResponse{Status: KEY_EEXISTS}, true},
+		{&KeyError{"k", &MCResponse{Status: KEY_EEXISTS}}, true},
+	}
+
+	for i, x := range tests {
+		if IsCasMismatch(x.e) != x.is {
+			t.Errorf("Expected %v for %#v (%v)", x.is, x.e, i)
+		}
+	}
+}
+
+func TestIsPathNotFound(t *testing.T) {
+	tests := []struct {
+		e  error
+		is bool
+	}{
+		{nil, false},
+		{&MCResponse{Status: KEY_ENOENT}, false},
+		{&MCResponse{Status: SUBDOC_PATH_ENOENT}, true},
+		{&KeyError{"k", &MCResponse{Status: SUBDOC_PATH_ENOENT}}, true},
+	}
+
+	for i, x := range tests {
+		if IsPathNotFound(x.e) != x.is {
+			t.Errorf("Expected %v for %#v (%v)", x.is, x.e, i)
+		}
+	}
+}
+
+func TestCheckExtras(t *testing.T) {
+	tests := []struct {
+		res MCResponse
+		ok  bool
+	}{
+		{MCResponse{Opcode: GET, Extras: make([]byte, 4)}, true},
+		{MCResponse{Opcode: GET}, false},
+		{MCResponse{Opcode: GETK, Extras: make([]byte, 8)}, false},
+		{MCResponse{Opcode: NOOP, Extras: []byte{1}}, false},
+		// Failures carry no extras.
+		{MCResponse{Opcode: GET, Status: KEY_ENOENT}, true},
+		// Mutations' extras depend on negotiated features.
+		{MCResponse{Opcode: SET, Extras: make([]byte, 16)}, true},
+		{MCResponse{Opcode: SET}, true},
+	}
+	for _, test := range tests {
+		err := test.res.CheckExtras()
+		if test.ok && err != nil {
+			t.Errorf("Unexpected error for %v: %v", test.res, err)
+		} else if !test.ok && !errors.Is(err, ErrExtrasLength) {
+			t.Errorf("Expected ErrExtrasLength for %v, got %v", test.res, err)
+		}
+	}
+}
+
 func TestIsFatal(t *testing.T) {
 	tests := []struct {
 		e  error
@@ -197,6 +304,16 @@ func TestIsFatal(t *testing.T) {
 		{&MCResponse{Status: KEY_ENOENT}, false},
 		{&MCResponse{Status: EINVAL}, true},
 		{&MCResponse{Status: TMPFAIL}, false},
+		{&MCResponse{Status: LOCKED}, false},
+		{&MCResponse{Status: AUTH_CONTINUE}, false},
+		{&MCResponse{Status: AUTH_ERROR}, true},
+		{&MCResponse{Status: SUBDOC_PATH_ENOENT}, false},
+		{&MCResponse{Status: SUBDOC_MULTI_PATH_FAILURE}, false},
+		{&MCResponse{Status: DURABILITY_IMPOSSIBLE}, false},
+		{&MCResponse{Status: SYNC_WRITE_AMBIGUOUS}, false},
+		{&MCResponse{Status: UNKNOWN_COLLECTION}, false},
+		{&MCResponse{Status: UNKNOWN_COMMAND}, false},
+		{&MCResponse{Status: NOT_SUPPORTED}, false},
 	}
 
 	for i, x := range tests {
@@ -244,6 +361,60 @@ func TestReceiveResponse(t *testing.T) {
 	}
 }
 
+func TestReceiveFlexResponse(t *testing.T) {
+	data := []byte{
+		FLEX_RES_MAGIC, byte(GET),
+		3,    // framing extras length
+		2,    // key length
+		1,    // extras length
+		0,    // datatype
+		0, 0, // status
+		0, 0, 0, 11, // total body length
+		0, 0, 0, 7, // opaque
+		0, 0, 0, 0, 0, 0, 0, 9, // cas
+		0x02, 0x12, 0x34, // framing extras
+		0xee,     // extras
+		'k', 'y', // key
+		'v', 'a', 'l', 'u', 'e',
+	}
+	res := MCResponse{}
+	if _, err := res.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	exp := MCResponse{
+		Opcode:        GET,
+		Opaque:        7,
+		Cas:           9,
+		FramingExtras: []byte{0x02, 0x12, 0x34},
+		Extras:        []byte{0xee},
+		Key:           []byte("ky"),
+		Body:          []byte("value"),
+	}
+	if !reflect.DeepEqual(exp, res) {
+		t.Fatalf("Expected %#v, got %#v", exp, res)
+	}
+
+	// And it's written back the same way.
+	if got := res.Bytes(); !bytes.Equal(got, data) {
+		t.Errorf("Expected %v, got %v", data, got)
+	}
+	res.Release()
+
+	// Classic headers still have a two byte key length.
+	classic := MCResponse{Opcode: GET, Key: bytes.Repeat([]byte("k"), 300), Body: []byte("v")}
+	data = classic.Bytes()
+	if data[0] != RES_MAGIC {
+		t.Errorf("Expected a classic magic, got 0x%02x", data[0])
+	}
+	got := MCResponse{}
+	if _, err := got.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if got.FramingExtras != nil || len(got.Key) != 300 || string(got.Body) != "v" {
+		t.Errorf("Expected %v, got %v", classic, got)
+	}
+}
+
 func TestReceiveResponseBadMagic(t *testing.T) {
 	res := MCResponse{
 		Opcode: SET,
@@ -304,6 +475,25 @@ func TestReceiveResponseShortBody(t *testing.T) {
 	}
 }
 
+func TestReceiveResponseUnderflow(t *testing.T) {
+	res := MCResponse{
+		Opcode: GET,
+		Extras: []byte{1, 2, 3, 4},
+		Key:    []byte("somekey"),
+		Body:   []byte("somevalue"),
+	}
+
+	data := res.Bytes()
+	// Claim a total body shorter than the key and extras.
+	binary.BigEndian.PutUint32(data[8:12], 3)
+
+	res2 := MCResponse{}
+	_, err := res2.Receive(bytes.NewReader(data), nil)
+	if err == nil {
+		t.Fatalf("Expected error, got: %#v", res2)
+	}
+}
+
 func TestReceiveResponseWithBuffer(t *testing.T) {
 	res := MCResponse{
 		Opcode: SET,
@@ -401,3 +591,220 @@ func BenchmarkReceiveResponseNoBuf(b *testing.B) {
 		res2.Receive(rdr, nil)
 	}
 }
+
+func BenchmarkReceiveResponseRelease(b *testing.B) {
+	req := MCResponse{
+		Opcode: SET,
+		Status: 183,
+		Cas:    0,
+		Opaque: 7242,
+		Extras: []byte{1},
+		Key:    []byte("somekey"),
+		Body:   []byte("somevalue"),
+	}
+
+	data := req.Bytes()
+	rdr := bytes.NewReader(data)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+
+	b.ResetTimer()
+	buf := make([]byte, HDR_LEN)
+	res2 := &MCResponse{}
+	for i := 0; i < b.N; i++ {
+		rdr.Seek(0, 0)
+		res2.Receive(rdr, buf)
+		res2.Release()
+	}
+}
+
+func TestResponseRelease(t *testing.T) {
+	res := MCResponse{
+		Opcode: GET,
+		Extras: []byte{1, 2, 3, 4},
+		Key:    []byte("k"),
+		Body:   []byte("somevalue"),
+	}
+	data := res.Bytes()
+
+	got := &MCResponse{}
+	if _, err := got.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	got.Release()
+	if got.Extras != nil || got.Key != nil || got.Body != nil {
+		t.Fatalf("Expected released response to be cleared, got %#v", got)
+	}
+
+	// A response received into a reused buffer is intact.
+	for i := 0; i < 3; i++ {
+		again := &MCResponse{}
+		if _, err := again.Receive(bytes.NewReader(data), nil); err != nil {
+			t.Fatalf("Error receiving: %v", err)
+		}
+		if !bytes.Equal(again.Extras, res.Extras) ||
+			!bytes.Equal(again.Key, res.Key) ||
+			!bytes.Equal(again.Body, res.Body) {
+			t.Fatalf("Expected %v, got %v", res, again)
+		}
+		again.Release()
+	}
+
+	// Releasing an empty response is harmless.
+	(&MCResponse{}).Release()
+}
+
+func TestReceiveInto(t *testing.T) {
+	res := MCResponse{
+		Opcode: GET,
+		Extras: []byte{1, 2, 3, 4},
+		Key:    []byte("k"),
+		Body:   []byte("somevalue"),
+	}
+	data := res.Bytes()
+
+	for _, size := range []int{len(res.Body), 100, 3, 0} {
+		buf := make([]byte, size)
+		got := &MCResponse{}
+		if _, err := got.ReceiveInto(bytes.NewReader(data), nil, buf); err != nil {
+			t.Fatalf("Error receiving into %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got.Extras, res.Extras) || !bytes.Equal(got.Key, res.Key) ||
+			!bytes.Equal(got.Body, res.Body) {
+			t.Fatalf("Expected %v, got %v", res, got)
+		}
+		inBuf := size >= len(res.Body)
+		if inBuf != (size > 0 && &got.Body[0] == &buf[0]) {
+			t.Errorf("With %d byte buffer, expected in buffer=%v", size, inBuf)
+		}
+	}
+}
+
+func TestReceiveLimit(t *testing.T) {
+	// Declares a 4GB body, which must be refused unread.
+	hdr := []byte{
+		RES_MAGIC, byte(GET),
+		0x0, 0x0, // key len
+		0x0,      // extra length
+		0x0,      // data type
+		0x0, 0x0, // status
+		0xff, 0xff, 0xff, 0xff, // Length of value
+		0x0, 0x0, 0x0, 0x0, // opaque
+		0, 0, 0, 0, 0, 0, 0, 0, // CAS
+	}
+	res := MCResponse{}
+	_, err := res.ReceiveLimit(bytes.NewReader(hdr), nil, nil, 1024)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("Expected ErrBodyTooLarge, got %v", err)
+	}
+
+	ok := MCResponse{Opcode: GET, Body: []byte("somevalue")}
+	for _, limit := range []int{0, len(ok.Body)} {
+		got := MCResponse{}
+		if _, err := got.ReceiveLimit(bytes.NewReader(ok.Bytes()), nil, nil, limit); err != nil {
+			t.Errorf("Error receiving with limit %v: %v", limit, err)
+		} else if string(got.Body) != "somevalue" {
+			t.Errorf("Expected somevalue with limit %v, got %q", limit, got.Body)
+		}
+	}
+}
+
+func TestResponseDatatype(t *testing.T) {
+	data := []byte{
+		RES_MAGIC, byte(GET),
+		0x0, 0x0, // key len
+		0x0,           // extra length
+		DATATYPE_JSON, // data type
+		0x0, 0x0,      // status
+		0x0, 0x0, 0x0, 0x2, // Length of value
+		0x0, 0x0, 0x0, 0x0, // opaque
+		0, 0, 0, 0, 0, 0, 0, 0, // CAS
+		'{', '}'}
+
+	res := MCResponse{}
+	if _, err := res.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if res.Datatype != DATATYPE_JSON || !res.IsJSON() || res.IsSnappy() || res.HasXattrs() {
+		t.Errorf("Expected JSON datatype, got %#x", res.Datatype)
+	}
+	if !bytes.Equal(res.Bytes(), data) {
+		t.Errorf("Expected datatype to round trip, got %v", res.Bytes())
+	}
+
+	res.Datatype = DATATYPE_SNAPPY | DATATYPE_XATTR
+	if res.IsJSON() || !res.IsSnappy() || !res.HasXattrs() {
+		t.Errorf("Unexpected predicates for %#x", res.Datatype)
+	}
+}
+
+func TestResponseErr(t *testing.T) {
+	res := &MCResponse{Status: SUCCESS}
+	if err := res.Err(); err != nil {
+		t.Errorf("Expected no error for success, got %v", err)
+	}
+
+	res = &MCResponse{Opcode: GET, Status: KEY_ENOENT}
+	err := res.Err()
+	if err != res {
+		t.Fatalf("Expected the response as the error, got %v", err)
+	}
+	if !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
+
+func TestKeyError(t *testing.T) {
+	res := &MCResponse{Opcode: GET, Status: KEY_ENOENT, Body: []byte("Not found")}
+	err := error(&KeyError{Key: "somekey", Res: res})
+
+	exp := `MCResponse status=KEY_ENOENT, opcode=GET, key="somekey", msg: Not found`
+	if err.Error() != exp {
+		t.Errorf("Expected %q, got %q", exp, err.Error())
+	}
+
+	var got *MCResponse
+	if !errors.As(err, &got) || got != res {
+		t.Errorf("Expected to unwrap to the response, got %v", got)
+	}
+}
+
+func TestReceiveTo(t *testing.T) {
+	res := MCResponse{
+		Opcode: GET,
+		Extras: []byte{1, 2, 3, 4},
+		Key:    []byte("k"),
+		Body:   bytes.Repeat([]byte("value"), 1000),
+	}
+	buf := &bytes.Buffer{}
+	got := MCResponse{}
+	n, err := got.ReceiveTo(bytes.NewReader(res.Bytes()), nil, buf)
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if n != int64(len(res.Body)) || !bytes.Equal(buf.Bytes(), res.Body) {
+		t.Errorf("Expected the body written, got %d bytes", n)
+	}
+	if got.Body != nil || !bytes.Equal(got.Extras, res.Extras) || string(got.Key) != "k" {
+		t.Errorf("Unexpected response: %#v", got)
+	}
+
+	// Failures' messages are read as usual.
+	res = MCResponse{Opcode: GET, Status: KEY_ENOENT, Body: []byte("Not found")}
+	buf.Reset()
+	got = MCResponse{}
+	if n, err := got.ReceiveTo(bytes.NewReader(res.Bytes()), nil, buf); err != nil || n != 0 {
+		t.Fatalf("Error receiving a failure: %d/%v", n, err)
+	}
+	if string(got.Body) != "Not found" || buf.Len() != 0 {
+		t.Errorf("Expected the message in Body, got %q and %q written", got.Body, buf.Bytes())
+	}
+
+	// A truncated body.
+	res = MCResponse{Opcode: GET, Body: []byte("value")}
+	data := res.Bytes()
+	if _, err := got.ReceiveTo(bytes.NewReader(data[:len(data)-2]), nil, buf); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package gomemcached
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// ErrCorruptSnappy is returned when a snappy compressed body can't be
+// decoded.  It's the snappy package's ErrCorrupt.
+var ErrCorruptSnappy = snappy.ErrCorrupt
+
+// Decompressed returns the body, decompressing it if its datatype
+// says it's snappy compressed.
+//
+// If decoding fails, the body is returned unchanged along with the
+// error.
+func (res *MCResponse) Decompressed() ([]byte, error) {
+	return res.DecompressedMax(0)
+}
+
+// DecompressedMax is Decompressed, but fails with ErrBodyTooLarge
+// rather than decompressing a body to more than limit bytes.  A limit
+// of 0 means no limit.
+func (res *MCResponse) DecompressedMax(limit int) ([]byte, error) {
+	if !res.IsSnappy() {
+		return res.Body, nil
+	}
+	b, err := snappyDecode(res.Body, limit)
+	if err != nil {
+		return res.Body, err
+	}
+	return b, nil
+}
+
+// The most a snappy block can expand: a 3 byte copy element produces
+// up to 64 bytes.  A header claiming more than this is corrupt, and
+// is rejected before the output is allocated.
+const snappyMaxExpansion = 22
+
+// snappyDecode decodes a snappy block (not the framed stream format,
+// which memcached doesn't use), of up to limit bytes if it's not 0.
+func snappyDecode(src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil || n > len(src)*snappyMaxExpansion {
+		return nil, ErrCorruptSnappy
+	}
+	if limit > 0 && n > limit {
+		return nil, fmt.Errorf("%w: decompressed body is %d bytes (max %d)",
+			ErrBodyTooLarge, n, limit)
+	}
+	return snappy.Decode(nil, src)
+}
@@ -0,0 +1,97 @@
+package gomemcached
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("hello")},
+		{"repeated", []byte(strings.Repeat("abc", 1000))},
+		{"json", []byte(`{"name": "gomemcached", "tags": ["a", "b", "a", "b"]}`)},
+		{"random", random},
+		// More than one of the encoder's 64KB blocks.
+		{"long", bytes.Repeat([]byte("0123456789"), 20000)},
+	}
+
+	for _, test := range tests {
+		got, err := snappyDecode(snappy.Encode(nil, test.in), 0)
+		if err != nil {
+			t.Errorf("%v: error decoding: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.in) {
+			t.Errorf("%v: value didn't survive the round trip", test.name)
+		}
+	}
+}
+
+func TestSnappyDecodeCorrupt(t *testing.T) {
+	encoded := snappy.Encode(nil, []byte(strings.Repeat("hello, ", 100)))
+	for _, in := range [][]byte{
+		{},
+		encoded[:len(encoded)-1],          // truncated
+		{5, 4 << 2, 'h', 'e'},             // short literal
+		{3, 0x01 | 0<<2, 3},               // copy before any output
+		{0xff, 0xff, 0xff, 0xff, 0xff, 1}, // huge length
+		{0xff, 0xff, 0xff, 0x7f, 0},       // more than the input could hold
+	} {
+		if got, err := snappyDecode(in, 0); err != ErrCorruptSnappy {
+			t.Errorf("Expected error decoding %v, got %q/%v", in, got, err)
+		}
+	}
+}
+
+func TestDecompressed(t *testing.T) {
+	res := MCResponse{Body: []byte("plain")}
+	if got, err := res.Decompressed(); err != nil || string(got) != "plain" {
+		t.Errorf("Expected plain body to pass through, got %q/%v", got, err)
+	}
+
+	res = MCResponse{
+		Datatype: DATATYPE_SNAPPY | DATATYPE_JSON,
+		Body:     snappy.Encode(nil, []byte("{}")),
+	}
+	if got, err := res.Decompressed(); err != nil || string(got) != "{}" {
+		t.Errorf("Expected decompressed body, got %q/%v", got, err)
+	}
+
+	bad := []byte{9, 2 << 2, 'a'}
+	res = MCResponse{Datatype: DATATYPE_SNAPPY, Body: bad}
+	got, err := res.Decompressed()
+	if err != ErrCorruptSnappy || !bytes.Equal(got, bad) || !bytes.Equal(res.Body, bad) {
+		t.Errorf("Expected original bytes and an error, got %v/%v", got, err)
+	}
+}
+
+func TestDecompressedLarge(t *testing.T) {
+	n := 2<<20 + 1
+	value := bytes.Repeat([]byte("x"), n)
+	res := MCResponse{Datatype: DATATYPE_SNAPPY, Body: snappy.Encode(nil, value)}
+	got, err := res.Decompressed()
+	if err != nil {
+		t.Fatalf("Error decompressing %d bytes: %v", n, err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("Expected %d x's, got %d bytes", n, len(got))
+	}
+
+	if got, err := res.DecompressedMax(n); err != nil || len(got) != n {
+		t.Errorf("Expected %d bytes within the limit, got %d/%v", n, len(got), err)
+	}
+	if _, err := res.DecompressedMax(1 << 20); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("Expected ErrBodyTooLarge past the limit, got %v", err)
+	}
+}
@@ -28,7 +28,7 @@ func TestTapConnectFlagNameString(t *testing.T) {
 	}
 
 	f = TapConnectFlag(0xffffffff)
-	f.String() // would hang if I were stupid
+	_ = f.String() // would hang if I were stupid
 }
 
 func TestTapParsers(t *testing.T) {
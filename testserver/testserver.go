@@ -0,0 +1,333 @@
+// Package testserver provides an in-memory memcached server speaking
+// the binary protocol, for tests and examples that shouldn't need a
+// real server.
+//
+// It supports GET, GETK, SET, ADD, REPLACE and DELETE (and their quiet
+// variants), GET_RANDOM_KEY, RGET, NOOP, VERSION, STAT and QUIT, with
+// CAS checks and item flags.  Expirations are stored but never
+// enforced, and vbuckets are ignored.
+package testserver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+	mcserver "github.com/couchbase/gomemcached/server"
+)
+
+// Version reported in response to VERSION.
+const Version = "testserver"
+
+// Server is an in-memory memcached server.  The zero value isn't
+// usable; create one with New.
+type Server struct {
+	mu    sync.Mutex
+	data  map[string]gomemcached.MCItem
+	cas   uint64
+	stats map[string]uint64
+
+	conns     map[net.Conn]bool
+	listeners []net.Listener
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// New returns an empty server.
+func New() *Server {
+	return &Server{
+		data:  map[string]gomemcached.MCItem{},
+		stats: map[string]uint64{},
+		conns: map[net.Conn]bool{},
+	}
+}
+
+// Start listens on a loopback TCP port and serves connections in the
+// background, returning the address to connect to.
+func (s *Server) Start() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go s.Serve(ln)
+	return ln.Addr().String(), nil
+}
+
+// Serve accepts and serves connections from ln until it fails or the
+// server is closed.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return io.ErrClosedPipe
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		s.ServeConn(conn)
+	}
+}
+
+// Pipe returns one end of an in-memory connection whose other end is
+// served in the background.
+func (s *Server) Pipe() net.Conn {
+	cconn, sconn := net.Pipe()
+	s.ServeConn(sconn)
+	return cconn
+}
+
+// ServeConn serves a single connection in the background until it
+// fails, the client quits, or the server is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for mcserver.HandleMessage(conn, conn, s) == nil {
+		}
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+}
+
+// Close stops the server's listeners and connections, and waits for
+// them to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Item returns the stored item for a key, if there is one.
+func (s *Server) Item(key string) (gomemcached.MCItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.data[key]
+	return item, ok
+}
+
+// Len returns the number of stored items.
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+// HandleMessage handles a single request, so a Server may also be
+// used as a RequestHandler with the server package.
+func (s *Server) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.QUIT:
+		// Answer before hanging up.
+		res := &gomemcached.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque}
+		res.Transmit(w)
+		return &gomemcached.MCResponse{Fatal: true}
+	case gomemcached.QUITQ:
+		return &gomemcached.MCResponse{Fatal: true}
+	case gomemcached.STAT:
+		return s.stat(w, req)
+	case gomemcached.RGET:
+		return s.rangeGet(w, req)
+	}
+
+	s.mu.Lock()
+	res := s.dispatch(req)
+	s.mu.Unlock()
+
+	if req.Opcode.IsQuiet() {
+		switch req.Opcode {
+		case gomemcached.GETQ, gomemcached.GETKQ:
+			if res.Status == gomemcached.KEY_ENOENT {
+				return nil
+			}
+		default:
+			if res.Status == gomemcached.SUCCESS {
+				return nil
+			}
+		}
+	}
+	return res
+}
+
+// dispatch handles everything but QUIT, STAT and RGET with s.mu
+// held.
+func (s *Server) dispatch(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	res := &gomemcached.MCResponse{}
+	key := string(req.Key)
+	item, exists := s.data[key]
+
+	switch req.Opcode {
+	case gomemcached.NOOP:
+	case gomemcached.VERSION:
+		res.Body = []byte(Version)
+	case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ:
+		s.stats["cmd_get"]++
+		if !exists {
+			s.stats["get_misses"]++
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		}
+		s.stats["get_hits"]++
+		res.Cas = item.Cas
+		res.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(res.Extras, item.Flags)
+		res.Body = item.Data
+		if req.Opcode == gomemcached.GETK || req.Opcode == gomemcached.GETKQ {
+			res.Key = req.Key
+		}
+	case gomemcached.SET, gomemcached.SETQ,
+		gomemcached.ADD, gomemcached.ADDQ,
+		gomemcached.REPLACE, gomemcached.REPLACEQ:
+		s.stats["cmd_set"]++
+		switch {
+		case (req.Opcode == gomemcached.ADD || req.Opcode == gomemcached.ADDQ) && exists:
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		case (req.Opcode == gomemcached.REPLACE || req.Opcode == gomemcached.REPLACEQ) && !exists:
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		case req.Cas != 0 && !exists:
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		case req.Cas != 0 && req.Cas != item.Cas:
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		}
+		s.cas++
+		item = gomemcached.MCItem{Cas: s.cas, Data: req.Body}
+		if len(req.Extras) >= 8 {
+			item.Flags = binary.BigEndian.Uint32(req.Extras)
+			item.Expiration = binary.BigEndian.Uint32(req.Extras[4:])
+		}
+		s.data[key] = item
+		res.Cas = item.Cas
+	case gomemcached.DELETE, gomemcached.DELETEQ:
+		switch {
+		case !exists:
+			res.Status = gomemcached.KEY_ENOENT
+			return res
+		case req.Cas != 0 && req.Cas != item.Cas:
+			res.Status = gomemcached.KEY_EEXISTS
+			return res
+		}
+		delete(s.data, key)
+	case gomemcached.GET_RANDOM_KEY:
+		res.Status = gomemcached.KEY_ENOENT
+		for k, item := range s.data {
+			res.Status = gomemcached.SUCCESS
+			res.Cas = item.Cas
+			res.Extras = make([]byte, 4)
+			binary.BigEndian.PutUint32(res.Extras, item.Flags)
+			res.Key = []byte(k)
+			res.Body = item.Data
+			break
+		}
+	default:
+		res.Status = gomemcached.UNKNOWN_COMMAND
+	}
+	return res
+}
+
+// stat streams the general stats, which are the only group
+// supported.
+func (s *Server) stat(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Key) > 0 {
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	}
+
+	s.mu.Lock()
+	stats := []struct {
+		k string
+		v uint64
+	}{
+		{"curr_items", uint64(len(s.data))},
+		{"cmd_get", s.stats["cmd_get"]},
+		{"cmd_set", s.stats["cmd_set"]},
+		{"get_hits", s.stats["get_hits"]},
+		{"get_misses", s.stats["get_misses"]},
+	}
+	s.mu.Unlock()
+
+	for _, st := range stats {
+		res := &gomemcached.MCResponse{
+			Opcode: req.Opcode,
+			Opaque: req.Opaque,
+			Key:    []byte(st.k),
+			Body:   []byte(strconv.FormatUint(st.v, 10)),
+		}
+		if _, err := res.Transmit(w); err != nil {
+			return &gomemcached.MCResponse{Fatal: true}
+		}
+	}
+	// The empty key terminates the group.
+	return &gomemcached.MCResponse{}
+}
+
+// rangeGet streams the items from req's key on, in key order, up to
+// the limit in its extras (if not zero).
+func (s *Server) rangeGet(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) != 4 {
+		return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+	}
+	limit := int(binary.BigEndian.Uint32(req.Extras))
+
+	s.mu.Lock()
+	var keys []string
+	for k := range s.data {
+		if k >= string(req.Key) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	items := make([]gomemcached.MCItem, len(keys))
+	for i, k := range keys {
+		items[i] = s.data[k]
+	}
+	s.mu.Unlock()
+
+	for i, item := range items {
+		res := &gomemcached.MCResponse{
+			Opcode: req.Opcode,
+			Opaque: req.Opaque,
+			Key:    []byte(keys[i]),
+			Extras: make([]byte, 4),
+			Cas:    item.Cas,
+			Body:   item.Data,
+		}
+		binary.BigEndian.PutUint32(res.Extras, item.Flags)
+		if _, err := res.Transmit(w); err != nil {
+			return &gomemcached.MCResponse{Fatal: true}
+		}
+	}
+	// As for STAT, the empty key terminates the range.
+	return &gomemcached.MCResponse{}
+}
@@ -0,0 +1,220 @@
+package testserver
+
+import (
+	"testing"
+
+	"github.com/couchbase/gomemcached"
+	memcached "github.com/couchbase/gomemcached/client"
+)
+
+func connect(t *testing.T, s *Server) *memcached.Client {
+	addr, err := s.Start()
+	if err != nil {
+		t.Fatalf("Error starting server: %v", err)
+	}
+	c, err := memcached.Connect("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return c
+}
+
+func TestGetSetDelete(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	if _, err := c.Get(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	set, err := c.Set(0, "k", 42, 0, []byte("v"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if set.Cas == 0 {
+		t.Errorf("Expected a CAS from set")
+	}
+
+	res, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != "v" || res.Cas != set.Cas || len(res.Extras) != 4 || res.Extras[3] != 42 {
+		t.Errorf("Expected v with flags 42 and CAS %v, got %v", set.Cas, res)
+	}
+
+	if _, err := c.Del(0, "k"); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	if _, err := c.Del(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found deleting again, got %v", err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Expected no items, got %v", s.Len())
+	}
+}
+
+func TestAddReplace(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	if _, err := c.Replace(0, "k", 0, 0, []byte("v")); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found replacing, got %v", err)
+	}
+	if _, err := c.Add(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error adding: %v", err)
+	}
+	if _, err := c.Add(0, "k", 0, 0, []byte("v2")); !gomemcached.IsExists(err) {
+		t.Errorf("Expected exists adding again, got %v", err)
+	}
+	if _, err := c.Replace(0, "k", 0, 0, []byte("v3")); err != nil {
+		t.Errorf("Error replacing: %v", err)
+	}
+	if item, _ := s.Item("k"); string(item.Data) != "v3" {
+		t.Errorf("Expected v3, got %q", item.Data)
+	}
+}
+
+func TestCas(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	set, err := c.Set(0, "k", 0, 0, []byte("v"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.SetCas(0, "k", 0, 0, set.Cas+1, []byte("v2")); !gomemcached.IsCasMismatch(err) {
+		t.Errorf("Expected CAS mismatch, got %v", err)
+	}
+	if _, err := c.SetCas(0, "k", 0, 0, set.Cas, []byte("v2")); err != nil {
+		t.Errorf("Error setting with CAS: %v", err)
+	}
+	if _, err := c.DelCas(0, "k", set.Cas); !gomemcached.IsCasMismatch(err) {
+		t.Errorf("Expected CAS mismatch deleting, got %v", err)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	for _, k := range []string{"a", "b"} {
+		if err := c.SetQ(0, k, 0, 0, []byte(k)); err != nil {
+			t.Fatalf("Error in SetQ: %v", err)
+		}
+	}
+	m, err := c.GetBulk(0, []string{"a", "b", "missing"})
+	if err != nil {
+		t.Fatalf("Error in GetBulk: %v", err)
+	}
+	if len(m) != 2 || string(m["a"].Body) != "a" || string(m["b"].Body) != "b" {
+		t.Errorf("Expected a and b, got %v", m)
+	}
+}
+
+func TestRandomKeyRange(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	if _, err := c.GetRandomKey(0); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found from an empty server, got %v", err)
+	}
+	for _, k := range []string{"c", "a", "b"} {
+		if _, err := c.Set(0, k, 0, 0, []byte(k)); err != nil {
+			t.Fatalf("Error setting %v: %v", k, err)
+		}
+	}
+	if it, err := c.GetRandomKey(0); err != nil || string(it.Value) != string(it.Key) {
+		t.Errorf("Expected a stored item, got %+v, %v", it, err)
+	}
+
+	items, next, err := c.Range(0, "a", 2)
+	if err != nil {
+		t.Fatalf("Error getting range: %v", err)
+	}
+	if len(items) != 2 || string(items[0].Key) != "a" || string(items[1].Key) != "b" || next == "" {
+		t.Errorf("Expected a and b with a cursor, got %v, %q", items, next)
+	}
+	if items, next, err = c.Range(0, next, 2); err != nil || len(items) != 1 || next != "" {
+		t.Errorf("Expected just c and no cursor, got %v, %q, %v", items, next, err)
+	}
+}
+
+func TestNoopVersionStats(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	if _, err := c.Noop(); err != nil {
+		t.Errorf("Error in noop: %v", err)
+	}
+	if v, err := c.Version(); err != nil || v != Version {
+		t.Errorf("Expected version %q, got %q, %v", Version, v, err)
+	}
+
+	c.Set(0, "k", 0, 0, []byte("v"))
+	c.Get(0, "k")
+	c.Get(0, "missing")
+
+	stats, err := c.StatsMap("")
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	exp := map[string]string{
+		"curr_items": "1",
+		"cmd_get":    "2",
+		"cmd_set":    "1",
+		"get_hits":   "1",
+		"get_misses": "1",
+	}
+	for k, v := range exp {
+		if stats[k] != v {
+			t.Errorf("Expected %v=%v, got %v", k, v, stats[k])
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	s := New()
+	defer s.Close()
+	c, err := memcached.Wrap(s.Pipe())
+	if err != nil {
+		t.Fatalf("Error wrapping pipe: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Set(0, "k", 0, 0, []byte("v")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if res, err := c.Get(0, "k"); err != nil || string(res.Body) != "v" {
+		t.Errorf("Expected v, got %v, %v", res, err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Errorf("Error quitting: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := New()
+	c := connect(t, s)
+	defer c.Close()
+
+	if _, err := c.Noop(); err != nil {
+		t.Fatalf("Error in noop: %v", err)
+	}
+	s.Close()
+	if _, err := c.Noop(); err == nil {
+		t.Errorf("Expected an error after the server closed")
+	}
+}